@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/juicity/juicity/cmd/internal/shared"
+	"github.com/juicity/juicity/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorCmd = &cobra.Command{
+		Use:   "doctor",
+		Short: "To diagnose the connectivity to the server in the config.",
+		Run: func(cmd *cobra.Command, args []string) {
+			arguments := shared.GetArguments()
+			conf, err := arguments.GetConfig()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if !printChecks(os.Stdout, client.Diagnose(context.Background(), conf)) {
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+// printChecks prints the checks and reports whether none failed.
+func printChecks(w io.Writer, checks []client.Check) bool {
+	ok := true
+	for _, c := range checks {
+		fmt.Fprintf(w, "[%-4v] %-12v %v\n", c.Status, c.Name, c.Detail)
+		if c.Status == client.CheckFail {
+			ok = false
+		}
+	}
+	return ok
+}
+
+func init() {
+	// cmds
+	rootCmd.AddCommand(doctorCmd)
+
+	// flags
+	shared.InitArgumentsFlags(doctorCmd)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/juicity/juicity/cmd/internal/shared"
+	"github.com/juicity/juicity/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	encryptOutput string
+
+	encryptConfigCmd = &cobra.Command{
+		Use:   "encrypt-config <config_file>",
+		Short: "To encrypt a config with a passphrase, which is asked for when the config is read.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			b, err := os.ReadFile(args[0])
+			if err != nil {
+				fail(err)
+			}
+			if config.IsEncrypted(b) {
+				fail(fmt.Errorf("%v is already encrypted", args[0]))
+			}
+			// Refuse to encrypt what cannot be run.
+			if _, err = config.ParseConfig(b); err != nil {
+				fail(err)
+			}
+			pass, err := newPassphrase()
+			if err != nil {
+				fail(err)
+			}
+			encrypted, err := config.EncryptConfig(b, pass)
+			if err != nil {
+				fail(err)
+			}
+			writeOutput(append(encrypted, '\n'))
+		},
+	}
+
+	decryptConfigCmd = &cobra.Command{
+		Use:   "decrypt-config <config_file>",
+		Short: "To decrypt a config encrypted by encrypt-config, e.g. to edit it.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			b, err := os.ReadFile(args[0])
+			if err != nil {
+				fail(err)
+			}
+			if !config.IsEncrypted(b) {
+				fail(fmt.Errorf("%v is not encrypted", args[0]))
+			}
+			pass, err := shared.ReadPassphrase()
+			if err != nil {
+				fail(err)
+			}
+			plain, err := config.DecryptConfig(b, pass)
+			if err != nil {
+				fail(err)
+			}
+			writeOutput(plain)
+		},
+	}
+)
+
+// newPassphrase returns the passphrase from shared.EnvConfigPassphrase, or
+// asks for it twice on the terminal.
+func newPassphrase() ([]byte, error) {
+	if s := os.Getenv(shared.EnvConfigPassphrase); s != "" {
+		return []byte(s), nil
+	}
+	pass, err := shared.AskPassphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := shared.AskPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pass, again) {
+		return nil, fmt.Errorf("the passphrases do not match")
+	}
+	return pass, nil
+}
+
+// writeOutput writes b to the file of --output, or to stdout.
+func writeOutput(b []byte) {
+	if encryptOutput == "" {
+		_, _ = os.Stdout.Write(b)
+		return
+	}
+	// Configs hold credentials.
+	if err := os.WriteFile(encryptOutput, b, 0600); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func init() {
+	// cmds
+	rootCmd.AddCommand(encryptConfigCmd)
+	rootCmd.AddCommand(decryptConfigCmd)
+
+	// flags
+	encryptConfigCmd.Flags().StringVarP(&encryptOutput, "output", "o", "", "write to the file instead of stdout")
+	decryptConfigCmd.Flags().StringVarP(&encryptOutput, "output", "o", "", "write to the file instead of stdout")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/juicity/juicity/config"
+)
+
+// parseLocalForward parses a forward in the format of ssh -L,
+// "[bind_address:]port:host:hostport[/tcp][/udp]", into the local and remote
+// addresses of the `forward` of the config. The bind address is 127.0.0.1 if
+// omitted, and all interfaces if "*".
+func parseLocalForward(s string) (local string, remote string, err error) {
+	spec, networks, _ := strings.Cut(s, "/")
+	fields, err := splitForward(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("forward %q: %w", s, err)
+	}
+	bind := "127.0.0.1"
+	switch len(fields) {
+	case 3:
+	case 4:
+		bind = fields[0]
+		if bind == "*" {
+			bind = ""
+		}
+		fields = fields[1:]
+	default:
+		return "", "", fmt.Errorf("forward %q: want [bind_address:]port:host:hostport", s)
+	}
+	for _, port := range []string{fields[0], fields[2]} {
+		if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			return "", "", fmt.Errorf("forward %q: invalid port %q", s, port)
+		}
+	}
+	if fields[1] == "" {
+		return "", "", fmt.Errorf("forward %q: empty host", s)
+	}
+	local = net.JoinHostPort(bind, fields[0])
+	if networks != "" {
+		for _, network := range strings.Split(networks, "/") {
+			if network != "tcp" && network != "udp" {
+				return "", "", fmt.Errorf("forward %q: unknown network %q", s, network)
+			}
+		}
+		local += "/" + networks
+	}
+	return local, net.JoinHostPort(fields[1], fields[2]), nil
+}
+
+// splitForward splits s by colons outside of brackets, which enclose IPv6
+// addresses, and strips the brackets.
+func splitForward(s string) (fields []string, err error) {
+	for {
+		var field string
+		if strings.HasPrefix(s, "[") {
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			field, s = s[1:end], s[end+1:]
+			if s != "" && !strings.HasPrefix(s, ":") {
+				return nil, fmt.Errorf("unexpected %q after ]", s)
+			}
+		} else {
+			field, _, _ = strings.Cut(s, ":")
+			s = s[len(field):]
+		}
+		fields = append(fields, field)
+		var ok bool
+		if s, ok = strings.CutPrefix(s, ":"); !ok {
+			break
+		}
+	}
+	return fields, nil
+}
+
+// addLocalForwards adds the forwards given by --forward to the config,
+// replacing the ones of the config on the same local address.
+func addLocalForwards(conf *config.Config, forwards []string) error {
+	for _, f := range forwards {
+		local, remote, err := parseLocalForward(f)
+		if err != nil {
+			return err
+		}
+		if conf.Forward == nil {
+			conf.Forward = make(map[string]string)
+		}
+		conf.Forward[local] = remote
+	}
+	return nil
+}
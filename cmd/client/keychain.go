@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/juicity/juicity/cmd/internal/shared"
+	"github.com/juicity/juicity/pkg/keychain"
+	"github.com/spf13/cobra"
+)
+
+var (
+	keychainCmd = &cobra.Command{
+		Use:   "keychain",
+		Short: "To manage the secrets of the config in the keychain of the OS.",
+	}
+
+	keychainSetCmd = &cobra.Command{
+		Use:   "set <account>",
+		Short: "To store a uuid or password in the keychain, referred to as \"keychain:<account>\" in the config.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			secret, err := shared.AskPassphrase("Secret of " + args[0] + ": ")
+			if err != nil {
+				fail(err)
+			}
+			again, err := shared.AskPassphrase("Repeat the secret: ")
+			if err != nil {
+				fail(err)
+			}
+			if !bytes.Equal(secret, again) {
+				fail(fmt.Errorf("the secrets do not match"))
+			}
+			if err = keychain.Set(args[0], string(secret)); err != nil {
+				fail(err)
+			}
+			fmt.Fprintf(os.Stderr, "Stored; refer to it as \"keychain:%v\" in the config.\n", args[0])
+		},
+	}
+
+	keychainDeleteCmd = &cobra.Command{
+		Use:   "delete <account>",
+		Short: "To remove a secret from the keychain.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := keychain.Delete(args[0]); err != nil {
+				fail(err)
+			}
+		},
+	}
+)
+
+func init() {
+	// cmds
+	keychainCmd.AddCommand(keychainSetCmd)
+	keychainCmd.AddCommand(keychainDeleteCmd)
+	rootCmd.AddCommand(keychainCmd)
+}
@@ -1,37 +1,25 @@
 package main
 
 import (
-	"bytes"
-	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/hex"
-	"fmt"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/daeuniverse/softwind/protocol"
-	"github.com/daeuniverse/softwind/protocol/juicity"
 	gliderLog "github.com/nadoo/glider/pkg/log"
-	"github.com/sourcegraph/conc/pool"
 	"github.com/spf13/cobra"
 
 	"github.com/juicity/juicity/cmd/internal/shared"
-	"github.com/juicity/juicity/common"
 	"github.com/juicity/juicity/config"
-	"github.com/juicity/juicity/pkg/client/dialer"
+	"github.com/juicity/juicity/pkg/client"
 	"github.com/juicity/juicity/pkg/log"
-	"github.com/juicity/juicity/server"
 )
 
 var (
 	logger = log.NewLogger(&log.Options{
 		TimeFormat: time.DateTime,
 	})
+	forwards []string
 
 	runCmd = &cobra.Command{
 		Use:   "run",
@@ -45,14 +33,24 @@ var (
 					Err(err).
 					Msg("Failed to read config")
 			}
+			if err = addLocalForwards(conf, forwards); err != nil {
+				logger.Fatal().
+					Err(err).
+					Msg("Failed to parse --forward")
+			}
 
 			// Logger.
-			if logger, err = arguments.GetLogger(conf.LogLevel); err != nil {
+			if logger, err = arguments.GetLogger(conf); err != nil {
 				logger.Fatal().
 					Err(err).
 					Msg("Failed to init logger")
 			}
 			gliderLog.SetLogger(logger)
+			removePidFile, err := arguments.WritePidFile()
+			if err != nil {
+				logger.Fatal().Err(err).Send()
+			}
+			defer removePidFile()
 
 			go func() {
 				if err := Serve(conf); err != nil {
@@ -70,101 +68,35 @@ var (
 )
 
 func Serve(conf *config.Config) error {
-	if conf.Sni == "" {
-		conf.Sni, _, _ = net.SplitHostPort(conf.Server)
-	}
-	tlsConfig := &tls.Config{
-		NextProtos:         []string{"h3"},
-		MinVersion:         tls.VersionTLS13,
-		ServerName:         conf.Sni,
-		InsecureSkipVerify: conf.AllowInsecure,
+	if err := shared.TuneCpu(conf, logger); err != nil {
+		return err
 	}
-	if conf.PinnedCertChainSha256 != "" {
-		pinnedHash, err := base64.URLEncoding.DecodeString(conf.PinnedCertChainSha256)
-		if err != nil {
-			pinnedHash, err = base64.StdEncoding.DecodeString(conf.PinnedCertChainSha256)
-			if err != nil {
-				pinnedHash, err = hex.DecodeString(conf.PinnedCertChainSha256)
-				if err != nil {
-					return fmt.Errorf("failed to decode PinnedCertChainSha256")
-				}
-			}
-		}
-		tlsConfig.InsecureSkipVerify = true
-		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			if !bytes.Equal(common.GenerateCertChainHash(rawCerts), pinnedHash) {
-				return fmt.Errorf("pinned hash of cert chain does not match")
-			}
-			return nil
-		}
+	if err := shared.ApplyProfile(conf, logger); err != nil {
+		return err
 	}
-	d, err := juicity.NewDialer(dialer.NewClientDialer(conf), protocol.Header{
-		ProxyAddress: conf.Server,
-		Feature1:     conf.CongestionControl,
-		TlsConfig:    tlsConfig,
-		User:         conf.Uuid,
-		Password:     conf.Password,
-		IsClient:     true,
-		Flags:        0,
+	c, err := client.New(conf, &client.Options{
+		Logger: logger,
 	})
 	if err != nil {
 		return err
 	}
-	if conf.Listen == "" && len(conf.Forward) == 0 {
-		logger.Fatal().Msg("Please fill in at least one of `listen` and `forward` in the config file.")
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	wg := pool.New().WithErrors().WithContext(ctx).WithCancelOnError()
-	if conf.Listen != "" {
-		s, err := server.NewMixed("mixed://"+conf.Listen, d)
-		if err != nil {
-			return err
-		}
-		wg.Go(func(ctx context.Context) error {
-			ch := make(chan struct{}, 1)
-			go func() {
-				s.ListenAndServe()
-				ch <- struct{}{}
-			}()
-			select {
-			case <-ch:
-				return fmt.Errorf("ListenAndServe: unexpected error")
-			case <-ctx.Done():
-				return nil
-			}
-		})
-	}
-	if len(conf.Forward) != 0 {
-		for local, remote := range conf.Forward {
-			forwarder, err := server.NewForwarder(server.ForwarderOptions{
-				Logger:     logger,
-				Dialer:     d,
-				LocalAddr:  local,
-				RemoteAddr: remote,
-			})
-			if err != nil {
-				return err
-			}
-			wg.Go(func(ctx context.Context) (err error) {
-				ch := make(chan error, 1)
-				go func() {
-					ch <- forwarder.Serve()
-				}()
-				select {
-				case err := <-ch:
-					return err
-				case <-ctx.Done():
-					return nil
-				}
-			})
+	if err = shared.StartGeodataUpdater(conf, logger, func(path string) {
+		if err := c.ReloadGeodata(path); err != nil {
+			logger.Warn().
+				Err(err).
+				Msg("Failed to reload asn_db")
 		}
+	}); err != nil {
+		return err
 	}
-	return wg.Wait()
+	return c.Serve()
 }
 
 func init() {
 	// cmds
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(shared.NewGeodataCmd())
+	rootCmd.AddCommand(shared.NewUpgradeCmd("juicity-client"))
 	shared.InitArgumentsFlags(runCmd)
+	runCmd.Flags().StringArrayVarP(&forwards, "forward", "L", nil, "forward a local port through the server like ssh -L: [bind_address:]port:host:hostport[/tcp][/udp]; repeatable")
 }
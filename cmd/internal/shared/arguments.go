@@ -2,8 +2,9 @@ package shared
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 	"sync"
-	"time"
 
 	"github.com/juicity/juicity/common/consts"
 	"github.com/juicity/juicity/config"
@@ -24,6 +25,7 @@ type Arguments struct {
 	LogMaxBackups       int
 	LogMaxAge           int
 	LogCompress         bool
+	PidFile             string
 }
 
 var (
@@ -41,18 +43,31 @@ func GetArguments() Arguments {
 	return defaultArguments
 }
 
-func (a *Arguments) GetLogger(logLevel string) (*log.Logger, error) {
-	lvl, err := zerolog.ParseLevel(logLevel)
+func (a *Arguments) GetLogger(conf *config.Config) (*log.Logger, error) {
+	lvl, err := zerolog.ParseLevel(conf.LogLevel)
 	if err != nil {
 		return nil, fmt.Errorf("ParseLevel: %w", err)
 	}
-	logTimeFormat := time.DateTime
+	logTimeFormat, err := log.ParseTimeFormat(conf.LogTimeFormat)
+	if err != nil {
+		return nil, fmt.Errorf("parse log_time_format: %w", err)
+	}
 	if a.LogDisableTimestamp {
 		logTimeFormat = ""
 	}
+	logTimezone, err := log.ParseTimeZone(conf.LogTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("parse log_timezone: %w", err)
+	}
+	output := a.LogOutput
+	if conf.Profile == ProfileEmbedded {
+		// Files fill the small flash or tmpfs of routers.
+		output = "console"
+	}
 	logger := log.NewLogger(&log.Options{
-		Output:     a.LogOutput,
+		Output:     output,
 		TimeFormat: logTimeFormat,
+		TimeZone:   logTimezone,
 		FileFormat: a.LogFileFormat,
 		NoColor:    a.LogDisableColor,
 		File:       a.LogFile,
@@ -66,18 +81,41 @@ func (a *Arguments) GetLogger(logLevel string) (*log.Logger, error) {
 }
 
 func (a *Arguments) GetConfig() (*config.Config, error) {
+	// The config in the environment takes precedence, so that the container
+	// image runs without mounted files.
+	conf, err := config.ReadEnvConfig()
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		return conf, nil
+	}
 	if a.CfgFile == "" {
-		return nil, fmt.Errorf("argument \"--config\" or \"-c\" is required but not provided")
+		return nil, fmt.Errorf("argument \"--config\" or \"-c\" (or env %v) is required but not provided", config.EnvConfigJson)
 	}
 
 	// Read config from --config cfgFile.
-	conf, err := config.ReadConfig(a.CfgFile)
+	conf, err = config.ReadConfig(a.CfgFile)
 	if err != nil {
 		return nil, fmt.Errorf("ReadConfig: %w", err)
 	}
 	return conf, nil
 }
 
+// WritePidFile writes the pid to the file given by --pid-file, if any, and
+// returns the function to remove it on exit.
+func (a *Arguments) WritePidFile() (remove func(), err error) {
+	if a.PidFile == "" {
+		return func() {}, nil
+	}
+	if err = os.WriteFile(a.PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return nil, fmt.Errorf("write pid file: %w", err)
+	}
+	return func() {
+		_ = os.Remove(a.PidFile)
+	}, nil
+}
+
 func InitArgumentsFlags(cmd *cobra.Command) {
 	// flags
 	cmd.PersistentFlags().StringVarP(&defaultArguments.CfgFile, "config", "c", "", "specify config file path")
@@ -93,4 +131,12 @@ func InitArgumentsFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().IntVarP(&defaultArguments.LogMaxBackups, "log-file-max-backups", "", consts.LogMaxBackups, "specify the maximum number of old log files to retain")
 	cmd.PersistentFlags().IntVarP(&defaultArguments.LogMaxAge, "log-file-max-age", "", consts.LogMaxAge, "specify the maximum number of days to retain old log files based on the timestamp encoded in their filename; unit: day")
 	cmd.PersistentFlags().BoolVarP(&defaultArguments.LogCompress, "log-file-compress", "", consts.LogCompress, "enable log compression; default: true")
+	cmd.PersistentFlags().StringVarP(&defaultArguments.PidFile, "pid-file", "", "", "write the pid to the file, which is removed on exit")
+	// An explicit --log-file implies logging to the file, which is what init
+	// scripts of daemons usually want.
+	cmd.PreRun = func(cmd *cobra.Command, args []string) {
+		if cmd.Flags().Changed("log-file") && !cmd.Flags().Changed("log-output") {
+			defaultArguments.LogOutput = "file"
+		}
+	}
 }
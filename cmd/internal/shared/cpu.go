@@ -0,0 +1,30 @@
+package shared
+
+import (
+	"fmt"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/cpu"
+	"github.com/juicity/juicity/pkg/log"
+)
+
+// TuneCpu applies gomaxprocs and cpu_affinity of the config. It is called
+// first thing, before the threads of the runtime multiply.
+func TuneCpu(conf *config.Config, logger *log.Logger) error {
+	if len(conf.CpuAffinity) > 0 {
+		if err := cpu.SetAffinity(conf.CpuAffinity); err != nil {
+			return fmt.Errorf("set cpu_affinity: %w", err)
+		}
+		logger.Info().
+			Ints("cpus", conf.CpuAffinity).
+			Msg("Pinned to CPUs")
+	}
+	procs, err := cpu.SetMaxProcs(conf.Gomaxprocs)
+	if err != nil {
+		return err
+	}
+	logger.Debug().
+		Int("gomaxprocs", procs).
+		Msg("GOMAXPROCS")
+	return nil
+}
@@ -0,0 +1,89 @@
+//go:build !no_geodata
+
+package shared
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/geodata"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+func geodataFiles(conf *config.Geodata) []*geodata.File {
+	files := make([]*geodata.File, 0, len(conf.Files))
+	for _, f := range conf.Files {
+		files = append(files, &geodata.File{Path: f.Path, Urls: f.Urls, Sha256sum: f.Sha256sum})
+	}
+	return files
+}
+
+// StartGeodataUpdater updates the geodata of the config in the background
+// if an interval is given. onUpdate is called with the path of every updated
+// file.
+func StartGeodataUpdater(conf *config.Config, logger *log.Logger, onUpdate func(path string)) error {
+	if conf.Geodata == nil || conf.Geodata.Interval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(conf.Geodata.Interval)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("parse interval of geodata: %v", conf.Geodata.Interval)
+	}
+	updater := &geodata.Updater{
+		Logger:   logger,
+		Client:   http.DefaultClient,
+		Files:    geodataFiles(conf.Geodata),
+		Interval: interval,
+		OnUpdate: func(f *geodata.File) {
+			if onUpdate != nil {
+				onUpdate(f.Path)
+			}
+		},
+	}
+	go updater.Run(context.Background())
+	return nil
+}
+
+// NewGeodataCmd returns the command to update the geodata of the config.
+func NewGeodataCmd() *cobra.Command {
+	geodataCmd := &cobra.Command{
+		Use:   "geodata",
+		Short: "To manage the geo databases in the config.",
+	}
+	updateCmd := &cobra.Command{
+		Use:   "update",
+		Short: "To download the geo databases in the config from their mirrors.",
+		Run: func(cmd *cobra.Command, args []string) {
+			arguments := GetArguments()
+			conf, err := arguments.GetConfig()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if conf.Geodata == nil || len(conf.Geodata.Files) == 0 {
+				fmt.Println(`no files in "geodata" of the config`)
+				os.Exit(1)
+			}
+			var failed bool
+			for _, f := range geodataFiles(conf.Geodata) {
+				if err := geodata.Update(context.Background(), http.DefaultClient, f); err != nil {
+					fmt.Println(err)
+					failed = true
+					continue
+				}
+				fmt.Printf("Updated %v\n", f.Path)
+			}
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+	geodataCmd.AddCommand(updateCmd)
+	InitArgumentsFlags(geodataCmd)
+	return geodataCmd
+}
@@ -0,0 +1,35 @@
+//go:build no_geodata
+
+package shared
+
+import (
+	"fmt"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+var errGeodataNotBuiltIn = fmt.Errorf("geodata is not built in (built with no_geodata)")
+
+// StartGeodataUpdater fails if an interval is given since the updater is not
+// built in.
+func StartGeodataUpdater(conf *config.Config, logger *log.Logger, onUpdate func(path string)) error {
+	if conf.Geodata == nil || conf.Geodata.Interval == "" {
+		return nil
+	}
+	return errGeodataNotBuiltIn
+}
+
+// NewGeodataCmd returns the command to update the geodata of the config,
+// which always fails.
+func NewGeodataCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:    "geodata",
+		Short:  "To manage the geo databases in the config.",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return errGeodataNotBuiltIn
+		},
+	}
+}
@@ -0,0 +1,46 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// EnvConfigPassphrase is the passphrase of an encrypted config, for services
+// without a terminal.
+const EnvConfigPassphrase = "JUICITY_CONFIG_PASSPHRASE"
+
+// ReadPassphrase returns the passphrase of an encrypted config from
+// EnvConfigPassphrase, or asks for it on the terminal.
+func ReadPassphrase() ([]byte, error) {
+	if s := os.Getenv(EnvConfigPassphrase); s != "" {
+		return []byte(s), nil
+	}
+	return AskPassphrase("Passphrase of the config: ")
+}
+
+// AskPassphrase asks for a passphrase on the terminal without echoing it.
+func AskPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase; set %v", EnvConfigPassphrase)
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	defer fmt.Fprintln(tty)
+	restore, err := disableEcho(tty)
+	if err != nil {
+		return nil, fmt.Errorf("disable echo of the terminal: %w; set %v", err, EnvConfigPassphrase)
+	}
+	defer restore()
+	line, err := bufio.NewReader(tty).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, err
+	}
+	pass := bytes.TrimRight(line, "\r\n")
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return pass, nil
+}
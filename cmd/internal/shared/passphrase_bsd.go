@@ -0,0 +1,13 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package shared
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func disableEcho(tty *os.File) (restore func(), err error) {
+	return setEcho(tty, unix.TIOCGETA, unix.TIOCSETA)
+}
@@ -0,0 +1,11 @@
+package shared
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func disableEcho(tty *os.File) (restore func(), err error) {
+	return setEcho(tty, unix.TCGETS, unix.TCSETS)
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package shared
+
+import (
+	"fmt"
+	"os"
+)
+
+func disableEcho(tty *os.File) (restore func(), err error) {
+	return nil, fmt.Errorf("not supported on this platform")
+}
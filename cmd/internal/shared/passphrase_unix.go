@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package shared
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setEcho turns off the echo of the terminal with the ioctl requests of the
+// platform.
+func setEcho(tty *os.File, get uint, set uint) (restore func(), err error) {
+	fd := int(tty.Fd())
+	old, err := unix.IoctlGetTermios(fd, get)
+	if err != nil {
+		return nil, err
+	}
+	t := *old
+	t.Lflag &^= unix.ECHO
+	t.Lflag |= unix.ICANON | unix.ISIG
+	if err = unix.IoctlSetTermios(fd, set, &t); err != nil {
+		return nil, err
+	}
+	return func() { _ = unix.IoctlSetTermios(fd, set, old) }, nil
+}
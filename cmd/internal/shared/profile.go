@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/log"
+)
+
+// ProfileEmbedded trades throughput for memory, see config.ProfileEmbedded.
+const ProfileEmbedded = config.ProfileEmbedded
+
+const (
+	// embeddedMemoryLimit is the soft limit of the heap, above which the
+	// garbage collector works harder instead of letting the heap grow.
+	embeddedMemoryLimit = 48 << 20
+	embeddedGcPercent   = 50
+	// embeddedMaxIncomingStreams is the default stream limit of the server.
+	embeddedMaxIncomingStreams = 32
+	// embeddedUdpSessionQueue is the default of the packets each UDP session
+	// of the server may queue, instead of relay.DefaultUdpSessionQueue.
+	embeddedUdpSessionQueue = 16
+)
+
+// ApplyProfile tunes the runtime for the profile of the config and fills in
+// the defaults of the profile. The environment variables of the runtime,
+// e.g. GOMEMLIMIT, take precedence.
+func ApplyProfile(conf *config.Config, logger *log.Logger) error {
+	switch conf.Profile {
+	case "":
+		return nil
+	case ProfileEmbedded:
+	default:
+		return fmt.Errorf("unexpected profile: %v", conf.Profile)
+	}
+	if os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(embeddedGcPercent)
+	}
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(embeddedMemoryLimit)
+	}
+	if conf.MaxIncomingStreams == 0 {
+		conf.MaxIncomingStreams = embeddedMaxIncomingStreams
+	}
+	if conf.MaxIncomingUniStreams == 0 {
+		conf.MaxIncomingUniStreams = embeddedMaxIncomingStreams
+	}
+	if conf.UdpSessionQueue == 0 {
+		conf.UdpSessionQueue = embeddedUdpSessionQueue
+	}
+	logger.Info().
+		Str("profile", conf.Profile).
+		Msg("Profile applied")
+	return nil
+}
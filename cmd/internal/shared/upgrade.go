@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/upgrade"
+	"github.com/spf13/cobra"
+)
+
+// NewUpgradeCmd returns the command to replace the binary, e.g.
+// juicity-server, with the one of a GitHub release.
+func NewUpgradeCmd(binary string) *cobra.Command {
+	var (
+		check   bool
+		tag     string
+		force   bool
+		restart bool
+		service string
+		repo    string
+	)
+	upgradeCmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "To upgrade " + binary + " to the latest release.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runUpgrade(binary, check, tag, force, restart, service, repo); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+	}
+	upgradeCmd.Flags().BoolVar(&check, "check", false, "only check whether a newer release is available")
+	upgradeCmd.Flags().StringVar(&tag, "tag", "", "the release to install, e.g. v0.4.0, instead of the latest one")
+	upgradeCmd.Flags().BoolVar(&force, "force", false, "install the release even if it is not newer")
+	upgradeCmd.Flags().BoolVar(&restart, "restart", false, "restart the service through systemd or the init script after upgrading")
+	upgradeCmd.Flags().StringVar(&service, "service", binary, "the name of the service to restart")
+	upgradeCmd.Flags().StringVar(&repo, "repo", upgrade.DefaultRepo, "the GitHub repository of the releases")
+	return upgradeCmd
+}
+
+func runUpgrade(binary string, check bool, tag string, force bool, restart bool, service string, repo string) error {
+	ctx := context.Background()
+	opts := upgrade.Options{Repo: repo}
+	release, err := upgrade.FetchRelease(ctx, opts, tag)
+	if err != nil {
+		return err
+	}
+	newer := upgrade.IsNewer(release.Tag, config.Version)
+	if check {
+		if newer {
+			fmt.Printf("%v is available (current: %v)\n", release.Tag, config.Version)
+		} else {
+			fmt.Printf("%v is up to date (latest: %v)\n", config.Version, release.Tag)
+		}
+		return nil
+	}
+	if !newer && !force && tag == "" {
+		fmt.Printf("%v is up to date (latest: %v)\n", config.Version, release.Tag)
+		return nil
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return err
+	}
+	fmt.Printf("Downloading %v\n", release.Tag)
+	b, err := upgrade.Download(ctx, opts, release, binary)
+	if err != nil {
+		return err
+	}
+	if err = upgrade.Replace(path, b); err != nil {
+		return fmt.Errorf("replace %v: %w", path, err)
+	}
+	fmt.Printf("Upgraded %v from %v to %v\n", path, config.Version, release.Tag)
+	if !restart {
+		fmt.Println("Restart the service to run the new version.")
+		return nil
+	}
+	if err = upgrade.Restart(service); err != nil {
+		return err
+	}
+	fmt.Printf("Restarted %v\n", service)
+	return nil
+}
@@ -0,0 +1,136 @@
+// Command libjuicity builds juicity-client as a C shared library for
+// frontends not written in Go:
+//
+//	go build -buildmode=c-shared -o libjuicity.so ./cmd/libjuicity
+//
+// Strings returned by the library must be released with JuicityFree.
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/client"
+
+	gliderLog "github.com/nadoo/glider/pkg/log"
+)
+
+var (
+	mu      sync.Mutex
+	running *client.Client
+)
+
+type statsResponse struct {
+	Running bool    `json:"running"`
+	Up      uint64  `json:"up"`
+	Down    uint64  `json:"down"`
+	RttMs   float64 `json:"rtt_ms,omitempty"`
+	// LastCloseReason is why the server closed the latest connection it
+	// closed.
+	LastCloseReason string `json:"last_close_reason,omitempty"`
+}
+
+func main() {}
+
+func start(configJson string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if running != nil {
+		return fmt.Errorf("juicity is already running")
+	}
+	conf, err := config.ParseConfig([]byte(configJson))
+	if err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+	logger, err := client.NewConsoleLogger(conf)
+	if err != nil {
+		return err
+	}
+	gliderLog.SetLogger(logger)
+	c, err := client.New(conf, &client.Options{
+		Logger: logger,
+	})
+	if err != nil {
+		return err
+	}
+	running = c
+	go func() {
+		if err := c.Serve(); err != nil {
+			logger.Error().
+				Err(err).
+				Msg("juicity stopped")
+		}
+		mu.Lock()
+		if running == c {
+			running = nil
+		}
+		mu.Unlock()
+	}()
+	return nil
+}
+
+// JuicityStart starts the client with the config in json in the background.
+// It returns NULL on success, or the error otherwise.
+//
+//export JuicityStart
+func JuicityStart(configJson *C.char) *C.char {
+	if err := start(C.GoString(configJson)); err != nil {
+		return C.CString(err.Error())
+	}
+	return nil
+}
+
+// JuicityStop stops the running client.
+//
+//export JuicityStop
+func JuicityStop() {
+	mu.Lock()
+	defer mu.Unlock()
+	if running != nil {
+		running.Close()
+		running = nil
+	}
+}
+
+// JuicityStats returns the state of the client in json, e.g.
+// {"running":true,"up":1024,"down":4096,"rtt_ms":23.5} where up and down are
+// the bytes sent and received through the server since start, and rtt_ms is
+// the round-trip time measured by heartbeats, if enabled. last_close_reason
+// is added once the server closed a connection, e.g. "the user is suspended
+// by the server".
+//
+//export JuicityStats
+func JuicityStats() *C.char {
+	mu.Lock()
+	var resp statsResponse
+	if running != nil {
+		traffic := running.Traffic()
+		resp = statsResponse{
+			Running: true,
+			Up:      traffic.Up.Load(),
+			Down:    traffic.Down.Load(),
+			RttMs:   float64(running.Rtt().Microseconds()) / 1000,
+		}
+		if reason := running.LastCloseReason(); reason != nil {
+			resp.LastCloseReason = reason.Text
+		}
+	}
+	mu.Unlock()
+	b, _ := json.Marshal(resp)
+	return C.CString(string(b))
+}
+
+// JuicityFree releases a string returned by the library.
+//
+//export JuicityFree
+func JuicityFree(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
@@ -0,0 +1,68 @@
+//go:build !no_api
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/api"
+	"github.com/juicity/juicity/server"
+)
+
+// serveApi serves the management API of the servers at api_listen, and to
+// api_admins through tunnel if not nil.
+func serveApi(conf *config.Config, servers []*server.Server, tunnel *server.ApiListener, snapshots *config.Snapshots) error {
+	if conf.ApiToken == "" && len(conf.ApiTokens) == 0 {
+		// Only a loopback api_listen passes the config check without one.
+		logger.Warn().Msg("Management API is served without a token: only stats can be read")
+	}
+	tokens := make([]api.Token, len(conf.ApiTokens))
+	for i, t := range conf.ApiTokens {
+		tokens[i].Value = t.Token
+		for _, scope := range t.Scopes {
+			tokens[i].Scopes = append(tokens[i].Scopes, api.Scope(scope))
+		}
+	}
+	a, err := api.New(&api.Options{
+		Logger:    logger,
+		Servers:   servers,
+		Token:     conf.ApiToken,
+		Tokens:    tokens,
+		Dashboard: conf.ApiDashboard,
+		Snapshots: snapshots,
+	})
+	if err != nil {
+		return err
+	}
+	if tunnel != nil {
+		logger.Info().
+			Strs("admins", conf.ApiAdmins).
+			Msg("Management API served in the tunnel at " + server.ApiHostname)
+		go func() {
+			if err := http.Serve(tunnel, a); err != nil {
+				logger.Fatal().
+					Err(err).
+					Msg("Failed to serve management API in the tunnel")
+			}
+		}()
+	}
+	if conf.ApiListen == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", conf.ApiListen)
+	if err != nil {
+		return fmt.Errorf("listen management API: %w", err)
+	}
+	logger.Info().Msg("Management API listen at " + conf.ApiListen)
+	go func() {
+		if err := http.Serve(ln, a); err != nil {
+			logger.Fatal().
+				Err(err).
+				Msg("Failed to serve management API")
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build no_api
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/server"
+)
+
+// serveApi fails since the management API is not built in.
+func serveApi(conf *config.Config, servers []*server.Server, tunnel *server.ApiListener, snapshots *config.Snapshots) error {
+	return fmt.Errorf("api_listen or api_admins is set but the management API is not built in (built with no_api)")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juicity/juicity/cmd/internal/shared"
+	"github.com/juicity/juicity/common"
+	"github.com/spf13/cobra"
+)
+
+var (
+	certInfoCmd = &cobra.Command{
+		Use:   "cert-info [fullchain_file]",
+		Short: "To print the details of a certificate chain, by default the one in the config.",
+		Run: func(cmd *cobra.Command, args []string) {
+			var certificate string
+			if len(args) > 0 {
+				certificate = args[0]
+			} else {
+				arguments := shared.GetArguments()
+				conf, err := arguments.GetConfig()
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				certificate = conf.Certificate
+			}
+			chain, err := common.ParseCertChain(certificate)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			printCertChain(os.Stdout, chain)
+		},
+	}
+)
+
+func printCertChain(w io.Writer, chain []*x509.Certificate) {
+	rawCerts := make([][]byte, 0, len(chain))
+	for i, cert := range chain {
+		rawCerts = append(rawCerts, cert.Raw)
+		fingerprint := sha256.Sum256(cert.Raw)
+		fmt.Fprintf(w, "Certificate %v:\n", i)
+		fmt.Fprintf(w, "  Subject:     %v\n", cert.Subject)
+		fmt.Fprintf(w, "  Issuer:      %v\n", cert.Issuer)
+		if len(cert.DNSNames) > 0 {
+			fmt.Fprintf(w, "  DNS names:   %v\n", strings.Join(cert.DNSNames, ", "))
+		}
+		if len(cert.IPAddresses) > 0 {
+			fmt.Fprintf(w, "  IPs:         %v\n", cert.IPAddresses)
+		}
+		fmt.Fprintf(w, "  Not before:  %v\n", cert.NotBefore.Format(time.RFC3339))
+		fmt.Fprintf(w, "  Not after:   %v (%v days remaining)\n", cert.NotAfter.Format(time.RFC3339), int(time.Until(cert.NotAfter).Hours()/24))
+		fmt.Fprintf(w, "  SHA-256:     %x\n", fingerprint)
+	}
+	fmt.Fprintf(w, "Chain hash (pinned_certchain_sha256): %v\n", base64.URLEncoding.EncodeToString(common.GenerateCertChainHash(rawCerts)))
+}
+
+func init() {
+	// cmds
+	rootCmd.AddCommand(certInfoCmd)
+
+	// flags
+	shared.InitArgumentsFlags(certInfoCmd)
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/juicity/juicity/cmd/internal/shared"
+	"github.com/juicity/juicity/common"
 	"github.com/spf13/cobra"
 )
 
@@ -52,7 +53,7 @@ func generateLink(arguments shared.Arguments) (string, error) {
 		break
 	}
 	// Validate the cert and key.
-	tlsCert, err := tls.LoadX509KeyPair(conf.Certificate, conf.PrivateKey)
+	tlsCert, err := common.LoadX509KeyPair(conf.Certificate, conf.PrivateKey)
 	if err != nil {
 		return "", err
 	}
@@ -118,11 +119,8 @@ func generateLink(arguments shared.Arguments) (string, error) {
 		_, err = cert.Verify(opts)
 		if err != nil {
 			// Get cert hash to pin.
-			hash, err := generateCertChainHash(conf.Certificate)
-			if err != nil {
-				return "", fmt.Errorf("generateCertChainHash: %w", err)
-			}
-			query.Set("pinned_certchain_sha256", hash)
+			hash := common.GenerateCertChainHash(tlsCert.Certificate)
+			query.Set("pinned_certchain_sha256", base64.URLEncoding.EncodeToString(hash))
 		}
 	}
 	link := url.URL{
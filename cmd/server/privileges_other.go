@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+func dropPrivileges(userName, groupName, chroot string) error {
+	if userName != "" || groupName != "" || chroot != "" {
+		return fmt.Errorf("user, group and chroot are not supported on this platform")
+	}
+	return nil
+}
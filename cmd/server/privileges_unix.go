@@ -0,0 +1,67 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges changes the root directory and switches to the given user
+// and group, which may be names or numeric ids. The group defaults to the
+// primary group of the user.
+func dropPrivileges(userName, groupName, chroot string) error {
+	uid, gid := -1, -1
+	// Look up before chroot, which usually hides /etc/passwd.
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return fmt.Errorf("lookup user: %w", err)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return fmt.Errorf("lookup group: %w", err)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return fmt.Errorf("chroot: %w", err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir: %w", err)
+		}
+	}
+	// The group must be changed while still privileged.
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid: %w", err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %w", err)
+		}
+	}
+	if uid >= 0 || gid >= 0 || chroot != "" {
+		logger.Info().
+			Int("uid", syscall.Getuid()).
+			Int("gid", syscall.Getgid()).
+			Str("chroot", chroot).
+			Msg("Dropped privileges")
+	}
+	return nil
+}
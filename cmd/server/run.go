@@ -1,19 +1,39 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"fmt"
 	"math"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/juicity/juicity/cmd/internal/shared"
+	"github.com/juicity/juicity/common"
 	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/acl"
+	"github.com/juicity/juicity/pkg/brutal"
+	"github.com/juicity/juicity/pkg/capture"
+	"github.com/juicity/juicity/pkg/cluster"
+	"github.com/juicity/juicity/pkg/event"
+	"github.com/juicity/juicity/pkg/geodata"
 	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/sandbox"
+	"github.com/juicity/juicity/pkg/schedule"
+	"github.com/juicity/juicity/pkg/stats"
 	"github.com/juicity/juicity/server"
 
+	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 )
 
@@ -36,12 +56,20 @@ var (
 			}
 
 			// Logger.
-			if logger, err = arguments.GetLogger(conf.LogLevel); err != nil {
+			if logger, err = arguments.GetLogger(conf); err != nil {
 				logger.Fatal().
 					Err(err).
 					Msg("Failed to init logger")
 			}
 
+			removePidFile, err := arguments.WritePidFile()
+			if err != nil {
+				logger.Fatal().
+					Err(err).
+					Send()
+			}
+			onExit(removePidFile)
+
 			go func() {
 				if err := Serve(conf); err != nil {
 					logger.Fatal().
@@ -55,50 +83,1127 @@ var (
 				logger.Warn().
 					Str("signal", sig.String()).
 					Msg("Exiting")
+				runExitHooks()
 				return
 			}
 		},
 	}
+
+	exitHooksMu sync.Mutex
+	exitHooks   []func()
+)
+
+// onExit registers f to run before exiting on a signal.
+func onExit(f func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, f)
+}
+
+// runExitHooks runs the registered hooks in reverse order.
+func runExitHooks() {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	exitHooks = nil
+}
+
+const (
+	defaultCertExpiryWarning = 14 * 24 * time.Hour
+	certCheckInterval        = 12 * time.Hour
 )
 
+// watchCertExpiry exports the expiry of the certificate and periodically
+// warns if it expires within the given duration.
+func watchCertExpiry(cert *x509.Certificate, warning time.Duration, st *stats.Stats) {
+	st.SetCertNotAfter(cert.NotAfter)
+	for {
+		remaining := time.Until(cert.NotAfter)
+		switch {
+		case remaining <= 0:
+			logger.Error().
+				Time("not_after", cert.NotAfter).
+				Msg("Certificate has expired")
+		case remaining <= warning:
+			logger.Warn().
+				Time("not_after", cert.NotAfter).
+				Str("remaining", remaining.Truncate(time.Minute).String()).
+				Msg("Certificate expires soon")
+		}
+		time.Sleep(certCheckInterval)
+	}
+}
+
+func parseFwmark(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	fwmark, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parse fwmark: %w", err)
+	}
+	if fwmark > math.MaxInt || fwmark > math.MaxUint32 {
+		return 0, fmt.Errorf("fwmark is too large")
+	}
+	return int(fwmark), nil
+}
+
+// parseSourcePorts parses a range like "20000-29999", or returns nil if s is
+// empty.
+func parseSourcePorts(s string) (*acl.PortRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ports, err := acl.ParsePortRange(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse source_ports: %w", err)
+	}
+	if ports.From == 0 {
+		return nil, fmt.Errorf("parse source_ports: port 0 is not allowed")
+	}
+	return &ports, nil
+}
+
+// parsePrefix parses a CIDR or a single IP.
+func parsePrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, e := netip.ParseAddr(s)
+		if e != nil {
+			return netip.Prefix{}, err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return prefix.Masked(), nil
+}
+
+func parseMatcher(m config.Match, asnDb *acl.AsnDb) (acl.Matcher, error) {
+	matcher := acl.Matcher{
+		Network: m.Network,
+	}
+	for _, domain := range m.Domains {
+		category, ok := strings.CutPrefix(domain, "geosite:")
+		if !ok {
+			matcher.Domains = append(matcher.Domains, domain)
+			continue
+		}
+		domains, err := geodata.Geosite(category)
+		if err != nil {
+			return acl.Matcher{}, err
+		}
+		matcher.Domains = append(matcher.Domains, domains...)
+	}
+	if len(m.Asns) > 0 {
+		if asnDb == nil {
+			return acl.Matcher{}, fmt.Errorf(`"asns" require "asn_db"`)
+		}
+		matcher.AsnDb = asnDb
+	}
+	for _, s := range m.Asns {
+		asn, err := acl.ParseAsn(s)
+		if err != nil {
+			return acl.Matcher{}, err
+		}
+		matcher.Asns = append(matcher.Asns, asn)
+	}
+	for _, ip := range m.Ips {
+		if category, ok := strings.CutPrefix(ip, "geoip:"); ok {
+			prefixes, err := geodata.Geoip(category)
+			if err != nil {
+				return acl.Matcher{}, err
+			}
+			matcher.Prefixes = append(matcher.Prefixes, prefixes...)
+			continue
+		}
+		prefix, err := parsePrefix(ip)
+		if err != nil {
+			return acl.Matcher{}, err
+		}
+		matcher.Prefixes = append(matcher.Prefixes, prefix)
+	}
+	for _, port := range m.Ports {
+		portRange, err := acl.ParsePortRange(port)
+		if err != nil {
+			return acl.Matcher{}, err
+		}
+		matcher.Ports = append(matcher.Ports, portRange)
+	}
+	return matcher, nil
+}
+
+// parseAcl parses the rules of the acl of given name, counting their hits in
+// st.
+func parseAcl(name string, rules []config.AclRule, conf *config.Config, asnDb *acl.AsnDb, st *stats.Stats) (*acl.Acl, error) {
+	if len(rules) == 0 && !conf.RejectIpTargets && conf.AclDefault == "" {
+		return nil, nil
+	}
+	reject, err := acl.ParseReject(conf.AclReject)
+	if err != nil {
+		return nil, fmt.Errorf("parse acl_reject: %w", err)
+	}
+	opts := acl.Options{RejectIpTargets: conf.RejectIpTargets, Reject: reject}
+	if conf.AclDefault != "" {
+		if opts.Default, err = acl.ParseAction(conf.AclDefault); err != nil {
+			return nil, fmt.Errorf("parse acl_default: %w", err)
+		}
+	}
+	for i, r := range rules {
+		action, err := acl.ParseAction(r.Action)
+		if err != nil {
+			return nil, fmt.Errorf("parse acl rule %v: %w", i, err)
+		}
+		rule := acl.Rule{Action: action, Hits: st.AclRule(name, i, string(action))}
+		if r.Reject != "" {
+			if rule.Reject, err = acl.ParseReject(r.Reject); err != nil {
+				return nil, fmt.Errorf("parse acl rule %v: %w", i, err)
+			}
+		}
+		if rule.Matcher, err = parseMatcher(r.Match, asnDb); err != nil {
+			return nil, fmt.Errorf("parse acl rule %v: %w", i, err)
+		}
+		if r.DryRun != "" {
+			dryRun, err := time.ParseDuration(r.DryRun)
+			if err != nil {
+				return nil, fmt.Errorf("parse dry_run of acl rule %v: %w", i, err)
+			}
+			rule.DryRunUntil = time.Now().Add(dryRun)
+		}
+		opts.Rules = append(opts.Rules, rule)
+	}
+	a, err := acl.New(opts)
+	if err != nil {
+		return nil, fmt.Errorf("parse acl: %w", err)
+	}
+	return a, nil
+}
+
+func parseBittorrent(b *config.Bittorrent) (*server.Bittorrent, error) {
+	bittorrent := &server.Bittorrent{Action: strings.ToLower(b.Action)}
+	if b.Rate != "" {
+		var err error
+		if bittorrent.Rate, err = brutal.ParseBandwidth(b.Rate); err != nil {
+			return nil, fmt.Errorf("parse rate of bittorrent: %w", err)
+		}
+	}
+	return bittorrent, nil
+}
+
+func parseOutboundPool(p *config.OutboundPool) (*server.OutboundPool, error) {
+	pool := &server.OutboundPool{Size: p.Size}
+	if p.Size < 0 {
+		return nil, fmt.Errorf("invalid size of outbound_pool: %v", p.Size)
+	}
+	if p.IdleTimeout != "" {
+		var err error
+		if pool.IdleTimeout, err = time.ParseDuration(p.IdleTimeout); err != nil {
+			return nil, fmt.Errorf("parse idle_timeout of outbound_pool: %w", err)
+		}
+	}
+	return pool, nil
+}
+
+// parseLoopGuard returns the guard of the ports that the server listens at.
+func parseLoopGuard(conf *config.Config) (*server.LoopGuard, error) {
+	listens := []string{conf.Listen, conf.MetricsListen, conf.ApiListen}
+	for _, l := range conf.Listeners {
+		listens = append(listens, l.Listen)
+	}
+	if conf.Fallback != nil {
+		listens = append(listens, conf.Fallback.Listen)
+	}
+	for _, s := range conf.ReverseServices {
+		listens = append(listens, s.Listen)
+	}
+	guard := server.NewLoopGuard(conf.BlockLocalTargets)
+	for _, listen := range listens {
+		if listen == "" {
+			continue
+		}
+		if err := guard.AddListen(listen); err != nil {
+			return nil, fmt.Errorf("listen %v: %w", listen, err)
+		}
+	}
+	return guard, nil
+}
+
+// parseReverse returns the reverse services, each served by a user of the
+// server or of one of its listeners.
+func parseReverse(conf *config.Config, strictHalfClose bool) (*server.Reverse, error) {
+	userSets := []map[string]string{conf.Users}
+	for _, l := range conf.Listeners {
+		userSets = append(userSets, l.Users)
+	}
+	users := map[uuid.UUID]bool{}
+	for _, userSet := range userSets {
+		for u := range userSet {
+			if id, err := uuid.Parse(u); err == nil {
+				users[id] = true
+			}
+		}
+	}
+	services := make([]server.ReverseService, 0, len(conf.ReverseServices))
+	for _, s := range conf.ReverseServices {
+		if s.Listen == "" {
+			return nil, fmt.Errorf("reverse service %v: \"listen\" is required", s.Name)
+		}
+		user, err := uuid.Parse(s.User)
+		if err != nil {
+			return nil, fmt.Errorf("reverse service %v: parse user: %w", s.Name, err)
+		}
+		if !users[user] {
+			return nil, fmt.Errorf("reverse service %v: unknown user %v", s.Name, user)
+		}
+		services = append(services, server.ReverseService{
+			Name:   s.Name,
+			Listen: s.Listen,
+			User:   user,
+		})
+	}
+	return server.NewReverse(server.ReverseOptions{
+		Logger:          logger,
+		Services:        services,
+		StrictHalfClose: strictHalfClose,
+	})
+}
+
+func parseTrafficAlerts(conf *config.Config) ([]stats.Alert, error) {
+	alerts := make([]stats.Alert, len(conf.TrafficAlerts))
+	for i, a := range conf.TrafficAlerts {
+		alert := &alerts[i]
+		alert.User = a.User
+		alert.Webhook = a.Webhook
+		alert.Command = a.Command
+		var err error
+		if a.Traffic != "" {
+			if alert.Traffic, err = stats.ParseSize(a.Traffic); err != nil {
+				return nil, fmt.Errorf("parse traffic of traffic alert: %w", err)
+			}
+		}
+		if a.Speed != "" {
+			if alert.Speed, err = brutal.ParseBandwidth(a.Speed); err != nil {
+				return nil, fmt.Errorf("parse speed of traffic alert: %w", err)
+			}
+		}
+		// The sandbox denies execve.
+		if len(a.Command) > 0 && conf.Sandbox {
+			return nil, fmt.Errorf("command of traffic alert is not allowed in the sandbox")
+		}
+	}
+	return alerts, nil
+}
+
+func parseObfuscation(o *config.Obfuscation) (*server.Obfuscation, error) {
+	obfuscation := &server.Obfuscation{}
+	if o.Padding != "" {
+		from, to, ok := strings.Cut(o.Padding, "-")
+		if !ok {
+			to = from
+		}
+		var err1, err2 error
+		obfuscation.PaddingMin, err1 = strconv.Atoi(strings.TrimSpace(from))
+		obfuscation.PaddingMax, err2 = strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("parse padding of obfuscation: %v, expect min-max", o.Padding)
+		}
+	}
+	if o.AuthJitter != "" {
+		var err error
+		if obfuscation.AuthJitter, err = time.ParseDuration(o.AuthJitter); err != nil {
+			return nil, fmt.Errorf("parse auth_jitter of obfuscation: %w", err)
+		}
+	}
+	return obfuscation, nil
+}
+
+func parseRewrite(rules []config.RewriteRule, asnDb *acl.AsnDb) (*acl.Rewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	var rewrites []acl.Rewrite
+	for i, r := range rules {
+		matcher, err := parseMatcher(r.Match, asnDb)
+		if err != nil {
+			return nil, fmt.Errorf("parse rewrite %v: %w", i, err)
+		}
+		host, port, err := acl.ParseRewriteTo(r.To)
+		if err != nil {
+			return nil, fmt.Errorf("parse rewrite %v: %w", i, err)
+		}
+		rewrites = append(rewrites, acl.Rewrite{Matcher: matcher, Host: host, Port: port})
+	}
+	return acl.NewRewriter(rewrites)
+}
+
+// parseSchedule returns the named windows of the schedule and the schedules
+// of users by uuid.
+func parseSchedule(conf *config.Schedule) (named map[string]*schedule.Schedule, users map[string]*schedule.Schedule, err error) {
+	if conf == nil {
+		return nil, nil, nil
+	}
+	loc, err := log.ParseTimeZone(conf.Timezone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse timezone of schedule: %w", err)
+	}
+	named = make(map[string]*schedule.Schedule, len(conf.Windows))
+	for name, windows := range conf.Windows {
+		if named[name], err = schedule.Parse(windows, loc); err != nil {
+			return nil, nil, fmt.Errorf("parse schedule %v: %w", name, err)
+		}
+	}
+	users = make(map[string]*schedule.Schedule, len(conf.Users))
+	for user, name := range conf.Users {
+		sched, ok := named[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown schedule of user %v: %v", user, name)
+		}
+		users[user] = sched
+	}
+	return named, users, nil
+}
+
+func parseGroups(conf *config.Config, schedules map[string]*schedule.Schedule, asnDb *acl.AsnDb, st *stats.Stats) ([]*server.Group, error) {
+	names := make([]string, 0, len(conf.Groups))
+	for name := range conf.Groups {
+		names = append(names, name)
+	}
+	// Sorted for the same error on a user in several groups every time.
+	sort.Strings(names)
+	var groups []*server.Group
+	for _, name := range names {
+		g := conf.Groups[name]
+		group := &server.Group{
+			Name:              name,
+			Users:             g.Users,
+			MaxConnsPerUser:   g.MaxConnsPerUser,
+			MaxStreamsPerUser: g.MaxStreamsPerUser,
+			CongestionControl: g.CongestionControl,
+			InitialCwnd:       g.InitialCwndPackets,
+			ClientCerts:       g.ClientCerts,
+		}
+		if g.Bandwidth != "" {
+			var err error
+			if group.MaxBandwidthUp, err = brutal.ParseBandwidth(g.Bandwidth); err != nil {
+				return nil, fmt.Errorf("group %v: parse bandwidth: %w", name, err)
+			}
+		}
+		if g.Bittorrent != nil {
+			var err error
+			if group.Bittorrent, err = parseBittorrent(g.Bittorrent); err != nil {
+				return nil, fmt.Errorf("group %v: %w", name, err)
+			}
+		}
+		if len(g.Acl) > 0 {
+			var err error
+			if group.Acl, err = parseAcl("group "+name, g.Acl, conf, asnDb, st); err != nil {
+				return nil, fmt.Errorf("group %v: %w", name, err)
+			}
+		}
+		if g.Schedule != "" {
+			var ok bool
+			if group.Schedule, ok = schedules[g.Schedule]; !ok {
+				return nil, fmt.Errorf("group %v: unknown schedule: %v", name, g.Schedule)
+			}
+		}
+		if g.Outbound != "" {
+			var ok bool
+			if group.DialerLink, ok = conf.Outbounds[g.Outbound]; !ok {
+				return nil, fmt.Errorf("group %v: unknown outbound: %v", name, g.Outbound)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
 func Serve(conf *config.Config) (err error) {
-	var fwmark uint64
-	if conf.Fwmark != "" {
-		fwmark, err = strconv.ParseUint(conf.Fwmark, 0, 32)
+	if err = shared.TuneCpu(conf, logger); err != nil {
+		return err
+	}
+	if err = shared.ApplyProfile(conf, logger); err != nil {
+		return err
+	}
+	for _, warning := range conf.Warnings {
+		logger.Warn().Str("warning", warning).Msg("Config warning")
+	}
+	fwmark, err := parseFwmark(conf.Fwmark)
+	if err != nil {
+		return err
+	}
+	sourcePorts, err := parseSourcePorts(conf.SourcePorts)
+	if err != nil {
+		return err
+	}
+	snapshots, err := newSnapshots(conf, shared.GetArguments().CfgFile)
+	if err != nil {
+		return err
+	}
+	if snapshots != nil {
+		var interval time.Duration
+		if conf.ConfigSnapshots.Interval != "" {
+			if interval, err = time.ParseDuration(conf.ConfigSnapshots.Interval); err != nil {
+				return fmt.Errorf("parse config_snapshots.interval: %w", err)
+			}
+		}
+		if err = keepSnapshots(snapshots, interval); err != nil {
+			return err
+		}
+	}
+	st := stats.New()
+	if conf.StatsFile != "" {
+		var interval time.Duration
+		if conf.StatsSaveInterval != "" {
+			if interval, err = time.ParseDuration(conf.StatsSaveInterval); err != nil {
+				return fmt.Errorf("parse stats_save_interval: %w", err)
+			}
+		}
+		if err = st.Load(conf.StatsFile); err != nil {
+			return fmt.Errorf("load stats: %w", err)
+		}
+		go st.SaveEvery(conf.StatsFile, interval, logger)
+		onExit(func() {
+			if err := st.Save(conf.StatsFile); err != nil {
+				logger.Warn().
+					Err(err).
+					Msg("Failed to save stats")
+			}
+		})
+	}
+	var peers server.Peers
+	if conf.Cluster != nil {
+		var interval time.Duration
+		if conf.Cluster.Interval != "" {
+			if interval, err = time.ParseDuration(conf.Cluster.Interval); err != nil {
+				return fmt.Errorf("parse interval of cluster: %w", err)
+			}
+		}
+		c, err := cluster.New(cluster.Options{
+			Logger:   logger,
+			Instance: st.Instance(),
+			Peers:    conf.Cluster.Peers,
+			Token:    conf.Cluster.Token,
+			Interval: interval,
+		})
+		if err != nil {
+			return err
+		}
+		logger.Info().
+			Strs("peers", c.Peers).
+			Msg("Cluster mode")
+		go c.Run(context.Background())
+		peers = c
+	}
+	var proxyProtocolTrusted []netip.Prefix
+	for _, trusted := range conf.ProxyProtocolTrusted {
+		prefix, err := parsePrefix(trusted)
+		if err != nil {
+			return fmt.Errorf("parse proxy_protocol_trusted: %w", err)
+		}
+		proxyProtocolTrusted = append(proxyProtocolTrusted, prefix)
+	}
+	var denySources []netip.Prefix
+	for _, denied := range conf.DenySources {
+		prefix, err := parsePrefix(denied)
 		if err != nil {
-			return fmt.Errorf("parse fwmark: %w", err)
+			return fmt.Errorf("parse deny_sources: %w", err)
+		}
+		denySources = append(denySources, prefix)
+	}
+	var tarpit bool
+	switch conf.DenySourcesMode {
+	case "", "drop":
+	case "tarpit":
+		tarpit = true
+	default:
+		return fmt.Errorf("unexpected deny_sources_mode: %v", conf.DenySourcesMode)
+	}
+	var asnDb *acl.AsnDb
+	if conf.AsnDb != "" {
+		if asnDb, err = acl.OpenAsnDb(conf.AsnDb); err != nil {
+			return fmt.Errorf("open asn_db: %w", err)
+		}
+	}
+	if err = shared.StartGeodataUpdater(conf, logger, func(path string) {
+		if asnDb == nil || filepath.Clean(path) != filepath.Clean(asnDb.Path()) {
+			return
 		}
-		if fwmark > math.MaxInt || fwmark > math.MaxUint32 {
-			return fmt.Errorf("fwmark is too large")
+		if err := asnDb.Reload(); err != nil {
+			logger.Warn().
+				Err(err).
+				Msg("Failed to reload asn_db")
+		}
+	}); err != nil {
+		return err
+	}
+	serverAcl, err := parseAcl("acl", conf.Acl, conf, asnDb, st)
+	if err != nil {
+		return err
+	}
+	rewriter, err := parseRewrite(conf.Rewrite, asnDb)
+	if err != nil {
+		return err
+	}
+	namedSchedules, schedules, err := parseSchedule(conf.Schedule)
+	if err != nil {
+		return err
+	}
+	groups, err := parseGroups(conf, namedSchedules, asnDb, st)
+	if err != nil {
+		return err
+	}
+	var strictHalfClose bool
+	switch conf.TcpHalfClose {
+	case "", "legacy":
+	case "strict":
+		strictHalfClose = true
+	default:
+		return fmt.Errorf("unexpected tcp_half_close: %v", conf.TcpHalfClose)
+	}
+	var listenNetwork string
+	switch conf.ListenStack {
+	case "", "dual":
+		listenNetwork = "udp"
+	case "ipv4":
+		listenNetwork = "udp4"
+	case "ipv6":
+		listenNetwork = "udp6"
+	default:
+		return fmt.Errorf("unexpected listen_stack: %v", conf.ListenStack)
+	}
+	if conf.Listen == "" && len(conf.Listeners) == 0 {
+		return fmt.Errorf(`"Listen" is required`)
+	}
+	var dialStrategy server.DialStrategy
+	switch conf.DialStrategy {
+	case "", "dual":
+		dialStrategy = server.DialDual
+	case "prefer_ipv4":
+		dialStrategy = server.DialPreferIPv4
+	case "prefer_ipv6":
+		dialStrategy = server.DialPreferIPv6
+	case "ipv4":
+		dialStrategy = server.DialIPv4
+	case "ipv6":
+		dialStrategy = server.DialIPv6
+	default:
+		return fmt.Errorf("unexpected dial_strategy: %v", conf.DialStrategy)
+	}
+	var udpBroadcast server.UdpBroadcast
+	switch conf.UdpBroadcast {
+	case "", "drop":
+		udpBroadcast = server.UdpBroadcastDrop
+	case "log":
+		udpBroadcast = server.UdpBroadcastLog
+	case "relay":
+		udpBroadcast = server.UdpBroadcastRelay
+	default:
+		return fmt.Errorf("unexpected udp_broadcast: %v", conf.UdpBroadcast)
+	}
+	loopGuard, err := parseLoopGuard(conf)
+	if err != nil {
+		return err
+	}
+	var dnsTimeout time.Duration
+	if conf.DnsTimeout != "" {
+		if dnsTimeout, err = time.ParseDuration(conf.DnsTimeout); err != nil || dnsTimeout <= 0 {
+			return fmt.Errorf("invalid dns_timeout: %v", conf.DnsTimeout)
+		}
+	}
+	var outboundPool *server.OutboundPool
+	if conf.OutboundPool != nil {
+		if outboundPool, err = parseOutboundPool(conf.OutboundPool); err != nil {
+			return err
 		}
 	}
-	s, err := server.New(&server.Options{
+	var dialFailureTtl time.Duration
+	if conf.DialFailureTtl != "" {
+		if dialFailureTtl, err = time.ParseDuration(conf.DialFailureTtl); err != nil {
+			return fmt.Errorf("parse dial_failure_ttl: %w", err)
+		}
+	}
+	var tcpIdleTimeoutUp, tcpIdleTimeoutDown time.Duration
+	if conf.TcpIdleTimeoutUp != "" {
+		if tcpIdleTimeoutUp, err = time.ParseDuration(conf.TcpIdleTimeoutUp); err != nil {
+			return fmt.Errorf("parse tcp_idle_timeout_up: %w", err)
+		}
+	}
+	if conf.TcpIdleTimeoutDown != "" {
+		if tcpIdleTimeoutDown, err = time.ParseDuration(conf.TcpIdleTimeoutDown); err != nil {
+			return fmt.Errorf("parse tcp_idle_timeout_down: %w", err)
+		}
+	}
+	certExpiryWarning := defaultCertExpiryWarning
+	if conf.CertExpiryWarning != "" {
+		if certExpiryWarning, err = time.ParseDuration(conf.CertExpiryWarning); err != nil {
+			return fmt.Errorf("parse cert_expiry_warning: %w", err)
+		}
+	}
+	var maxBandwidthUp uint64
+	if conf.Bandwidth != nil && conf.Bandwidth.Up != "" {
+		if maxBandwidthUp, err = brutal.ParseBandwidth(conf.Bandwidth.Up); err != nil {
+			return fmt.Errorf("parse bandwidth: %w", err)
+		}
+	}
+	var bittorrent *server.Bittorrent
+	if conf.Bittorrent != nil {
+		if bittorrent, err = parseBittorrent(conf.Bittorrent); err != nil {
+			return err
+		}
+	}
+	var obfuscation *server.Obfuscation
+	if conf.Obfuscation != nil {
+		if obfuscation, err = parseObfuscation(conf.Obfuscation); err != nil {
+			return err
+		}
+	}
+	var clientCAs *x509.CertPool
+	if conf.ClientCa != "" {
+		certs, err := common.ParseCertChain(conf.ClientCa)
+		if err != nil {
+			return fmt.Errorf("parse client_ca: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		for _, cert := range certs {
+			clientCAs.AddCert(cert)
+		}
+	}
+	var sessionTicketPolicy server.SessionTicketPolicy
+	if conf.SessionTicketRotation != "" {
+		if sessionTicketPolicy.Rotation, err = time.ParseDuration(conf.SessionTicketRotation); err != nil || sessionTicketPolicy.Rotation < time.Minute {
+			return fmt.Errorf("invalid session_ticket_rotation: %v, expect a minute or more", conf.SessionTicketRotation)
+		}
+	}
+	if conf.SessionTicketMaxKeys < 0 {
+		return fmt.Errorf("invalid session_ticket_max_keys: %v", conf.SessionTicketMaxKeys)
+	}
+	sessionTicketPolicy.ValidKeys = conf.SessionTicketMaxKeys
+	var sessionTicketKeys *server.SessionTicketKeys
+	if conf.SessionTicketKeys != "" || sessionTicketPolicy != (server.SessionTicketPolicy{}) {
+		if sessionTicketKeys, err = server.LoadSessionTicketKeys(logger, conf.SessionTicketKeys, sessionTicketPolicy); err != nil {
+			return fmt.Errorf("load session_ticket_keys: %w", err)
+		}
+		go sessionTicketKeys.Run()
+	}
+	var (
+		highRtt     time.Duration
+		highRttCwnd int
+	)
+	if conf.InitialCwndHighRtt != nil {
+		if highRtt, err = time.ParseDuration(conf.InitialCwndHighRtt.Rtt); err != nil {
+			return fmt.Errorf("parse rtt of initial_cwnd_high_rtt: %w", err)
+		}
+		highRttCwnd = conf.InitialCwndHighRtt.Packets
+	}
+	opts := server.Options{
 		Logger:                logger,
+		Stats:                 st,
+		Events:                event.NewBus(),
 		Users:                 conf.Users,
 		Certificate:           conf.Certificate,
 		PrivateKey:            conf.PrivateKey,
 		CongestionControl:     conf.CongestionControl,
-		Fwmark:                int(fwmark),
+		Fwmark:                fwmark,
 		SendThrough:           conf.SendThrough,
+		SourcePorts:           sourcePorts,
+		DialStrategy:          dialStrategy,
+		DnsTimeout:            dnsTimeout,
+		LoopGuard:             loopGuard,
+		OutboundPool:          outboundPool,
 		DialerLink:            conf.DialerLink,
+		Detour:                conf.Detour,
+		MaxBandwidthUp:        maxBandwidthUp,
+		MaxIncomingStreams:    conf.MaxIncomingStreams,
+		MaxIncomingUniStreams: conf.MaxIncomingUniStreams,
+		InitialCwnd:           conf.InitialCwndPackets,
+		HighRtt:               highRtt,
+		HighRttCwnd:           highRttCwnd,
 		DisableOutboundUdp443: conf.DisableOutboundUdp443,
+		UdpBroadcast:          udpBroadcast,
+		MaxStreamsPerConn:     conf.MaxStreamsPerConn,
+		MaxStreamsPerUser:     conf.MaxStreamsPerUser,
+		MaxConnsPerUser:       conf.MaxConnsPerUser,
+		Peers:                 peers,
+		ProxyProtocolTrusted:  proxyProtocolTrusted,
+		DenySources:           denySources,
+		Tarpit:                tarpit,
+		ListenNetwork:         listenNetwork,
+		UdpReceiveBuffer:      conf.UdpReceiveBuffer,
+		UdpSendBuffer:         conf.UdpSendBuffer,
+		UdpSessionQueue:       conf.UdpSessionQueue,
+		DialFailureTtl:        dialFailureTtl,
+		TcpIdleTimeoutUp:      tcpIdleTimeoutUp,
+		TcpIdleTimeoutDown:    tcpIdleTimeoutDown,
+		StrictHalfClose:       strictHalfClose,
+		Acl:                   serverAcl,
+		Rewriter:              rewriter,
+		Bittorrent:            bittorrent,
+		Obfuscation:           obfuscation,
+		ApiAdmins:             conf.ApiAdmins,
+		Schedules:             schedules,
+		Groups:                groups,
+		SessionTicketKeys:     sessionTicketKeys,
+		ClientCAs:             clientCAs,
+	}
+	if conf.Profile == shared.ProfileEmbedded {
+		opts.ReceiveWindows = &server.SmallReceiveWindows
+	}
+	if len(conf.ApiAdmins) > 0 {
+		opts.Api = server.NewApiListener()
+	}
+	if len(conf.ReverseServices) > 0 {
+		if opts.Reverse, err = parseReverse(conf, strictHalfClose); err != nil {
+			return err
+		}
+	}
+	if conf.TraceQlogDir != "" {
+		if err = os.MkdirAll(conf.TraceQlogDir, 0700); err != nil {
+			return fmt.Errorf("trace_qlog_dir: %w", err)
+		}
+	}
+	opts.Tracing = server.NewTracing(logger, conf.TraceQlogDir)
+	// Every listener is a tenant with its own users and outbound, sharing
+	// the stats, event bus and management API with the others.
+	var (
+		servers []*server.Server
+		listens []string
+	)
+	if conf.Listen != "" {
+		s, err := server.New(&opts)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, s)
+		listens = append(listens, conf.Listen)
+	}
+	for _, l := range conf.Listeners {
+		if l.Listen == "" {
+			return fmt.Errorf(`"listen" of listeners is required`)
+		}
+		tenantOpts := opts
+		tenantOpts.Users = l.Users
+		if l.Fwmark != "" {
+			if tenantOpts.Fwmark, err = parseFwmark(l.Fwmark); err != nil {
+				return fmt.Errorf("listener %v: %w", l.Listen, err)
+			}
+		}
+		if l.SendThrough != "" {
+			tenantOpts.SendThrough = l.SendThrough
+		}
+		if l.SourcePorts != "" {
+			if tenantOpts.SourcePorts, err = parseSourcePorts(l.SourcePorts); err != nil {
+				return fmt.Errorf("listener %v: %w", l.Listen, err)
+			}
+		}
+		if l.DialerLink != "" {
+			tenantOpts.DialerLink = l.DialerLink
+		}
+		if l.MaxIncomingStreams != 0 {
+			tenantOpts.MaxIncomingStreams = l.MaxIncomingStreams
+		}
+		if l.MaxIncomingUniStreams != 0 {
+			tenantOpts.MaxIncomingUniStreams = l.MaxIncomingUniStreams
+		}
+		if len(l.Acl) > 0 {
+			if tenantOpts.Acl, err = parseAcl("listener "+l.Listen, l.Acl, conf, asnDb, st); err != nil {
+				return fmt.Errorf("listener %v: %w", l.Listen, err)
+			}
+		}
+		s, err := server.New(&tenantOpts)
+		if err != nil {
+			return fmt.Errorf("listener %v: %w", l.Listen, err)
+		}
+		servers = append(servers, s)
+		listens = append(listens, l.Listen)
+	}
+	// All listeners share the certificate.
+	cert, err := servers[0].Certificate()
+	if err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
+	}
+	go watchCertExpiry(cert, certExpiryWarning, st)
+	if conf.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", st)
+		ln, err := net.Listen("tcp", conf.MetricsListen)
+		if err != nil {
+			return fmt.Errorf("listen metrics: %w", err)
+		}
+		logger.Info().Msg("Metrics listen at " + conf.MetricsListen)
+		go func() {
+			if err := http.Serve(ln, mux); err != nil {
+				logger.Fatal().
+					Err(err).
+					Msg("Failed to serve metrics")
+			}
+		}()
+	}
+	if conf.ApiListen != "" || opts.Api != nil {
+		if err = serveApi(conf, servers, opts.Api, snapshots); err != nil {
+			return err
+		}
+	}
+	for _, e := range conf.StatsExporters {
+		var interval time.Duration
+		if e.Interval != "" {
+			if interval, err = time.ParseDuration(e.Interval); err != nil {
+				return fmt.Errorf("parse interval of stats exporter: %w", err)
+			}
+		}
+		exporter, err := stats.NewExporter(st, stats.ExporterOptions{
+			Logger:   logger,
+			Type:     e.Type,
+			Address:  e.Address,
+			Token:    e.Token,
+			Prefix:   e.Prefix,
+			Interval: interval,
+		})
+		if err != nil {
+			return err
+		}
+		logger.Info().
+			Str("type", e.Type).
+			Str("address", e.Address).
+			Msg("Push stats")
+		go exporter.Run(context.Background())
+	}
+	for _, e := range conf.EventSinks {
+		types := make([]event.Type, len(e.Types))
+		for i, t := range e.Types {
+			types[i] = event.Type(t)
+		}
+		sink, err := event.NewSink(event.SinkOptions{
+			Logger:  logger,
+			Type:    e.Type,
+			Address: e.Address,
+			Topic:   e.Topic,
+			Types:   types,
+		})
+		if err != nil {
+			return err
+		}
+		logger.Info().
+			Str("type", e.Type).
+			Str("address", e.Address).
+			Msg("Send events")
+		sink.Start(context.Background(), servers[0].Events())
+	}
+	if len(conf.TrafficAlerts) > 0 {
+		alerts, err := parseTrafficAlerts(conf)
+		if err != nil {
+			return err
+		}
+		alerter, err := stats.NewAlerter(st, logger, alerts)
+		if err != nil {
+			return err
+		}
+		if c, ok := peers.(*cluster.Cluster); ok {
+			alerter.SetPeers(c)
+		}
+		go alerter.Run(context.Background())
+	}
+	if conf.ExitOnIdle != "" {
+		idle, err := time.ParseDuration(conf.ExitOnIdle)
+		if err != nil {
+			return fmt.Errorf("parse exit_on_idle: %w", err)
+		}
+		go exitOnIdle(servers, idle)
+	}
+	// Bind everything before dropping privileges.
+	pktConns := make([]net.PacketConn, len(servers))
+	for i, s := range servers {
+		if pktConns[i], err = s.Listen(listens[i]); err != nil {
+			return fmt.Errorf("listen at %v: %w", listens[i], err)
+		}
+	}
+	var fallbackConn net.PacketConn
+	if conf.Fallback != nil && conf.Fallback.Listen != "" {
+		if conf.Listen == "" {
+			return fmt.Errorf(`"listen" is required by fallback`)
+		}
+		if fallbackConn, err = servers[0].ListenFallback(conf.Fallback.Listen, conf.Fallback.Path); err != nil {
+			return fmt.Errorf("listen fallback at %v: %w", conf.Fallback.Listen, err)
+		}
+	}
+	if opts.Reverse != nil {
+		if err = opts.Reverse.Listen(); err != nil {
+			return err
+		}
+	}
+	if conf.Capture != nil {
+		if err = startCapture(conf.Capture, servers[0].Events(), pktConns, listens, &fallbackConn); err != nil {
+			return fmt.Errorf("capture: %w", err)
+		}
+	}
+	if err = dropPrivileges(conf.User, conf.Group, conf.Chroot); err != nil {
+		return fmt.Errorf("drop privileges: %w", err)
+	}
+	if conf.Sandbox {
+		if err = sandbox.Apply(sandboxOptions(conf)); err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+		logger.Info().Msg("Sandbox applied")
+	}
+	errs := make(chan error, len(servers)+2)
+	for i, s := range servers {
+		logger.Info().Msg("Listen at " + listens[i])
+		go func(s *server.Server, pktConn net.PacketConn, listen string) {
+			if err := s.ServePacketConn(pktConn); err != nil {
+				errs <- fmt.Errorf("listen at %v: %w", listen, err)
+			}
+		}(s, pktConns[i], listens[i])
+	}
+	if fallbackConn != nil {
+		logger.Info().Msg("Fallback listen at " + conf.Fallback.Listen)
+		go func() {
+			if err := servers[0].ServePacketConn(fallbackConn); err != nil {
+				errs <- fmt.Errorf("listen fallback at %v: %w", conf.Fallback.Listen, err)
+			}
+		}()
+	}
+	if opts.Reverse != nil {
+		go func() {
+			if err := opts.Reverse.Serve(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	return <-errs
+}
+
+// startCapture starts capturing the stream events of bus and, if pcaps are
+// enabled, the datagrams of pktConns and the fallback.
+func startCapture(conf *config.Capture, bus *event.Bus, pktConns []net.PacketConn, listens []string, fallbackConn *net.PacketConn) error {
+	if conf.Dir == "" {
+		return fmt.Errorf(`"dir" is required`)
+	}
+	var duration time.Duration
+	if conf.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(conf.Duration); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid duration: %v", conf.Duration)
+		}
+	}
+	c, err := capture.New(&capture.Options{
+		Logger:   logger,
+		Dir:      conf.Dir,
+		Duration: duration,
+		Pcap:     conf.Pcap,
 	})
 	if err != nil {
 		return err
 	}
-	if conf.Listen == "" {
-		return fmt.Errorf(`"Listen" is required`)
-	}
-	logger.Info().Msg("Listen at " + conf.Listen)
-	if err = s.Serve(conf.Listen); err != nil {
+	if err = c.Streams(bus); err != nil {
 		return err
 	}
+	for i := range pktConns {
+		if pktConns[i], err = c.WrapPacketConn(pktConns[i], listens[i]); err != nil {
+			return err
+		}
+	}
+	if *fallbackConn != nil {
+		if *fallbackConn, err = c.WrapPacketConn(*fallbackConn, "fallback"); err != nil {
+			return err
+		}
+	}
+	logger.Warn().
+		Str("dir", conf.Dir).
+		Bool("pcap", conf.Pcap).
+		Msg("Capture started; it records the targets of users")
 	return nil
 }
 
+// sandboxOptions allows the files the server may still open after
+// initialization: certificates, logs, the stats and pid files, qlogs of
+// traces, config snapshots, drops of sockets in /proc, and the system
+// files used for name resolution and TLS verification of dialer_link.
+func sandboxOptions(conf *config.Config) *sandbox.Options {
+	opts := &sandbox.Options{
+		ReadPaths: []string{
+			"/etc/hosts",
+			"/etc/resolv.conf",
+			"/etc/nsswitch.conf",
+			"/etc/services",
+			"/etc/ssl",
+			"/etc/pki",
+			"/etc/ca-certificates",
+			"/proc/net",
+		},
+	}
+	for _, path := range []string{conf.Certificate, conf.PrivateKey} {
+		if !common.IsInlinePem(path) {
+			opts.ReadPaths = append(opts.ReadPaths, path)
+		}
+	}
+	if conf.AsnDb != "" {
+		// It is reloaded once updated.
+		opts.ReadPaths = append(opts.ReadPaths, conf.AsnDb)
+	}
+	if conf.Geodata != nil && conf.Geodata.Interval != "" {
+		// Updates replace the files with temporary ones, whose rules the
+		// files would not carry over.
+		for _, f := range conf.Geodata.Files {
+			opts.WritePaths = append(opts.WritePaths, filepath.Dir(f.Path))
+		}
+	}
+	arguments := shared.GetArguments()
+	if strings.Contains(arguments.LogOutput, "file") {
+		// Rotation creates and removes files beside the log file.
+		opts.WritePaths = append(opts.WritePaths, filepath.Dir(arguments.LogFile))
+	}
+	if arguments.PidFile != "" {
+		opts.WritePaths = append(opts.WritePaths, filepath.Dir(arguments.PidFile))
+	}
+	if conf.StatsFile != "" {
+		// Stats are saved to a temporary file renamed to the stats file.
+		opts.WritePaths = append(opts.WritePaths, filepath.Dir(conf.StatsFile))
+	}
+	if conf.SessionTicketKeys != "" {
+		// Keys are rotated by replacing the file with a temporary one.
+		opts.WritePaths = append(opts.WritePaths, filepath.Dir(conf.SessionTicketKeys))
+	}
+	if conf.TraceQlogDir != "" {
+		opts.WritePaths = append(opts.WritePaths, conf.TraceQlogDir)
+	}
+	if conf.ConfigSnapshots != nil && arguments.CfgFile != "" {
+		// A rollback replaces the config file with a temporary one.
+		opts.WritePaths = append(opts.WritePaths, conf.ConfigSnapshots.Dir, filepath.Dir(arguments.CfgFile))
+	}
+	return opts
+}
+
+// exitOnIdle exits cleanly once no server has had a connection for the idle
+// duration, counting from the start. Connections are checked every tenth of
+// it, between a second and ten seconds.
+func exitOnIdle(servers []*server.Server, idle time.Duration) {
+	interval := max(min(idle/10, 10*time.Second), time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	idleSince := time.Now()
+	for range ticker.C {
+		var connections int64
+		for _, s := range servers {
+			connections += s.Connections()
+		}
+		if connections > 0 {
+			idleSince = time.Now()
+			continue
+		}
+		if time.Since(idleSince) >= idle {
+			logger.Info().
+				Dur("idle", idle).
+				Msg("Exiting on idle")
+			runExitHooks()
+			os.Exit(0)
+		}
+	}
+}
+
 func init() {
 	// cmds
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(shared.NewGeodataCmd())
+	rootCmd.AddCommand(shared.NewUpgradeCmd("juicity-server"))
 
 	// flags
 	shared.InitArgumentsFlags(runCmd)
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juicity/juicity/cmd/internal/shared"
+	"github.com/juicity/juicity/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	snapshotCmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "To manage the snapshots of the config file in config_snapshots.dir.",
+		Long: `To manage the snapshots of the config file in config_snapshots.dir.
+
+A snapshot is a copy of the config file as written: an encrypted file stays
+encrypted, and a template is kept unrendered, without the files it includes.
+The state of the running server, e.g. users suspended by kicks, is not kept.`,
+	}
+	snapshotListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "To list the snapshots of the config file, the newest first.",
+		Run: func(cmd *cobra.Command, args []string) {
+			snapshots := mustSnapshots()
+			list, err := snapshots.List()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			for _, s := range list {
+				fmt.Printf("%v\t%v\t%v bytes\n", s.Name, s.Time.Local().Format(time.DateTime), s.Size)
+			}
+		},
+	}
+	snapshotSaveCmd = &cobra.Command{
+		Use:   "save",
+		Short: "To take a snapshot of the config file, not of the state of the server.",
+		Run: func(cmd *cobra.Command, args []string) {
+			s, err := mustSnapshots().Save()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println(s.Name)
+		},
+	}
+	snapshotRollbackCmd = &cobra.Command{
+		Use:   "rollback <name>",
+		Short: "To replace the config file with a snapshot, applied when the server restarts.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			backup, err := mustSnapshots().Rollback(args[0])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Printf("Rolled back to %v; the replaced config is kept as %v. Restart the server to apply it.\n", args[0], backup.Name)
+		},
+	}
+)
+
+// newSnapshots returns the snapshots of the config file, or nil if
+// config_snapshots is not set.
+func newSnapshots(conf *config.Config, file string) (*config.Snapshots, error) {
+	if conf.ConfigSnapshots == nil {
+		return nil, nil
+	}
+	if conf.ConfigSnapshots.Dir == "" {
+		return nil, fmt.Errorf("config_snapshots.dir is required")
+	}
+	// A config from the environment has no file to roll back.
+	if file == "" || os.Getenv(config.EnvConfigJson) != "" || os.Getenv(config.EnvConfigJsonBase64) != "" {
+		return nil, fmt.Errorf("config_snapshots requires a config file given by --config")
+	}
+	return &config.Snapshots{
+		File: file,
+		Dir:  conf.ConfigSnapshots.Dir,
+		Max:  conf.ConfigSnapshots.Max,
+	}, nil
+}
+
+func mustSnapshots() *config.Snapshots {
+	arguments := shared.GetArguments()
+	conf, err := arguments.GetConfig()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	snapshots, err := newSnapshots(conf, arguments.CfgFile)
+	if err == nil && snapshots == nil {
+		err = fmt.Errorf("config_snapshots is not set in the config")
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return snapshots
+}
+
+// keepSnapshots takes a snapshot of the config file at start, and then
+// every interval if set.
+func keepSnapshots(snapshots *config.Snapshots, interval time.Duration) error {
+	s, err := snapshots.Save()
+	if err != nil {
+		return fmt.Errorf("snapshot the config file: %w", err)
+	}
+	logger.Info().
+		Str("dir", snapshots.Dir).
+		Str("latest", s.Name).
+		Msg("Keep snapshots of the config file")
+	if interval <= 0 {
+		return nil
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := snapshots.Save(); err != nil {
+				logger.Warn().
+					Err(err).
+					Str("dir", snapshots.Dir).
+					Msg("Failed to snapshot the config file")
+			}
+		}
+	}()
+	return nil
+}
+
+func init() {
+	// cmds
+	rootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotListCmd, snapshotSaveCmd, snapshotRollbackCmd)
+
+	// flags
+	shared.InitArgumentsFlags(snapshotCmd)
+}
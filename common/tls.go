@@ -0,0 +1,68 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// IsInlinePem reports whether s is PEM content rather than a file path.
+func IsInlinePem(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN ")
+}
+
+// LoadX509KeyPair loads a certificate chain and its private key, each of which
+// is either a file path or inline PEM content.
+func LoadX509KeyPair(certificate, privateKey string) (tls.Certificate, error) {
+	if !IsInlinePem(certificate) && !IsInlinePem(privateKey) {
+		return tls.LoadX509KeyPair(certificate, privateKey)
+	}
+	certPem, err := readPem(certificate)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPem, err := readPem(privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPem, keyPem)
+}
+
+func readPem(s string) ([]byte, error) {
+	if IsInlinePem(s) {
+		return []byte(s), nil
+	}
+	return os.ReadFile(s)
+}
+
+// ParseCertChain parses the certificates of a chain, which is either a file
+// path or inline PEM content.
+func ParseCertChain(certificate string) ([]*x509.Certificate, error) {
+	b, err := readPem(certificate)
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return chain, nil
+}
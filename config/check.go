@@ -0,0 +1,343 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// checker collects the problems of a config, with the line of the field in
+// the json if known.
+type checker struct {
+	b []byte
+	// lines are the lines of fields by their paths, e.g. "acl[0]" or
+	// "listeners[0].users.<uuid>".
+	lines    map[string]int
+	problems []error
+	// warnings are the problems that do not fail the config.
+	warnings []string
+}
+
+func (c *checker) line(offset int64) int {
+	return 1 + bytes.Count(c.b[:offset], []byte("\n"))
+}
+
+func (c *checker) add(path string, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if line, ok := c.lines[path]; ok {
+		c.problems = append(c.problems, fmt.Errorf("line %v: %v: %v", line, path, msg))
+		return
+	}
+	c.problems = append(c.problems, fmt.Errorf("%v: %v", path, msg))
+}
+
+// scan records the lines of keys and reports the keys repeated in an
+// object, which json.Unmarshal silently overwrites. A repeated user is a
+// problem, since one of its passwords would be lost; other keys are warned
+// about.
+func (c *checker) scan(dec *json.Decoder, path string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		seen := map[string]bool{}
+		for dec.More() {
+			tok, err = dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := tok.(string)
+			p := key
+			if path != "" {
+				p = path + "." + key
+			}
+			line := c.line(dec.InputOffset())
+			switch {
+			case seen[key] && (path == "users" || strings.HasSuffix(path, ".users")):
+				c.problems = append(c.problems, fmt.Errorf("line %v: %v: duplicate key", line, p))
+			case seen[key]:
+				c.warnings = append(c.warnings, fmt.Sprintf("line %v: %v: duplicate key, the last one wins", line, p))
+			default:
+				c.lines[p] = line
+			}
+			seen[key] = true
+			if err = c.scan(dec, p); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			p := fmt.Sprintf("%v[%v]", path, i)
+			// The element starts after the separator and spaces.
+			offset := dec.InputOffset()
+			for offset < int64(len(c.b)) && strings.IndexByte(" \t\r\n,", c.b[offset]) >= 0 {
+				offset++
+			}
+			c.lines[p] = c.line(offset)
+			if err = c.scan(dec, p); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+func (c *checker) checkUsers(path string, users map[string]string) {
+	keys := make([]string, 0, len(users))
+	for k := range users {
+		keys = append(keys, k)
+	}
+	// In the order of the file, so that the later one is the duplicate.
+	sort.Slice(keys, func(i, j int) bool {
+		li, lj := c.lines[path+"."+keys[i]], c.lines[path+"."+keys[j]]
+		if li != lj {
+			return li < lj
+		}
+		return keys[i] < keys[j]
+	})
+	ids := map[uuid.UUID]string{}
+	for _, k := range keys {
+		p := path + "." + k
+		id, err := uuid.Parse(k)
+		if err != nil {
+			c.add(p, "invalid uuid")
+			continue
+		}
+		if users[k] == "" {
+			c.add(p, "empty password")
+		}
+		if dup, ok := ids[id]; ok {
+			c.add(p, "duplicate uuid of %v", dup)
+			continue
+		}
+		ids[id] = k
+	}
+}
+
+// checkApiAdmins reports admins that are not users of any listener.
+func (c *checker) checkApiAdmins(conf *Config) {
+	users := map[uuid.UUID]bool{}
+	for _, m := range append([]map[string]string{conf.Users}, listenerUsers(conf.Listeners)...) {
+		for k := range m {
+			if id, err := uuid.Parse(k); err == nil {
+				users[id] = true
+			}
+		}
+	}
+	for i, admin := range conf.ApiAdmins {
+		p := fmt.Sprintf("api_admins[%v]", i)
+		id, err := uuid.Parse(admin)
+		switch {
+		case err != nil:
+			c.add(p, "invalid uuid")
+		case !users[id]:
+			c.add(p, "not a user")
+		}
+	}
+}
+
+func listenerUsers(listeners []Listener) []map[string]string {
+	users := make([]map[string]string, len(listeners))
+	for i, l := range listeners {
+		users[i] = l.Users
+	}
+	return users
+}
+
+func (c *checker) checkListen(path string, addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil {
+		c.add(path, "invalid address %v, expect host:port", addr)
+	}
+}
+
+// checkPositiveDuration reports durations that do not parse or are not
+// positive.
+func (c *checker) checkPositiveDuration(path string, s string) {
+	d, err := time.ParseDuration(s)
+	switch {
+	case err != nil:
+		c.add(path, "invalid duration %v", s)
+	case d <= 0:
+		c.add(path, "non-positive duration %v", s)
+	}
+}
+
+// isLoopback reports whether the listen address only binds the loopback.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkAcl reports rules that duplicate or conflict with an earlier rule of
+// the same match, or never apply after a rule matching everything.
+func (c *checker) checkAcl(path string, rules []AclRule) {
+	for j, r := range rules {
+		p := fmt.Sprintf("%v[%v]", path, j)
+		for i, earlier := range rules[:j] {
+			if matchesAny(earlier.Match) {
+				c.add(p, "never applies since %v[%v] matches everything", path, i)
+				break
+			}
+			if !sameMatch(earlier.Match, r.Match) {
+				continue
+			}
+			if strings.EqualFold(earlier.Action, r.Action) {
+				c.add(p, "duplicates %v[%v]", path, i)
+			} else {
+				c.add(p, "conflicts with %v[%v], which matches the same with action %v", path, i, earlier.Action)
+			}
+			break
+		}
+	}
+}
+
+func (c *checker) checkBittorrent(path string, b *Bittorrent) {
+	if b == nil {
+		return
+	}
+	switch strings.ToLower(b.Action) {
+	case "block":
+	case "throttle":
+		if b.Rate == "" {
+			c.add(path, "throttle requires a rate")
+		}
+	default:
+		c.add(path+".action", "unexpected action %v, expect block or throttle", b.Action)
+	}
+}
+
+func matchesAny(m Match) bool {
+	return m.Network == "" && len(m.Domains) == 0 && len(m.Ips) == 0 && len(m.Asns) == 0 && len(m.Ports) == 0
+}
+
+func sameMatch(a, b Match) bool {
+	normalize := func(m Match) Match {
+		m.Network = strings.ToLower(m.Network)
+		for _, s := range []*[]string{&m.Domains, &m.Ips, &m.Asns, &m.Ports} {
+			sorted := make([]string, len(*s))
+			for i, v := range *s {
+				sorted[i] = strings.ToLower(v)
+			}
+			sort.Strings(sorted)
+			*s = sorted
+		}
+		return m
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+// check reports all problems of the config c parsed from b, and returns the
+// warnings if there are none.
+func check(c *Config, b []byte) (warnings []string, err error) {
+	ck := &checker{b: b, lines: map[string]int{}}
+	if err = ck.scan(json.NewDecoder(bytes.NewReader(b)), ""); err != nil {
+		return nil, err
+	}
+	isServer := len(c.Users) > 0 || len(c.Listeners) > 0
+	if c.Server != "" && !isServer {
+		// Secrets in the keychain are checked once read by the client.
+		if _, err := uuid.Parse(c.Uuid); err != nil && !strings.HasPrefix(c.Uuid, KeychainPrefix) {
+			ck.add("uuid", "invalid uuid")
+		}
+		if c.Password == "" || c.Password == KeychainPrefix {
+			ck.add("password", "empty password")
+		}
+	}
+	if isServer {
+		ck.checkUsers("users", c.Users)
+		if c.Listen != "" {
+			ck.checkListen("listen", c.Listen)
+		}
+		ck.checkAcl("acl", c.Acl)
+		for i, l := range c.Listeners {
+			p := fmt.Sprintf("listeners[%v]", i)
+			ck.checkListen(p+".listen", l.Listen)
+			ck.checkUsers(p+".users", l.Users)
+			ck.checkAcl(p+".acl", l.Acl)
+		}
+		names := make([]string, 0, len(c.Groups))
+		for name := range c.Groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ck.checkAcl("groups."+name+".acl", c.Groups[name].Acl)
+			ck.checkBittorrent("groups."+name+".bittorrent", c.Groups[name].Bittorrent)
+		}
+		ck.checkBittorrent("bittorrent", c.Bittorrent)
+		if c.UdpReceiveBuffer < 0 {
+			ck.add("udp_receive_buffer", "negative size")
+		}
+		if c.UdpSendBuffer < 0 {
+			ck.add("udp_send_buffer", "negative size")
+		}
+		if c.UdpSessionQueue < 0 {
+			ck.add("udp_session_queue", "negative size")
+		}
+		if c.Fallback != nil && c.Fallback.Listen != "" {
+			ck.checkListen("fallback.listen", c.Fallback.Listen)
+		}
+		if c.MetricsListen != "" {
+			ck.checkListen("metrics_listen", c.MetricsListen)
+		}
+		if c.ExitOnIdle != "" {
+			ck.checkPositiveDuration("exit_on_idle", c.ExitOnIdle)
+		}
+		if c.ApiListen != "" {
+			ck.checkListen("api_listen", c.ApiListen)
+			if c.ApiToken == "" && len(c.ApiTokens) == 0 && !isLoopback(c.ApiListen) {
+				ck.add("api_listen", "not a loopback address, requires api_token or api_tokens")
+			}
+		}
+		ck.checkApiAdmins(c)
+	}
+	if err = errors.Join(ck.problems...); err != nil {
+		return nil, err
+	}
+	return ck.warnings, nil
+}
+
+// withLine adds the line to the errors of json.Unmarshal on b.
+func withLine(b []byte, err error) error {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		offset    int64
+	)
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	return fmt.Errorf("line %v: %w", 1+bytes.Count(b[:offset], []byte("\n")), err)
+}
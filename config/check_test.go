@@ -0,0 +1,124 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigProblems(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+  "listen": ":23182",
+  "users": {
+    "00000000-0000-0000-0000-000000000001": "a",
+    "00000000-0000-0000-0000-000000000001": "b",
+    "{00000000-0000-0000-0000-000000000001}": "c",
+    "not-a-uuid": "d",
+    "00000000-0000-0000-0000-000000000002": ""
+  },
+  "acl": [
+    {"action": "block", "domains": ["a.example.com", "b.example.com"]},
+    {"action": "allow", "domains": ["B.example.com", "a.example.com"]},
+    {"action": "allow"},
+    {"action": "block", "ports": ["25"]}
+  ],
+  "listeners": [{"listen": "localhost", "users": {"00000000-0000-0000-0000-000000000003": "e"}}],
+  "bittorrent": {"action": "throttle"}
+}`))
+	if err == nil {
+		t.Fatal("expect problems")
+	}
+	want := []string{
+		"line 5: users.00000000-0000-0000-0000-000000000001: duplicate key",
+		"line 6: users.{00000000-0000-0000-0000-000000000001}: duplicate uuid of 00000000-0000-0000-0000-000000000001",
+		"line 7: users.not-a-uuid: invalid uuid",
+		"line 8: users.00000000-0000-0000-0000-000000000002: empty password",
+		"line 12: acl[1]: conflicts with acl[0]",
+		"line 14: acl[3]: never applies since acl[2] matches everything",
+		"line 16: listeners[0].listen: invalid address localhost",
+		"line 17: bittorrent: throttle requires a rate",
+	}
+	problems := strings.Split(err.Error(), "\n")
+	if len(problems) != len(want) {
+		t.Fatalf("got %v problems: %v", len(problems), err)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(problems[i], w) {
+			t.Errorf("problem %v: got %q, want %q", i, problems[i], w)
+		}
+	}
+}
+
+func TestParseConfigLine(t *testing.T) {
+	_, err := ParseConfig([]byte("{\n  \"listen\": \":23182\",\n  \"users\": {\"00000000-0000-0000-0000-000000000001\": 1}\n}"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3: ") {
+		t.Fatalf("got %v, want an error of line 3", err)
+	}
+}
+
+func TestParseConfigDuplicateKey(t *testing.T) {
+	conf, err := ParseConfig([]byte(`{
+  "server": "example.com:23182",
+  "uuid": "00000000-0000-0000-0000-000000000001",
+  "password": "a",
+  "log_level": "info",
+  "log_level": "debug"
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.LogLevel != "debug" {
+		t.Errorf("got log_level %v, want the last one", conf.LogLevel)
+	}
+	want := []string{"line 6: log_level: duplicate key, the last one wins"}
+	if !slices.Equal(conf.Warnings, want) {
+		t.Errorf("got warnings %q, want %q", conf.Warnings, want)
+	}
+}
+
+func TestParseConfigApiListen(t *testing.T) {
+	for _, tc := range []struct {
+		conf    string
+		problem bool
+	}{
+		{`"api_listen": "127.0.0.1:9101"`, false},
+		{`"api_listen": "[::1]:9101"`, false},
+		{`"api_listen": "localhost:9101"`, false},
+		{`"api_listen": ":9101"`, true},
+		{`"api_listen": "0.0.0.0:9101"`, true},
+		{`"api_listen": "0.0.0.0:9101", "api_token": "t"`, false},
+		{`"api_listen": "0.0.0.0:9101", "api_tokens": [{"token": "t", "scopes": ["stats"]}]`, false},
+	} {
+		_, err := ParseConfig([]byte(`{"listen": ":23182", "users": {"00000000-0000-0000-0000-000000000001": "a"}, ` + tc.conf + `}`))
+		if problem := err != nil; problem != tc.problem {
+			t.Errorf("%v: got %v", tc.conf, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "api_listen: not a loopback address") {
+			t.Errorf("%v: unexpected problem: %v", tc.conf, err)
+		}
+	}
+}
+
+func TestParseConfigExitOnIdle(t *testing.T) {
+	for _, tc := range []struct {
+		exitOnIdle string
+		problem    string
+	}{
+		{"10m", ""},
+		{"1ns", ""},
+		{"0s", "exit_on_idle: non-positive duration 0s"},
+		{"-1m", "exit_on_idle: non-positive duration -1m"},
+		{"10", "exit_on_idle: invalid duration 10"},
+	} {
+		_, err := ParseConfig([]byte(`{"listen": ":23182", "users": {"00000000-0000-0000-0000-000000000001": "a"}, "exit_on_idle": "` + tc.exitOnIdle + `"}`))
+		if tc.problem == "" {
+			if err != nil {
+				t.Errorf("%v: got %v", tc.exitOnIdle, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%v: got %v, want %q", tc.exitOnIdle, err, tc.problem)
+		}
+	}
+}
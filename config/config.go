@@ -1,8 +1,12 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 var (
@@ -18,32 +22,472 @@ type Config struct {
 	AllowInsecure         bool              `json:"allow_insecure"`
 	PinnedCertChainSha256 string            `json:"pinned_certchain_sha256"`
 	ProtectPath           string            `json:"protect_path"`
+	ClientCertificate     string            `json:"client_certificate"`
+	ClientPrivateKey      string            `json:"client_private_key"`
 	Forward               map[string]string `json:"forward"`
+	Reverse               map[string]string `json:"reverse"`
+	ListenAllow           []string          `json:"listen_allow"`
+	IsolateSocksAuth      bool              `json:"isolate_socks_auth"`
+	IsolateDestinations   int               `json:"isolate_destinations"`
+	Routing               *Routing          `json:"routing"`
+	Pac                   *Pac              `json:"pac"`
+	Dns                   *Dns              `json:"dns"`
+	Heartbeat             *Heartbeat        `json:"heartbeat"`
+	Decoy                 *Decoy            `json:"decoy"`
+	NatKeepalive          *NatKeepalive     `json:"nat_keepalive"`
+	MaxClockSkew          string            `json:"max_clock_skew"`
 
 	// Server
 	Users                 map[string]string `json:"users"`
 	Certificate           string            `json:"certificate"`
 	PrivateKey            string            `json:"private_key"`
+	ClientCa              string            `json:"client_ca"`
+	CertExpiryWarning     string            `json:"cert_expiry_warning"`
 	Fwmark                string            `json:"fwmark"`
 	SendThrough           string            `json:"send_through"`
+	SourcePorts           string            `json:"source_ports"`
+	DialStrategy          string            `json:"dial_strategy"`
+	DnsTimeout            string            `json:"dns_timeout"`
+	OutboundPool          *OutboundPool     `json:"outbound_pool"`
 	DialerLink            string            `json:"dialer_link"`
 	DisableOutboundUdp443 bool              `json:"disable_outbound_udp443"`
+	UdpBroadcast          string            `json:"udp_broadcast"`
+	BlockLocalTargets     bool              `json:"block_local_targets"`
+	Acl                   []AclRule         `json:"acl"`
+	RejectIpTargets       bool              `json:"reject_ip_targets"`
+	AsnDb                 string            `json:"asn_db"`
+	AclReject             string            `json:"acl_reject"`
+	AclDefault            string            `json:"acl_default"`
+	Rewrite               []RewriteRule     `json:"rewrite"`
+	Bittorrent            *Bittorrent       `json:"bittorrent"`
+	MaxStreamsPerConn     int               `json:"max_streams_per_connection"`
+	MaxStreamsPerUser     int               `json:"max_streams_per_user"`
+	MaxConnsPerUser       int               `json:"max_connections_per_user"`
+	MaxIncomingStreams    int64             `json:"max_incoming_streams"`
+	MaxIncomingUniStreams int64             `json:"max_incoming_uni_streams"`
+	InitialCwndPackets    int               `json:"initial_cwnd_packets"`
+	InitialCwndHighRtt    *HighRttCwnd      `json:"initial_cwnd_high_rtt"`
+	Schedule              *Schedule         `json:"schedule"`
+	Groups                map[string]Group  `json:"groups"`
+	Outbounds             map[string]string `json:"outbounds"`
+	Cluster               *Cluster          `json:"cluster"`
+	Listeners             []Listener        `json:"listeners"`
+	ProxyProtocolTrusted  []string          `json:"proxy_protocol_trusted"`
+	DenySources           []string          `json:"deny_sources"`
+	DenySourcesMode       string            `json:"deny_sources_mode"`
+	ListenStack           string            `json:"listen_stack"`
+	Obfuscation           *Obfuscation      `json:"obfuscation"`
+	UdpReceiveBuffer      int               `json:"udp_receive_buffer"`
+	UdpSendBuffer         int               `json:"udp_send_buffer"`
+	UdpSessionQueue       int               `json:"udp_session_queue"`
+	DialFailureTtl        string            `json:"dial_failure_ttl"`
+	TcpIdleTimeoutUp      string            `json:"tcp_idle_timeout_up"`
+	TcpIdleTimeoutDown    string            `json:"tcp_idle_timeout_down"`
+	ExitOnIdle            string            `json:"exit_on_idle"`
+	User                  string            `json:"user"`
+	Group                 string            `json:"group"`
+	Chroot                string            `json:"chroot"`
+	Sandbox               bool              `json:"sandbox"`
+	MetricsListen         string            `json:"metrics_listen"`
+	ApiListen             string            `json:"api_listen"`
+	ApiToken              string            `json:"api_token"`
+	ApiTokens             []ApiToken        `json:"api_tokens"`
+	ApiDashboard          bool              `json:"api_dashboard"`
+	ApiAdmins             []string          `json:"api_admins"`
+	ReverseServices       []ReverseService  `json:"reverse_services"`
+	StatsExporters        []StatsExporter   `json:"stats_exporters"`
+	EventSinks            []EventSink       `json:"event_sinks"`
+	TrafficAlerts         []TrafficAlert    `json:"traffic_alerts"`
+	ConfigSnapshots       *ConfigSnapshots  `json:"config_snapshots"`
+	StatsFile             string            `json:"stats_file"`
+	StatsSaveInterval     string            `json:"stats_save_interval"`
+	SessionTicketKeys     string            `json:"session_ticket_keys"`
+	SessionTicketRotation string            `json:"session_ticket_rotation"`
+	SessionTicketMaxKeys  int               `json:"session_ticket_max_keys"`
+	Capture               *Capture          `json:"capture"`
+	TraceQlogDir          string            `json:"trace_qlog_dir"`
 
 	// Common
-	Listen            string `json:"listen"`
-	CongestionControl string `json:"congestion_control"`
-	LogLevel          string `json:"log_level"`
+	Listen            string   `json:"listen"`
+	CongestionControl string   `json:"congestion_control"`
+	TcpHalfClose      string   `json:"tcp_half_close"`
+	LogLevel          string   `json:"log_level"`
+	LogTimeFormat     string   `json:"log_time_format"`
+	LogTimezone       string   `json:"log_timezone"`
+	Geodata           *Geodata `json:"geodata"`
+	// Detour are dialer links of hops to the server for the client, and
+	// before dialer_link for the server.
+	Detour    []string   `json:"detour"`
+	Fallback  *Fallback  `json:"fallback"`
+	Bandwidth *Bandwidth `json:"bandwidth"`
+	// Gomaxprocs is a number or "auto" for the cpu quota of the cgroup.
+	// CpuAffinity are the CPUs the process runs on.
+	Gomaxprocs  string `json:"gomaxprocs"`
+	CpuAffinity []int  `json:"cpu_affinity"`
+	// Profile is empty or ProfileEmbedded for devices short of memory.
+	Profile string `json:"profile"`
+
+	// Warnings are the problems found by ParseConfig that do not fail it,
+	// e.g. duplicate keys outside users, with their lines.
+	Warnings []string `json:"-"`
+}
+
+// ProfileEmbedded trades throughput for memory, for routers with 64 to 128 MB
+// of RAM and for mobile VPN processes.
+const ProfileEmbedded = "embedded"
+
+// Heartbeat are pings of the client detecting broken connections.
+type Heartbeat struct {
+	Interval string `json:"interval"`
+	// Timeout of a ping, after which the connection is rebuilt.
+	Timeout string `json:"timeout"`
+}
+
+// NatKeepalive are tiny datagrams of the client keeping the NAT binding of
+// its socket to the server, for NATs expiring bindings faster than QUIC
+// keeps alive.
+type NatKeepalive struct {
+	Interval string `json:"interval"`
+	// MaxInterval is how far the interval backs off while the path is
+	// stable, no backoff if empty.
+	MaxInterval string `json:"max_interval"`
 }
 
+// Decoy is dummy traffic of the client masking idle tunnels.
+type Decoy struct {
+	// Rate is the average, e.g. "32 kbps".
+	Rate string `json:"rate"`
+	// Schedule are windows like "mon-fri 08:00-23:00" in local time when
+	// decoys are sent, any time if empty.
+	Schedule []string `json:"schedule"`
+}
+
+// Bandwidth is like "100 mbps". The client declares its bandwidth to the
+// server, and the server caps the declared rates by its own.
+type Bandwidth struct {
+	Up   string `json:"up"`
+	Down string `json:"down"`
+}
+
+// Bittorrent handles the BitTorrent traffic detected in relayed streams.
+type Bittorrent struct {
+	// Action is block or throttle.
+	Action string `json:"action"`
+	// Rate is shared by the BitTorrent traffic of each user when throttled,
+	// e.g. "1 mbps".
+	Rate string `json:"rate"`
+}
+
+// Fallback carries QUIC over TCP/TLS or WebSocket where UDP is blocked.
+type Fallback struct {
+	// Listen is the TCP address of the companion listener of the server.
+	Listen string `json:"listen"`
+	// Server is the address of the companion listener for the client, the
+	// one of server if empty.
+	Server string `json:"server"`
+	// Path selects WebSocket at the path instead of length-prefixed TLS.
+	Path string `json:"path"`
+	// Mode of the client is auto (default) or always.
+	Mode string `json:"mode"`
+}
+
+// Geodata are geo databases kept up to date from mirrors.
+type Geodata struct {
+	Files []GeodataFile `json:"files"`
+	// Interval of updates while running; no updates while running if empty.
+	Interval string `json:"interval"`
+}
+
+type GeodataFile struct {
+	Path string `json:"path"`
+	// Urls are mirrors tried in order.
+	Urls []string `json:"urls"`
+	// Sha256sum verifies downloads against <url>.sha256sum.
+	Sha256sum bool `json:"sha256sum"`
+}
+
+// Capture records the metadata of streams, and optionally the datagrams of
+// the listeners, for a while to debug interop issues.
+type Capture struct {
+	Dir string `json:"dir"`
+	// Duration defaults to 10m.
+	Duration string `json:"duration"`
+	Pcap     bool   `json:"pcap"`
+}
+
+type StatsExporter struct {
+	Type     string `json:"type"`
+	Address  string `json:"address"`
+	Token    string `json:"token"`
+	Prefix   string `json:"prefix"`
+	Interval string `json:"interval"`
+}
+
+// OutboundPool keeps spare TCP connections of the server to targets dialed
+// repeatedly.
+type OutboundPool struct {
+	// Size is how many targets may have a spare at once.
+	Size int `json:"size"`
+	// IdleTimeout is how long a spare is kept, and how soon a target must be
+	// dialed again to get one.
+	IdleTimeout string `json:"idle_timeout"`
+}
+
+// Obfuscation blurs the handshake against passive classifiers.
+type Obfuscation struct {
+	// Padding is the range of bytes padded, e.g. "64-1024".
+	Padding    string `json:"padding"`
+	AuthJitter string `json:"auth_jitter"`
+}
+
+// ApiToken is a token of the management API limited to its scopes: all,
+// stats, kick, users or traces.
+type ApiToken struct {
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// EventSink sends events to an external system, e.g. abuse detection.
+type EventSink struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Topic   string `json:"topic"`
+	// Types are the types of events sent, stream_close if empty.
+	Types []string `json:"types"`
+}
+
+// TrafficAlert posts to a webhook or runs a command when the traffic of a
+// user, or of all users, crosses a threshold.
+type TrafficAlert struct {
+	// User is the uuid of a user, "*" for each user, or empty for all users
+	// together.
+	User string `json:"user"`
+	// Traffic is like "100 GB" in both directions, and Speed is like
+	// "500 mbps" in either direction.
+	Traffic string   `json:"traffic"`
+	Speed   string   `json:"speed"`
+	Webhook string   `json:"webhook"`
+	Command []string `json:"command"`
+}
+
+// ReverseService exposes a port of the server forwarding to the client of
+// the user that serves the service in its `reverse`.
+type ReverseService struct {
+	Name   string `json:"name"`
+	Listen string `json:"listen"`
+	User   string `json:"user"`
+}
+
+// ConfigSnapshots keeps copies of the config file to roll back bad edits.
+type ConfigSnapshots struct {
+	Dir string `json:"dir"`
+	// Interval of scheduled snapshots, none if empty. A snapshot is also
+	// taken at start.
+	Interval string `json:"interval"`
+	// Max snapshots kept, 30 by default.
+	Max int `json:"max"`
+}
+
+// Listener is an extra listener of the server with its own users. Empty
+// outbound fields inherit the top-level ones.
+type Listener struct {
+	Listen      string            `json:"listen"`
+	Users       map[string]string `json:"users"`
+	Fwmark      string            `json:"fwmark"`
+	SendThrough string            `json:"send_through"`
+	SourcePorts string            `json:"source_ports"`
+	DialerLink  string            `json:"dialer_link"`
+	// Acl replaces the top-level acl if not empty.
+	Acl []AclRule `json:"acl"`
+	// MaxIncomingStreams and MaxIncomingUniStreams replace the top-level
+	// ones if not zero.
+	MaxIncomingStreams    int64 `json:"max_incoming_streams"`
+	MaxIncomingUniStreams int64 `json:"max_incoming_uni_streams"`
+}
+
+// Match matches the targets of streams. Empty conditions match anything.
+type Match struct {
+	Network string   `json:"network"`
+	Domains []string `json:"domains"`
+	Ips     []string `json:"ips"`
+	// Asns are like "AS13335" and require asn_db.
+	Asns  []string `json:"asns"`
+	Ports []string `json:"ports"`
+}
+
+type AclRule struct {
+	Action string `json:"action"`
+	// Reject overrides the top-level acl_reject for block rules.
+	Reject string `json:"reject"`
+	// DryRun is how long after start the rule is only logged, e.g. "24h".
+	DryRun string `json:"dry_run"`
+	Match
+}
+
+type RewriteRule struct {
+	Match
+	// To is a host, a host:port or a :port.
+	To string `json:"to"`
+}
+
+// Routing chooses the outbound of connections to the local listener by the
+// processes that opened them and the ASNs of their targets.
+type Routing struct {
+	Rules []RoutingRule `json:"rules"`
+	// Default is the outbound of connections matching no rule.
+	Default string `json:"default"`
+}
+
+type RoutingRule struct {
+	// Processes are executable names, or absolute paths.
+	Processes []string `json:"processes"`
+	// Asns match targets that are IPs of these autonomous systems in asn_db,
+	// e.g. "AS13335". Domain targets are not resolved, so they never match.
+	Asns []string `json:"asns"`
+	// Outbound is proxy or direct.
+	Outbound string `json:"outbound"`
+	// DryRun is how long after start the rule is only logged, e.g. "24h".
+	DryRun string `json:"dry_run"`
+}
+
+// Dns is a local DNS server forwarding queries through the server.
+type Dns struct {
+	Listen string `json:"listen"`
+	// Upstream is the ip:port of the resolver, 1.1.1.1:53 by default.
+	Upstream string `json:"upstream"`
+}
+
+// Pac is a PAC file served by the local listener.
+type Pac struct {
+	// Path defaults to /proxy.pac.
+	Path string `json:"path"`
+	// File is a text/template of the PAC file with {{.Proxy}} and
+	// {{.Bypass}}. A file proxying everything except Bypass is served if
+	// empty.
+	File   string   `json:"file"`
+	Bypass []string `json:"bypass"`
+}
+
+// Group is a policy shared by its users. Empty fields inherit the top-level
+// ones.
+type Group struct {
+	Users             []string  `json:"users"`
+	MaxConnsPerUser   int       `json:"max_connections_per_user"`
+	MaxStreamsPerUser int       `json:"max_streams_per_user"`
+	Acl               []AclRule `json:"acl"`
+	// Schedule is the name of windows in the schedule.
+	Schedule string `json:"schedule"`
+	// Outbound is the tag of an outbound in outbounds.
+	Outbound string `json:"outbound"`
+	// CongestionControl and InitialCwndPackets replace the top-level ones
+	// for members.
+	CongestionControl  string `json:"congestion_control"`
+	InitialCwndPackets int    `json:"initial_cwnd_packets"`
+	// Bandwidth caps the rate of members like the top-level bandwidth.up.
+	Bandwidth  string      `json:"bandwidth"`
+	Bittorrent *Bittorrent `json:"bittorrent"`
+	// ClientCerts are patterns like "ou:Engineering" of client certificates
+	// taking the acl and outbound of the group.
+	ClientCerts []string `json:"client_certs"`
+}
+
+// HighRttCwnd raises the initial congestion window of clients far away.
+type HighRttCwnd struct {
+	// Rtt is the handshake RTT from which Packets apply, e.g. "150ms".
+	Rtt     string `json:"rtt"`
+	Packets int    `json:"packets"`
+}
+
+// Schedule restricts when users may connect.
+type Schedule struct {
+	// Windows are named lists of weekly windows, e.g. "mon-fri 08:00-18:00".
+	Windows map[string][]string `json:"windows"`
+	// Users maps the uuids of users to the names of their windows.
+	Users    map[string]string `json:"users"`
+	Timezone string            `json:"timezone"`
+}
+
+type Cluster struct {
+	Peers    []string `json:"peers"`
+	Token    string   `json:"token"`
+	Interval string   `json:"interval"`
+}
+
+// ReadConfig reads the config file at p, see load.
 func ReadConfig(p string) (*Config, error) {
-	f, err := os.Open(p)
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return load(b, filepath.Base(p), filepath.Dir(p))
+}
+
+// load decrypts a config, evaluates its template actions if it is a
+// template, see render, and parses it. Files of templates are relative to
+// dir.
+func load(b []byte, name string, dir string) (*Config, error) {
+	b, err := decrypt(b)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = render(b, name, dir); err != nil {
+		return nil, err
+	}
+	return ParseConfig(b)
+}
+
+// KeychainPrefix marks the uuid or password of the client as the account of
+// a secret in the keychain of the OS, e.g. "keychain:alice".
+const KeychainPrefix = "keychain:"
+
+// Environment variables that carry the complete config, e.g. for containers
+// without mounted files.
+const (
+	EnvConfigJson       = "JUICITY_CONFIG_JSON"
+	EnvConfigJsonBase64 = "JUICITY_CONFIG_JSON_BASE64"
+)
+
+// ReadEnvConfig reads the config from EnvConfigJson or EnvConfigJsonBase64
+// like ReadConfig reads files, with the files of templates relative to the
+// working directory. It returns nil if neither is set.
+func ReadEnvConfig() (*Config, error) {
+	if s := os.Getenv(EnvConfigJson); s != "" {
+		c, err := load([]byte(s), EnvConfigJson, ".")
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", EnvConfigJson, err)
+		}
+		return c, nil
+	}
+	if s := strings.TrimSpace(os.Getenv(EnvConfigJsonBase64)); s != "" {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", EnvConfigJsonBase64, err)
+		}
+		c, err := load(b, EnvConfigJsonBase64, ".")
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", EnvConfigJsonBase64, err)
+		}
+		return c, nil
+	}
+	return nil, nil
+}
+
+// ParseConfig parses a config in json, which is decrypted first if it is
+// encrypted. All problems found in the config, e.g. invalid or duplicate
+// uuids, are reported at once. Those that do not fail it are in Warnings.
+func ParseConfig(b []byte) (*Config, error) {
+	b, err := decrypt(b)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 	var c Config
-	if err = json.NewDecoder(f).Decode(&c); err != nil {
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, withLine(b, err)
+	}
+	warnings, err := check(&c, b)
+	if err != nil {
 		return nil, err
 	}
+	c.Warnings = warnings
 	return &c, nil
 }
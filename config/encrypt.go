@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted config is a json envelope of the config encrypted with
+// AES-256-GCM by a key derived from a passphrase with scrypt.
+const (
+	encryptedVersion = 1
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+	saltSize         = 16
+	keySize          = 32
+)
+
+var ErrEncrypted = fmt.Errorf("the config is encrypted but no passphrase is available")
+
+type encryptedConfig struct {
+	// Version marks the envelope; configs never have the field.
+	Version int    `json:"juicity_encrypted_config"`
+	Kdf     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+var (
+	passphraseMu sync.Mutex
+	passphrase   func() ([]byte, error)
+)
+
+// SetPassphraseFunc sets the function asking for the passphrase of an
+// encrypted config, e.g. on the terminal. Encrypted configs are rejected
+// with ErrEncrypted if it is not set.
+func SetPassphraseFunc(f func() ([]byte, error)) {
+	passphraseMu.Lock()
+	defer passphraseMu.Unlock()
+	passphrase = f
+}
+
+// IsEncrypted reports whether b is an encrypted config.
+func IsEncrypted(b []byte) bool {
+	if !bytes.Contains(b, []byte(`"juicity_encrypted_config"`)) {
+		return false
+	}
+	var e encryptedConfig
+	return json.Unmarshal(b, &e) == nil && e.Version > 0
+}
+
+// configCipher returns the cipher of the envelope. Scrypt parameters beyond
+// those EncryptConfig writes are rejected, so that a crafted config cannot
+// make reading it take unbounded memory and time.
+func configCipher(pass []byte, e *encryptedConfig) (cipher.AEAD, error) {
+	if e.N > scryptN || e.R > scryptR || e.P > scryptP {
+		return nil, fmt.Errorf("scrypt parameters of encrypted config beyond n=%v, r=%v, p=%v", scryptN, scryptR, scryptP)
+	}
+	key, err := scrypt.Key(pass, e.Salt, e.N, e.R, e.P, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptConfig encrypts the config b with the passphrase.
+func EncryptConfig(b []byte, pass []byte) ([]byte, error) {
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	e := encryptedConfig{
+		Version: encryptedVersion,
+		Kdf:     "scrypt",
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, saltSize),
+	}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := configCipher(pass, &e)
+	if err != nil {
+		return nil, err
+	}
+	e.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Data = aead.Seal(nil, e.Nonce, b, nil)
+	return json.MarshalIndent(&e, "", "  ")
+}
+
+// DecryptConfig decrypts the encrypted config b with the passphrase.
+func DecryptConfig(b []byte, pass []byte) ([]byte, error) {
+	var e encryptedConfig
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	if e.Version != encryptedVersion {
+		return nil, fmt.Errorf("unsupported version of encrypted config: %v", e.Version)
+	}
+	if e.Kdf != "scrypt" {
+		return nil, fmt.Errorf("unsupported kdf of encrypted config: %v", e.Kdf)
+	}
+	aead, err := configCipher(pass, &e)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce of encrypted config")
+	}
+	plain, err := aead.Open(nil, e.Nonce, e.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted config")
+	}
+	return plain, nil
+}
+
+// decrypt returns b decrypted with the passphrase asked for if it is an
+// encrypted config, or b as is.
+func decrypt(b []byte) ([]byte, error) {
+	if !IsEncrypted(b) {
+		return b, nil
+	}
+	passphraseMu.Lock()
+	f := passphrase
+	passphraseMu.Unlock()
+	if f == nil {
+		return nil, ErrEncrypted
+	}
+	pass, err := f()
+	if err != nil {
+		return nil, fmt.Errorf("read passphrase: %w", err)
+	}
+	return DecryptConfig(b, pass)
+}
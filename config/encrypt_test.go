@@ -0,0 +1,51 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncryptConfig(t *testing.T) {
+	plain := []byte(`{"server": "example.com:443", "uuid": "00000000-0000-0000-0000-000000000001", "password": "secret"}`)
+	encrypted, err := EncryptConfig(plain, []byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) || IsEncrypted(plain) {
+		t.Fatal("unexpected IsEncrypted")
+	}
+	if _, err = DecryptConfig(encrypted, []byte("wrong")); err == nil {
+		t.Fatal("expect an error with a wrong passphrase")
+	}
+
+	defer SetPassphraseFunc(nil)
+	if _, err = ParseConfig(encrypted); !errors.Is(err, ErrEncrypted) {
+		t.Fatalf("expect ErrEncrypted, got %v", err)
+	}
+	SetPassphraseFunc(func() ([]byte, error) { return []byte("pass"), nil })
+	c, err := ParseConfig(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != "secret" {
+		t.Fatalf("unexpected password: %v", c.Password)
+	}
+}
+
+func TestDecryptConfigScryptLimits(t *testing.T) {
+	encrypted, err := EncryptConfig([]byte(`{}`), []byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"n": 32768`, `"r": 8`, `"p": 1`} {
+		name, _, _ := strings.Cut(field, ":")
+		crafted := strings.Replace(string(encrypted), field, name+": 1073741824", 1)
+		if crafted == string(encrypted) {
+			t.Fatalf("no %v in %s", field, encrypted)
+		}
+		if _, err = DecryptConfig([]byte(crafted), []byte("pass")); err == nil || !strings.Contains(err.Error(), "scrypt parameters") {
+			t.Errorf("got %v with a crafted %v", err, name)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSnapshotsMax = 30
+
+	snapshotPrefix = "config-"
+	snapshotSuffix = ".json"
+	// snapshotTimeLayout sorts lexically in time order.
+	snapshotTimeLayout = "20060102T150405.000Z"
+)
+
+var (
+	ErrSnapshotNotFound = errors.New("config snapshot not found")
+	ErrSnapshotInvalid  = errors.New("invalid config snapshot")
+)
+
+// Snapshots keeps timestamped copies of a config file in a directory, so
+// that a bad edit of the file can be rolled back. A copy is of the file as
+// written, still encrypted or a template if it is, not of the config it
+// renders to, and holds no state of the running server, e.g. the users
+// suspended by kicks.
+type Snapshots struct {
+	// File is the config file.
+	File string
+	Dir  string
+	// Max is the number of snapshots kept, DefaultSnapshotsMax if zero. The
+	// oldest ones are removed beyond.
+	Max int
+}
+
+type Snapshot struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// Save copies the config file to a new snapshot, unless it is the same as
+// the latest one, which is returned instead. The files of templates are not
+// copied.
+func (s *Snapshots) Save() (*Snapshot, error) {
+	b, err := os.ReadFile(s.File)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(s.Dir, 0700); err != nil {
+		return nil, err
+	}
+	snapshots, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) > 0 {
+		latest, err := s.Read(snapshots[0].Name)
+		if err == nil && bytes.Equal(latest, b) {
+			return &snapshots[0], nil
+		}
+	}
+	snapshot := &Snapshot{
+		Time: time.Now().UTC().Truncate(time.Millisecond),
+		Size: int64(len(b)),
+	}
+	// Names are unique even for snapshots taken within a millisecond.
+	var f *os.File
+	for {
+		snapshot.Name = snapshotPrefix + snapshot.Time.Format(snapshotTimeLayout) + snapshotSuffix
+		// The config holds passwords of users.
+		f, err = os.OpenFile(filepath.Join(s.Dir, snapshot.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+		snapshot.Time = snapshot.Time.Add(time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	keep := s.Max
+	if keep <= 0 {
+		keep = DefaultSnapshotsMax
+	}
+	// snapshots are the ones before the new one.
+	for i := keep - 1; i < len(snapshots); i++ {
+		_ = os.Remove(filepath.Join(s.Dir, snapshots[i].Name))
+	}
+	return snapshot, nil
+}
+
+// List returns the snapshots, the newest first.
+func (s *Snapshots) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, e := range entries {
+		t, ok := parseSnapshotName(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{
+			Name: e.Name(),
+			Time: t,
+			Size: info.Size(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name > snapshots[j].Name
+	})
+	return snapshots, nil
+}
+
+func parseSnapshotName(name string) (time.Time, bool) {
+	ts, ok := strings.CutPrefix(name, snapshotPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	if ts, ok = strings.CutSuffix(ts, snapshotSuffix); !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(snapshotTimeLayout, ts)
+	return t, err == nil
+}
+
+// Read returns the content of the snapshot.
+func (s *Snapshots) Read(name string) ([]byte, error) {
+	// Names never reach outside of the directory.
+	if _, ok := parseSnapshotName(name); !ok || filepath.Base(name) != name {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, name)
+	}
+	b, err := os.ReadFile(filepath.Join(s.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotNotFound, name)
+	}
+	return b, err
+}
+
+// Rollback replaces the config file with the snapshot after checking that
+// it is a valid config, and returns the snapshot of the replaced file, so
+// that the rollback itself can be rolled back. It takes effect on the next
+// start of the server.
+func (s *Snapshots) Rollback(name string) (backup *Snapshot, err error) {
+	b, err := s.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := decrypt(b)
+	if err == nil {
+		rendered, err = render(rendered, name, filepath.Dir(s.File))
+	}
+	if err == nil {
+		_, err = ParseConfig(rendered)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w %v: %v", ErrSnapshotInvalid, name, err)
+	}
+	info, err := os.Stat(s.File)
+	if err != nil {
+		return nil, err
+	}
+	if backup, err = s.Save(); err != nil {
+		return nil, fmt.Errorf("snapshot the config file: %w", err)
+	}
+	// The file is replaced atomically so that a crash never leaves a
+	// truncated config.
+	f, err := os.CreateTemp(filepath.Dir(s.File), filepath.Base(s.File)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Chmod(info.Mode().Perm()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	return backup, os.Rename(f.Name(), s.File)
+}
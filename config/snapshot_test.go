@@ -0,0 +1,74 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	s := &Snapshots{
+		File: filepath.Join(dir, "server.json"),
+		Dir:  filepath.Join(dir, "snapshots"),
+		Max:  2,
+	}
+	good := []byte(`{"listen": ":23182", "users": {"00000000-0000-0000-0000-000000000001": "a"}}`)
+	if err := os.WriteFile(s.File, good, 0640); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An unchanged file is not snapshotted again.
+	if again, err := s.Save(); err != nil || again.Name != first.Name {
+		t.Fatalf("got %+v, %v, want %v", again, err, first.Name)
+	}
+
+	bad := []byte(`{"listen": ":23182", "users": {"not-a-uuid": "a"}}`)
+	if err = os.WriteFile(s.File, bad, 0640); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Rollback(second.Name); !errors.Is(err, ErrSnapshotInvalid) {
+		t.Fatalf("got %v, want %v", err, ErrSnapshotInvalid)
+	}
+	if _, err = s.Rollback("../server.json"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("got %v, want %v", err, ErrSnapshotNotFound)
+	}
+
+	backup, err := s.Rollback(first.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.Name != second.Name {
+		t.Errorf("got backup %v, want %v", backup.Name, second.Name)
+	}
+	b, _ := os.ReadFile(s.File)
+	if string(b) != string(good) {
+		t.Errorf("got config %s after the rollback", b)
+	}
+	if info, _ := os.Stat(s.File); info.Mode().Perm() != 0640 {
+		t.Errorf("got mode %v after the rollback", info.Mode().Perm())
+	}
+
+	// The oldest snapshots are removed beyond Max.
+	if err = os.WriteFile(s.File, append(good, '\n'), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[1].Name != second.Name {
+		t.Errorf("got snapshots %+v", list)
+	}
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// TemplateMarker starts the configs that are templates, so that templating
+// is opt-in and a "{{" in a plain config, e.g. in a password, is kept as it
+// is. It is a template comment, which renders to nothing.
+const TemplateMarker = "{{/* template */}}"
+
+// IsTemplate reports whether the config starts with TemplateMarker, after
+// leading spaces.
+func IsTemplate(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte(TemplateMarker))
+}
+
+// render evaluates the template actions of a config starting with
+// TemplateMarker, so that one config serves a fleet of nodes:
+//
+//	{{ env "NODE_NAME" }}              the environment variable, which must be set
+//	{{ env "NODE_NAME" "relay" }}      or the default if it is unset
+//	{{ file "/run/secrets/key" }}      the file, relative to dir, without the trailing newline
+//
+// Values are escaped to be placed inside json strings. Other configs are
+// returned as they are.
+func render(b []byte, name string, dir string) ([]byte, error) {
+	if !IsTemplate(b) {
+		return b, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{
+		"env": func(key string, def ...string) (string, error) {
+			if len(def) > 1 {
+				return "", fmt.Errorf("env %v: at most one default", key)
+			}
+			v, ok := os.LookupEnv(key)
+			if !ok {
+				if len(def) == 0 {
+					return "", fmt.Errorf("env %v is not set", key)
+				}
+				v = def[0]
+			}
+			return jsonEscape(v), nil
+		},
+		"file": func(path string) (string, error) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			v, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return jsonEscape(strings.TrimRight(string(v), "\r\n")), nil
+		},
+	}).Parse(string(b))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonEscape escapes s to be placed inside a json string.
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("se\"cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JUICITY_TEST_NODE", "relay-1.example.com")
+	p := filepath.Join(dir, "config.json")
+	tmpl := TemplateMarker + `
+{
+  "server": "{{ env "JUICITY_TEST_NODE" }}:443",
+  "uuid": "{{ env "JUICITY_TEST_UNSET" "00000000-0000-0000-0000-000000000001" }}",
+  "password": "{{ file "password" }}"
+}`
+	if err := os.WriteFile(p, []byte(tmpl), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server != "relay-1.example.com:443" || c.Uuid != "00000000-0000-0000-0000-000000000001" || c.Password != `se"cret` {
+		t.Fatalf("unexpected config: %v, %v, %v", c.Server, c.Uuid, c.Password)
+	}
+
+	if err = os.WriteFile(p, []byte(TemplateMarker+`{"server": "{{ env "JUICITY_TEST_UNSET" }}:443"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadConfig(p); err == nil || !strings.Contains(err.Error(), "JUICITY_TEST_UNSET is not set") {
+		t.Fatalf("expect an error of the unset env, got %v", err)
+	}
+
+	// Configs without the marker are not templates.
+	if err = os.WriteFile(p, []byte(`{"server": "example.com:443", "uuid": "00000000-0000-0000-0000-000000000001", "password": "{{ env \"X\" }}"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = ReadConfig(p); err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != `{{ env "X" }}` {
+		t.Fatalf("got password %q, want it as it is", c.Password)
+	}
+}
+
+func TestReadEnvConfigTemplate(t *testing.T) {
+	t.Setenv("JUICITY_TEST_NODE", "relay-1.example.com")
+	t.Setenv(EnvConfigJson, TemplateMarker+`{"server": "{{ env "JUICITY_TEST_NODE" }}:443", "uuid": "00000000-0000-0000-0000-000000000001", "password": "p"}`)
+	c, err := ReadEnvConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Server != "relay-1.example.com:443" {
+		t.Fatalf("got server %v", c.Server)
+	}
+}
@@ -0,0 +1,181 @@
+package juicity
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/pkg/fastrand"
+	"github.com/daeuniverse/softwind/pool"
+	swjuicity "github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/daeuniverse/softwind/protocol/trojanc"
+	"github.com/daeuniverse/softwind/protocol/tuic"
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+	"github.com/mzz2017/quic-go"
+)
+
+type clientOption struct {
+	TlsConfig            *tls.Config
+	QuicConfig           *quic.Config
+	Uuid                 [16]byte
+	Password             string
+	CongestionController string
+	CWND                 int
+	Ctx                  context.Context
+	Cancel               func()
+	UnderlayAuth         chan *swjuicity.UnderlayAuth
+}
+
+// clientImpl is one QUIC connection to the server.
+type clientImpl struct {
+	*clientOption
+
+	quicConn  quic.Connection
+	connMutex sync.Mutex
+
+	detachCallback func()
+}
+
+func (t *clientImpl) getQuicConn(ctx context.Context, dialer netproxy.Dialer, dialFn common.DialFunc) (quic.Connection, error) {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	if t.quicConn != nil {
+		return t.quicConn, nil
+	}
+	transport, addr, err := dialFn(ctx, dialer)
+	if err != nil {
+		return nil, err
+	}
+	quicConn, err := transport.Dial(ctx, addr, t.TlsConfig, t.QuicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	common.SetCongestionController(quicConn, t.CongestionController, t.CWND)
+
+	go func() {
+		if err := t.sendAuthentication(quicConn); err != nil {
+			_ = t.Close()
+		}
+	}()
+
+	t.quicConn = quicConn
+	return quicConn, nil
+}
+
+func (t *clientImpl) sendAuthentication(quicConn quic.Connection) (err error) {
+	uniStream, err := quicConn.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	buf := pool.GetBuffer()
+	defer pool.PutBuffer(buf)
+	token, err := tuic.GenToken(quicConn.ConnectionState(), t.Uuid, t.Password)
+	if err != nil {
+		return err
+	}
+	err = tuic.NewAuthenticate(t.Uuid, token, swjuicity.Version0).WriteTo(buf)
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(uniStream)
+	if err != nil {
+		return err
+	}
+	defer uniStream.Close()
+	for {
+		var auth *swjuicity.UnderlayAuth
+		select {
+		case <-t.Ctx.Done():
+			return t.Ctx.Err()
+		case auth = <-t.UnderlayAuth:
+		}
+		buf := auth.PackFromPool()
+		_, err = uniStream.Write(buf)
+		buf.Put()
+		if err != nil {
+			t.Close()
+			return err
+		}
+	}
+}
+
+func (t *clientImpl) Close() (err error) {
+	t.connMutex.Lock()
+	select {
+	case <-t.Ctx.Done():
+		t.connMutex.Unlock()
+		return
+	default:
+		t.Cancel()
+	}
+	if t.detachCallback != nil {
+		go t.detachCallback()
+		t.detachCallback = nil
+	}
+	t.connMutex.Unlock()
+	// Give 10s for closing.
+	time.AfterFunc(10*time.Second, func() {
+		t.connMutex.Lock()
+		defer t.connMutex.Unlock()
+		if t.quicConn != nil {
+			err = t.quicConn.CloseWithError(tuic.ProtocolError, common.ErrClientClosed.Error())
+			t.quicConn = nil
+		}
+	})
+	return err
+}
+
+func (t *clientImpl) Dial(metadata *trojanc.Metadata, dialer netproxy.Dialer, dialFn common.DialFunc) (*swjuicity.Conn, error) {
+	select {
+	case <-t.Ctx.Done():
+		return nil, common.ErrClientClosed
+	default:
+	}
+	quicConn, err := t.getQuicConn(t.Ctx, dialer, dialFn)
+	if err != nil {
+		return nil, fmt.Errorf("getQuicConn: %w", err)
+	}
+	quicStream, err := quicConn.OpenStream()
+	if err != nil {
+		t.connMutex.Lock()
+		// Detach it from pool due to bad connection.
+		if t.detachCallback != nil {
+			go t.detachCallback()
+			t.detachCallback = nil
+		}
+		t.connMutex.Unlock()
+		return nil, fmt.Errorf("OpenStream: %w", err)
+	}
+	return swjuicity.NewConn(quicStream, metadata, nil), nil
+}
+
+func (t *clientImpl) DialAuth(metadata *trojanc.Metadata, dialer netproxy.Dialer, dialFn common.DialFunc) (iv []byte, psk []byte, err error) {
+	select {
+	case <-t.Ctx.Done():
+		return nil, nil, common.ErrClientClosed
+	default:
+	}
+	_, err = t.getQuicConn(t.Ctx, dialer, dialFn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getQuicConn: %w", err)
+	}
+	iv = make([]byte, swjuicity.CipherConf.SaltLen)
+	psk = make([]byte, swjuicity.CipherConf.KeyLen)
+	iv[0], iv[1] = 0, 0
+	_, _ = fastrand.Read(iv[2:])
+	_, _ = fastrand.Read(psk)
+	t.UnderlayAuth <- &swjuicity.UnderlayAuth{
+		IV:       iv,
+		Psk:      psk,
+		Metadata: metadata,
+	}
+	return iv, psk, nil
+}
+
+func (t *clientImpl) setOnClose(f func()) {
+	t.detachCallback = f
+}
@@ -0,0 +1,187 @@
+// Package juicity is the juicity dialer of softwind, forked to let the client
+// choose the QUIC receive windows, which softwind fixes at sizes for servers.
+// The streams and packets it returns are those of softwind.
+package juicity
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol"
+	swjuicity "github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/daeuniverse/softwind/protocol/shadowsocks"
+	"github.com/daeuniverse/softwind/protocol/trojanc"
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+)
+
+// ReceiveWindows are the sizes in bytes of the QUIC flow control windows,
+// which bound the memory buffered for each stream and connection. It
+// converts to and from server.ReceiveWindows.
+type ReceiveWindows struct {
+	InitialStream     uint64
+	MaxStream         uint64
+	InitialConnection uint64
+	MaxConnection     uint64
+}
+
+// DefaultReceiveWindows are the windows of softwind.
+var DefaultReceiveWindows = ReceiveWindows{
+	InitialStream:     common.InitialStreamReceiveWindow,
+	MaxStream:         common.MaxStreamReceiveWindow,
+	InitialConnection: common.InitialConnectionReceiveWindow,
+	MaxConnection:     common.MaxConnectionReceiveWindow,
+}
+
+type Dialer struct {
+	clientRing *clientRing
+
+	proxyAddress string
+	nextDialer   netproxy.Dialer
+}
+
+// NewDialer is juicity.NewDialer of softwind with the given receive windows.
+func NewDialer(nextDialer netproxy.Dialer, header protocol.Header, windows ReceiveWindows) (netproxy.Dialer, error) {
+	id, err := uuid.Parse(header.User)
+	if err != nil {
+		return nil, fmt.Errorf("parse UUID: %w", err)
+	}
+	maxOpenIncomingStreams := int64(100)
+	reservedStreamsCapability := maxOpenIncomingStreams / 5
+	if reservedStreamsCapability < 1 {
+		reservedStreamsCapability = 1
+	}
+	if reservedStreamsCapability > 5 {
+		reservedStreamsCapability = 5
+	}
+	return &Dialer{
+		clientRing: newClientRing(func(capabilityCallback func(n int64)) *clientImpl {
+			ctx, cancel := context.WithCancel(context.Background())
+			return &clientImpl{
+				clientOption: &clientOption{
+					TlsConfig: header.TlsConfig,
+					QuicConfig: &quic.Config{
+						InitialStreamReceiveWindow:     windows.InitialStream,
+						MaxStreamReceiveWindow:         windows.MaxStream,
+						InitialConnectionReceiveWindow: windows.InitialConnection,
+						MaxConnectionReceiveWindow:     windows.MaxConnection,
+						KeepAlivePeriod:                5 * time.Second,
+						DisablePathMTUDiscovery:        false,
+						EnableDatagrams:                false,
+						HandshakeIdleTimeout:           8 * time.Second,
+						CapabilityCallback:             capabilityCallback,
+					},
+					Uuid:                 id,
+					Password:             header.Password,
+					CongestionController: header.Feature1,
+					CWND:                 10,
+					Ctx:                  ctx,
+					Cancel:               cancel,
+					UnderlayAuth:         make(chan *swjuicity.UnderlayAuth, 64),
+				},
+			}
+		}, reservedStreamsCapability),
+		proxyAddress: header.ProxyAddress,
+		nextDialer:   nextDialer,
+	}, nil
+}
+
+func (d *Dialer) dialFuncFactory(udpNetwork string, rAddr net.Addr) common.DialFunc {
+	return func(ctx context.Context, dialer netproxy.Dialer) (transport *quic.Transport, addr net.Addr, err error) {
+		conn, err := dialer.Dial(udpNetwork, d.proxyAddress)
+		if err != nil {
+			return nil, nil, err
+		}
+		pc := &netproxy.FakeNetPacketConn{
+			PacketConn: conn.(netproxy.PacketConn),
+			LAddr:      net.UDPAddrFromAddrPort(common.GetUniqueFakeAddrPort()),
+			RAddr:      rAddr,
+		}
+		transport = &quic.Transport{Conn: pc}
+		transport.SetCreatedConn(true)
+		transport.SetSingleUse(true)
+		return transport, rAddr, nil
+	}
+}
+
+func (d *Dialer) Dial(network string, addr string) (c netproxy.Conn, err error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	switch magicNetwork.Network {
+	case "tcp", "udp":
+		mdata, err := protocol.ParseMetadata(addr)
+		if err != nil {
+			return nil, err
+		}
+		mdata.IsClient = true
+		proxyAddr, err := net.ResolveUDPAddr("udp", d.proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		udpNetwork := network
+		if magicNetwork.Network == "tcp" {
+			udpNetwork = netproxy.MagicNetwork{
+				Network: "udp",
+				Mark:    magicNetwork.Mark,
+			}.Encode()
+		}
+		if magicNetwork.Network == "udp" && mdata.Port == 0 {
+			iv, psk, err := d.clientRing.DialAuth(&trojanc.Metadata{
+				Metadata: mdata,
+				Network:  magicNetwork.Network,
+			}, d.nextDialer, d.dialFuncFactory(udpNetwork, proxyAddr))
+			if err != nil {
+				return nil, err
+			}
+			innerAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port))))
+			if err != nil {
+				return nil, err
+			}
+			transport, _, err := d.dialFuncFactory(udpNetwork, proxyAddr)(context.TODO(), d.nextDialer)
+			if err != nil {
+				return nil, err
+			}
+			return &TransportPacketConn{
+				Transport: transport,
+				proxyAddr: proxyAddr,
+				tgt:       innerAddr.AddrPort(),
+				key: &shadowsocks.Key{
+					CipherConf: swjuicity.CipherConf,
+					MasterKey:  psk,
+				},
+				firstIv: iv,
+			}, nil
+		}
+		conn, err := d.clientRing.Dial(&trojanc.Metadata{
+			Metadata: mdata,
+			Network:  magicNetwork.Network,
+		}, d.nextDialer,
+			d.dialFuncFactory(udpNetwork, proxyAddr),
+		)
+		if err != nil {
+			return nil, err
+		}
+		if magicNetwork.Network == "tcp" {
+			time.AfterFunc(100*time.Millisecond, func() {
+				// avoid the situation where the server sends messages first
+				if _, err = conn.Write(nil); err != nil {
+					return
+				}
+			})
+			return conn, nil
+		}
+		return &swjuicity.PacketConn{
+			Conn: conn,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %v", netproxy.UnsupportedTunnelTypeError, magicNetwork.Network)
+	}
+}
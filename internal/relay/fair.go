@@ -0,0 +1,205 @@
+package relay
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/pool"
+
+	"github.com/juicity/juicity/common/consts"
+)
+
+const (
+	// DefaultUdpSessionQueue is the default of the packets a UDP session
+	// may have queued towards the client.
+	DefaultUdpSessionQueue = 64
+	// udpSchedulerSlots bounds the packets being written to the streams of a
+	// connection at once. Each write waits for quic-go to take the packet of
+	// the previous one of its stream, so more slots only queue more packets
+	// in quic-go.
+	udpSchedulerSlots = 16
+	// udpQuantum is the bytes a session may send each round.
+	udpQuantum = consts.EthernetMtu
+)
+
+// UdpScheduler forwards the packets of the UDP sessions of a connection to
+// the client fairly. Each session queues a bounded number of packets, the
+// oldest dropped when full, and the queues are served in deficit round-robin
+// order with one packet in flight per session, so that a high-rate session
+// can neither starve the others nor hoard stale packets.
+type UdpScheduler struct {
+	maxQueue int
+
+	mu sync.Mutex
+	// ready are the sessions with queued packets and no packet in flight,
+	// in round-robin order.
+	ready    []*udpSession
+	inflight int
+
+	// Dropped is the number of packets dropped from full queues.
+	Dropped atomic.Uint64
+}
+
+// NewUdpScheduler returns a UdpScheduler queueing maxQueue packets per
+// session, DefaultUdpSessionQueue if zero.
+func NewUdpScheduler(maxQueue int) *UdpScheduler {
+	if maxQueue <= 0 {
+		maxQueue = DefaultUdpSessionQueue
+	}
+	return &UdpScheduler{maxQueue: maxQueue}
+}
+
+type udpPacket struct {
+	buf  pool.PB
+	addr netip.AddrPort
+}
+
+type udpSession struct {
+	sched *UdpScheduler
+	dst   netproxy.FullConn
+	src   netproxy.PacketConn
+	next  chan udpPacket
+	// done is closed once the writer exits.
+	done chan struct{}
+
+	// The fields below are protected by the mutex of sched.
+	queue   []udpPacket
+	deficit int
+	writing bool
+	ready   bool
+	closed  bool
+	err     error
+}
+
+// push queues the packet, dropping the oldest one if the queue is full. It
+// returns the error of a failed write instead once there is one.
+func (sess *udpSession) push(p udpPacket) error {
+	s := sess.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.err != nil {
+		p.buf.Put()
+		return sess.err
+	}
+	if len(sess.queue) >= s.maxQueue {
+		sess.queue[0].buf.Put()
+		sess.queue = append(sess.queue[:0], sess.queue[1:]...)
+		s.Dropped.Add(1)
+	}
+	sess.queue = append(sess.queue, p)
+	if !sess.writing && !sess.ready {
+		sess.ready = true
+		s.ready = append(s.ready, sess)
+	}
+	s.dispatchLocked()
+	return nil
+}
+
+// dispatchLocked hands packets of ready sessions to their writers while
+// there are free slots.
+func (s *UdpScheduler) dispatchLocked() {
+	for s.inflight < udpSchedulerSlots && len(s.ready) > 0 {
+		sess := s.ready[0]
+		s.ready = s.ready[1:]
+		if sess.closed || len(sess.queue) == 0 {
+			sess.ready = false
+			continue
+		}
+		p := sess.queue[0]
+		if sess.deficit < len(p.buf) {
+			// Its turn of this round is used up.
+			sess.deficit += udpQuantum
+			s.ready = append(s.ready, sess)
+			continue
+		}
+		sess.deficit -= len(p.buf)
+		sess.queue = append(sess.queue[:0], sess.queue[1:]...)
+		sess.ready = false
+		sess.writing = true
+		s.inflight++
+		sess.next <- p
+	}
+}
+
+// written finishes the write of a packet of the session.
+func (sess *udpSession) written(err error) {
+	s := sess.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess.writing = false
+	s.inflight--
+	if err != nil && sess.err == nil {
+		sess.err = err
+		// Stop reading so that the relay returns the error.
+		_ = sess.src.SetReadDeadline(time.Now())
+	}
+	switch {
+	case len(sess.queue) == 0:
+		sess.deficit = 0
+	case !sess.closed && sess.err == nil:
+		sess.ready = true
+		s.ready = append(s.ready, sess)
+	}
+	s.dispatchLocked()
+}
+
+// close drops the queue of the session, waits for the packet in flight and
+// returns the error of the writes.
+func (sess *udpSession) close() error {
+	s := sess.sched
+	s.mu.Lock()
+	sess.closed = true
+	for _, p := range sess.queue {
+		p.buf.Put()
+	}
+	sess.queue = nil
+	close(sess.next)
+	s.mu.Unlock()
+	<-sess.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sess.err
+}
+
+func (sess *udpSession) write() {
+	defer close(sess.done)
+	for p := range sess.next {
+		_ = sess.dst.SetWriteDeadline(time.Now().Add(consts.DefaultNatTimeout)) // should keep consistent
+		_, err := sess.dst.WriteTo(p.buf, p.addr.String())
+		p.buf.Put()
+		sess.written(err)
+	}
+}
+
+// relayUDPToConn is RelayUDPToConn through the scheduler.
+func (s *UdpScheduler) relayUDPToConn(dst netproxy.FullConn, src netproxy.PacketConn, timeout time.Duration, bufSize int) (err error) {
+	sess := &udpSession{
+		sched: s,
+		dst:   dst,
+		src:   src,
+		// The scheduler hands one packet at a time.
+		next: make(chan udpPacket, 1),
+		done: make(chan struct{}),
+	}
+	go sess.write()
+	defer func() {
+		if e := sess.close(); e != nil {
+			err = e
+		}
+	}()
+	for {
+		buf := pool.GetFullCap(bufSize)
+		_ = src.SetReadDeadline(time.Now().Add(timeout))
+		n, addr, err := src.ReadFrom(buf)
+		if err != nil {
+			buf.Put()
+			return err
+		}
+		if err = sess.push(udpPacket{buf: buf[:n], addr: addr}); err != nil {
+			return err
+		}
+	}
+}
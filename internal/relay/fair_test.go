@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/pool"
+)
+
+// blockingConn records the packets written to it, blocking each write until
+// released.
+type blockingConn struct {
+	netproxy.FullConn
+	release chan struct{}
+	written chan int
+}
+
+func (c *blockingConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *blockingConn) WriteTo(p []byte, addr string) (int, error) {
+	if c.release != nil {
+		<-c.release
+	}
+	c.written <- len(p)
+	return len(p), nil
+}
+
+func newTestSession(s *UdpScheduler, dst *blockingConn) *udpSession {
+	sess := &udpSession{sched: s, dst: dst, next: make(chan udpPacket, 1), done: make(chan struct{})}
+	go sess.write()
+	return sess
+}
+
+func testPacket(size int) udpPacket {
+	return udpPacket{buf: pool.Get(size), addr: netip.MustParseAddrPort("192.0.2.1:53")}
+}
+
+func TestUdpScheduler(t *testing.T) {
+	s := NewUdpScheduler(4)
+	slow := &blockingConn{release: make(chan struct{}), written: make(chan int, 100)}
+	fast := &blockingConn{written: make(chan int, 100)}
+	bulk := newTestSession(s, slow)
+	dns := newTestSession(s, fast)
+
+	// The first packet of bulk is in flight and blocked, 4 more are queued
+	// and the rest dropped.
+	for i := 0; i < 10; i++ {
+		if err := bulk.push(testPacket(1200)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dropped := s.Dropped.Load(); dropped != 5 {
+		t.Errorf("got %v dropped packets, want 5", dropped)
+	}
+	// dns is not held up by bulk.
+	if err := dns.push(testPacket(100)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-fast.written:
+		if n != 100 {
+			t.Errorf("got a packet of %v bytes, want 100", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a session is starved by a blocked one")
+	}
+	close(slow.release)
+	for i := 0; i < 5; i++ {
+		select {
+		case <-slow.written:
+		case <-time.After(time.Second):
+			t.Fatalf("got %v packets of the queue, want 5", i)
+		}
+	}
+	if err := bulk.close(); err != nil {
+		t.Error(err)
+	}
+	if err := dns.close(); err != nil {
+		t.Error(err)
+	}
+	if s.inflight != 0 || len(s.ready) != 0 {
+		t.Errorf("got %v packets in flight and %v ready sessions after close", s.inflight, len(s.ready))
+	}
+}
@@ -5,28 +5,39 @@ import (
 	"time"
 
 	"github.com/daeuniverse/softwind/netproxy"
-	"github.com/daeuniverse/softwind/protocol/juicity"
 
 	"github.com/juicity/juicity/pkg/log"
 )
 
 type relay struct {
-	logger *log.Logger
+	logger          *log.Logger
+	strictHalfClose bool
 }
 
 type Relay interface {
 	RelayTCP(lConn, rConn netproxy.Conn) (err error)
 	RelayUDP(dst net.PacketConn, laddr net.Addr, src net.PacketConn, timeout time.Duration) (err error)
 	SelectTimeout(packet []byte) time.Duration
-	RelayUoT(rConn netproxy.PacketConn, lConn *juicity.PacketConn, bufLen int) (err error)
+	RelayUoT(rConn netproxy.PacketConn, lConn PacketStream, bufLen int, sched *UdpScheduler) (err error)
 	RelayUDPToConn(dst netproxy.FullConn, src netproxy.PacketConn, timeout time.Duration, bufSize int) (err error)
 }
 type WriteCloser interface {
 	CloseWrite() error
 }
 
-func NewRelay(logger *log.Logger) Relay {
+// PacketStream is a stream of a client carrying UDP packets.
+type PacketStream interface {
+	netproxy.FullConn
+	WriteCloser
+}
+
+// NewRelay returns a Relay. When a TCP peer half-closes, its FIN is always
+// propagated to the other side. With strictHalfClose, the opposite direction
+// keeps being relayed until it finishes too, instead of being cut after
+// legacyHalfCloseTimeout.
+func NewRelay(logger *log.Logger, strictHalfClose bool) Relay {
 	return &relay{
-		logger: logger,
+		logger:          logger,
+		strictHalfClose: strictHalfClose,
 	}
 }
@@ -7,24 +7,37 @@ import (
 	io2 "github.com/daeuniverse/softwind/pkg/zeroalloc/io"
 )
 
+// legacyHalfCloseTimeout bounds the opposite direction after one direction
+// of a TCP relay finished, unless the half-close is strict.
+const legacyHalfCloseTimeout = 10 * time.Second
+
 func (r *relay) RelayTCP(lConn, rConn netproxy.Conn) (err error) {
 	eCh := make(chan error, 1)
 	go func() {
 		_, e := io2.Copy(rConn, lConn)
-		if rConn, ok := rConn.(WriteCloser); ok {
-			_ = rConn.CloseWrite()
-		}
-		_ = rConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		r.finishCopy(rConn, e)
 		eCh <- e
 	}()
 	_, e := io2.Copy(lConn, rConn)
-	if lConn, ok := lConn.(WriteCloser); ok {
-		_ = lConn.CloseWrite()
-	}
-	_ = lConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r.finishCopy(lConn, e)
 	if e != nil {
 		<-eCh
 		return e
 	}
 	return <-eCh
 }
+
+// finishCopy propagates the end of the copy to dst, which is also the source
+// of the opposite direction.
+func (r *relay) finishCopy(dst netproxy.Conn, err error) {
+	if dst, ok := dst.(WriteCloser); ok {
+		_ = dst.CloseWrite()
+	}
+	switch {
+	case !r.strictHalfClose:
+		_ = dst.SetReadDeadline(time.Now().Add(legacyHalfCloseTimeout))
+	case err != nil:
+		// The copy did not finish cleanly, so abort the opposite direction.
+		_ = dst.SetReadDeadline(time.Now())
+	}
+}
@@ -9,7 +9,6 @@ import (
 
 	"github.com/daeuniverse/softwind/netproxy"
 	"github.com/daeuniverse/softwind/pool"
-	"github.com/daeuniverse/softwind/protocol/juicity"
 	"github.com/miekg/dns"
 
 	"github.com/juicity/juicity/common/consts"
@@ -33,7 +32,7 @@ func (r *relay) RelayUDP(dst net.PacketConn, laddr net.Addr, src net.PacketConn,
 	}
 }
 
-func (r *relay) relayConnToUDP(dst netproxy.PacketConn, src *juicity.PacketConn, timeout time.Duration) (err error) {
+func (r *relay) relayConnToUDP(dst netproxy.PacketConn, src PacketStream, timeout time.Duration) (err error) {
 	var n int
 	var addr netip.AddrPort
 	buf := pool.GetFullCap(consts.EthernetMtu)
@@ -71,15 +70,21 @@ func (r *relay) SelectTimeout(packet []byte) time.Duration {
 	return consts.DnsQueryTimeout
 }
 
-// RelayUoT relays UDP traffict over TCP
-func (r *relay) RelayUoT(rConn netproxy.PacketConn, lConn *juicity.PacketConn, bufLen int) (err error) {
+// RelayUoT relays UDP traffict over TCP. Packets towards lConn go through
+// sched if it is not nil.
+func (r *relay) RelayUoT(rConn netproxy.PacketConn, lConn PacketStream, bufLen int, sched *UdpScheduler) (err error) {
 	eCh := make(chan error, 1)
 	go func() {
 		e := r.relayConnToUDP(rConn, lConn, consts.DefaultNatTimeout)
 		_ = rConn.SetReadDeadline(time.Now().Add(10 * time.Second))
 		eCh <- e
 	}()
-	e := r.RelayUDPToConn(lConn, rConn, consts.DefaultNatTimeout, bufLen)
+	var e error
+	if sched != nil {
+		e = sched.relayUDPToConn(lConn, rConn, consts.DefaultNatTimeout, bufLen)
+	} else {
+		e = r.RelayUDPToConn(lConn, rConn, consts.DefaultNatTimeout, bufLen)
+	}
 	_ = lConn.CloseWrite()
 	_ = lConn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	var netErr net.Error
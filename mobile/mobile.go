@@ -0,0 +1,212 @@
+// Package mobile provides bindings of juicity-client for Android and iOS apps,
+// built with:
+//
+//	gomobile bind -target=android -o juicity.aar github.com/juicity/juicity/mobile
+//	gomobile bind -target=ios -o Juicity.xcframework github.com/juicity/juicity/mobile
+//
+// The client serves the `listen` and `forward` of the config. StartWithTun
+// also relays the TCP connections and UDP flows of the TUN device of a
+// VpnService or of a Packet Tunnel Provider, so no tun2socks is needed. On
+// Android, the sockets to the server are protected with SetProtector. Logs
+// are written to stderr only.
+package mobile
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/client"
+	"github.com/juicity/juicity/pkg/client/dialer"
+
+	gliderLog "github.com/nadoo/glider/pkg/log"
+)
+
+// Protector protects a socket from being routed into the VPN, usually by
+// calling VpnService.protect.
+type Protector interface {
+	Protect(fd int32) bool
+}
+
+// StatsListener receives the total bytes sent and received through the
+// server since Start.
+type StatsListener interface {
+	OnStats(up int64, down int64)
+}
+
+var (
+	mu       sync.Mutex
+	running  *client.Client
+	stopStat chan struct{}
+	listener StatsListener
+	interval = time.Second
+)
+
+// SetProtector sets the protector of sockets to the server. It should be set
+// before Start.
+func SetProtector(p Protector) {
+	if p == nil {
+		dialer.SetProtector(nil)
+		return
+	}
+	dialer.SetProtector(func(fd int) error {
+		if !p.Protect(int32(fd)) {
+			return fmt.Errorf("failed to protect fd %v", fd)
+		}
+		return nil
+	})
+}
+
+// SetStatsListener sets the listener called every intervalMillis while the
+// client is running. It should be set before Start.
+func SetStatsListener(l StatsListener, intervalMillis int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	listener = l
+	if intervalMillis > 0 {
+		interval = time.Duration(intervalMillis) * time.Millisecond
+	}
+}
+
+// SetMemoryLimit sets a soft limit of the memory of the Go runtime in bytes,
+// so the garbage collector runs more often as the limit is approached. Apps
+// of restricted processes, e.g. the iOS Packet Tunnel extension which is
+// killed above about 50 MiB, should set it below the limit of the process.
+// Zero or negative removes the limit.
+func SetMemoryLimit(bytes int64) {
+	if bytes <= 0 {
+		bytes = math.MaxInt64
+	}
+	debug.SetMemoryLimit(bytes)
+}
+
+// Start starts the client with the config in json. The client runs in the
+// background until Stop is called.
+func Start(configJson string) error {
+	return start(configJson, -1)
+}
+
+// StartWithTun is Start relaying the IP packets of the TUN device fd, e.g.
+// the one of VpnService.Builder.establish or of the packetFlow of a Packet
+// Tunnel Provider, through the server. The fd is not closed, and the config
+// may have no `listen`. The `"profile": "embedded"` of the config bounds the
+// buffers of the client for the iOS Packet Tunnel extension, along with
+// SetMemoryLimit.
+func StartWithTun(configJson string, fd int32) error {
+	if fd < 0 {
+		return fmt.Errorf("invalid tun fd: %v", fd)
+	}
+	return start(configJson, fd)
+}
+
+// start starts the client, with the TUN device fd unless it is negative.
+func start(configJson string, fd int32) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if running != nil {
+		return fmt.Errorf("juicity is already running")
+	}
+	conf, err := config.ParseConfig([]byte(configJson))
+	if err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+	logger, err := client.NewConsoleLogger(conf)
+	if err != nil {
+		return err
+	}
+	gliderLog.SetLogger(logger)
+	var device io.ReadWriteCloser
+	if fd >= 0 {
+		f, err := openTun(fd)
+		if err != nil {
+			return err
+		}
+		device = f
+	}
+	c, err := client.New(conf, &client.Options{
+		Logger: logger,
+		Tun:    device,
+	})
+	if err != nil {
+		if device != nil {
+			_ = device.Close()
+		}
+		return err
+	}
+	running = c
+	go func() {
+		if err := c.Serve(); err != nil {
+			logger.Error().
+				Err(err).
+				Msg("juicity stopped")
+		}
+		mu.Lock()
+		if running == c {
+			stopLocked()
+		}
+		mu.Unlock()
+	}()
+	if listener != nil {
+		stopStat = make(chan struct{})
+		go reportStats(c, listener, interval, stopStat)
+	}
+	return nil
+}
+
+// Stop stops the running client.
+func Stop() {
+	mu.Lock()
+	defer mu.Unlock()
+	stopLocked()
+}
+
+func stopLocked() {
+	if running == nil {
+		return
+	}
+	running.Close()
+	running = nil
+	if stopStat != nil {
+		close(stopStat)
+		stopStat = nil
+	}
+}
+
+// IsRunning reports whether the client is running.
+func IsRunning() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return running != nil
+}
+
+// LastCloseReason returns why the server closed the latest connection it
+// closed, or an empty string if it closed none or the client is not running.
+func LastCloseReason() string {
+	mu.Lock()
+	defer mu.Unlock()
+	if running == nil {
+		return ""
+	}
+	if reason := running.LastCloseReason(); reason != nil {
+		return reason.Text
+	}
+	return ""
+}
+
+func reportStats(c *client.Client, l StatsListener, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		traffic := c.Traffic()
+		l.OnStats(int64(traffic.Up.Load()), int64(traffic.Down.Load()))
+	}
+}
@@ -0,0 +1,226 @@
+//go:build unix
+
+package mobile
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/acl"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/server"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+const (
+	testUser     = "00000000-0000-0000-0000-000000000001"
+	testPassword = "password"
+	mtu          = 1500
+)
+
+// startServer serves a server of testUser on loopback, which rewrites every
+// target to target, and returns its address.
+func startServer(t *testing.T, target string) string {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	target4 := netip.MustParseAddrPort(target)
+	rewriter, err := acl.NewRewriter([]acl.Rewrite{{
+		Host: target4.Addr().String(),
+		Port: target4.Port(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.New(&server.Options{
+		Logger:      log.NewLogger(&log.Options{}),
+		Users:       map[string]string{testUser: testPassword},
+		Certificate: certFile,
+		PrivateKey:  keyFile,
+		Rewriter:    rewriter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() { _ = s.ServePacketConn(pc) }()
+	return pc.LocalAddr().String()
+}
+
+func startEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// newPeerStack returns the network stack of the system side of the TUN
+// device at 10.0.0.2, which reads and writes one IP packet at a time.
+func newPeerStack(t *testing.T, device io.ReadWriter) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	ep := channel.New(64, mtu, "")
+	if err := s.CreateNIC(1, ep); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{10, 0, 0, 2}).WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		s.Close()
+	})
+	go func() {
+		buf := make([]byte, mtu)
+		for {
+			n, err := device.Read(buf)
+			if err != nil {
+				return
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(buf[:n])})
+			ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+			pkt.DecRef()
+		}
+	}()
+	go func() {
+		for {
+			pkt := ep.ReadContext(ctx)
+			if pkt.IsNil() {
+				return
+			}
+			var b []byte
+			for _, s := range pkt.AsSlices() {
+				b = append(b, s...)
+			}
+			pkt.DecRef()
+			_, _ = device.Write(b)
+		}
+	}()
+	return s
+}
+
+func TestStartWithTun(t *testing.T) {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		t.Skip("the peer does not write the packet information of utun")
+	}
+	addr := startServer(t, startEcho(t))
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := os.NewFile(uintptr(fds[1]), "peer")
+	defer peer.Close()
+	// StartWithTun duplicates the fd.
+	defer syscall.Close(fds[0])
+
+	if err = StartWithTun(fmt.Sprintf(`{
+		"server": %q,
+		"uuid": %q,
+		"password": %q,
+		"sni": "localhost",
+		"allow_insecure": true,
+		"profile": "embedded"
+	}`, addr, testUser, testPassword), int32(fds[0])); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	s := newPeerStack(t, peer)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := gonet.DialContextTCP(ctx, s, tcpip.FullAddress{
+		Addr: tcpip.AddrFrom4([4]byte{198, 51, 100, 1}),
+		Port: 80,
+	}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, %v through the tun, want ping", buf, err)
+	}
+	mu.Lock()
+	up := running.Traffic().Up.Load()
+	mu.Unlock()
+	if up == 0 {
+		t.Fatal("no traffic through the server")
+	}
+}
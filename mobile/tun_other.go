@@ -0,0 +1,12 @@
+//go:build !unix
+
+package mobile
+
+import (
+	"fmt"
+	"os"
+)
+
+func openTun(fd int32) (*os.File, error) {
+	return nil, fmt.Errorf("tun fd is not supported on this platform")
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package mobile
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTun returns the TUN device of fd. The fd is duplicated, so the app
+// keeps its own, and made nonblocking, so that Stop interrupts reads.
+func openTun(fd int32) (*os.File, error) {
+	dup, err := unix.Dup(int(fd))
+	if err != nil {
+		return nil, fmt.Errorf("dup tun fd: %w", err)
+	}
+	if err = unix.SetNonblock(dup, true); err != nil {
+		_ = unix.Close(dup)
+		return nil, fmt.Errorf("set tun fd nonblocking: %w", err)
+	}
+	return os.NewFile(uintptr(dup), "tun"), nil
+}
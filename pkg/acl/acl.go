@@ -0,0 +1,372 @@
+// Package acl decides whether the server relays a stream to its target.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Action string
+
+const (
+	ActionAllow Action = "allow"
+	ActionBlock Action = "block"
+)
+
+// Reject is how a blocked TCP stream is rejected.
+type Reject string
+
+const (
+	// RejectReset resets the stream immediately.
+	RejectReset Reject = "reset"
+	// RejectBlackhole accepts the stream and drops its data.
+	RejectBlackhole Reject = "blackhole"
+	// RejectHttp403 responds HTTP 403 to plain HTTP requests, and resets
+	// other streams.
+	RejectHttp403 Reject = "http403"
+)
+
+func ParseReject(s string) (Reject, error) {
+	switch Reject(s) {
+	case "":
+		return RejectReset, nil
+	case RejectReset, RejectBlackhole, RejectHttp403:
+		return Reject(s), nil
+	default:
+		return "", fmt.Errorf("unexpected reject: %v", s)
+	}
+}
+
+// Decision is the result of an Acl for a target.
+type Decision struct {
+	Action Action
+	// Reject is set if Action is ActionBlock.
+	Reject Reject
+	// DryRun is set if a rule in dry run would have decided otherwise.
+	DryRun *DryRun
+}
+
+// DryRun is the decision a rule in dry run would have made.
+type DryRun struct {
+	// Rule is the index of the rule.
+	Rule   int
+	Action Action
+}
+
+func ParseAction(s string) (Action, error) {
+	switch Action(s) {
+	case ActionAllow, ActionBlock:
+		return Action(s), nil
+	default:
+		return "", fmt.Errorf("unexpected action: %v", s)
+	}
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// ParsePortRange parses a port like "443" or a range like "8000-9000".
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("parse port %v: %w", s, err)
+	}
+	if !isRange {
+		return PortRange{From: uint16(f), To: uint16(f)}, nil
+	}
+	t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("parse port %v: %w", s, err)
+	}
+	if t < f {
+		return PortRange{}, fmt.Errorf("invalid port range: %v", s)
+	}
+	return PortRange{From: uint16(f), To: uint16(t)}, nil
+}
+
+// Target is the destination of a stream.
+type Target struct {
+	// Network is tcp or udp.
+	Network string
+	// Host is the domain of the target, or its IP literal.
+	Host string
+	// Addr is valid if Host is an IP literal.
+	Addr netip.Addr
+	Port uint16
+	// resolved is the address the domain resolved to, for DecideResolved.
+	resolved netip.Addr
+}
+
+// NewTarget classifies the host of a target by parsing it, so that IP
+// literals sent as domains are matched as IPs and never resolved for it.
+func NewTarget(network, host string, port uint16) Target {
+	t := Target{Network: network, Host: host, Port: port}
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		t.Addr = addr.Unmap()
+		t.Host = t.Addr.String()
+	}
+	return t
+}
+
+// String returns the host:port of the target.
+func (t Target) String() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(int(t.Port)))
+}
+
+// IsIp reports whether the host of the target is an IP literal.
+func (t *Target) IsIp() bool {
+	return t.Addr.IsValid()
+}
+
+// Matcher matches targets by all of its non-empty conditions. Domains only
+// match targets with domains while Prefixes and Asns match IP literal
+// targets, and domain targets by their resolved addresses in DecideResolved,
+// so a matcher with both kinds matches either kind of target.
+type Matcher struct {
+	// Network is tcp or udp; empty matches both.
+	Network string
+	// Domains match the domain and its subdomains, or the domain only if
+	// prefixed with "full:".
+	Domains  []string
+	Prefixes []netip.Prefix
+	// Asns match the IPs that AsnDb attributes to them.
+	Asns  []uint32
+	AsnDb *AsnDb
+	Ports []PortRange
+}
+
+// normalize validates the matcher and lowercases its domains.
+func (m *Matcher) normalize() error {
+	switch m.Network {
+	case "", "tcp", "udp":
+	default:
+		return fmt.Errorf("unexpected network: %v", m.Network)
+	}
+	if len(m.Asns) > 0 && m.AsnDb == nil {
+		return fmt.Errorf("asns require an asn database")
+	}
+	domains := make([]string, 0, len(m.Domains))
+	for _, d := range m.Domains {
+		domains = append(domains, strings.ToLower(strings.TrimSuffix(d, ".")))
+	}
+	m.Domains = domains
+	return nil
+}
+
+func (m *Matcher) Match(t *Target) bool {
+	if m.Network != "" && m.Network != t.Network {
+		return false
+	}
+	if len(m.Ports) > 0 && !matchPort(m.Ports, t.Port) {
+		return false
+	}
+	if len(m.Domains) == 0 && len(m.Prefixes) == 0 && len(m.Asns) == 0 {
+		return true
+	}
+	if t.IsIp() {
+		return m.matchAddr(t.Addr)
+	}
+	host := strings.ToLower(strings.TrimSuffix(t.Host, "."))
+	for _, domain := range m.Domains {
+		if full, ok := strings.CutPrefix(domain, "full:"); ok {
+			if host == full {
+				return true
+			}
+			continue
+		}
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return t.resolved.IsValid() && m.matchAddr(t.resolved)
+}
+
+func (m *Matcher) matchAddr(addr netip.Addr) bool {
+	for _, prefix := range m.Prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if len(m.Asns) > 0 {
+		if asn, ok := m.AsnDb.Lookup(addr); ok {
+			for _, a := range m.Asns {
+				if a == asn {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Rule is the action for the targets its matcher matches.
+type Rule struct {
+	Action Action
+	// Reject overrides the default reject of Options for block rules.
+	Reject Reject
+	// DryRunUntil puts the rule in dry run until then: it is evaluated but
+	// skipped, and reported in the Decision if it would decide otherwise.
+	DryRunUntil time.Time
+	// Hits counts the matches of the rule, in dry run or not, if not nil.
+	Hits HitCounter
+	Matcher
+}
+
+// HitCounter counts the matches of a rule, e.g. in stats.
+type HitCounter interface {
+	Hit()
+}
+
+func (r *Rule) dryRun(now func() time.Time) bool {
+	return !r.DryRunUntil.IsZero() && now().Before(r.DryRunUntil)
+}
+
+func matchPort(ports []PortRange, port uint16) bool {
+	for _, r := range ports {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+type Options struct {
+	Rules []Rule
+	// RejectIpTargets blocks targets that are IP literals unless a rule
+	// allows them, for deployments that require domain-only access.
+	RejectIpTargets bool
+	// Reject is how blocked streams are rejected. Defaults to RejectReset.
+	Reject Reject
+	// Default is the action for targets matching no rule, ActionAllow if
+	// empty. ActionBlock reaches only the targets rules allow.
+	Default Action
+}
+
+// Acl evaluates its rules in order; the first matching rule decides. Targets
+// that match no rule are allowed, unless the default is ActionBlock.
+type Acl struct {
+	rules           []Rule
+	rejectIpTargets bool
+	reject          Reject
+	fallback        Action
+	// now is replaced by tests.
+	now func() time.Time
+}
+
+func New(opts Options) (*Acl, error) {
+	fallback := ActionAllow
+	if opts.Default != "" {
+		if _, err := ParseAction(string(opts.Default)); err != nil {
+			return nil, fmt.Errorf("default: %w", err)
+		}
+		fallback = opts.Default
+	}
+	rules := make([]Rule, 0, len(opts.Rules))
+	for i, r := range opts.Rules {
+		if _, err := ParseAction(string(r.Action)); err != nil {
+			return nil, fmt.Errorf("rule %v: %w", i, err)
+		}
+		if err := r.normalize(); err != nil {
+			return nil, fmt.Errorf("rule %v: %w", i, err)
+		}
+		if r.Reject == "" {
+			r.Reject = opts.Reject
+		}
+		rules = append(rules, r)
+	}
+	return &Acl{
+		rules:           rules,
+		rejectIpTargets: opts.RejectIpTargets,
+		reject:          opts.Reject,
+		fallback:        fallback,
+		now:             time.Now,
+	}, nil
+}
+
+// Decide returns the decision for the target. It is safe to call on a nil
+// Acl, which allows everything.
+func (a *Acl) Decide(t Target) Decision {
+	if a == nil {
+		return Decision{Action: ActionAllow}
+	}
+	var dryRun *DryRun
+	for i := range a.rules {
+		r := &a.rules[i]
+		if !r.Match(&t) {
+			continue
+		}
+		if r.Hits != nil {
+			r.Hits.Hit()
+		}
+		if r.dryRun(a.now) {
+			if dryRun == nil {
+				dryRun = &DryRun{Rule: i, Action: r.Action}
+			}
+			continue
+		}
+		return a.withDryRun(a.decision(r.Action, r.Reject), dryRun)
+	}
+	if a.rejectIpTargets && t.IsIp() {
+		return a.withDryRun(a.decision(ActionBlock, a.reject), dryRun)
+	}
+	return a.withDryRun(a.decision(a.fallback, a.reject), dryRun)
+}
+
+// DecideResolved returns the decision for an address that the domain of t
+// resolved to, so that rules of IPs apply to domains resolving into them:
+// the rules are evaluated again matching both the domain and the address.
+// Targets that match no rule keep the decision of Decide, and rules in dry
+// run are skipped. It is safe to call on a nil Acl, which allows everything.
+func (a *Acl) DecideResolved(t Target, addr netip.Addr) Decision {
+	if a == nil || t.IsIp() {
+		return Decision{Action: ActionAllow}
+	}
+	t.resolved = addr.Unmap()
+	for i := range a.rules {
+		r := &a.rules[i]
+		if r.dryRun(a.now) || !r.Match(&t) {
+			continue
+		}
+		// A rule blocking here matched by the address, since Decide let
+		// the domain through: count its hit.
+		if r.Action == ActionBlock && r.Hits != nil {
+			r.Hits.Hit()
+		}
+		return a.decision(r.Action, r.Reject)
+	}
+	return Decision{Action: ActionAllow}
+}
+
+func (a *Acl) withDryRun(d Decision, dryRun *DryRun) Decision {
+	if dryRun != nil && dryRun.Action != d.Action {
+		d.DryRun = dryRun
+	}
+	return d
+}
+
+func (a *Acl) decision(action Action, reject Reject) Decision {
+	if action != ActionBlock {
+		return Decision{Action: action}
+	}
+	if reject == "" {
+		reject = RejectReset
+	}
+	return Decision{Action: action, Reject: reject}
+}
+
+// ParseAsn parses an ASN like "AS13335" or "13335".
+func ParseAsn(s string) (uint32, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parse asn %v: %w", s, err)
+	}
+	return uint32(n), nil
+}
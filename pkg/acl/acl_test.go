@@ -0,0 +1,190 @@
+package acl
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDecide(t *testing.T) {
+	a, err := New(Options{
+		Rules: []Rule{
+			{Action: ActionBlock, Matcher: Matcher{Domains: []string{"ads.example.com", "full:tracker.test"}}},
+			{Action: ActionAllow, Matcher: Matcher{Prefixes: []netip.Prefix{netip.MustParsePrefix("1.1.1.0/24")}}},
+			{Action: ActionBlock, Matcher: Matcher{Network: "tcp", Ports: []PortRange{{From: 25, To: 25}}}},
+			{Action: ActionBlock, Matcher: Matcher{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Ports: []PortRange{{From: 8000, To: 9000}}}},
+		},
+		RejectIpTargets: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		network string
+		host    string
+		port    uint16
+		want    Action
+	}{
+		{"tcp", "ads.example.com", 443, ActionBlock},
+		{"tcp", "a.ads.example.com.", 443, ActionBlock},
+		{"tcp", "ADS.example.com", 443, ActionBlock},
+		{"tcp", "bads.example.com", 443, ActionAllow},
+		{"tcp", "tracker.test", 443, ActionBlock},
+		{"tcp", "a.tracker.test", 443, ActionAllow},
+		{"udp", "1.1.1.1", 53, ActionAllow},
+		{"tcp", "::ffff:1.1.1.1", 53, ActionAllow},
+		{"tcp", "mail.example.com", 25, ActionBlock},
+		{"udp", "mail.example.com", 25, ActionAllow},
+		{"tcp", "10.1.2.3", 8080, ActionBlock},
+		{"tcp", "8.8.8.8", 443, ActionBlock},
+		{"tcp", "[2001:db8::1]", 443, ActionBlock},
+	}
+	for _, tt := range tests {
+		if got := a.Decide(NewTarget(tt.network, tt.host, tt.port)).Action; got != tt.want {
+			t.Errorf("Decide(%v %v:%v) = %v, want %v", tt.network, tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestDecideDefaultBlock(t *testing.T) {
+	a, err := New(Options{
+		Rules: []Rule{
+			{Action: ActionAllow, Matcher: Matcher{Domains: []string{"corp.example.com"}}},
+			{Action: ActionAllow, Matcher: Matcher{Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}},
+		},
+		Reject:  RejectHttp403,
+		Default: ActionBlock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host string
+		want Action
+	}{
+		{"git.corp.example.com", ActionAllow},
+		{"192.0.2.7", ActionAllow},
+		{"example.com", ActionBlock},
+		{"198.51.100.1", ActionBlock},
+	} {
+		if d := a.Decide(NewTarget("tcp", tt.host, 443)); d.Action != tt.want {
+			t.Errorf("Decide(%v) = %v, want %v", tt.host, d.Action, tt.want)
+		}
+	}
+	if d := a.Decide(NewTarget("udp", "example.com", 53)); d.Reject != RejectHttp403 {
+		t.Errorf("got reject %v by default, want %v", d.Reject, RejectHttp403)
+	}
+	if _, err = New(Options{Default: "deny"}); err == nil {
+		t.Error("expected an error of an unexpected default")
+	}
+}
+
+func TestDecideResolved(t *testing.T) {
+	hits := &hitCounter{}
+	a, err := New(Options{
+		Rules: []Rule{
+			{Action: ActionAllow, Matcher: Matcher{Domains: []string{"intranet.example.com"}}},
+			{Action: ActionBlock, Hits: hits, Reject: RejectBlackhole, Matcher: Matcher{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}},
+		},
+		Default: ActionBlock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		addr string
+		want Action
+	}{
+		// Domains resolving into blocked IPs are blocked as the IPs.
+		{"evil.test", "10.1.2.3", ActionBlock},
+		{"evil.test", "::ffff:10.1.2.3", ActionBlock},
+		// Rules before keep deciding by the domain.
+		{"intranet.example.com", "10.1.2.3", ActionAllow},
+		// Addresses matching no rule keep the decision by the domain, not
+		// the default.
+		{"example.com", "93.184.216.34", ActionAllow},
+		// IP literals were decided by Decide already.
+		{"10.1.2.3", "10.1.2.3", ActionAllow},
+	}
+	for _, tt := range tests {
+		d := a.DecideResolved(NewTarget("tcp", tt.host, 443), netip.MustParseAddr(tt.addr))
+		if d.Action != tt.want {
+			t.Errorf("DecideResolved(%v, %v) = %v, want %v", tt.host, tt.addr, d.Action, tt.want)
+		}
+		if d.Action == ActionBlock && d.Reject != RejectBlackhole {
+			t.Errorf("DecideResolved(%v, %v) rejects by %v, want %v", tt.host, tt.addr, d.Reject, RejectBlackhole)
+		}
+	}
+	if hits.n != 2 {
+		t.Errorf("got %v hits, want 2", hits.n)
+	}
+	if d := (*Acl)(nil).DecideResolved(NewTarget("tcp", "evil.test", 443), netip.MustParseAddr("10.1.2.3")); d.Action != ActionAllow {
+		t.Errorf("got %v of a nil acl", d.Action)
+	}
+}
+
+func TestDecideDryRun(t *testing.T) {
+	start := time.Now()
+	hits := &hitCounter{}
+	a, err := New(Options{
+		Rules: []Rule{
+			{Action: ActionBlock, DryRunUntil: start.Add(time.Hour), Hits: hits, Matcher: Matcher{Domains: []string{"example.com"}}},
+			{Action: ActionBlock, Matcher: Matcher{Domains: []string{"ads.example.com"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return start }
+	d := a.Decide(NewTarget("tcp", "www.example.com", 443))
+	if d.Action != ActionAllow || d.DryRun == nil || d.DryRun.Rule != 0 || d.DryRun.Action != ActionBlock {
+		t.Fatalf("got %+v, %+v in dry run", d, d.DryRun)
+	}
+	// Dry runs deciding the same are not reported.
+	if d = a.Decide(NewTarget("tcp", "ads.example.com", 443)); d.Action != ActionBlock || d.DryRun != nil {
+		t.Fatalf("got %+v, %+v in dry run", d, d.DryRun)
+	}
+	a.now = func() time.Time { return start.Add(time.Hour) }
+	if d = a.Decide(NewTarget("tcp", "www.example.com", 443)); d.Action != ActionBlock || d.DryRun != nil {
+		t.Fatalf("got %+v, %+v after dry run", d, d.DryRun)
+	}
+	// Matches in dry run count as hits too.
+	if hits.n != 3 {
+		t.Errorf("got %v hits, want 3", hits.n)
+	}
+}
+
+type hitCounter struct {
+	n int
+}
+
+func (c *hitCounter) Hit() { c.n++ }
+
+func TestRewrite(t *testing.T) {
+	r, err := NewRewriter([]Rewrite{
+		{Matcher: Matcher{Domains: []string{"resolver.test"}}, Host: "192.0.2.53"},
+		{Matcher: Matcher{Network: "tcp", Ports: []PortRange{{From: 8080, To: 8080}}}, Port: 80},
+		{Matcher: Matcher{Prefixes: []netip.Prefix{netip.MustParsePrefix("198.51.100.1/32")}}, Host: "new.test", Port: 443},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		network string
+		host    string
+		port    uint16
+		want    string
+	}{
+		{"udp", "dns.resolver.test", 53, "192.0.2.53:53"},
+		{"tcp", "example.test", 8080, "example.test:80"},
+		{"udp", "example.test", 8080, "example.test:8080"},
+		{"tcp", "::ffff:198.51.100.1", 22, "new.test:443"},
+	}
+	for _, tt := range tests {
+		got, _ := r.Rewrite(NewTarget(tt.network, tt.host, tt.port))
+		if got.String() != tt.want {
+			t.Errorf("Rewrite(%v %v:%v) = %v, want %v", tt.network, tt.host, tt.port, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Package acltest writes ASN databases for tests of the users of acl.
+package acltest
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// WriteAsnDb writes an IPv4 MMDB attributing the prefix to the ASN, and
+// nothing else, to a temporary file and returns its path.
+func WriteAsnDb(t testing.TB, prefix netip.Prefix, asn uint32) string {
+	t.Helper()
+	if !prefix.Addr().Is4() || prefix.Bits() == 0 {
+		t.Fatalf("unexpected prefix %v: only IPv4 prefixes of some bits are supported", prefix)
+	}
+	p := filepath.Join(t.TempDir(), "asn.mmdb")
+	if err := os.WriteFile(p, asnDb(prefix.Masked(), asn), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// asnDb returns the MMDB of WriteAsnDb. Its search tree has a node of each
+// bit of the prefix, in records of 32 bits.
+func asnDb(prefix netip.Prefix, asn uint32) []byte {
+	const separator = 16
+	nodes := uint32(prefix.Bits())
+	empty, data := nodes, nodes+separator
+	addr := prefix.Addr().As4()
+	var b []byte
+	for i := uint32(0); i < nodes; i++ {
+		next := i + 1
+		if next == nodes {
+			next = data
+		}
+		if addr[i/8]>>(7-i%8)&1 == 0 {
+			b = binary.BigEndian.AppendUint32(b, next)
+			b = binary.BigEndian.AppendUint32(b, empty)
+		} else {
+			b = binary.BigEndian.AppendUint32(b, empty)
+			b = binary.BigEndian.AppendUint32(b, next)
+		}
+	}
+	b = append(b, make([]byte, separator)...)
+	b = appendMap(b, 1)
+	b = appendString(b, "autonomous_system_number")
+	b = appendUint32(b, asn)
+	b = append(b, "\xab\xcd\xefMaxMind.com"...)
+	b = appendMap(b, 3)
+	b = appendString(b, "node_count")
+	b = appendUint32(b, nodes)
+	b = appendString(b, "record_size")
+	b = appendUint32(b, 32)
+	b = appendString(b, "ip_version")
+	b = appendUint32(b, 4)
+	return b
+}
+
+// The control bytes of the data section put the type in the 3 high bits and
+// the size in the 5 low bits.
+const (
+	typeString = 2 << 5
+	typeUint32 = 6 << 5
+	typeMap    = 7 << 5
+)
+
+func appendMap(b []byte, entries int) []byte {
+	return append(b, byte(typeMap|entries))
+}
+
+func appendString(b []byte, s string) []byte {
+	// Sizes beyond 28 take extra bytes, which no key needs.
+	return append(append(b, byte(typeString|len(s))), s...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(append(b, typeUint32|4), v)
+}
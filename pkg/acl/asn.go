@@ -0,0 +1,65 @@
+//go:build !no_geodata
+
+package acl
+
+import (
+	"net/netip"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// AsnDb looks up the autonomous systems of IPs in an MMDB with ASN data, e.g.
+// GeoLite2-ASN.mmdb.
+type AsnDb struct {
+	path string
+
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+}
+
+func OpenAsnDb(path string) (*AsnDb, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &AsnDb{path: path, reader: reader}, nil
+}
+
+// Reload reopens the database file, e.g. after it was updated. The database
+// in use is kept if the file cannot be opened.
+func (db *AsnDb) Reload() error {
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	old := db.reader
+	db.reader = reader
+	db.mu.Unlock()
+	return old.Close()
+}
+
+// Path returns the path of the database file.
+func (db *AsnDb) Path() string {
+	return db.path
+}
+
+// Lookup returns the ASN of the addr, or false if the database has none.
+func (db *AsnDb) Lookup(addr netip.Addr) (uint32, bool) {
+	var record struct {
+		AutonomousSystemNumber uint32 `maxminddb:"autonomous_system_number"`
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if err := db.reader.Lookup(addr.AsSlice(), &record); err != nil || record.AutonomousSystemNumber == 0 {
+		return 0, false
+	}
+	return record.AutonomousSystemNumber, true
+}
+
+func (db *AsnDb) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.reader.Close()
+}
@@ -0,0 +1,33 @@
+//go:build no_geodata
+
+package acl
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// AsnDb is not built in with no_geodata, so no database can be opened.
+type AsnDb struct {
+	path string
+}
+
+func OpenAsnDb(path string) (*AsnDb, error) {
+	return nil, fmt.Errorf("asn database is not built in (built with no_geodata)")
+}
+
+func (db *AsnDb) Reload() error {
+	return nil
+}
+
+func (db *AsnDb) Path() string {
+	return db.path
+}
+
+func (db *AsnDb) Lookup(addr netip.Addr) (uint32, bool) {
+	return 0, false
+}
+
+func (db *AsnDb) Close() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+//go:build !no_geodata
+
+package acl
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/juicity/juicity/pkg/acl/acltest"
+)
+
+func TestAsnDb(t *testing.T) {
+	p := acltest.WriteAsnDb(t, netip.MustParsePrefix("1.1.1.0/24"), 13335)
+	db, err := OpenAsnDb(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, c := range []struct {
+		addr string
+		asn  uint32
+		ok   bool
+	}{
+		{"1.1.1.1", 13335, true},
+		{"1.1.1.255", 13335, true},
+		{"1.1.2.1", 0, false},
+		{"8.8.8.8", 0, false},
+		{"2606:4700::1111", 0, false},
+	} {
+		if asn, ok := db.Lookup(netip.MustParseAddr(c.addr)); asn != c.asn || ok != c.ok {
+			t.Errorf("%v: got %v, %v, want %v, %v", c.addr, asn, ok, c.asn, c.ok)
+		}
+	}
+
+	// Reload picks the file replaced like geodata does up, and keeps the
+	// database in use if the file is broken.
+	updated := acltest.WriteAsnDb(t, netip.MustParsePrefix("8.8.8.0/24"), 15169)
+	if err = os.Rename(updated, p); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if asn, ok := db.Lookup(netip.MustParseAddr("8.8.8.8")); asn != 15169 || !ok {
+		t.Errorf("got %v, %v after reload, want 15169", asn, ok)
+	}
+	broken := p + ".tmp"
+	if err = os.WriteFile(broken, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(broken, p); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Reload(); err == nil {
+		t.Error("got no error reloading a broken file")
+	}
+	if asn, ok := db.Lookup(netip.MustParseAddr("8.8.8.8")); asn != 15169 || !ok {
+		t.Errorf("got %v, %v after a failed reload, want 15169", asn, ok)
+	}
+}
+
+func TestMatchAsn(t *testing.T) {
+	db, err := OpenAsnDb(acltest.WriteAsnDb(t, netip.MustParsePrefix("1.1.1.0/24"), 13335))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a, err := New(Options{Rules: []Rule{{
+		Action:  ActionBlock,
+		Matcher: Matcher{Asns: []uint32{13335}, AsnDb: db},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host string
+		want Action
+	}{
+		{"1.1.1.1", ActionBlock},
+		{"::ffff:1.1.1.1", ActionBlock},
+		{"8.8.8.8", ActionAllow},
+		// Domains are not resolved to match ASNs.
+		{"one.one.one.one", ActionAllow},
+	} {
+		if got := a.Decide(NewTarget("tcp", c.host, 443)).Action; got != c.want {
+			t.Errorf("%v: got %v, want %v", c.host, got, c.want)
+		}
+	}
+	if _, err = New(Options{Rules: []Rule{{Action: ActionBlock, Matcher: Matcher{Asns: []uint32{13335}}}}}); err == nil {
+		t.Error("got no error of asns without a database")
+	}
+}
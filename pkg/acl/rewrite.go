@@ -0,0 +1,73 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Rewrite replaces the targets its matcher matches.
+type Rewrite struct {
+	Matcher
+	// Host replaces the host of the target if not empty.
+	Host string
+	// Port replaces the port of the target if not zero.
+	Port uint16
+}
+
+// Rewriter applies the first matching rewrite to targets.
+type Rewriter struct {
+	rewrites []Rewrite
+}
+
+func NewRewriter(rewrites []Rewrite) (*Rewriter, error) {
+	normalized := make([]Rewrite, 0, len(rewrites))
+	for i, r := range rewrites {
+		if r.Host == "" && r.Port == 0 {
+			return nil, fmt.Errorf("rewrite %v: nothing to rewrite to", i)
+		}
+		if err := r.normalize(); err != nil {
+			return nil, fmt.Errorf("rewrite %v: %w", i, err)
+		}
+		normalized = append(normalized, r)
+	}
+	return &Rewriter{rewrites: normalized}, nil
+}
+
+// Rewrite returns the rewritten target and whether any rewrite matched. It is
+// safe to call on a nil Rewriter, which rewrites nothing.
+func (r *Rewriter) Rewrite(t Target) (Target, bool) {
+	if r == nil {
+		return t, false
+	}
+	for i := range r.rewrites {
+		rw := &r.rewrites[i]
+		if !rw.Match(&t) {
+			continue
+		}
+		host, port := t.Host, t.Port
+		if rw.Host != "" {
+			host = rw.Host
+		}
+		if rw.Port != 0 {
+			port = rw.Port
+		}
+		return NewTarget(t.Network, host, port), true
+	}
+	return t, false
+}
+
+// ParseRewriteTo parses the replacement of a rewrite: a host, a host:port, or
+// a :port.
+func ParseRewriteTo(s string) (host string, port uint16, err error) {
+	h, p, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port.
+		return s, 0, nil
+	}
+	portNum, err := strconv.ParseUint(p, 10, 16)
+	if err != nil || portNum == 0 {
+		return "", 0, fmt.Errorf("invalid port: %v", s)
+	}
+	return h, uint16(portNum), nil
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/server"
+)
+
+type Options struct {
+	Logger *log.Logger
+	// Servers are the servers of all listeners, which share the same stats
+	// and event bus.
+	Servers []*server.Server
+	// Token grants everything. Tokens grant their scopes. If there is
+	// neither, only reads of stats are allowed without authentication.
+	Token     string
+	Tokens    []Token
+	Dashboard bool
+	// Snapshots are the snapshots of the config file, if kept.
+	Snapshots *config.Snapshots
+}
+
+// Api is the management API of juicity-server.
+type Api struct {
+	logger    *log.Logger
+	servers   []*server.Server
+	tokens    []Token
+	snapshots *config.Snapshots
+	mux       *http.ServeMux
+}
+
+func New(opts *Options) (*Api, error) {
+	a := &Api{
+		logger:    opts.Logger,
+		servers:   opts.Servers,
+		snapshots: opts.Snapshots,
+		mux:       http.NewServeMux(),
+	}
+	if opts.Token != "" {
+		a.tokens = append(a.tokens, Token{Value: opts.Token, Scopes: []Scope{ScopeAll}})
+	}
+	for i := range opts.Tokens {
+		if err := opts.Tokens[i].validate(); err != nil {
+			return nil, fmt.Errorf("api token %v: %w", i, err)
+		}
+		a.tokens = append(a.tokens, opts.Tokens[i])
+	}
+	a.mux.HandleFunc("/api/v1/openapi.yaml", handleOpenApi)
+	a.mux.Handle("/metrics", a.authorized(ScopeStats, ScopeStats, a.servers[0].Stats()))
+	a.mux.Handle("/api/v1/stats", a.authorized(ScopeStats, ScopeStats, http.HandlerFunc(a.handleStats)))
+	a.mux.Handle("/api/v1/events", a.authorized(ScopeStats, ScopeStats, http.HandlerFunc(a.handleEvents)))
+	a.mux.Handle("/api/v1/kick", a.authorized(ScopeKick, ScopeKick, http.HandlerFunc(a.handleKick)))
+	a.mux.Handle("/api/v1/bans", a.authorized(ScopeStats, ScopeUsers, http.HandlerFunc(a.handleBans)))
+	a.mux.Handle("/api/v1/bans/", a.authorized(ScopeStats, ScopeUsers, http.HandlerFunc(a.handleBans)))
+	a.mux.Handle("/api/v1/traces", a.authorized(ScopeStats, ScopeTraces, http.HandlerFunc(a.handleTraces)))
+	a.mux.Handle("/api/v1/traces/", a.authorized(ScopeStats, ScopeTraces, http.HandlerFunc(a.handleTraces)))
+	// Snapshots hold the passwords of users.
+	a.mux.Handle("/api/v1/config/snapshots", a.authorized(ScopeAll, ScopeAll, http.HandlerFunc(a.handleSnapshots)))
+	a.mux.Handle("/api/v1/config/snapshots/", a.authorized(ScopeAll, ScopeAll, http.HandlerFunc(a.handleSnapshots)))
+	if opts.Dashboard {
+		a.mux.Handle("/", dashboardHandler())
+	}
+	return a, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (a *Api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *Api) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.servers[0].Stats().Snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,246 @@
+// Package apiclient is a client of the management API of juicity-server,
+// following pkg/api/openapi.yaml. Its methods are named after the
+// operationIds of the document.
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Error is a response of the API other than success.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("management api: %v %v: %v", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+type Client struct {
+	// Server is the url of the API, e.g. http://127.0.0.1:9101.
+	Server string
+	// Token is the bearer token, if any.
+	Token string
+	// HTTPClient sends the requests, http.DefaultClient if nil. It may dial
+	// through the proxy of a juicity client to reach http://_api.juicity.
+	HTTPClient *http.Client
+}
+
+func New(server string, token string) *Client {
+	return &Client{
+		Server: strings.TrimSuffix(server, "/"),
+		Token:  token,
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do sends the request with the json of in, if any, and decodes the json
+// response into out, if any.
+func (c *Client) do(ctx context.Context, method string, path string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Server+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if b, ok := out.(*[]byte); ok {
+		*b, err = io.ReadAll(resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func decodeError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &body) == nil && body.Error != "" {
+		e.Message = body.Error
+	} else {
+		e.Message = string(bytes.TrimSpace(b))
+	}
+	return e
+}
+
+// GetMetrics returns the metrics in the prometheus text format.
+func (c *Client) GetMetrics(ctx context.Context) ([]byte, error) {
+	var b []byte
+	err := c.do(ctx, http.MethodGet, "/metrics", nil, &b)
+	return b, err
+}
+
+// GetOpenApi returns the OpenAPI document served by the server.
+func (c *Client) GetOpenApi(ctx context.Context) ([]byte, error) {
+	var b []byte
+	err := c.do(ctx, http.MethodGet, "/api/v1/openapi.yaml", nil, &b)
+	return b, err
+}
+
+func (c *Client) GetStats(ctx context.Context) (*Snapshot, error) {
+	var s Snapshot
+	if err := c.do(ctx, http.MethodGet, "/api/v1/stats", nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Kick closes all connections of a user, and suspends it if req.Ban is set.
+func (c *Client) Kick(ctx context.Context, req KickRequest) (*KickResponse, error) {
+	var resp KickResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/kick", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) ListBans(ctx context.Context) ([]Ban, error) {
+	var bans []Ban
+	err := c.do(ctx, http.MethodGet, "/api/v1/bans", nil, &bans)
+	return bans, err
+}
+
+// Unban lifts the suspension of a user.
+func (c *Client) Unban(ctx context.Context, user string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/bans/"+url.PathEscape(user), nil, nil)
+}
+
+func (c *Client) ListTraces(ctx context.Context) ([]TraceFilter, error) {
+	var filters []TraceFilter
+	err := c.do(ctx, http.MethodGet, "/api/v1/traces", nil, &filters)
+	return filters, err
+}
+
+func (c *Client) AddTrace(ctx context.Context, req TraceRequest) (*TraceFilter, error) {
+	var f TraceFilter
+	if err := c.do(ctx, http.MethodPost, "/api/v1/traces", req, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (c *Client) RemoveTrace(ctx context.Context, id uint64) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/traces/"+strconv.FormatUint(id, 10), nil, nil)
+}
+
+func (c *Client) ListConfigSnapshots(ctx context.Context) ([]ConfigSnapshot, error) {
+	var snapshots []ConfigSnapshot
+	err := c.do(ctx, http.MethodGet, "/api/v1/config/snapshots", nil, &snapshots)
+	return snapshots, err
+}
+
+// SaveConfigSnapshot takes a snapshot of the config file, or returns the
+// latest one if the file has not changed since. It holds the file only, not
+// the suspensions of users.
+func (c *Client) SaveConfigSnapshot(ctx context.Context) (*ConfigSnapshot, error) {
+	var s ConfigSnapshot
+	if err := c.do(ctx, http.MethodPost, "/api/v1/config/snapshots", nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// RollbackConfig replaces the config file with the snapshot, which the
+// server applies when it restarts.
+func (c *Client) RollbackConfig(ctx context.Context, name string) (*RollbackResponse, error) {
+	var resp RollbackResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/config/snapshots/"+url.PathEscape(name)+"/rollback", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Events receives the connection events of the server.
+type Events struct {
+	ws *websocket.Conn
+}
+
+// GetEvents subscribes to the connection events of the server. The events
+// are read with Next until Close.
+func (c *Client) GetEvents(ctx context.Context) (*Events, error) {
+	u, err := url.Parse(c.Server + "/api/v1/events")
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	header := http.Header{}
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+	dialer := *websocket.DefaultDialer
+	if c.HTTPClient != nil {
+		if t, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+			dialer.Proxy = t.Proxy
+			dialer.NetDialContext = t.DialContext
+			dialer.TLSClientConfig = t.TLSClientConfig
+		}
+	}
+	ws, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			return nil, decodeError(resp)
+		}
+		return nil, err
+	}
+	return &Events{ws: ws}, nil
+}
+
+// Next blocks until the next event.
+func (e *Events) Next() (*Event, error) {
+	var ev Event
+	if err := e.ws.ReadJSON(&ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (e *Events) Close() error {
+	return e.ws.Close()
+}
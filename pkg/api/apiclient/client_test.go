@@ -0,0 +1,71 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	var kicked KickRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"unauthorized"}`))
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/stats":
+			_, _ = w.Write([]byte(`{"up":1,"users":[{"name":"a","connections":2,"classes":{"tls":{"streams":3}}}]}`))
+		case "POST /api/v1/kick":
+			_ = json.NewDecoder(r.Body).Decode(&kicked)
+			_, _ = w.Write([]byte(`{"closed":4}`))
+		case "DELETE /api/v1/traces/7":
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /api/v1/config/snapshots/config-20240101T000000.000Z.json/rollback":
+			_, _ = w.Write([]byte(`{"backup":{"name":"config-20240102T000000.000Z.json","size":5}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"no such trace filter"}`))
+		}
+	}))
+	defer s.Close()
+	ctx := context.Background()
+
+	c := New(s.URL+"/", "tok")
+	snapshot, err := c.GetStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Up != 1 || len(snapshot.Users) != 1 || snapshot.Users[0].Classes["tls"].Streams != 3 {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	resp, err := c.Kick(ctx, KickRequest{User: "u", Ban: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Closed != 4 || kicked.User != "u" || kicked.Ban != "1m" {
+		t.Fatalf("unexpected kick: %+v %+v", resp, kicked)
+	}
+	if err = c.RemoveTrace(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	rollback, err := c.RollbackConfig(ctx, "config-20240101T000000.000Z.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollback.Backup.Name != "config-20240102T000000.000Z.json" || rollback.Backup.Size != 5 {
+		t.Fatalf("unexpected rollback: %+v", rollback)
+	}
+
+	var e *Error
+	if err = c.RemoveTrace(ctx, 8); !errors.As(err, &e) || e.StatusCode != http.StatusNotFound || e.Message != "no such trace filter" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = New(s.URL, "").GetStats(ctx); !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package apiclient
+
+import (
+	"time"
+)
+
+// The types below are the schemas of openapi.yaml. They do not depend on the
+// server, so that panels importing this package do not build it.
+
+type Snapshot struct {
+	// Instance is the random id of the server process, drawn on every start.
+	Instance  string    `json:"instance"`
+	Time      time.Time `json:"time"`
+	Up        uint64    `json:"up"`
+	Down      uint64    `json:"down"`
+	UpSpeed   uint64    `json:"up_speed"`
+	DownSpeed uint64    `json:"down_speed"`
+	Users     []User    `json:"users"`
+	// TopDestinations are the most dialed targets.
+	TopDestinations []TopNEntry `json:"top_destinations"`
+	// AuthFailures counts the authentication failures by reason.
+	AuthFailures       map[string]uint64 `json:"auth_failures"`
+	RecentAuthFailures []AuthFailure     `json:"recent_auth_failures"`
+	Sockets            []Socket          `json:"sockets,omitempty"`
+	AclRules           []AclRule         `json:"acl_rules,omitempty"`
+}
+
+type User struct {
+	Name        string  `json:"name"`
+	Connections int64   `json:"connections"`
+	Up          uint64  `json:"up"`
+	Down        uint64  `json:"down"`
+	UpSpeed     uint64  `json:"up_speed"`
+	DownSpeed   uint64  `json:"down_speed"`
+	RttMs       float64 `json:"rtt_ms,omitempty"`
+	// Classes is the traffic by sniffed class, e.g. tls or bittorrent.
+	Classes map[string]Class `json:"classes,omitempty"`
+}
+
+type Class struct {
+	Streams uint64 `json:"streams"`
+	Up      uint64 `json:"up"`
+	Down    uint64 `json:"down"`
+}
+
+type TopNEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+type AuthFailure struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Reason string    `json:"reason"`
+}
+
+type Socket struct {
+	Listen        string `json:"listen"`
+	Drops         uint64 `json:"drops"`
+	SendErrors    uint64 `json:"send_errors"`
+	ReadBatches   uint64 `json:"read_batches"`
+	ReadPackets   uint64 `json:"read_packets"`
+	ReceiveBuffer int64  `json:"receive_buffer"`
+	SendBuffer    int64  `json:"send_buffer"`
+}
+
+type AclRule struct {
+	// Acl is "acl" for the top-level acl, "group <name>" or
+	// "listener <listen>".
+	Acl    string `json:"acl"`
+	Rule   int    `json:"rule"`
+	Action string `json:"action"`
+	// Hits are the matches of the rule, including those in dry run.
+	Hits    uint64     `json:"hits"`
+	LastHit *time.Time `json:"last_hit,omitempty"`
+}
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Source  string    `json:"source,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Network string    `json:"network,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Class   string    `json:"class,omitempty"`
+	Domain  string    `json:"domain,omitempty"`
+	Up      uint64    `json:"up,omitempty"`
+	Down    uint64    `json:"down,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type KickRequest struct {
+	User string `json:"user"`
+	// Ban is how long to suspend the user for, e.g. "10m". No suspension if
+	// empty.
+	Ban string `json:"ban,omitempty"`
+}
+
+type KickResponse struct {
+	Closed      int        `json:"closed"`
+	BannedUntil *time.Time `json:"banned_until,omitempty"`
+}
+
+type Ban struct {
+	User  string    `json:"user"`
+	Until time.Time `json:"until"`
+}
+
+type TraceRequest struct {
+	// Source is an IP or a CIDR. Any source if empty.
+	Source string `json:"source,omitempty"`
+	// User is the uuid of a user. Any user if empty.
+	User string `json:"user,omitempty"`
+	// Duration is how long to trace for, e.g. "10m".
+	Duration string `json:"duration,omitempty"`
+}
+
+type TraceFilter struct {
+	Id uint64 `json:"id"`
+	// Source is a CIDR, empty for any source.
+	Source string `json:"source"`
+	// User is the nil uuid for any user.
+	User  string    `json:"user"`
+	Until time.Time `json:"until"`
+}
+
+type ConfigSnapshot struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+type RollbackResponse struct {
+	// Backup is the snapshot of the config file before the rollback.
+	Backup ConfigSnapshot `json:"backup"`
+}
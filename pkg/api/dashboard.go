@@ -0,0 +1,17 @@
+//go:build !no_dashboard
+
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFS embed.FS
+
+func dashboardHandler() http.Handler {
+	sub, _ := fs.Sub(dashboardFS, "dashboard")
+	return http.FileServer(http.FS(sub))
+}
@@ -0,0 +1,13 @@
+//go:build no_dashboard
+
+package api
+
+import (
+	"net/http"
+)
+
+func dashboardHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "dashboard is not built in", http.StatusNotFound)
+	})
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	eventBufferSize   = 256
+	eventWriteTimeout = 10 * time.Second
+	eventPingInterval = 30 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// Any web page could otherwise read the events of an API the browser
+	// reaches, e.g. on the loopback without a token. The dashboard is of the
+	// same origin and clients other than browsers send none.
+	CheckOrigin: sameOrigin,
+}
+
+// sameOrigin reports whether the request has no origin or one of the host
+// it was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// handleEvents streams connection events as json text messages.
+func (a *Api) handleEvents(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	sub := a.servers[0].Events().Subscribe(eventBufferSize)
+	defer sub.Close()
+
+	// Drain the client to process control frames and detect closing.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(eventPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteTimeout)); err != nil {
+				return
+			}
+		case e := <-sub.C():
+			_ = ws.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := ws.WriteJSON(e); err != nil {
+				a.logger.Debug().
+					Err(err).
+					Msg("Failed to write event")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// OpenApi is the OpenAPI document of the management API, the contract of
+// the client in pkg/api/apiclient.
+//
+//go:embed openapi.yaml
+var OpenApi []byte
+
+// handleOpenApi serves OpenApi without authentication, as it holds nothing
+// about the server.
+func handleOpenApi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(OpenApi)
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/juicity/juicity/config"
+)
+
+type rollbackResponse struct {
+	// Backup is the snapshot of the config file before the rollback.
+	Backup *config.Snapshot `json:"backup"`
+}
+
+// handleSnapshots lists the config snapshots on GET
+// /api/v1/config/snapshots, takes one on POST /api/v1/config/snapshots and
+// rolls the config file back to one on POST
+// /api/v1/config/snapshots/{name}/rollback.
+func (a *Api) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if a.snapshots == nil {
+		writeError(w, http.StatusNotFound, "config_snapshots is not configured")
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/config/snapshots"), "/")
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		snapshots, err := a.snapshots.List()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if snapshots == nil {
+			snapshots = []config.Snapshot{}
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+	case r.Method == http.MethodPost && path == "":
+		snapshot, err := a.snapshots.Save()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, snapshot)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/rollback"):
+		name := strings.TrimSuffix(path, "/rollback")
+		backup, err := a.snapshots.Rollback(name)
+		if err != nil {
+			switch {
+			case errors.Is(err, config.ErrSnapshotNotFound):
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			case errors.Is(err, config.ErrSnapshotInvalid):
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		a.logger.Warn().
+			Str("snapshot", name).
+			Str("backup", backup.Name).
+			Msg("Config file rolled back; restart to apply it")
+		writeJSON(w, http.StatusOK, rollbackResponse{Backup: backup})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
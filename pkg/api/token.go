@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Scope is what a token may do with the management API.
+type Scope string
+
+const (
+	// ScopeAll grants everything, like api_token.
+	ScopeAll Scope = "all"
+	// ScopeStats reads stats, metrics, events, bans and traces.
+	ScopeStats Scope = "stats"
+	// ScopeKick closes the connections of users.
+	ScopeKick Scope = "kick"
+	// ScopeUsers suspends users and lifts suspensions.
+	ScopeUsers Scope = "users"
+	// ScopeTraces adds and removes trace filters.
+	ScopeTraces Scope = "traces"
+)
+
+// Token is a bearer token of the management API with its scopes.
+type Token struct {
+	Value  string
+	Scopes []Scope
+}
+
+func (t *Token) validate() error {
+	if t.Value == "" {
+		return fmt.Errorf("empty token")
+	}
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("token without scopes")
+	}
+	for _, s := range t.Scopes {
+		switch s {
+		case ScopeAll, ScopeStats, ScopeKick, ScopeUsers, ScopeTraces:
+		default:
+			return fmt.Errorf("unexpected scope: %v", s)
+		}
+	}
+	return nil
+}
+
+type scopesKey struct{}
+
+// hasScope reports whether the token of the request is granted the scope.
+func hasScope(r *http.Request, scope Scope) bool {
+	scopes, ok := r.Context().Value(scopesKey{}).([]Scope)
+	if !ok {
+		// No token is configured, which grants reads only.
+		return false
+	}
+	for _, s := range scopes {
+		if s == scope || s == ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// token returns the bearer token of the request. It can also be given by the
+// "token" query parameter because browsers cannot set headers of websocket
+// requests.
+func token(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	return token
+}
+
+// authorized requires a token with the read scope for GET requests and the
+// write scope for others. Without any token configured, only reads of
+// ScopeStats are allowed, as anything changing the server or revealing the
+// passwords of users requires a token.
+func (a *Api) authorized(read, write Scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(a.tokens) == 0 {
+			if (r.Method != http.MethodGet && r.Method != http.MethodHead) || read != ScopeStats {
+				writeError(w, http.StatusUnauthorized, "api_token is required")
+				return
+			}
+		} else {
+			var scopes []Scope
+			got := []byte(token(r))
+			for _, t := range a.tokens {
+				if subtle.ConstantTimeCompare(got, []byte(t.Value)) == 1 {
+					scopes = t.Scopes
+				}
+			}
+			if scopes == nil {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), scopesKey{}, scopes))
+			scope := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				scope = read
+			}
+			if !hasScope(r, scope) {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("token lacks scope %v", scope))
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/server"
+
+	"github.com/gorilla/websocket"
+)
+
+const testUser = "00000000-0000-0000-0000-000000000001"
+
+// newTestApi returns the API of a server of testUser, which is not served.
+func newTestApi(t *testing.T, opts *Options) *Api {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.NewLogger(&log.Options{})
+	s, err := server.New(&server.Options{
+		Logger:      logger,
+		Users:       map[string]string{testUser: "password"},
+		Certificate: certFile,
+		PrivateKey:  keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Logger = logger
+	opts.Servers = []*server.Server{s}
+	a, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// request serves a request with the token, if any, and returns its status.
+// POST requests name testUser.
+func request(a *Api, method, path, token string) int {
+	body := ""
+	if method == http.MethodPost {
+		body = `{"user": "` + testUser + `"}`
+	}
+	return requestBody(a, method, path, token, body)
+}
+
+// requestBody is request with the body.
+func requestBody(a *Api, method, path, token, body string) int {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestWithoutToken(t *testing.T) {
+	a := newTestApi(t, &Options{})
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/api/v1/stats", http.StatusOK},
+		{http.MethodGet, "/metrics", http.StatusOK},
+		{http.MethodGet, "/api/v1/bans", http.StatusOK},
+		{http.MethodGet, "/api/v1/traces", http.StatusOK},
+		{http.MethodPost, "/api/v1/kick", http.StatusUnauthorized},
+		{http.MethodDelete, "/api/v1/bans/" + testUser, http.StatusUnauthorized},
+		{http.MethodPost, "/api/v1/traces", http.StatusUnauthorized},
+		{http.MethodGet, "/api/v1/config/snapshots", http.StatusUnauthorized},
+		{http.MethodPost, "/api/v1/config/snapshots/a/rollback", http.StatusUnauthorized},
+	} {
+		if code := request(a, tc.method, tc.path, ""); code != tc.code {
+			t.Errorf("%v %v: got %v, want %v", tc.method, tc.path, code, tc.code)
+		}
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	a := newTestApi(t, &Options{
+		Token: "all",
+		Tokens: []Token{
+			{Value: "stats", Scopes: []Scope{ScopeStats}},
+			{Value: "kick", Scopes: []Scope{ScopeKick}},
+			{Value: "users", Scopes: []Scope{ScopeUsers}},
+			{Value: "traces", Scopes: []Scope{ScopeTraces}},
+			{Value: "kick-users", Scopes: []Scope{ScopeKick, ScopeUsers}},
+		},
+	})
+	tokens := []string{"", "wrong", "all", "stats", "kick", "users", "traces", "kick-users"}
+	for _, tc := range []struct {
+		method, path string
+		body         string
+		// allowed are the tokens passing authorization. Others get 401
+		// without a valid token and 403 with one lacking the scope.
+		allowed []string
+	}{
+		{http.MethodGet, "/metrics", "", []string{"all", "stats"}},
+		{http.MethodGet, "/api/v1/stats", "", []string{"all", "stats"}},
+		{http.MethodGet, "/api/v1/bans", "", []string{"all", "stats"}},
+		{http.MethodGet, "/api/v1/traces", "", []string{"all", "stats"}},
+		{http.MethodPost, "/api/v1/kick", `{"user": "` + testUser + `"}`, []string{"all", "kick", "kick-users"}},
+		// Banning while kicking also takes the scope of users.
+		{http.MethodPost, "/api/v1/kick", `{"user": "` + testUser + `", "ban": "1m"}`, []string{"all", "kick-users"}},
+		{http.MethodDelete, "/api/v1/bans/" + testUser, "", []string{"all", "users", "kick-users"}},
+		{http.MethodPost, "/api/v1/traces", `{"user": "` + testUser + `"}`, []string{"all", "traces"}},
+		{http.MethodDelete, "/api/v1/traces/1", "", []string{"all", "traces"}},
+		// Snapshots reveal the passwords of users.
+		{http.MethodGet, "/api/v1/config/snapshots", "", []string{"all"}},
+		{http.MethodPost, "/api/v1/config/snapshots/a/rollback", "", []string{"all"}},
+	} {
+		for _, token := range tokens {
+			code := requestBody(a, tc.method, tc.path, token, tc.body)
+			var want int
+			switch {
+			case slices.Contains(tc.allowed, token):
+				if code == http.StatusUnauthorized || code == http.StatusForbidden {
+					t.Errorf("%v %v with %q: got %v, want it allowed", tc.method, tc.path, token, code)
+				}
+				continue
+			case token == "" || token == "wrong":
+				want = http.StatusUnauthorized
+			default:
+				want = http.StatusForbidden
+			}
+			if code != want {
+				t.Errorf("%v %v with %q: got %v, want %v", tc.method, tc.path, token, code, want)
+			}
+		}
+	}
+}
+
+func TestEventsOrigin(t *testing.T) {
+	s := httptest.NewServer(newTestApi(t, &Options{}))
+	defer s.Close()
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + "/api/v1/events"
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{s.URL, true},
+		{"http://example.com", false},
+	} {
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			ws.Close()
+		}
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("origin %q: got %v", tc.origin, err)
+		}
+		if !tc.ok && (resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q: got response %v", tc.origin, resp)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juicity/juicity/server"
+
+	"github.com/google/uuid"
+)
+
+type traceRequest struct {
+	// Source is an IP or a CIDR.
+	Source string `json:"source"`
+	User   string `json:"user"`
+	// Duration is how long to trace for, e.g. "10m". Defaults to
+	// server.DefaultTraceDuration.
+	Duration string `json:"duration"`
+}
+
+// handleTraces lists the trace filters on GET /api/v1/traces, adds one on
+// POST /api/v1/traces and removes one on DELETE /api/v1/traces/{id}.
+func (a *Api) handleTraces(w http.ResponseWriter, r *http.Request) {
+	tracing := a.servers[0].Tracing()
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/traces"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, tracing.Filters())
+	case r.Method == http.MethodPost && id == "":
+		var req traceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad request: "+err.Error())
+			return
+		}
+		var (
+			f   server.TraceFilter
+			err error
+		)
+		if req.Source != "" {
+			if f.Source, err = netip.ParsePrefix(req.Source); err != nil {
+				addr, e := netip.ParseAddr(req.Source)
+				if e != nil {
+					writeError(w, http.StatusBadRequest, "parse source: "+err.Error())
+					return
+				}
+				f.Source = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if req.User != "" {
+			if f.User, err = uuid.Parse(req.User); err != nil {
+				writeError(w, http.StatusBadRequest, "parse user: "+err.Error())
+				return
+			}
+		}
+		if req.Duration != "" {
+			duration, err := time.ParseDuration(req.Duration)
+			if err != nil || duration <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid duration: "+req.Duration)
+				return
+			}
+			f.Until = time.Now().Add(duration)
+		}
+		if f, err = tracing.Add(f); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, f)
+	case r.Method == http.MethodDelete && id != "":
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "parse id: "+err.Error())
+			return
+		}
+		if !tracing.Remove(n) {
+			writeError(w, http.StatusNotFound, "no such trace filter")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juicity/juicity/server"
+
+	"github.com/google/uuid"
+)
+
+type kickRequest struct {
+	User string `json:"user"`
+	// Ban is the duration to suspend the user for, e.g. "10m". No suspension
+	// if empty.
+	Ban string `json:"ban"`
+}
+
+type kickResponse struct {
+	Closed      int        `json:"closed"`
+	BannedUntil *time.Time `json:"banned_until,omitempty"`
+}
+
+// handleKick closes all connections of a user and optionally suspends it.
+func (a *Api) handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req kickRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	user, err := uuid.Parse(req.User)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parse user: "+err.Error())
+		return
+	}
+	var ban time.Duration
+	if req.Ban != "" {
+		if !hasScope(r, ScopeUsers) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("token lacks scope %v to ban", ScopeUsers))
+			return
+		}
+		if ban, err = time.ParseDuration(req.Ban); err != nil || ban < 0 {
+			writeError(w, http.StatusBadRequest, "invalid ban duration: "+req.Ban)
+			return
+		}
+	}
+	// The user is kicked from every listener that knows it.
+	var (
+		closed int
+		known  bool
+	)
+	for _, s := range a.servers {
+		n, err := s.Kick(user, ban)
+		if err != nil {
+			if errors.Is(err, server.ErrUnknownUser) {
+				continue
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		closed += n
+		known = true
+	}
+	if !known {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%v: %v", server.ErrUnknownUser, user))
+		return
+	}
+	resp := kickResponse{Closed: closed}
+	if ban > 0 {
+		until := time.Now().Add(ban)
+		resp.BannedUntil = &until
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleBans lists the suspended users on GET /api/v1/bans and lifts a
+// suspension on DELETE /api/v1/bans/{uuid}.
+func (a *Api) handleBans(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/bans"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		bans := []server.Ban{}
+		for _, s := range a.servers {
+			bans = append(bans, s.Bans()...)
+		}
+		writeJSON(w, http.StatusOK, bans)
+	case r.Method == http.MethodDelete && id != "":
+		user, err := uuid.Parse(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "parse user: "+err.Error())
+			return
+		}
+		var unbanned bool
+		for _, s := range a.servers {
+			if s.Unban(user) {
+				unbanned = true
+			}
+		}
+		if !unbanned {
+			writeError(w, http.StatusNotFound, "user is not suspended")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
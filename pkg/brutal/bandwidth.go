@@ -0,0 +1,37 @@
+package brutal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var units = []struct {
+	suffix string
+	bits   uint64
+}{
+	{"tbps", 1e12},
+	{"gbps", 1e9},
+	{"mbps", 1e6},
+	{"kbps", 1e3},
+	{"bps", 1},
+}
+
+// ParseBandwidth parses a rate in bits per second like "100 mbps" or "1gbps"
+// and returns it in bytes per second. A plain number is in bits per second.
+func ParseBandwidth(s string) (uint64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	multiplier := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			multiplier = u.bits
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth: %v", s)
+	}
+	return uint64(f * float64(multiplier) / 8), nil
+}
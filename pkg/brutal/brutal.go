@@ -0,0 +1,208 @@
+// Package brutal is a congestion controller sending at a fixed rate declared
+// by the receiver, like the one of Hysteria. It compensates losses by sending
+// more instead of backing off, so it must only be given the real bandwidth
+// of the link.
+package brutal
+
+import (
+	"math"
+	"time"
+
+	"github.com/mzz2017/quic-go/congestion"
+)
+
+const (
+	// initialMaxDatagramSize is the initial packet size of QUIC over IPv4.
+	initialMaxDatagramSize congestion.ByteCount = 1252
+
+	// The ack rate is sampled over the packets of the last slotCount
+	// seconds.
+	slotCount      = 5
+	minSampleCount = 50
+	minAckRate     = 0.8
+
+	congestionWindowMultiplier = 2
+)
+
+type ackSlot struct {
+	timestamp int64
+	acked     uint64
+	lost      uint64
+}
+
+// Sender is a congestion.CongestionControl sending at a fixed rate.
+type Sender struct {
+	rttStats        congestion.RTTStatsProvider
+	bps             congestion.ByteCount
+	maxDatagramSize congestion.ByteCount
+	pacer           *pacer
+
+	slots   [slotCount]ackSlot
+	ackRate float64
+}
+
+var _ congestion.CongestionControl = (*Sender)(nil)
+
+// NewSender returns a Sender of bps bytes per second, which must be positive.
+func NewSender(bps uint64) *Sender {
+	s := &Sender{
+		bps:             congestion.ByteCount(bps),
+		maxDatagramSize: initialMaxDatagramSize,
+		ackRate:         1,
+	}
+	s.pacer = newPacer(s.bandwidth)
+	return s
+}
+
+// bandwidth is the rate to send at, raised by the loss rate.
+func (s *Sender) bandwidth() congestion.ByteCount {
+	return congestion.ByteCount(float64(s.bps) / s.ackRate)
+}
+
+func (s *Sender) SetRTTStatsProvider(provider congestion.RTTStatsProvider) {
+	s.rttStats = provider
+}
+
+func (s *Sender) TimeUntilSend(bytesInFlight congestion.ByteCount) time.Time {
+	return s.pacer.timeUntilSend()
+}
+
+func (s *Sender) HasPacingBudget(now time.Time) bool {
+	return s.pacer.budget(now) >= s.maxDatagramSize
+}
+
+func (s *Sender) CanSend(bytesInFlight congestion.ByteCount) bool {
+	return bytesInFlight <= s.GetCongestionWindow()
+}
+
+// GetCongestionWindow returns the bytes of the rate over the time that acks
+// may take, so that pacing rather than the window limits the rate.
+func (s *Sender) GetCongestionWindow() congestion.ByteCount {
+	var rtt time.Duration
+	if s.rttStats != nil {
+		rtt = s.rttStats.SmoothedRTT()
+	}
+	if rtt <= 0 {
+		return 10240
+	}
+	rtt += s.rttStats.MaxAckDelay()
+	cwnd := congestion.ByteCount(float64(s.bps) * rtt.Seconds() * congestionWindowMultiplier / s.ackRate)
+	if floor := maxBurstPackets * s.maxDatagramSize; cwnd < floor {
+		return floor
+	}
+	return cwnd
+}
+
+func (s *Sender) OnPacketSent(sentTime time.Time, bytesInFlight congestion.ByteCount, packetNumber congestion.PacketNumber, bytes congestion.ByteCount, isRetransmittable bool) {
+	s.pacer.sentPacket(sentTime, bytes)
+}
+
+func (s *Sender) OnPacketAcked(number congestion.PacketNumber, ackedBytes congestion.ByteCount, priorInFlight congestion.ByteCount, eventTime time.Time) {
+	slot := s.slotAt(eventTime.Unix())
+	slot.acked++
+	s.updateAckRate(eventTime.Unix())
+}
+
+func (s *Sender) OnPacketLost(number congestion.PacketNumber, lostBytes congestion.ByteCount, priorInFlight congestion.ByteCount) {
+	now := time.Now().Unix()
+	slot := s.slotAt(now)
+	slot.lost++
+	s.updateAckRate(now)
+}
+
+// slotAt returns the slot of the second, resetting it if it is outdated.
+func (s *Sender) slotAt(timestamp int64) *ackSlot {
+	slot := &s.slots[timestamp%slotCount]
+	if slot.timestamp != timestamp {
+		*slot = ackSlot{timestamp: timestamp}
+	}
+	return slot
+}
+
+func (s *Sender) updateAckRate(now int64) {
+	var acked, lost uint64
+	for _, slot := range s.slots {
+		if slot.timestamp < now-slotCount {
+			continue
+		}
+		acked += slot.acked
+		lost += slot.lost
+	}
+	if acked+lost < minSampleCount {
+		s.ackRate = 1
+		return
+	}
+	s.ackRate = math.Max(float64(acked)/float64(acked+lost), minAckRate)
+}
+
+func (s *Sender) MaybeExitSlowStart() {}
+
+func (s *Sender) OnRetransmissionTimeout(packetsRetransmitted bool) {}
+
+func (s *Sender) SetMaxDatagramSize(size congestion.ByteCount) {
+	s.maxDatagramSize = size
+	s.pacer.maxDatagramSize = size
+}
+
+func (s *Sender) InSlowStart() bool { return false }
+
+func (s *Sender) InRecovery() bool { return false }
+
+const (
+	maxBurstPackets = 10
+	minPacingDelay  = time.Millisecond
+)
+
+// pacer spreads the packets of a rate over time, allowing short bursts.
+type pacer struct {
+	budgetAtLastSent congestion.ByteCount
+	maxDatagramSize  congestion.ByteCount
+	lastSentTime     time.Time
+	bandwidth        func() congestion.ByteCount
+}
+
+func newPacer(bandwidth func() congestion.ByteCount) *pacer {
+	return &pacer{
+		budgetAtLastSent: maxBurstPackets * initialMaxDatagramSize,
+		maxDatagramSize:  initialMaxDatagramSize,
+		bandwidth:        bandwidth,
+	}
+}
+
+func (p *pacer) sentPacket(sendTime time.Time, size congestion.ByteCount) {
+	budget := p.budget(sendTime)
+	if size > budget {
+		p.budgetAtLastSent = 0
+	} else {
+		p.budgetAtLastSent = budget - size
+	}
+	p.lastSentTime = sendTime
+}
+
+func (p *pacer) budget(now time.Time) congestion.ByteCount {
+	if p.lastSentTime.IsZero() {
+		return p.maxBurstSize()
+	}
+	// Floats do not overflow on long idle periods.
+	budget := float64(p.budgetAtLastSent) + float64(p.bandwidth())*now.Sub(p.lastSentTime).Seconds()
+	return congestion.ByteCount(math.Min(float64(p.maxBurstSize()), budget))
+}
+
+func (p *pacer) maxBurstSize() congestion.ByteCount {
+	burst := congestion.ByteCount((minPacingDelay + time.Millisecond).Seconds() * float64(p.bandwidth()))
+	if floor := maxBurstPackets * p.maxDatagramSize; burst < floor {
+		return floor
+	}
+	return burst
+}
+
+func (p *pacer) timeUntilSend() time.Time {
+	if p.budgetAtLastSent >= p.maxDatagramSize {
+		return time.Time{}
+	}
+	delay := time.Duration(math.Ceil(float64(p.maxDatagramSize-p.budgetAtLastSent) * 1e9 / float64(p.bandwidth())))
+	if delay < minPacingDelay {
+		delay = minPacingDelay
+	}
+	return p.lastSentTime.Add(delay)
+}
@@ -0,0 +1,48 @@
+package brutal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"100 mbps", 12_500_000, true},
+		{"1Gbps", 125_000_000, true},
+		{"800kbps", 100_000, true},
+		{"8000", 1000, true},
+		{"0 mbps", 0, false},
+		{"fast", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseBandwidth(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseBandwidth(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestAckRate(t *testing.T) {
+	s := NewSender(1_000_000)
+	now := time.Now()
+	for i := 0; i < 60; i++ {
+		s.OnPacketAcked(0, 0, 0, now)
+	}
+	if s.ackRate != 1 {
+		t.Fatalf("ack rate without losses: %v", s.ackRate)
+	}
+	for i := 0; i < 40; i++ {
+		s.OnPacketLost(0, 0, 0)
+	}
+	// Losses raise the rate at most by 1/minAckRate.
+	if s.ackRate != minAckRate {
+		t.Fatalf("ack rate with 40%% losses: %v", s.ackRate)
+	}
+	if got := s.bandwidth(); got != 1_250_000 {
+		t.Fatalf("bandwidth: %v", got)
+	}
+}
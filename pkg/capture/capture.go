@@ -0,0 +1,243 @@
+// Package capture records diagnostics of juicity-server for a bounded
+// duration, to debug interop issues with other clients: the metadata of
+// relayed streams in json lines, and optionally the raw UDP datagrams of
+// the QUIC sockets in pcap files. Payloads of streams are never recorded.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/pkg/event"
+	"github.com/juicity/juicity/pkg/log"
+)
+
+const (
+	DefaultDuration = 10 * time.Minute
+	// MaxPcapSize stops a pcap file from growing further.
+	MaxPcapSize = 256 << 20
+
+	eventBufferSize = 1024
+)
+
+type Options struct {
+	Logger *log.Logger
+	// Dir is created if it does not exist.
+	Dir      string
+	Duration time.Duration
+	Pcap     bool
+}
+
+// Capture writes the files of a capture until its duration is over.
+type Capture struct {
+	logger   *log.Logger
+	dir      string
+	prefix   string
+	pcap     bool
+	deadline time.Time
+
+	mu     sync.Mutex
+	files  []*os.File
+	closed bool
+}
+
+// New starts a capture. Files are opened up front, so that they can be
+// written after privileges are dropped.
+func New(opts *Options) (*Capture, error) {
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+	duration := opts.Duration
+	if duration <= 0 {
+		duration = DefaultDuration
+	}
+	c := &Capture{
+		logger:   opts.Logger,
+		dir:      opts.Dir,
+		prefix:   time.Now().Format("20060102-150405"),
+		pcap:     opts.Pcap,
+		deadline: time.Now().Add(duration),
+	}
+	time.AfterFunc(duration, c.close)
+	return c, nil
+}
+
+func (c *Capture) active() bool {
+	return time.Now().Before(c.deadline)
+}
+
+func (c *Capture) create(name string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(c.dir, c.prefix+"-"+name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.files = append(c.files, f)
+	c.mu.Unlock()
+	return f, nil
+}
+
+func (c *Capture) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, f := range c.files {
+		_ = f.Close()
+	}
+	c.logger.Info().
+		Str("dir", c.dir).
+		Msg("Capture finished")
+}
+
+// flush flushes w to its file unless the capture is closed.
+func (c *Capture) flush(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		_ = w.Flush()
+	}
+}
+
+// Streams writes the stream events of bus to streams.jsonl.
+func (c *Capture) Streams(bus *event.Bus) error {
+	f, err := c.create("streams.jsonl")
+	if err != nil {
+		return err
+	}
+	sub := bus.Subscribe(eventBufferSize)
+	go func() {
+		defer sub.Close()
+		w := bufio.NewWriter(f)
+		enc := json.NewEncoder(w)
+		flush := time.NewTicker(time.Second)
+		defer flush.Stop()
+		done := time.NewTimer(time.Until(c.deadline))
+		defer done.Stop()
+		for {
+			select {
+			case e := <-sub.C():
+				if e.Type != event.TypeStreamOpen && e.Type != event.TypeStreamClose {
+					continue
+				}
+				_ = enc.Encode(e)
+			case <-flush.C:
+				c.flush(w)
+			case <-done.C:
+				c.flush(w)
+				if dropped := sub.Dropped.Load(); dropped > 0 {
+					c.logger.Warn().
+						Uint64("dropped", dropped).
+						Msg("Capture dropped stream events")
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// WrapPacketConn returns conn writing its datagrams to a pcap file named
+// after listen if pcaps are enabled, otherwise conn itself.
+func (c *Capture) WrapPacketConn(conn net.PacketConn, listen string) (net.PacketConn, error) {
+	if !c.pcap {
+		return conn, nil
+	}
+	name := strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_").Replace(listen)
+	f, err := c.create(name + ".pcap")
+	if err != nil {
+		return nil, err
+	}
+	w, err := newPcapWriter(f)
+	if err != nil {
+		return nil, err
+	}
+	var local netip.AddrPort
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		local = addr.AddrPort()
+	}
+	p := &packetConn{PacketConn: conn, c: c, w: w, local: local}
+	if oob, ok := conn.(oobConn); ok {
+		return newOobPacketConn(p, oob), nil
+	}
+	return p, nil
+}
+
+type packetConn struct {
+	net.PacketConn
+	c     *Capture
+	local netip.AddrPort
+	w     *pcapWriter
+	// full is set once the pcap is full, guarded by the mutex of c.
+	full bool
+}
+
+func (p *packetConn) record(src netip.AddrPort, dst netip.AddrPort, b []byte) {
+	if !p.c.active() {
+		return
+	}
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+	if p.c.closed || p.full {
+		return
+	}
+	if err := p.w.writeUdp(time.Now(), src, dst, b); err != nil || p.w.n >= MaxPcapSize {
+		p.full = true
+		if err == nil {
+			err = fmt.Errorf("reached %v bytes", MaxPcapSize)
+		}
+		p.c.logger.Warn().
+			Err(err).
+			Msg("Capture stopped writing the pcap")
+	}
+}
+
+// addrs returns the addresses of a datagram exchanged with remote, in the
+// family of remote.
+func (p *packetConn) addrs(remote net.Addr) (netip.AddrPort, netip.AddrPort, bool) {
+	udpAddr, ok := remote.(*net.UDPAddr)
+	if !ok {
+		return netip.AddrPort{}, netip.AddrPort{}, false
+	}
+	r := udpAddr.AddrPort()
+	r = netip.AddrPortFrom(r.Addr().Unmap(), r.Port())
+	l := netip.AddrPortFrom(p.local.Addr().Unmap(), p.local.Port())
+	if l.Addr().Is4() != r.Addr().Is4() {
+		if r.Addr().Is4() {
+			l = netip.AddrPortFrom(netip.IPv4Unspecified(), l.Port())
+		} else {
+			l = netip.AddrPortFrom(netip.IPv6Unspecified(), l.Port())
+		}
+	}
+	return l, r, true
+}
+
+func (p *packetConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = p.PacketConn.ReadFrom(b)
+	if err == nil {
+		if l, r, ok := p.addrs(addr); ok {
+			p.record(r, l, b[:n])
+		}
+	}
+	return n, addr, err
+}
+
+func (p *packetConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	n, err = p.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		if l, r, ok := p.addrs(addr); ok {
+			p.record(l, r, b[:n])
+		}
+	}
+	return n, err
+}
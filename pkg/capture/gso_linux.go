@@ -0,0 +1,22 @@
+package capture
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+)
+
+// gsoSegmentSize returns the UDP_SEGMENT size in the control messages of a
+// write, zero if none.
+func gsoSegmentSize(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.IPPROTO_UDP && msg.Header.Type == unix.UDP_SEGMENT && len(msg.Data) >= 2 {
+			return int(binary.NativeEndian.Uint16(msg.Data))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,24 @@
+package capture
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestGsoSegmentSize(t *testing.T) {
+	oob := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgSpace(0):], 1252)
+	if got := gsoSegmentSize(oob); got != 1252 {
+		t.Errorf("got %v, want 1252", got)
+	}
+	if got := gsoSegmentSize(nil); got != 0 {
+		t.Errorf("got %v without control messages, want 0", got)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package capture
+
+// gsoSegmentSize returns zero: writes are segmented on Linux only.
+func gsoSegmentSize(oob []byte) int {
+	return 0
+}
@@ -0,0 +1,90 @@
+package capture
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+)
+
+// oobConn is a socket that quic-go reads in batches and with ECN, e.g. a
+// *net.UDPConn.
+type oobConn interface {
+	net.PacketConn
+	SyscallConn() (syscall.RawConn, error)
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+	ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error)
+	WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error)
+}
+
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// oobPacketConn is a packetConn of an oobConn, which keeps its batched reads,
+// ECN and GSO for quic-go, and the stats a socket counts in them.
+type oobPacketConn struct {
+	*packetConn
+	oob   oobConn
+	batch batchReader
+}
+
+func newOobPacketConn(p *packetConn, oob oobConn) *oobPacketConn {
+	batch, ok := oob.(batchReader)
+	if !ok {
+		batch = ipv4.NewPacketConn(oob)
+	}
+	return &oobPacketConn{packetConn: p, oob: oob, batch: batch}
+}
+
+func (p *oobPacketConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, err := p.batch.ReadBatch(ms, flags)
+	for i := 0; i < n; i++ {
+		if l, r, ok := p.addrs(ms[i].Addr); ok {
+			p.record(r, l, ms[i].Buffers[0][:ms[i].N])
+		}
+	}
+	return n, err
+}
+
+func (p *oobPacketConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	n, oobn, flags, addr, err = p.oob.ReadMsgUDP(b, oob)
+	if err == nil {
+		if l, r, ok := p.addrs(addr); ok {
+			p.record(r, l, b[:n])
+		}
+	}
+	return n, oobn, flags, addr, err
+}
+
+func (p *oobPacketConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	n, oobn, err = p.oob.WriteMsgUDP(b, oob, addr)
+	if err == nil {
+		if l, r, ok := p.addrs(addr); ok {
+			// A write with a segment size carries several datagrams.
+			segment := gsoSegmentSize(oob)
+			if segment <= 0 {
+				segment = n
+			}
+			for rest := b[:n]; len(rest) > 0; {
+				size := min(segment, len(rest))
+				p.record(l, r, rest[:size])
+				rest = rest[size:]
+			}
+		}
+	}
+	return n, oobn, err
+}
+
+func (p *oobPacketConn) SyscallConn() (syscall.RawConn, error) {
+	return p.oob.SyscallConn()
+}
+
+func (p *oobPacketConn) SetReadBuffer(bytes int) error {
+	return p.oob.SetReadBuffer(bytes)
+}
+
+func (p *oobPacketConn) SetWriteBuffer(bytes int) error {
+	return p.oob.SetWriteBuffer(bytes)
+}
@@ -0,0 +1,54 @@
+package capture
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestOobPacketConn(t *testing.T) {
+	c, err := New(&Options{Logger: log.NewLogger(&log.Options{}), Dir: t.TempDir(), Duration: time.Minute, Pcap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	wrapped, err := c.WrapPacketConn(udpConn, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := wrapped.(*oobPacketConn)
+	if !ok {
+		t.Fatalf("got %T, lost the batched reads of the socket", wrapped)
+	}
+	peer, err := net.DialUDP("udp4", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err = peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ms := []ipv4.Message{{Buffers: [][]byte{make([]byte, 16)}, OOB: make([]byte, 64)}}
+	if n, err := p.ReadBatch(ms, 0); err != nil || n != 1 || string(ms[0].Buffers[0][:ms[0].N]) != "hello" {
+		t.Fatalf("got %v, %v", n, err)
+	}
+	const pcapHeader, packetHeader = 24, 16 + 20 + 8
+	if want := int64(pcapHeader + packetHeader + 5); p.w.n != want {
+		t.Errorf("got %v bytes of pcap after a read, want %v", p.w.n, want)
+	}
+	if _, _, err = p.WriteMsgUDP([]byte("hi"), nil, peer.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(pcapHeader + 2*packetHeader + 5 + 2); p.w.n != want {
+		t.Errorf("got %v bytes of pcap after a write, want %v", p.w.n, want)
+	}
+}
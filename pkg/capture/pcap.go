@@ -0,0 +1,110 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+)
+
+const (
+	pcapMagic     = 0xa1b2c3d4
+	pcapSnapLen   = 65535
+	linkTypeRaw   = 101
+	ipProtocolUdp = 17
+)
+
+// pcapWriter writes UDP datagrams to a pcap file as raw IP packets, so that
+// Wireshark can decode them as QUIC.
+type pcapWriter struct {
+	w io.Writer
+	n int64
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: w, n: int64(len(header))}, nil
+}
+
+// writeUdp writes a datagram from src to dst. The addresses must be of the
+// same family.
+func (p *pcapWriter) writeUdp(t time.Time, src netip.AddrPort, dst netip.AddrPort, payload []byte) error {
+	packet := udpPacket(src, dst, payload)
+	if len(packet) > pcapSnapLen {
+		packet = packet[:pcapSnapLen]
+	}
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, packet...)
+	n, err := p.w.Write(record)
+	p.n += int64(n)
+	return err
+}
+
+// udpPacket builds the IP packet of a datagram.
+func udpPacket(src netip.AddrPort, dst netip.AddrPort, payload []byte) []byte {
+	udpLen := 8 + len(payload)
+	var (
+		packet []byte
+		pseudo []byte
+	)
+	if src.Addr().Is4() {
+		packet = make([]byte, 20+udpLen)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[8] = 64
+		packet[9] = ipProtocolUdp
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(packet[12:], s[:])
+		copy(packet[16:], d[:])
+		binary.BigEndian.PutUint16(packet[10:], ^sum(0, packet[:20]))
+		pseudo = append(packet[12:20:20], 0, ipProtocolUdp, byte(udpLen>>8), byte(udpLen))
+	} else {
+		packet = make([]byte, 40+udpLen)
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(udpLen))
+		packet[6] = ipProtocolUdp
+		packet[7] = 64
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(packet[8:], s[:])
+		copy(packet[24:], d[:])
+		pseudo = append(packet[8:40:40], 0, 0, byte(udpLen>>8), byte(udpLen), 0, 0, 0, ipProtocolUdp)
+	}
+	udp := packet[len(packet)-udpLen:]
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[8:], payload)
+	checksum := ^sum(sum(0, pseudo), udp)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], checksum)
+	return packet
+}
+
+// sum adds the 16-bit words of b to the ones' complement sum s.
+func sum(s uint16, b []byte) uint16 {
+	acc := uint32(s)
+	for i := 0; i+1 < len(b); i += 2 {
+		acc += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		acc += uint32(b[len(b)-1]) << 8
+	}
+	for acc > 0xffff {
+		acc = acc>>16 + acc&0xffff
+	}
+	return uint16(acc)
+}
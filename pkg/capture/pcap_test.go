@@ -0,0 +1,40 @@
+package capture
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestUdpPacketChecksums(t *testing.T) {
+	for _, addrs := range [][2]string{
+		{"192.0.2.1:443", "198.51.100.2:50000"},
+		{"[2001:db8::1]:443", "[2001:db8::2]:50000"},
+	} {
+		src, dst := netip.MustParseAddrPort(addrs[0]), netip.MustParseAddrPort(addrs[1])
+		for _, payload := range [][]byte{nil, []byte("odd"), []byte("even")} {
+			packet := udpPacket(src, dst, payload)
+			header, pseudoLen := 20, 12
+			if src.Addr().Is6() {
+				header, pseudoLen = 40, 40
+			}
+			udp := packet[header:]
+			if len(udp) != 8+len(payload) {
+				t.Fatalf("%v: udp length %v", addrs, len(udp))
+			}
+			if src.Addr().Is4() && sum(0, packet[:20]) != 0xffff {
+				t.Errorf("%v: bad ip checksum", addrs)
+			}
+			pseudo := make([]byte, 0, pseudoLen)
+			if src.Addr().Is4() {
+				pseudo = append(pseudo, packet[12:20]...)
+				pseudo = append(pseudo, 0, ipProtocolUdp, 0, byte(len(udp)))
+			} else {
+				pseudo = append(pseudo, packet[8:40]...)
+				pseudo = append(pseudo, 0, 0, 0, byte(len(udp)), 0, 0, 0, ipProtocolUdp)
+			}
+			if sum(sum(0, pseudo), udp) != 0xffff {
+				t.Errorf("%v %q: bad udp checksum", addrs, payload)
+			}
+		}
+	}
+}
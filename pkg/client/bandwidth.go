@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/brutal"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/server"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// bandwidthDeclaration declares the bandwidth of the client on every new
+// connection to the server, so that the server sends at the downlink with
+// brutal.
+type bandwidthDeclaration struct {
+	logger  *log.Logger
+	payload []byte
+	// pending is set once a new connection to the server is dialed, until it
+	// is declared on.
+	pending atomic.Bool
+}
+
+func newBandwidthDeclaration(logger *log.Logger, bandwidth *config.Bandwidth) (*bandwidthDeclaration, error) {
+	var (
+		up, down uint64
+		err      error
+	)
+	if bandwidth.Up != "" {
+		if up, err = brutal.ParseBandwidth(bandwidth.Up); err != nil {
+			return nil, fmt.Errorf("parse bandwidth: %w", err)
+		}
+	}
+	if bandwidth.Down != "" {
+		if down, err = brutal.ParseBandwidth(bandwidth.Down); err != nil {
+			return nil, fmt.Errorf("parse bandwidth: %w", err)
+		}
+	}
+	return &bandwidthDeclaration{
+		logger:  logger,
+		payload: server.EncodeBandwidth(up, down),
+	}, nil
+}
+
+// underlay returns the dialer of the server noticing new connections.
+func (b *bandwidthDeclaration) underlay(d netproxy.Dialer) netproxy.Dialer {
+	return &bandwidthUnderlay{Dialer: d, b: b}
+}
+
+// wrap returns d declaring the bandwidth after dialing through a new
+// connection.
+func (b *bandwidthDeclaration) wrap(d netproxy.Dialer) netproxy.Dialer {
+	return &bandwidthDialer{Dialer: d, b: b}
+}
+
+func (b *bandwidthDeclaration) declare(d netproxy.Dialer) {
+	conn, err := d.Dial("tcp", net.JoinHostPort(server.BandwidthHostname, "0"))
+	if err == nil {
+		_, err = conn.Write(b.payload)
+		_ = conn.Close()
+	}
+	if err != nil {
+		b.logger.Warn().
+			Err(err).
+			Msg("Failed to declare bandwidth")
+	}
+}
+
+type bandwidthUnderlay struct {
+	netproxy.Dialer
+	b *bandwidthDeclaration
+}
+
+func (d *bandwidthUnderlay) Dial(network string, addr string) (netproxy.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err == nil {
+		if magicNetwork, _ := netproxy.ParseMagicNetwork(network); magicNetwork != nil && magicNetwork.Network == "udp" {
+			d.b.pending.Store(true)
+		}
+	}
+	return conn, err
+}
+
+type bandwidthDialer struct {
+	netproxy.Dialer
+	b *bandwidthDeclaration
+}
+
+func (d *bandwidthDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err == nil && d.b.pending.CompareAndSwap(true, false) {
+		go d.b.declare(d.Dialer)
+	}
+	return conn, err
+}
@@ -0,0 +1,529 @@
+// Package client is the engine of juicity-client. It can be embedded by
+// apps, see the mobile package.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/common"
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/internal/juicity"
+	"github.com/juicity/juicity/pkg/acl"
+	"github.com/juicity/juicity/pkg/client/dialer"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/stats"
+	"github.com/juicity/juicity/pkg/tun"
+	"github.com/juicity/juicity/server"
+
+	outbound "github.com/daeuniverse/outbound/dialer"
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/rs/zerolog"
+	"github.com/sourcegraph/conc/pool"
+)
+
+type Options struct {
+	Logger *log.Logger
+	// Tun is a TUN device whose TCP connections and UDP flows are relayed
+	// through the server, e.g. the one of a mobile VPN. Nil serves none.
+	Tun io.ReadWriteCloser
+}
+
+// Client serves the local listeners of juicity-client.
+type Client struct {
+	logger *log.Logger
+	conf   *config.Config
+	dialer netproxy.Dialer
+	router *router
+	// asnDb is opened for routing rules if asn_db is set.
+	asnDb   *acl.AsnDb
+	allowed []netip.Prefix
+	pac     *pac
+	dns     *dnsForwarder
+	traffic stats.Traffic
+	// isolation gives SOCKS users or destination sites connections of their
+	// own, if enabled.
+	isolation *isolation
+	// heartbeat pings the server through heartbeatD, bypassing the traffic
+	// counters.
+	heartbeat  *heartbeat
+	heartbeatD netproxy.Dialer
+	// decoy sends dummy traffic through decoyD, also bypassing the traffic
+	// counters.
+	decoy  *decoy
+	decoyD netproxy.Dialer
+	// clock compares the local clock with the server through clockD.
+	clock  *clock
+	clockD netproxy.Dialer
+	// reverses park their streams through reverseD, which is not isolated.
+	reverses []*reverse
+	reverseD netproxy.Dialer
+	closes   *closeWatcher
+	tun      *tun.Tun
+
+	mu         sync.Mutex
+	closed     bool
+	mixed      *server.Mixed
+	forwarders []*server.Forwarder
+	// cancel stops the loops of Serve that have no listener to close.
+	cancel func()
+}
+
+func New(conf *config.Config, opts *Options) (*Client, error) {
+	for _, warning := range conf.Warnings {
+		opts.Logger.Warn().Str("warning", warning).Msg("Config warning")
+	}
+	if err := resolveSecrets(conf); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTlsConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	var underlay netproxy.Dialer = dialer.NewClientDialer(conf)
+	for _, link := range conf.Detour {
+		var (
+			property *outbound.Property
+			err      error
+		)
+		if underlay, property, err = outbound.NewNetproxyDialerFromLink(underlay, &outbound.ExtraOption{}, link); err != nil {
+			return nil, fmt.Errorf("parse detour: %w", err)
+		}
+		opts.Logger.Info().
+			Str("name", property.Name).
+			Str("proto", property.Protocol).
+			Str("addr", property.Address).
+			Msg("Dial the server through detour")
+	}
+	if len(conf.Detour) > 0 {
+		underlay = &detourDialer{Dialer: underlay}
+	}
+	if conf.NatKeepalive != nil {
+		keepalive, err := newNatKeepalive(opts.Logger, conf.NatKeepalive)
+		if err != nil {
+			return nil, err
+		}
+		// Only sockets over UDP have NAT bindings, not fallback streams.
+		underlay = keepalive.underlay(underlay)
+	}
+	var transport *fallbackTransport
+	if conf.Fallback != nil {
+		var err error
+		if transport, err = newFallbackTransport(opts.Logger, conf, tlsConfig); err != nil {
+			return nil, err
+		}
+		underlay = transport.underlay(underlay)
+	}
+	var beat *heartbeat
+	if conf.Heartbeat != nil {
+		var err error
+		if beat, err = newHeartbeat(opts.Logger, conf.Heartbeat); err != nil {
+			return nil, err
+		}
+		underlay = beat.underlay(underlay)
+	}
+	var dummy *decoy
+	if conf.Decoy != nil {
+		var err error
+		if dummy, err = newDecoy(opts.Logger, conf.Decoy); err != nil {
+			return nil, err
+		}
+	}
+	clk, err := newClock(opts.Logger, conf.MaxClockSkew)
+	if err != nil {
+		return nil, err
+	}
+	var declaration *bandwidthDeclaration
+	if conf.Bandwidth != nil {
+		var err error
+		if declaration, err = newBandwidthDeclaration(opts.Logger, conf.Bandwidth); err != nil {
+			return nil, err
+		}
+		underlay = declaration.underlay(underlay)
+	}
+	header := protocol.Header{
+		ProxyAddress: conf.Server,
+		Feature1:     conf.CongestionControl,
+		TlsConfig:    tlsConfig,
+		User:         conf.Uuid,
+		Password:     conf.Password,
+		IsClient:     true,
+		Flags:        0,
+	}
+	// The embedded profile bounds the memory buffered by the connections to
+	// the server and by the TUN device.
+	windows := juicity.DefaultReceiveWindows
+	tunBuffers := &tun.DefaultBuffers
+	if conf.Profile == config.ProfileEmbedded {
+		windows = juicity.ReceiveWindows(server.SmallReceiveWindows)
+		tunBuffers = &tun.SmallBuffers
+	}
+	d, err := juicity.NewDialer(underlay, header, windows)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Listen == "" && len(conf.Forward) == 0 && conf.Dns == nil && len(conf.Reverse) == 0 && opts.Tun == nil {
+		return nil, fmt.Errorf("please fill in at least one of `listen`, `forward`, `dns` and `reverse` in the config")
+	}
+	switch conf.TcpHalfClose {
+	case "", "legacy", "strict":
+	default:
+		return nil, fmt.Errorf("unexpected tcp_half_close: %v", conf.TcpHalfClose)
+	}
+	closes := &closeWatcher{logger: opts.Logger}
+	c := &Client{
+		logger:     opts.Logger,
+		conf:       conf,
+		heartbeat:  beat,
+		heartbeatD: closes.wrap(d),
+		decoy:      dummy,
+		decoyD:     closes.wrap(d),
+		clock:      clk,
+		clockD:     closes.wrap(d),
+		closes:     closes,
+	}
+	if c.allowed, err = parseAllowedSources(conf.ListenAllow); err != nil {
+		return nil, err
+	}
+	if conf.Pac != nil {
+		if c.pac, err = newPac(conf.Pac); err != nil {
+			return nil, err
+		}
+	}
+	// newDialer wraps a dialer of the server for the listeners.
+	newDialer := func(d netproxy.Dialer) netproxy.Dialer {
+		serverDialer := closes.wrap(d)
+		if transport != nil {
+			serverDialer = transport.watch(serverDialer)
+		}
+		if declaration != nil {
+			serverDialer = declaration.wrap(serverDialer)
+		}
+		return &trafficDialer{Dialer: serverDialer, traffic: &c.traffic}
+	}
+	c.dialer = newDialer(d)
+	c.reverseD = c.dialer
+	for name, target := range conf.Reverse {
+		r, err := newReverse(c.logger, name, target, conf.TcpHalfClose == "strict")
+		if err != nil {
+			return nil, err
+		}
+		c.reverses = append(c.reverses, r)
+	}
+	if conf.IsolateDestinations < 0 {
+		return nil, fmt.Errorf("invalid isolate_destinations: %v", conf.IsolateDestinations)
+	}
+	if conf.IsolateSocksAuth || conf.IsolateDestinations > 0 {
+		c.isolation = newIsolation(c.dialer, func() (netproxy.Dialer, io.Closer, error) {
+			sockets := newUnderlaySockets(underlay)
+			d, err := juicity.NewDialer(sockets, header, windows)
+			if err != nil {
+				return nil, nil, err
+			}
+			return newDialer(d), &juicityCloser{dialer: d, sockets: sockets}, nil
+		}, conf.IsolateDestinations)
+		c.dialer = c.isolation.proxy
+	}
+	if conf.Dns != nil {
+		if c.dns, err = newDnsForwarder(c.logger, c.dialer, conf.Dns.Listen, conf.Dns.Upstream); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Routing != nil {
+		if conf.AsnDb != "" {
+			if c.asnDb, err = acl.OpenAsnDb(conf.AsnDb); err != nil {
+				return nil, fmt.Errorf("open asn_db: %w", err)
+			}
+		}
+		if c.router, err = newRouter(conf.Routing, c.asnDb, c.dialer, c.logger); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Tun != nil {
+		if c.tun, err = tun.New(&tun.Options{
+			Logger:          c.logger,
+			Device:          opts.Tun,
+			Dialer:          c.tunDialer,
+			StrictHalfClose: conf.TcpHalfClose == "strict",
+			Buffers:         tunBuffers,
+		}); err != nil {
+			if c.asnDb != nil {
+				_ = c.asnDb.Close()
+			}
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// tunDialer returns the dialer of the TUN device for the source, routed like
+// the connections of the local listener.
+func (c *Client) tunDialer(source net.Addr) netproxy.Dialer {
+	if c.router != nil {
+		return c.router.route(source)
+	}
+	return c.dialer
+}
+
+// Traffic returns the bytes sent and received through the server.
+func (c *Client) Traffic() *stats.Traffic {
+	return &c.traffic
+}
+
+// Rtt returns the round-trip time to the server measured by the latest
+// heartbeat, or zero if heartbeats are disabled or none succeeded yet.
+func (c *Client) Rtt() time.Duration {
+	if c.heartbeat == nil {
+		return 0
+	}
+	return c.heartbeat.Rtt()
+}
+
+// LastCloseReason returns why the server closed the latest connection it
+// closed, or nil if it closed none.
+func (c *Client) LastCloseReason() *CloseReason {
+	return c.closes.Last()
+}
+
+// Serve serves the listeners until Close is called or any of them fails.
+func (c *Client) Serve() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.conf.Listen != "" {
+		mixed, err := server.NewMixed("mixed://"+c.conf.Listen, c.dialer)
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		if c.router != nil {
+			mixed.SetRouter(c.router.route)
+		}
+		mixed.SetAllowedSources(c.allowed)
+		if c.isolation != nil && c.conf.IsolateSocksAuth {
+			mixed.SetIsolation(c.isolation.isolate)
+		}
+		if c.pac != nil {
+			mixed.SetPac(c.pac.path, c.pac.render)
+		}
+		if u, _ := url.Parse("mixed://" + c.conf.Listen); u != nil && isExposed(u) && len(c.allowed) == 0 {
+			c.logger.Warn().
+				Str("listen", c.conf.Listen).
+				Msg("The listener is open to other hosts without authentication; set a user and password in listen, or listen_allow")
+		}
+		c.mixed = mixed
+	}
+	for local, remote := range c.conf.Forward {
+		forwarder, err := server.NewForwarder(server.ForwarderOptions{
+			Logger:          c.logger,
+			Dialer:          c.dialer,
+			LocalAddr:       local,
+			RemoteAddr:      remote,
+			StrictHalfClose: c.conf.TcpHalfClose == "strict",
+		})
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.forwarders = append(c.forwarders, forwarder)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	wg := pool.New().WithErrors().WithContext(ctx).WithCancelOnError()
+	if c.mixed != nil {
+		wg.Go(func(ctx context.Context) error {
+			return c.mixed.ListenAndServe()
+		})
+	}
+	for _, forwarder := range c.forwarders {
+		forwarder := forwarder
+		wg.Go(func(ctx context.Context) error {
+			return forwarder.Serve()
+		})
+	}
+	if c.dns != nil {
+		c.logger.Info().Msgf("Forward dns queries on %v to %v", c.conf.Dns.Listen, c.dns.upstream)
+		for _, server := range c.dns.servers {
+			server := server
+			wg.Go(func(ctx context.Context) error {
+				return server.ListenAndServe()
+			})
+		}
+	}
+	if c.heartbeat != nil {
+		wg.Go(func(ctx context.Context) error {
+			c.heartbeat.run(ctx, c.heartbeatD)
+			return nil
+		})
+	}
+	if c.decoy != nil {
+		wg.Go(func(ctx context.Context) error {
+			c.decoy.run(ctx, c.decoyD)
+			return nil
+		})
+	}
+	wg.Go(func(ctx context.Context) error {
+		c.clock.run(ctx, c.clockD)
+		return nil
+	})
+	for _, r := range c.reverses {
+		r := r
+		wg.Go(func(ctx context.Context) error {
+			r.run(ctx, c.reverseD)
+			return nil
+		})
+	}
+	if c.tun != nil {
+		wg.Go(func(ctx context.Context) error {
+			return c.tun.Serve()
+		})
+	}
+	err := wg.Wait()
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		// Listeners fail once closed.
+		return nil
+	}
+	c.Close()
+	return err
+}
+
+// Close stops all listeners.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.mixed != nil {
+		c.mixed.Close()
+	}
+	for _, forwarder := range c.forwarders {
+		forwarder.Close()
+	}
+	if c.tun != nil {
+		_ = c.tun.Close()
+	}
+	if c.dns != nil {
+		for _, server := range c.dns.servers {
+			_ = server.Shutdown()
+		}
+	}
+	if c.isolation != nil {
+		c.isolation.close()
+	}
+	if c.asnDb != nil {
+		_ = c.asnDb.Close()
+	}
+	return nil
+}
+
+// ReloadGeodata reopens the database of routing at path, if any, after it
+// was updated.
+func (c *Client) ReloadGeodata(path string) error {
+	if c.asnDb == nil || filepath.Clean(path) != filepath.Clean(c.asnDb.Path()) {
+		return nil
+	}
+	return c.asnDb.Reload()
+}
+
+// NewConsoleLogger returns the logger of an embedded client, which writes to
+// stderr without color in the log level and time format of the config.
+func NewConsoleLogger(conf *config.Config) (*log.Logger, error) {
+	lvl, err := zerolog.ParseLevel(conf.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("ParseLevel: %w", err)
+	}
+	logTimezone, err := log.ParseTimeZone(conf.LogTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("parse log_timezone: %w", err)
+	}
+	logTimeFormat, err := log.ParseTimeFormat(conf.LogTimeFormat)
+	if err != nil {
+		return nil, fmt.Errorf("parse log_time_format: %w", err)
+	}
+	logger := log.NewLogger(&log.Options{
+		TimeFormat: logTimeFormat,
+		TimeZone:   logTimezone,
+		NoColor:    true,
+	})
+	*logger = logger.Level(lvl)
+	return logger, nil
+}
+
+// newTlsConfig returns the TLS config of the connections to the server,
+// filling conf.Sni if empty.
+func newTlsConfig(conf *config.Config) (*tls.Config, error) {
+	if conf.Sni == "" {
+		conf.Sni, _, _ = net.SplitHostPort(conf.Server)
+	}
+	tlsConfig := &tls.Config{
+		NextProtos:         []string{"h3"},
+		MinVersion:         tls.VersionTLS13,
+		ServerName:         conf.Sni,
+		InsecureSkipVerify: conf.AllowInsecure,
+		// Reconnections resume the session with the ticket of the server,
+		// skipping the certificate and its verification.
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if conf.ClientCertificate != "" || conf.ClientPrivateKey != "" {
+		cert, err := common.LoadX509KeyPair(conf.ClientCertificate, conf.ClientPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if conf.PinnedCertChainSha256 != "" {
+		pinnedHash, err := decodeCertChainHash(conf.PinnedCertChainSha256)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if !bytes.Equal(common.GenerateCertChainHash(rawCerts), pinnedHash) {
+				return fmt.Errorf("pinned hash of cert chain does not match")
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// decodeCertChainHash decodes pinned_certchain_sha256 in base64 or hex.
+func decodeCertChainHash(s string) ([]byte, error) {
+	hash, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		hash, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			hash, err = hex.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode PinnedCertChainSha256")
+			}
+		}
+	}
+	return hash, nil
+}
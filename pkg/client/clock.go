@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/server"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+const (
+	DefaultMaxClockSkew = 30 * time.Second
+	// clockCheckInterval is how often the clock is compared with the server
+	// after the start.
+	clockCheckInterval = time.Hour
+	clockTimeout       = 10 * time.Second
+)
+
+// clock compares the local clock with the server and warns when they are
+// apart. Authentication does not depend on time, but TLS certificates fail
+// to verify on clocks far off, and logs of both ends no longer match.
+type clock struct {
+	logger  *log.Logger
+	maxSkew time.Duration
+}
+
+func newClock(logger *log.Logger, maxSkew string) (*clock, error) {
+	c := &clock{logger: logger, maxSkew: DefaultMaxClockSkew}
+	if maxSkew != "" {
+		var err error
+		if c.maxSkew, err = time.ParseDuration(maxSkew); err != nil || c.maxSkew <= 0 {
+			return nil, fmt.Errorf("invalid max_clock_skew: %v", maxSkew)
+		}
+	}
+	return c, nil
+}
+
+// run checks the clock through dialer at the start and every
+// clockCheckInterval until ctx is done.
+func (c *clock) run(ctx context.Context, dialer netproxy.Dialer) {
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.check(dialer)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *clock) check(dialer netproxy.Dialer) {
+	skew, err := measureClockSkew(dialer)
+	if err != nil {
+		// Servers without the clock extension reset the stream.
+		c.logger.Debug().
+			Err(err).
+			Msg("Failed to compare the clock with the server")
+		return
+	}
+	if skew.Abs() > c.maxSkew {
+		c.logger.Warn().
+			Dur("skew", skew).
+			Msgf("The local clock is %v %v the server; sync it (e.g. enable NTP), or TLS certificates may fail to verify", skew.Abs().Round(time.Second), aheadOrBehind(skew))
+		return
+	}
+	c.logger.Debug().
+		Dur("skew", skew).
+		Msg("Clock of the server")
+}
+
+// measureClockSkew returns how far the local clock is ahead of the server,
+// assuming the path is symmetric.
+func measureClockSkew(dialer netproxy.Dialer) (time.Duration, error) {
+	stream, err := dialer.Dial("tcp", net.JoinHostPort(server.ClockHostname, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(clockTimeout))
+	sent := time.Now()
+	if _, err = stream.Write(server.EncodeClock(sent)); err != nil {
+		return 0, err
+	}
+	b := make([]byte, server.ClockSize)
+	if _, err = io.ReadFull(stream, b); err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	middle := sent.Add(received.Sub(sent) / 2)
+	return middle.Sub(server.DecodeClock(b)), nil
+}
+
+func aheadOrBehind(skew time.Duration) string {
+	if skew > 0 {
+		return "ahead of"
+	}
+	return "behind"
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/server"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol/tuic"
+	"github.com/mzz2017/quic-go"
+)
+
+// closeReasonLogInterval is how long the same close reason is not logged
+// again, since every stream of a closed connection fails with it.
+const closeReasonLogInterval = 10 * time.Second
+
+var closeReasonTexts = map[quic.ApplicationErrorCode]string{
+	tuic.ProtocolError:              "protocol error",
+	tuic.AuthenticationFailed:       "authentication failed; check uuid and password",
+	tuic.AuthenticationTimeout:      "authentication timed out",
+	tuic.BadCommand:                 "bad command",
+	server.CloseCodeKicked:          "kicked by the administrator of the server",
+	server.CloseCodeSuspended:       "the user is suspended by the server",
+	server.CloseCodeTooManyConns:    "the user has too many connections to the server",
+	server.CloseCodeOutsideSchedule: "the user is outside the schedule of the server",
+}
+
+// CloseReason is why the server closed a connection.
+type CloseReason struct {
+	Code uint64
+	// Text is the human-readable reason.
+	Text string
+	Time time.Time
+}
+
+func newCloseReason(err *quic.ApplicationError) *CloseReason {
+	text, ok := closeReasonTexts[err.ErrorCode]
+	if !ok {
+		text = fmt.Sprintf("closed by the server with code %#x", uint64(err.ErrorCode))
+		if err.ErrorMessage != "" {
+			text += ": " + err.ErrorMessage
+		}
+	}
+	return &CloseReason{Code: uint64(err.ErrorCode), Text: text, Time: time.Now()}
+}
+
+// closeWatcher records the reasons of the server closing connections from
+// the errors of dials and streams.
+type closeWatcher struct {
+	logger *log.Logger
+
+	mu     sync.Mutex
+	last   *CloseReason
+	logged time.Time
+}
+
+// Last returns the latest close reason, or nil if the server closed none.
+func (w *closeWatcher) Last() *CloseReason {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
+
+func (w *closeWatcher) observe(err error) {
+	var appErr *quic.ApplicationError
+	if err == nil || !errors.As(err, &appErr) || !appErr.Remote {
+		return
+	}
+	reason := newCloseReason(appErr)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.last != nil && w.last.Code == reason.Code && reason.Time.Sub(w.logged) < closeReasonLogInterval {
+		w.last = reason
+		return
+	}
+	w.last = reason
+	w.logged = reason.Time
+	w.logger.Warn().
+		Str("code", fmt.Sprintf("%#x", reason.Code)).
+		Msg("The server closed the connection: " + reason.Text)
+}
+
+// wrap returns d recording the close reasons of its connections.
+func (w *closeWatcher) wrap(d netproxy.Dialer) netproxy.Dialer {
+	return &closeWatchDialer{Dialer: d, w: w}
+}
+
+type closeWatchDialer struct {
+	netproxy.Dialer
+	w *closeWatcher
+}
+
+func (d *closeWatchDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	c, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		d.w.observe(err)
+		return nil, err
+	}
+	if pc, ok := c.(netproxy.PacketConn); ok {
+		return &closeWatchPacketConn{PacketConn: pc, w: d.w}, nil
+	}
+	return &closeWatchConn{Conn: c, w: d.w}, nil
+}
+
+type closeWatchConn struct {
+	netproxy.Conn
+	w *closeWatcher
+}
+
+func (c *closeWatchConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.w.observe(err)
+	return n, err
+}
+
+func (c *closeWatchConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.w.observe(err)
+	return n, err
+}
+
+func (c *closeWatchConn) CloseWrite() error {
+	if conn, ok := c.Conn.(relay.WriteCloser); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+type closeWatchPacketConn struct {
+	netproxy.PacketConn
+	w *closeWatcher
+}
+
+func (c *closeWatchPacketConn) Read(b []byte) (n int, err error) {
+	n, err = c.PacketConn.Read(b)
+	c.w.observe(err)
+	return n, err
+}
+
+func (c *closeWatchPacketConn) Write(b []byte) (n int, err error) {
+	n, err = c.PacketConn.Write(b)
+	c.w.observe(err)
+	return n, err
+}
+
+func (c *closeWatchPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	c.w.observe(err)
+	return n, addr, err
+}
+
+func (c *closeWatchPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	c.w.observe(err)
+	return n, err
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/brutal"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/schedule"
+	"github.com/juicity/juicity/server"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+const (
+	// The sizes of decoys are log-normal like those of web requests and
+	// objects: requests of about 500 bytes, and responses of about 8 KiB
+	// with a long tail.
+	decoyRequestMedian  = 500
+	decoyRequestSigma   = 0.5
+	decoyResponseMedian = 8 << 10
+	decoyResponseSigma  = 1.5
+	// maxDecoys bounds the decoys in flight.
+	maxDecoys    = 4
+	decoyTimeout = 30 * time.Second
+)
+
+// decoy sends dummy requests through the server at random moments, so that
+// the tunnel is never idle to observers correlating flows. Decoys average
+// the configured rate while the schedule allows them.
+type decoy struct {
+	logger   *log.Logger
+	rate     uint64
+	schedule *schedule.Schedule
+}
+
+func newDecoy(logger *log.Logger, conf *config.Decoy) (*decoy, error) {
+	if conf.Rate == "" {
+		return nil, fmt.Errorf("decoy: rate is required")
+	}
+	rate, err := brutal.ParseBandwidth(conf.Rate)
+	if err != nil {
+		return nil, fmt.Errorf("parse rate of decoy: %w", err)
+	}
+	if rate == 0 {
+		return nil, fmt.Errorf("decoy: rate is zero")
+	}
+	d := &decoy{logger: logger, rate: rate}
+	if len(conf.Schedule) > 0 {
+		if d.schedule, err = schedule.Parse(conf.Schedule, nil); err != nil {
+			return nil, fmt.Errorf("parse schedule of decoy: %w", err)
+		}
+	}
+	return d, nil
+}
+
+// logNormal returns a log-normal size with the median, at most limit.
+func logNormal(median float64, sigma float64, limit int) int {
+	return min(limit, int(median*math.Exp(sigma*rand.NormFloat64())))
+}
+
+// meanInterval is the mean time between decoys for their mean size to
+// average the rate.
+func (d *decoy) meanInterval() time.Duration {
+	meanSize := decoyRequestMedian*math.Exp(decoyRequestSigma*decoyRequestSigma/2) +
+		decoyResponseMedian*math.Exp(decoyResponseSigma*decoyResponseSigma/2)
+	return time.Duration(meanSize / float64(d.rate) * float64(time.Second))
+}
+
+// run sends decoys through dialer at exponentially distributed intervals
+// until ctx is done.
+func (d *decoy) run(ctx context.Context, dialer netproxy.Dialer) {
+	mean := d.meanInterval()
+	slots := make(chan struct{}, maxDecoys)
+	for {
+		timer := time.NewTimer(time.Duration(rand.ExpFloat64() * float64(mean)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !d.schedule.Allows(time.Now()) {
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			// The server is too slow to keep up; skip this one.
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			if err := d.send(dialer); err != nil {
+				d.logger.Debug().
+					Err(err).
+					Msg("Failed to send a decoy")
+			}
+		}()
+	}
+}
+
+func (d *decoy) send(dialer netproxy.Dialer) error {
+	stream, err := dialer.Dial("tcp", net.JoinHostPort(server.DecoyHostname, "0"))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(decoyTimeout))
+	response := logNormal(decoyResponseMedian, decoyResponseSigma, server.MaxDecoySize)
+	padding := logNormal(decoyRequestMedian, decoyRequestSigma, server.MaxDecoySize) - server.DecoyHeaderSize
+	if _, err = stream.Write(server.EncodeDecoyRequest(response, max(0, padding))); err != nil {
+		return err
+	}
+	_, err = io.CopyN(io.Discard, stream, int64(response))
+	return err
+}
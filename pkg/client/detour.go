@@ -0,0 +1,166 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// detourDialer dials the server through a chain of other proxies. QUIC of
+// juicity needs a real UDP socket, so UDP through the chain is bridged by a
+// pair of loopback sockets.
+type detourDialer struct {
+	netproxy.Dialer
+}
+
+func (d *detourDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if magicNetwork.Network != "udp" {
+		return d.Dialer.Dial(network, addr)
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(netproxy.PacketConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, fmt.Errorf("detour does not support udp")
+	}
+	return newUdpBridge(pc, addr, remoteAddr)
+}
+
+// udpBridge is the local end of a bridge to a packet conn through the detour.
+// QUIC reads and writes the local socket, and the relay socket forwards the
+// datagrams to and from the detour.
+type udpBridge struct {
+	*net.UDPConn
+	relay      *net.UDPConn
+	remote     netproxy.PacketConn
+	addr       string
+	remoteAddr *net.UDPAddr
+	closeOnce  sync.Once
+}
+
+func newUdpBridge(remote netproxy.PacketConn, addr string, remoteAddr *net.UDPAddr) (*udpBridge, error) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	local, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		_ = remote.Close()
+		return nil, err
+	}
+	relay, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		_ = local.Close()
+		_ = remote.Close()
+		return nil, err
+	}
+	b := &udpBridge{
+		UDPConn:    local,
+		relay:      relay,
+		remote:     remote,
+		addr:       addr,
+		remoteAddr: remoteAddr,
+	}
+	go b.relayToRemote()
+	go b.relayFromRemote()
+	return b, nil
+}
+
+func (b *udpBridge) relayToRemote() {
+	defer b.Close()
+	localAddr := b.UDPConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := b.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if from != localAddr {
+			continue
+		}
+		if _, err = b.remote.WriteTo(buf[:n], b.addr); err != nil {
+			return
+		}
+	}
+}
+
+func (b *udpBridge) relayFromRemote() {
+	defer b.Close()
+	localAddr := b.UDPConn.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := b.remote.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if _, err = b.relay.WriteToUDP(buf[:n], localAddr); err != nil {
+			return
+		}
+	}
+}
+
+func (b *udpBridge) relayAddr() *net.UDPAddr {
+	return b.relay.LocalAddr().(*net.UDPAddr)
+}
+
+// read reads a datagram of the relay, dropping the ones of other senders.
+func (b *udpBridge) read(p []byte, oob []byte) (n int, oobn int, flags int, err error) {
+	relayAddr := b.relayAddr().AddrPort()
+	for {
+		var from netip.AddrPort
+		n, oobn, flags, from, err = b.UDPConn.ReadMsgUDPAddrPort(p, oob)
+		if err != nil || from == relayAddr {
+			return n, oobn, flags, err
+		}
+	}
+}
+
+func (b *udpBridge) Read(p []byte) (n int, err error) {
+	n, _, _, err = b.read(p, nil)
+	return n, err
+}
+
+func (b *udpBridge) Write(p []byte) (n int, err error) {
+	return b.UDPConn.WriteToUDP(p, b.relayAddr())
+}
+
+func (b *udpBridge) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, _, _, err = b.read(p, nil)
+	return n, b.remoteAddr.AddrPort(), err
+}
+
+func (b *udpBridge) WriteTo(p []byte, addr string) (n int, err error) {
+	return b.Write(p)
+}
+
+// ReadMsgUDP implements quic.OOBCapablePacketConn.
+func (b *udpBridge) ReadMsgUDP(p []byte, oob []byte) (n int, oobn int, flags int, addr *net.UDPAddr, err error) {
+	n, oobn, flags, err = b.read(p, oob)
+	return n, oobn, flags, b.remoteAddr, err
+}
+
+// WriteMsgUDP implements quic.OOBCapablePacketConn.
+func (b *udpBridge) WriteMsgUDP(p []byte, oob []byte, addr *net.UDPAddr) (n int, oobn int, err error) {
+	return b.UDPConn.WriteMsgUDP(p, oob, b.relayAddr())
+}
+
+func (b *udpBridge) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		err = b.UDPConn.Close()
+		_ = b.relay.Close()
+		_ = b.remote.Close()
+	})
+	return err
+}
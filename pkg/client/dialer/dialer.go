@@ -8,7 +8,17 @@ import (
 	"github.com/juicity/juicity/config"
 )
 
-var protectPath string
+var (
+	protectPath string
+	protector   func(fd int) error
+)
+
+// SetProtector sets the function to protect sockets to the server from being
+// routed back into a VPN, e.g. VpnService.protect on Android. It takes
+// precedence over protect_path.
+func SetProtector(f func(fd int) error) {
+	protector = f
+}
 
 type clientDialer struct {
 	netproxy.Dialer
@@ -25,7 +35,7 @@ func NewClientDialer(conf *config.Config) *clientDialer {
 func (c *clientDialer) Dial(network string, addr string) (netproxy.Conn, error) {
 	if runtime.GOOS == "android" || runtime.GOOS == "linux" {
 		protectPath = c.conf.ProtectPath
-		if protectPath != "" {
+		if protectPath != "" || protector != nil {
 			// Use SoMark func
 			magicNetwork := netproxy.MagicNetwork{
 				Network: "udp",
@@ -10,7 +10,7 @@ import (
 func init() {
 	soMark := netproxy.SoMark
 	netproxy.SoMark = func(fd, mark int) error {
-		if protectPath == "" {
+		if protectPath == "" && protector == nil {
 			return soMark(fd, mark)
 		}
 		if err := protect(fd, protectPath); err != nil {
@@ -20,7 +20,7 @@ func init() {
 	}
 	soMarkControl := netproxy.SoMarkControl
 	netproxy.SoMarkControl = func(c syscall.RawConn, mark int) error {
-		if protectPath == "" {
+		if protectPath == "" && protector == nil {
 			return soMarkControl(c, mark)
 		}
 		var sockOptErr error
@@ -41,6 +41,9 @@ func protect(fd int, unixPath string) error {
 	if fd <= 0 {
 		return nil
 	}
+	if protector != nil {
+		return protector(fd)
+	}
 
 	socket, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
 	if err != nil {
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultDnsUpstream = "1.1.1.1:53"
+	dnsTimeout         = 10 * time.Second
+)
+
+// dnsForwarder answers DNS queries on a local address by forwarding them
+// through the server to an upstream resolver. Queries are sent over TCP, one
+// stream each, so that no UDP association is kept per local port.
+type dnsForwarder struct {
+	logger   *log.Logger
+	dialer   netproxy.Dialer
+	upstream string
+	servers  []*dns.Server
+}
+
+func newDnsForwarder(logger *log.Logger, dialer netproxy.Dialer, listen string, upstream string) (*dnsForwarder, error) {
+	if listen == "" {
+		return nil, fmt.Errorf(`"listen" of dns is required`)
+	}
+	if upstream == "" {
+		upstream = DefaultDnsUpstream
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return nil, fmt.Errorf("parse upstream of dns: %w", err)
+	}
+	f := &dnsForwarder{
+		logger:   logger,
+		dialer:   dialer,
+		upstream: upstream,
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		f.servers = append(f.servers, &dns.Server{
+			Addr:    listen,
+			Net:     network,
+			Handler: dns.HandlerFunc(f.serveDns),
+		})
+	}
+	return f, nil
+}
+
+func (f *dnsForwarder) serveDns(w dns.ResponseWriter, req *dns.Msg) {
+	resp, err := f.exchange(req)
+	if err != nil {
+		f.logger.Debug().
+			Err(err).
+			Str("upstream", f.upstream).
+			Msg("Failed to forward dns query")
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (f *dnsForwarder) exchange(req *dns.Msg) (*dns.Msg, error) {
+	c, err := f.dialer.Dial("tcp", f.upstream)
+	if err != nil {
+		return nil, err
+	}
+	conn := &dns.Conn{Conn: &netproxy.FakeNetConn{Conn: c}}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if err = conn.WriteMsg(req); err != nil {
+		return nil, err
+	}
+	return conn.ReadMsg()
+}
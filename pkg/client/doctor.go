@@ -0,0 +1,286 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/juicity/juicity/common"
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/client/dialer"
+	"github.com/juicity/juicity/server"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/mzz2017/quic-go"
+)
+
+const (
+	doctorTimeout = 5 * time.Second
+	// certExpiryWarning is how long before the expiry of the certificate of
+	// the server the doctor warns.
+	certExpiryWarning = 14 * 24 * time.Hour
+	// quicPacketSize is the size of the UDP datagrams of the handshake of
+	// QUIC: the 1200-byte minimum payload plus the IPv6 and UDP headers.
+	quicPacketSize = 1200 + 40 + 8
+)
+
+type CheckStatus string
+
+const (
+	CheckOk   CheckStatus = "ok"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+// Check is the outcome of a diagnostic of the connectivity to the server.
+type Check struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+type doctor struct {
+	conf   *config.Config
+	checks []Check
+	// certClock is the check of the clock against the validity of the
+	// certificate, used if the server does not tell its time.
+	certClock *Check
+}
+
+func (d *doctor) add(name string, status CheckStatus, format string, a ...any) {
+	d.checks = append(d.checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, a...)})
+}
+
+// Diagnose checks the usual causes of a client failing to connect: the
+// resolution of the server, the reachability of it over UDP, the QUIC
+// handshake, the certificate, the local clock, the MTU and the credentials.
+// Checks that depend on a failed one are left out. Detours and fallbacks are
+// bypassed, so the direct path to the server is diagnosed.
+func Diagnose(ctx context.Context, conf *config.Config) []Check {
+	d := &doctor{conf: conf}
+	if err := resolveSecrets(conf); err != nil {
+		d.add("config", CheckFail, "%v", err)
+		return d.checks
+	}
+	tlsConfig, err := newTlsConfig(conf)
+	if err != nil {
+		d.add("config", CheckFail, "%v", err)
+		return d.checks
+	}
+	if len(conf.Detour) > 0 || conf.Fallback != nil {
+		d.add("config", CheckWarn, "detour and fallback are bypassed by the doctor")
+	}
+
+	host, port, err := net.SplitHostPort(conf.Server)
+	if err != nil {
+		d.add("resolve", CheckFail, "invalid server %v: %v", conf.Server, err)
+		return d.checks
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		d.add("resolve", CheckFail, "cannot resolve %v: %v", host, err)
+		return d.checks
+	}
+	addr, err := netip.ParseAddrPort(net.JoinHostPort(addrs[0].Unmap().String(), port))
+	if err != nil {
+		d.add("resolve", CheckFail, "invalid server %v: %v", conf.Server, err)
+		return d.checks
+	}
+	d.add("resolve", CheckOk, "%v is %v", host, addr.Addr())
+
+	// Handshake without verification to diagnose the certificate after.
+	handshakeTls := tlsConfig.Clone()
+	handshakeTls.InsecureSkipVerify = true
+	handshakeTls.VerifyPeerCertificate = nil
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		d.add("udp", CheckFail, "%v", err)
+		return d.checks
+	}
+	defer udpConn.Close()
+	dialCtx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := quic.Dial(dialCtx, udpConn, net.UDPAddrFromAddrPort(addr), handshakeTls, &quic.Config{
+		HandshakeIdleTimeout: doctorTimeout,
+	})
+	if err != nil {
+		var idle *quic.IdleTimeoutError
+		var handshake *quic.HandshakeTimeoutError
+		if errors.As(err, &idle) || errors.As(err, &handshake) || errors.Is(err, context.DeadlineExceeded) {
+			d.add("udp", CheckFail, "no reply from %v over UDP in %v: UDP is blocked on the way, or the server is down", addr, doctorTimeout)
+		} else {
+			d.add("udp", CheckOk, "%v replied", addr)
+			d.add("quic", CheckFail, "handshake failed: %v", err)
+		}
+		return d.checks
+	}
+	handshakeTime := time.Since(start)
+	state := conn.ConnectionState().TLS
+	_ = conn.CloseWithError(0, "")
+	d.add("udp", CheckOk, "%v replied", addr)
+	d.add("quic", CheckOk, "handshake in %v", handshakeTime.Round(time.Millisecond))
+
+	d.checkCertificate(state.PeerCertificates)
+	d.checkMtu(addr)
+	if pd := d.checkAuth(tlsConfig); pd != nil {
+		d.checkClock(pd)
+	} else if d.certClock != nil {
+		d.checks = append(d.checks, *d.certClock)
+	}
+	return d.checks
+}
+
+func (d *doctor) checkCertificate(chain []*x509.Certificate) {
+	if len(chain) == 0 {
+		d.add("certificate", CheckFail, "the server sent no certificate")
+		return
+	}
+	leaf := chain[0]
+	now := time.Now()
+	// A certificate that is not yet valid is usually a clock behind.
+	switch {
+	case now.Before(leaf.NotBefore):
+		d.certClock = &Check{"clock", CheckFail, fmt.Sprintf("local time %v is before the certificate is valid (%v): the local clock is likely behind", now.Format(time.RFC3339), leaf.NotBefore.Format(time.RFC3339))}
+	case now.After(leaf.NotAfter):
+		d.certClock = &Check{"clock", CheckWarn, fmt.Sprintf("local time %v is after the certificate expired (%v): the certificate expired or the local clock is ahead", now.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))}
+	default:
+		d.certClock = &Check{"clock", CheckOk, fmt.Sprintf("local time %v is within the validity of the certificate", now.Format(time.RFC3339))}
+	}
+
+	remaining := leaf.NotAfter.Sub(now)
+	switch {
+	case d.conf.PinnedCertChainSha256 != "":
+		raw := make([][]byte, 0, len(chain))
+		for _, cert := range chain {
+			raw = append(raw, cert.Raw)
+		}
+		pinned, _ := decodeCertChainHash(d.conf.PinnedCertChainSha256)
+		if !bytes.Equal(common.GenerateCertChainHash(raw), pinned) {
+			d.add("certificate", CheckFail, "the chain does not match pinned_certchain_sha256: the certificate was renewed, or the connection is intercepted")
+			return
+		}
+		d.add("certificate", CheckOk, "the chain matches pinned_certchain_sha256")
+	case d.conf.AllowInsecure:
+		d.add("certificate", CheckWarn, "not verified because of allow_insecure")
+		return
+	default:
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       d.conf.Sni,
+			Intermediates: intermediates,
+		}); err != nil {
+			d.add("certificate", CheckFail, "%v", err)
+			return
+		}
+		d.add("certificate", CheckOk, "valid for %v", d.conf.Sni)
+	}
+	if remaining < certExpiryWarning {
+		d.add("certificate", CheckWarn, "expires in %v days (%v)", int(remaining.Hours()/24), leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// checkMtu checks the MTU of the interface towards the server. The
+// handshake already proved that full-size QUIC packets get through.
+func (d *doctor) checkMtu(addr netip.AddrPort) {
+	ifi := interfaceTowards(addr)
+	if ifi == nil {
+		d.add("mtu", CheckOk, "packets of the handshake got through")
+		return
+	}
+	if ifi.MTU < quicPacketSize {
+		d.add("mtu", CheckWarn, "MTU %v of %v is below %v, which QUIC packets need", ifi.MTU, ifi.Name, quicPacketSize)
+		return
+	}
+	d.add("mtu", CheckOk, "MTU %v of %v; packets of the handshake got through", ifi.MTU, ifi.Name)
+}
+
+// interfaceTowards returns the interface routing to addr, if known.
+func interfaceTowards(addr netip.AddrPort) *net.Interface {
+	// Connecting a UDP socket sends nothing but picks the local address.
+	c, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return nil
+	}
+	local := c.LocalAddr().(*net.UDPAddr)
+	_ = c.Close()
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i := range ifis {
+		addrs, _ := ifis[i].Addrs()
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(local.IP) {
+				return &ifis[i]
+			}
+		}
+	}
+	return nil
+}
+
+// checkAuth pings the heartbeat of the server, which only answers
+// authenticated clients, and returns the dialer if it did.
+func (d *doctor) checkAuth(tlsConfig *tls.Config) netproxy.Dialer {
+	header := protocol.Header{
+		ProxyAddress: d.conf.Server,
+		Feature1:     d.conf.CongestionControl,
+		User:         d.conf.Uuid,
+		Password:     d.conf.Password,
+		TlsConfig:    tlsConfig,
+		IsClient:     true,
+	}
+	pd, err := juicity.NewDialer(dialer.NewClientDialer(d.conf), header)
+	if err != nil {
+		d.add("auth", CheckFail, "%v", err)
+		return nil
+	}
+	stream, err := pd.Dial("tcp", net.JoinHostPort(server.HeartbeatHostname, "0"))
+	if err != nil {
+		d.add("auth", CheckFail, "%v", err)
+		return nil
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(doctorTimeout))
+	if _, err = stream.Write(server.EncodeHeartbeat(1, 0)); err == nil {
+		_, err = io.ReadFull(stream, make([]byte, server.HeartbeatPongSize))
+	}
+	if err != nil {
+		d.add("auth", CheckFail, "the server did not answer a heartbeat: uuid or password is likely wrong, or the server is too old (%v)", err)
+		return nil
+	}
+	d.add("auth", CheckOk, "authenticated as %v", d.conf.Uuid)
+	return pd
+}
+
+// checkClock compares the local clock with the time of the server, or with
+// the validity of the certificate if the server does not tell it.
+func (d *doctor) checkClock(dialer netproxy.Dialer) {
+	maxSkew := DefaultMaxClockSkew
+	if clk, err := newClock(nil, d.conf.MaxClockSkew); err == nil {
+		maxSkew = clk.maxSkew
+	}
+	skew, err := measureClockSkew(dialer)
+	switch {
+	case err != nil:
+		if d.certClock != nil {
+			d.checks = append(d.checks, *d.certClock)
+		}
+	case skew.Abs() > maxSkew:
+		d.add("clock", CheckWarn, "the local clock is %v %v the server", skew.Abs().Round(time.Second), aheadOrBehind(skew))
+	default:
+		d.add("clock", CheckOk, "the local clock is %v %v the server", skew.Abs().Round(time.Millisecond), aheadOrBehind(skew))
+	}
+}
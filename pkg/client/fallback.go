@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/fallback"
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+const (
+	// fallbackRetryInterval is how long the client keeps to the fallback
+	// before trying UDP again for new connections to the server.
+	fallbackRetryInterval = 5 * time.Minute
+	fallbackDialTimeout   = 10 * time.Second
+)
+
+// fallbackTransport decides whether QUIC to the server is carried by UDP or
+// by the fallback over TCP. In auto mode, it switches to the fallback once a
+// handshake over UDP times out or is rejected.
+type fallbackTransport struct {
+	logger    *log.Logger
+	always    bool
+	server    string
+	path      string
+	tlsConfig *tls.Config
+
+	mu        sync.Mutex
+	streamEnd time.Time
+}
+
+func newFallbackTransport(logger *log.Logger, conf *config.Config, tlsConfig *tls.Config) (*fallbackTransport, error) {
+	f := &fallbackTransport{
+		logger: logger,
+		server: conf.Fallback.Server,
+		path:   conf.Fallback.Path,
+	}
+	switch conf.Fallback.Mode {
+	case "", "auto":
+	case "always":
+		f.always = true
+	default:
+		return nil, fmt.Errorf("unexpected mode of fallback: %v", conf.Fallback.Mode)
+	}
+	if f.server == "" {
+		f.server = conf.Server
+	}
+	f.tlsConfig = tlsConfig.Clone()
+	f.tlsConfig.NextProtos = []string{fallback.NextProto}
+	return f, nil
+}
+
+func (f *fallbackTransport) useStream() bool {
+	if f.always {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Now().Before(f.streamEnd)
+}
+
+// udpBlocked switches new connections to the server to the fallback for a
+// while.
+func (f *fallbackTransport) udpBlocked() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Now().Before(f.streamEnd) {
+		return
+	}
+	f.streamEnd = time.Now().Add(fallbackRetryInterval)
+	f.logger.Warn().
+		Str("fallback", f.server).
+		Msg("UDP to the server seems blocked; falling back to TCP")
+}
+
+// underlay returns the dialer of the server, carrying UDP by the fallback
+// when needed.
+func (f *fallbackTransport) underlay(d netproxy.Dialer) netproxy.Dialer {
+	return &fallbackDialer{Dialer: d, f: f}
+}
+
+// watch returns d detecting QUIC handshakes over UDP failing as blocked.
+func (f *fallbackTransport) watch(d netproxy.Dialer) netproxy.Dialer {
+	return &fallbackWatchDialer{Dialer: d, f: f}
+}
+
+type fallbackDialer struct {
+	netproxy.Dialer
+	f *fallbackTransport
+}
+
+func (d *fallbackDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if magicNetwork.Network != "udp" || !d.f.useStream() {
+		return d.Dialer.Dial(network, addr)
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialStream()
+	if err != nil {
+		return nil, fmt.Errorf("dial fallback: %w", err)
+	}
+	return newUdpBridge(&fallbackPacketConn{Conn: conn, remoteAddr: remoteAddr.AddrPort()}, addr, remoteAddr)
+}
+
+func (d *fallbackDialer) dialStream() (fallback.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fallbackDialTimeout)
+	defer cancel()
+	conn, err := d.Dialer.Dial("tcp", d.f.server)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(&netproxy.FakeNetConn{
+		Conn:  conn,
+		LAddr: &net.TCPAddr{},
+		RAddr: &net.TCPAddr{},
+	}, d.f.tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if d.f.path == "" {
+		return fallback.NewFrameConn(tlsConn), nil
+	}
+	ws, err := fallback.DialWs(ctx, tlsConn, d.f.server, d.f.path)
+	if err != nil {
+		_ = tlsConn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+type fallbackWatchDialer struct {
+	netproxy.Dialer
+	f *fallbackTransport
+}
+
+func (d *fallbackWatchDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err != nil && isUdpBlocked(err) && !d.f.useStream() {
+		d.f.udpBlocked()
+	}
+	return conn, err
+}
+
+// isUdpBlocked reports whether the handshake failed because UDP is dropped or
+// rejected on the way to the server.
+func isUdpBlocked(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// QUIC reports socket errors by message only.
+	return errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), syscall.ECONNREFUSED.Error())
+}
+
+// fallbackPacketConn is the netproxy.PacketConn of a fallback stream to the
+// server.
+type fallbackPacketConn struct {
+	fallback.Conn
+	remoteAddr netip.AddrPort
+}
+
+func (c *fallbackPacketConn) Read(p []byte) (n int, err error) {
+	return c.Conn.ReadDatagram(p)
+}
+
+func (c *fallbackPacketConn) Write(p []byte) (n int, err error) {
+	if err = c.Conn.WriteDatagram(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *fallbackPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, err = c.Conn.ReadDatagram(p)
+	return n, c.remoteAddr, err
+}
+
+func (c *fallbackPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	return c.Write(p)
+}
+
+// The bridge reading and writing the stream needs no deadlines.
+
+func (c *fallbackPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fallbackPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fallbackPacketConn) SetWriteDeadline(t time.Time) error { return nil }
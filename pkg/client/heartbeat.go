@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/server"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+const (
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultHeartbeatTimeout  = 10 * time.Second
+)
+
+// heartbeat pings the server over a stream of the current connection and
+// measures the round-trip time. A connection whose pings stall is rebuilt by
+// closing its socket, even if QUIC has not timed it out yet, as happens on
+// paths that silently broke, e.g. after a NAT rebinding of a mobile network.
+// The pings go over a bidirectional stream, which the server echoes on.
+type heartbeat struct {
+	logger   *log.Logger
+	interval time.Duration
+	timeout  time.Duration
+	rtt      atomic.Int64
+
+	mu sync.Mutex
+	// conn is the socket of the current connection to the server.
+	conn netproxy.Conn
+}
+
+func newHeartbeat(logger *log.Logger, conf *config.Heartbeat) (*heartbeat, error) {
+	h := &heartbeat{
+		logger:   logger,
+		interval: DefaultHeartbeatInterval,
+		timeout:  DefaultHeartbeatTimeout,
+	}
+	var err error
+	if conf.Interval != "" {
+		if h.interval, err = time.ParseDuration(conf.Interval); err != nil || h.interval <= 0 {
+			return nil, fmt.Errorf("invalid interval of heartbeat: %v", conf.Interval)
+		}
+	}
+	if conf.Timeout != "" {
+		if h.timeout, err = time.ParseDuration(conf.Timeout); err != nil || h.timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout of heartbeat: %v", conf.Timeout)
+		}
+	}
+	return h, nil
+}
+
+// underlay returns the dialer of the server keeping track of the socket of
+// the current connection.
+func (h *heartbeat) underlay(d netproxy.Dialer) netproxy.Dialer {
+	return &heartbeatUnderlay{Dialer: d, h: h}
+}
+
+// Rtt returns the round-trip time of the latest successful ping.
+func (h *heartbeat) Rtt() time.Duration {
+	return time.Duration(h.rtt.Load())
+}
+
+// run pings the server through d every interval until ctx is done. Nothing is
+// sent before the first connection to the server.
+func (h *heartbeat) run(ctx context.Context, d netproxy.Dialer) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	var (
+		stream     netproxy.Conn
+		streamConn netproxy.Conn
+		nonce      uint64
+		// rebuilding is set once a connection stalled, so that the next
+		// stream dials a new one instead of waiting for other traffic.
+		rebuilding bool
+	)
+	defer func() {
+		if stream != nil {
+			_ = stream.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.mu.Lock()
+		conn := h.conn
+		h.mu.Unlock()
+		if conn == nil && !rebuilding {
+			continue
+		}
+		if stream == nil || streamConn != conn {
+			if stream != nil {
+				_ = stream.Close()
+			}
+			var err error
+			if stream, err = d.Dial("tcp", net.JoinHostPort(server.HeartbeatHostname, "0")); err != nil {
+				h.logger.Debug().
+					Err(err).
+					Msg("Failed to open the heartbeat stream")
+				stream = nil
+				continue
+			}
+			h.mu.Lock()
+			conn = h.conn
+			h.mu.Unlock()
+			streamConn = conn
+			rebuilding = false
+		}
+		nonce++
+		rtt, err := h.ping(stream, nonce)
+		if err == nil {
+			h.rtt.Store(int64(rtt))
+			continue
+		}
+		_ = stream.Close()
+		stream = nil
+		h.mu.Lock()
+		stalled := h.conn == conn
+		if stalled {
+			h.conn = nil
+		}
+		h.mu.Unlock()
+		if stalled {
+			rebuilding = true
+			h.logger.Warn().
+				Err(err).
+				Msg("Heartbeat stalled; rebuilding the connection to the server")
+			_ = conn.Close()
+		}
+	}
+}
+
+func (h *heartbeat) ping(stream netproxy.Conn, nonce uint64) (time.Duration, error) {
+	start := time.Now()
+	_ = stream.SetDeadline(start.Add(h.timeout))
+	if _, err := stream.Write(server.EncodeHeartbeat(nonce, h.Rtt())); err != nil {
+		return 0, err
+	}
+	b := make([]byte, server.HeartbeatPongSize)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint64(b) != nonce {
+		return 0, fmt.Errorf("unexpected heartbeat nonce")
+	}
+	return time.Since(start), nil
+}
+
+type heartbeatUnderlay struct {
+	netproxy.Dialer
+	h *heartbeat
+}
+
+func (d *heartbeatUnderlay) Dial(network string, addr string) (netproxy.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err == nil {
+		if magicNetwork, _ := netproxy.ParseMagicNetwork(network); magicNetwork != nil && magicNetwork.Network == "udp" {
+			d.h.mu.Lock()
+			d.h.conn = conn
+			d.h.mu.Unlock()
+		}
+	}
+	return conn, err
+}
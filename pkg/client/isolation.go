@@ -0,0 +1,302 @@
+package client
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"golang.org/x/net/publicsuffix"
+)
+
+// maxIsolatedUsers bounds the dialers kept for SOCKS users. The dialer of the
+// least recently seen user is closed beyond, with the streams still open
+// through it.
+const maxIsolatedUsers = 256
+
+var errIsolationClosed = fmt.Errorf("isolated dialer closed")
+
+// isolation gives each SOCKS user, or each destination site, a dialer of the
+// server of its own, so that their streams never share a connection, like
+// the IsolateSOCKSAuth and IsolateDestAddr of Tor.
+type isolation struct {
+	// proxy is the dialer of the server for the listeners, isolating
+	// destinations if enabled.
+	proxy netproxy.Dialer
+	// newDialer returns a dialer of the server of its own, and the closer
+	// of its connections.
+	newDialer func() (netproxy.Dialer, io.Closer, error)
+	// destinations is set if sites are isolated.
+	destinations bool
+	max          int
+
+	mu      sync.Mutex
+	closed  bool
+	dialers map[string]*list.Element
+	// lru holds the keyedDialers, most recently used first.
+	lru *list.List
+}
+
+type keyedDialer struct {
+	key string
+	netproxy.Dialer
+	closer io.Closer
+}
+
+// newIsolation isolates SOCKS users from the shared dialer if
+// maxDestinations is zero, and destination sites as well otherwise, keeping
+// the dialers of as many.
+func newIsolation(shared netproxy.Dialer, newDialer func() (netproxy.Dialer, io.Closer, error), maxDestinations int) *isolation {
+	i := &isolation{
+		proxy:        shared,
+		newDialer:    newDialer,
+		destinations: maxDestinations > 0,
+		max:          maxIsolatedUsers,
+		dialers:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+	if i.destinations {
+		i.max = maxDestinations
+		i.proxy = &isolatedDialer{i: i}
+	}
+	return i
+}
+
+// isolate returns the dialer of the user in place of the dialer of the
+// server, also within dialers routing by targets. Other dialers, e.g. direct
+// ones of routing, are returned as they are.
+func (i *isolation) isolate(user string, d netproxy.Dialer) netproxy.Dialer {
+	if routed, ok := d.(*routedDialer); ok {
+		isolated := *routed
+		isolated.proxy = i.isolate(user, routed.proxy)
+		return &isolated
+	}
+	if d != i.proxy {
+		return d
+	}
+	return &isolatedDialer{i: i, user: user}
+}
+
+// dialerOf returns the dialer of the key, creating it if missing.
+func (i *isolation) dialerOf(key string) netproxy.Dialer {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return &failedDialer{err: errIsolationClosed}
+	}
+	if e, ok := i.dialers[key]; ok {
+		i.lru.MoveToFront(e)
+		return e.Value.(*keyedDialer)
+	}
+	d, closer, err := i.newDialer()
+	if err != nil {
+		// Never fall back to a shared dialer, which would link the key to
+		// others.
+		return &failedDialer{err: err}
+	}
+	e := i.lru.PushFront(&keyedDialer{key: key, Dialer: d, closer: closer})
+	i.dialers[key] = e
+	if i.lru.Len() > i.max {
+		oldest := i.lru.Remove(i.lru.Back()).(*keyedDialer)
+		delete(i.dialers, oldest.key)
+		go oldest.closer.Close()
+	}
+	return e.Value.(*keyedDialer)
+}
+
+// close closes the dialers of all keys. Dials fail afterwards.
+func (i *isolation) close() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.closed = true
+	for e := i.lru.Front(); e != nil; e = e.Next() {
+		go e.Value.(*keyedDialer).closer.Close()
+	}
+	i.lru.Init()
+	clear(i.dialers)
+}
+
+// isolatedDialer dials through the dialer of its user and, if destinations
+// are isolated, of the site of the target.
+type isolatedDialer struct {
+	i    *isolation
+	user string
+}
+
+func (d *isolatedDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	key := d.user
+	if d.i.destinations {
+		key += "\x00" + siteOf(addr)
+	}
+	return d.i.dialerOf(key).Dial(network, addr)
+}
+
+// siteOf returns the registrable domain of the host of addr, e.g. example.com
+// for www.example.com:443, or the host if it has none, e.g. an IP.
+func siteOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if site, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return site
+	}
+	return host
+}
+
+type failedDialer struct {
+	err error
+}
+
+func (d *failedDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	return nil, d.err
+}
+
+// underlaySockets tracks the sockets that a dialer of the server opens
+// through the underlay, so that its QUIC connections can be ended: the
+// juicity dialer of softwind has no Close, and keeps its connections alive
+// forever.
+type underlaySockets struct {
+	netproxy.Dialer
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[*trackedPacketConn]struct{}
+}
+
+func newUnderlaySockets(underlay netproxy.Dialer) *underlaySockets {
+	return &underlaySockets{Dialer: underlay, conns: map[*trackedPacketConn]struct{}{}}
+}
+
+func (u *underlaySockets) Dial(network string, addr string) (netproxy.Conn, error) {
+	conn, err := u.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(netproxy.PacketConn)
+	if !ok {
+		// QUIC only dials packet conns.
+		return conn, nil
+	}
+	tracked := &trackedPacketConn{PacketConn: pc, sockets: u}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		_ = pc.Close()
+		return nil, errIsolationClosed
+	}
+	u.conns[tracked] = struct{}{}
+	return tracked, nil
+}
+
+// Close closes the sockets, which ends the QUIC connections over them, and
+// fails the sockets dialed afterwards.
+func (u *underlaySockets) Close() error {
+	u.mu.Lock()
+	u.closed = true
+	conns := make([]*trackedPacketConn, 0, len(u.conns))
+	for conn := range u.conns {
+		conns = append(conns, conn)
+	}
+	clear(u.conns)
+	u.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.PacketConn.Close()
+	}
+	return nil
+}
+
+// trackedPacketConn passes the methods of *net.UDPConn that quic-go asks
+// the socket for through, so that it keeps its batching, ECN and buffers.
+type trackedPacketConn struct {
+	netproxy.PacketConn
+	sockets *underlaySockets
+}
+
+func (c *trackedPacketConn) Close() error {
+	c.sockets.mu.Lock()
+	delete(c.sockets.conns, c)
+	c.sockets.mu.Unlock()
+	return c.PacketConn.Close()
+}
+
+// udpConn is the part of *net.UDPConn that quic-go uses.
+type udpConn interface {
+	ReadMsgUDP(b []byte, oob []byte) (n int, oobn int, flags int, addr *net.UDPAddr, err error)
+	WriteMsgUDP(b []byte, oob []byte, addr *net.UDPAddr) (n int, oobn int, err error)
+	SetReadBuffer(size int) error
+	SetWriteBuffer(size int) error
+	SyscallConn() (syscall.RawConn, error)
+}
+
+func (c *trackedPacketConn) udpConn() (udpConn, error) {
+	conn, ok := c.PacketConn.(udpConn)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a udp socket", c.PacketConn)
+	}
+	return conn, nil
+}
+
+func (c *trackedPacketConn) ReadMsgUDP(b []byte, oob []byte) (n int, oobn int, flags int, addr *net.UDPAddr, err error) {
+	conn, err := c.udpConn()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	return conn.ReadMsgUDP(b, oob)
+}
+
+func (c *trackedPacketConn) WriteMsgUDP(b []byte, oob []byte, addr *net.UDPAddr) (n int, oobn int, err error) {
+	conn, err := c.udpConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	return conn.WriteMsgUDP(b, oob, addr)
+}
+
+func (c *trackedPacketConn) SetReadBuffer(size int) error {
+	conn, err := c.udpConn()
+	if err != nil {
+		return err
+	}
+	return conn.SetReadBuffer(size)
+}
+
+func (c *trackedPacketConn) SetWriteBuffer(size int) error {
+	conn, err := c.udpConn()
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteBuffer(size)
+}
+
+func (c *trackedPacketConn) SyscallConn() (syscall.RawConn, error) {
+	conn, err := c.udpConn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.SyscallConn()
+}
+
+// juicityCloser closes a juicity dialer of the server by its underlay
+// sockets.
+type juicityCloser struct {
+	dialer  netproxy.Dialer
+	sockets *underlaySockets
+}
+
+func (c *juicityCloser) Close() error {
+	_ = c.sockets.Close()
+	// The authentication of softwind waits for underlay udp sessions until
+	// its client is cancelled, which only a failed write does: an underlay
+	// session on the closed connection ends it.
+	if conn, err := c.dialer.Dial("udp", "0.0.0.0:0"); err == nil {
+		_ = conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol/direct"
+)
+
+type countingCloser struct {
+	closed atomic.Int32
+}
+
+func (c *countingCloser) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+func TestIsolationEviction(t *testing.T) {
+	var closers []*countingCloser
+	i := newIsolation(&failedDialer{}, func() (netproxy.Dialer, io.Closer, error) {
+		closer := &countingCloser{}
+		closers = append(closers, closer)
+		return &failedDialer{}, closer, nil
+	}, 0)
+	i.max = 2
+	i.dialerOf("a")
+	i.dialerOf("b")
+	i.dialerOf("a")
+	i.dialerOf("c")
+	if len(closers) != 3 {
+		t.Fatalf("got %v dialers, want 3", len(closers))
+	}
+	// b is the least recently used.
+	if !eventually(func() bool { return closers[1].closed.Load() == 1 }) || closers[0].closed.Load() != 0 {
+		t.Fatalf("got closes %v and %v of a and b, want 0 and 1", closers[0].closed.Load(), closers[1].closed.Load())
+	}
+	i.close()
+	for key, closer := range closers {
+		if !eventually(func() bool { return closer.closed.Load() == 1 }) {
+			t.Errorf("dialer %v closed %v times, want once", key, closer.closed.Load())
+		}
+	}
+	if _, err := i.dialerOf("a").Dial("udp", "127.0.0.1:53"); err != errIsolationClosed {
+		t.Errorf("got %v after close, want %v", err, errIsolationClosed)
+	}
+}
+
+func TestUnderlaySockets(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	sockets := newUnderlaySockets(direct.SymmetricDirect)
+	dial := func() (netproxy.Conn, error) { return sockets.Dial("udp", peer.LocalAddr().String()) }
+	closed, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := closed.(netproxy.PacketConn); !ok {
+		t.Fatalf("got %T, want a netproxy.PacketConn", closed)
+	}
+	_ = closed.Close()
+	open, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets.conns) != 1 {
+		t.Fatalf("got %v sockets tracked, want 1", len(sockets.conns))
+	}
+	_ = sockets.Close()
+	if _, err = open.Write([]byte("x")); err == nil {
+		t.Error("got no error writing a closed socket")
+	}
+	if _, err = dial(); err != errIsolationClosed {
+		t.Errorf("got %v dialing after close, want %v", err, errIsolationClosed)
+	}
+}
+
+// eventually waits up to a second for cond, which closers satisfy in the
+// background.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+const (
+	DefaultNatKeepaliveInterval = 3 * time.Second
+	// natKeepaliveStable is how long the server must keep replying before the
+	// interval backs off.
+	natKeepaliveStable = 2 * time.Minute
+	// natKeepaliveSilence is how long the server must be silent for the path
+	// to be deemed broken: three keep-alives of QUIC without a reply.
+	natKeepaliveSilence = 15 * time.Second
+	// natKeepaliveMaxSize keeps the datagrams shorter than a short header
+	// with the 4-byte connection ID of the server, so that QUIC drops them
+	// before looking up any connection.
+	natKeepaliveMaxSize = 4
+)
+
+// natKeepalive sends tiny datagrams on the sockets to the server whenever
+// nothing else was sent for the interval, keeping the bindings of NATs that
+// expire faster than the keep-alives of QUIC. The datagrams carry the fixed
+// bit of QUIC so that the server drops them silently.
+//
+// While the server keeps replying, the interval grows by half every
+// natKeepaliveStable up to the maximum. Once the server is silent for
+// natKeepaliveSilence, the binding likely expired: the interval falls back to
+// the minimum and never grows to the one that failed again.
+type natKeepalive struct {
+	logger *log.Logger
+	min    time.Duration
+
+	mu       sync.Mutex
+	interval time.Duration
+	max      time.Duration
+	// stableSince is when the interval last changed or the path was last
+	// silent.
+	stableSince time.Time
+}
+
+func newNatKeepalive(logger *log.Logger, conf *config.NatKeepalive) (*natKeepalive, error) {
+	k := &natKeepalive{
+		logger: logger,
+		min:    DefaultNatKeepaliveInterval,
+	}
+	var err error
+	if conf.Interval != "" {
+		if k.min, err = time.ParseDuration(conf.Interval); err != nil || k.min <= 0 {
+			return nil, fmt.Errorf("invalid interval of nat_keepalive: %v", conf.Interval)
+		}
+	}
+	k.max = k.min
+	if conf.MaxInterval != "" {
+		if k.max, err = time.ParseDuration(conf.MaxInterval); err != nil || k.max < k.min {
+			return nil, fmt.Errorf("invalid max_interval of nat_keepalive: %v", conf.MaxInterval)
+		}
+	}
+	k.interval = k.min
+	k.stableSince = time.Now()
+	return k, nil
+}
+
+// underlay returns the dialer of the server keeping its sockets alive.
+func (k *natKeepalive) underlay(d netproxy.Dialer) netproxy.Dialer {
+	return &natKeepaliveUnderlay{Dialer: d, k: k}
+}
+
+// Interval returns the current interval.
+func (k *natKeepalive) Interval() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.interval
+}
+
+// observe adapts the interval to how long ago the server last replied and
+// returns it.
+func (k *natKeepalive) observe(silence time.Duration) time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	switch {
+	case silence >= natKeepaliveSilence:
+		if k.interval > k.min {
+			// The last interval that kept the binding is the ceiling.
+			k.max = max(k.min, k.interval*2/3)
+			k.interval = k.min
+			k.logger.Info().
+				Dur("interval", k.interval).
+				Dur("max_interval", k.max).
+				Msg("The server went silent; sending NAT keep-alives more often")
+		}
+		k.stableSince = now
+	case k.interval < k.max && now.Sub(k.stableSince) >= natKeepaliveStable:
+		k.interval = min(k.max, k.interval*3/2)
+		k.stableSince = now
+		k.logger.Debug().
+			Dur("interval", k.interval).
+			Msg("The path is stable; sending NAT keep-alives less often")
+	}
+	return k.interval
+}
+
+// run keeps conn alive until it is closed.
+func (k *natKeepalive) run(conn *natKeepaliveConn) {
+	b := make([]byte, natKeepaliveMaxSize)
+	interval := k.Interval()
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case <-time.After(interval):
+		}
+		now := time.Now()
+		interval = k.observe(now.Sub(time.Unix(0, conn.lastRead.Load())))
+		idle := now.Sub(time.Unix(0, conn.lastWrite.Load()))
+		if idle < interval {
+			// Traffic refreshed the binding; wait for the rest of the interval.
+			interval -= idle
+			continue
+		}
+		n := 1 + rand.Intn(natKeepaliveMaxSize)
+		for i := range b[:n] {
+			b[i] = byte(rand.Uint32())
+		}
+		// A short header without the long header bit but with the fixed bit.
+		b[0] = 0x40 | b[0]&0x3f
+		if _, err := conn.natKeepaliveSocket.WriteTo(b[:n], conn.addr); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			k.logger.Debug().
+				Err(err).
+				Msg("Failed to send a NAT keep-alive")
+		}
+		conn.lastWrite.Store(time.Now().UnixNano())
+	}
+}
+
+type natKeepaliveUnderlay struct {
+	netproxy.Dialer
+	k *natKeepalive
+}
+
+func (d *natKeepaliveUnderlay) Dial(network string, addr string) (netproxy.Conn, error) {
+	conn, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(natKeepaliveSocket)
+	if magicNetwork, _ := netproxy.ParseMagicNetwork(network); !ok || magicNetwork == nil || magicNetwork.Network != "udp" {
+		return conn, nil
+	}
+	c := &natKeepaliveConn{natKeepaliveSocket: pc, addr: addr, closed: make(chan struct{})}
+	now := time.Now().UnixNano()
+	c.lastRead.Store(now)
+	c.lastWrite.Store(now)
+	go d.k.run(c)
+	return c, nil
+}
+
+// natKeepaliveSocket is a UDP socket as QUIC uses it: by the messages of
+// *net.UDPConn.
+type natKeepaliveSocket interface {
+	netproxy.PacketConn
+	ReadMsgUDP(b []byte, oob []byte) (n int, oobn int, flags int, addr *net.UDPAddr, err error)
+	WriteMsgUDP(b []byte, oob []byte, addr *net.UDPAddr) (n int, oobn int, err error)
+	SyscallConn() (syscall.RawConn, error)
+	SetReadBuffer(size int) error
+	SetWriteBuffer(size int) error
+}
+
+// natKeepaliveConn is a socket to the server recording when it was last read
+// from and written to.
+type natKeepaliveConn struct {
+	natKeepaliveSocket
+	// addr is the address of the server, which QUIC writes to.
+	addr      string
+	lastRead  atomic.Int64
+	lastWrite atomic.Int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *natKeepaliveConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, err = c.natKeepaliveSocket.ReadFrom(p)
+	if err == nil {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, addr, err
+}
+
+func (c *natKeepaliveConn) ReadMsgUDP(b []byte, oob []byte) (n int, oobn int, flags int, addr *net.UDPAddr, err error) {
+	n, oobn, flags, addr, err = c.natKeepaliveSocket.ReadMsgUDP(b, oob)
+	if err == nil {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, oobn, flags, addr, err
+}
+
+func (c *natKeepaliveConn) WriteTo(p []byte, addr string) (n int, err error) {
+	c.lastWrite.Store(time.Now().UnixNano())
+	return c.natKeepaliveSocket.WriteTo(p, addr)
+}
+
+func (c *natKeepaliveConn) WriteMsgUDP(b []byte, oob []byte, addr *net.UDPAddr) (n int, oobn int, err error) {
+	c.lastWrite.Store(time.Now().UnixNano())
+	return c.natKeepaliveSocket.WriteMsgUDP(b, oob, addr)
+}
+
+func (c *natKeepaliveConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.natKeepaliveSocket.Close()
+}
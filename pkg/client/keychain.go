@@ -0,0 +1,40 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/keychain"
+
+	"github.com/google/uuid"
+)
+
+// resolveSecrets replaces the uuid and the password of conf referring to the
+// keychain with the secrets in it.
+func resolveSecrets(conf *config.Config) error {
+	if !strings.HasPrefix(conf.Uuid, config.KeychainPrefix) && !strings.HasPrefix(conf.Password, config.KeychainPrefix) {
+		return nil
+	}
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{
+		{"uuid", &conf.Uuid},
+		{"password", &conf.Password},
+	} {
+		account, ok := strings.CutPrefix(*f.value, config.KeychainPrefix)
+		if !ok {
+			continue
+		}
+		secret, err := keychain.Get(account)
+		if err != nil {
+			return fmt.Errorf("read %v from keychain account %v: %w", f.name, account, err)
+		}
+		*f.value = secret
+	}
+	if _, err := uuid.Parse(conf.Uuid); err != nil {
+		return fmt.Errorf("invalid uuid in keychain: %w", err)
+	}
+	return nil
+}
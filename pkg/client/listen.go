@@ -0,0 +1,51 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// parseAllowedSources parses IPs and CIDRs allowed to use the local
+// listener.
+func parseAllowedSources(sources []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(sources))
+	for _, s := range sources {
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("parse listen_allow: %w", err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse listen_allow: %w", err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// isExposed reports whether the listener of the mixed url accepts
+// connections or UDP packets from other hosts without authentication. UDP is
+// only relayed for the sources of UDP associations, which are made on
+// connections authenticated like any other. A user without a password
+// authenticates nothing.
+func isExposed(u *url.URL) bool {
+	if password, ok := u.User.Password(); ok && password != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil || host == "" {
+		return true
+	}
+	if host == "localhost" {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	return err != nil || !addr.IsLoopback()
+}
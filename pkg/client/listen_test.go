@@ -0,0 +1,31 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestIsExposed(t *testing.T) {
+	for _, tc := range []struct {
+		listen  string
+		exposed bool
+	}{
+		{"127.0.0.1:1080", false},
+		{"localhost:1080", false},
+		{"[::1]:1080", false},
+		{":1080", true},
+		{"0.0.0.0:1080", true},
+		{"user:pass@0.0.0.0:1080", false},
+		// A user without a password authenticates neither TCP nor UDP.
+		{"user@0.0.0.0:1080", true},
+		{"user:@0.0.0.0:1080", true},
+	} {
+		u, err := url.Parse("mixed://" + tc.listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exposed := isExposed(u); exposed != tc.exposed {
+			t.Errorf("%v: got %v, want %v", tc.listen, exposed, tc.exposed)
+		}
+	}
+}
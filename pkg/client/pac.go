@@ -0,0 +1,106 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/juicity/juicity/config"
+)
+
+const DefaultPacPath = "/proxy.pac"
+
+const defaultPacTemplate = `function FindProxyForURL(url, host) {
+  if ({{.Bypass}}) {
+    return "DIRECT";
+  }
+  return "PROXY {{.Proxy}}; SOCKS5 {{.Proxy}}";
+}
+`
+
+// pacData is what PAC templates are executed with.
+type pacData struct {
+	// Proxy is the host:port the PAC file was requested from.
+	Proxy string
+	// Bypass is a JavaScript expression that is true for hosts to connect to
+	// directly.
+	Bypass string
+}
+
+type pac struct {
+	path     string
+	template *template.Template
+	bypass   string
+}
+
+func newPac(conf *config.Pac) (*pac, error) {
+	p := &pac{path: conf.Path}
+	if p.path == "" {
+		p.path = DefaultPacPath
+	}
+	if !strings.HasPrefix(p.path, "/") {
+		return nil, fmt.Errorf("path of pac must start with /: %v", p.path)
+	}
+	text := defaultPacTemplate
+	if conf.File != "" {
+		b, err := os.ReadFile(conf.File)
+		if err != nil {
+			return nil, fmt.Errorf("read pac file: %w", err)
+		}
+		text = string(b)
+	}
+	var err error
+	if p.template, err = template.New("pac").Parse(text); err != nil {
+		return nil, fmt.Errorf("parse pac file: %w", err)
+	}
+	if p.bypass, err = pacBypass(conf.Bypass); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pac) render(proxyAddr string) []byte {
+	var buf bytes.Buffer
+	if err := p.template.Execute(&buf, pacData{Proxy: proxyAddr, Bypass: p.bypass}); err != nil {
+		return []byte("// " + err.Error() + "\n")
+	}
+	return buf.Bytes()
+}
+
+// pacBypass translates bypass rules into a JavaScript expression. A rule is
+// "<local>" for plain host names, an IPv4 CIDR, an IP, a domain with its
+// subdomains, or a shell expression with "*".
+func pacBypass(rules []string) (string, error) {
+	if len(rules) == 0 {
+		return "false", nil
+	}
+	conditions := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		switch {
+		case rule == "<local>":
+			conditions = append(conditions, "isPlainHostName(host)")
+		case strings.Contains(rule, "/"):
+			prefix, err := netip.ParsePrefix(rule)
+			if err != nil || !prefix.Addr().Is4() {
+				return "", fmt.Errorf("pac bypass: invalid IPv4 CIDR: %v", rule)
+			}
+			mask := net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+			conditions = append(conditions, fmt.Sprintf("isInNet(host, %q, %q)", prefix.Masked().Addr(), mask))
+		case strings.Contains(rule, "*"):
+			conditions = append(conditions, "shExpMatch(host, "+strconv.Quote(rule)+")")
+		default:
+			if _, err := netip.ParseAddr(rule); err == nil {
+				conditions = append(conditions, "host == "+strconv.Quote(rule))
+				continue
+			}
+			domain := strings.TrimPrefix(rule, ".")
+			conditions = append(conditions, fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", domain, "."+domain))
+		}
+	}
+	return strings.Join(conditions, " ||\n      "), nil
+}
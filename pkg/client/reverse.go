@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/server"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/mzz2017/quic-go"
+)
+
+const (
+	// reverseStreams is the number of streams kept parked at the server for
+	// each reverse service, which bounds the connections to the service
+	// accepted at once before the client opens new ones.
+	reverseStreams = 4
+	// reverseDialTimeout bounds the dials of the local targets.
+	reverseDialTimeout = 10 * time.Second
+	reverseMaxBackoff  = 30 * time.Second
+)
+
+// reverse serves a reverse service of the server: it parks streams at the
+// server, and relays the connections to the service arriving over them to
+// the target on the local network.
+type reverse struct {
+	logger *log.Logger
+	name   string
+	target string
+	relay  relay.Relay
+}
+
+func newReverse(logger *log.Logger, name string, target string, strictHalfClose bool) (*reverse, error) {
+	if name == "" || len(name) > 255 {
+		return nil, fmt.Errorf("invalid name of reverse: %q", name)
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, fmt.Errorf("invalid target of reverse %v: %w", name, err)
+	}
+	return &reverse{
+		logger: logger,
+		name:   name,
+		target: target,
+		relay:  relay.NewRelay(logger, strictHalfClose),
+	}, nil
+}
+
+// run keeps reverseStreams streams parked through d until ctx is done.
+func (r *reverse) run(ctx context.Context, d netproxy.Dialer) {
+	r.logger.Info().Msgf("Reverse service %v of the server <-tcp-> local %v", r.name, r.target)
+	done := make(chan struct{})
+	for i := 0; i < reverseStreams; i++ {
+		go func() {
+			r.park(ctx, d)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < reverseStreams; i++ {
+		<-done
+	}
+}
+
+// park parks a stream at a time, and hands it to a relay once a connection
+// arrives over it. Failures are retried with a backoff.
+func (r *reverse) park(ctx context.Context, d netproxy.Dialer) {
+	var backoff time.Duration
+	for ctx.Err() == nil {
+		stream, err := r.wait(ctx, d)
+		if err == nil {
+			backoff = 0
+			go r.serve(stream)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		var streamErr *quic.StreamError
+		// Rejections are warned of once until a stream is parked again.
+		if errors.As(err, &streamErr) && streamErr.ErrorCode == server.StreamCodeBlocked && backoff == 0 {
+			r.logger.Warn().
+				Str("name", r.name).
+				Msg("The server rejected the reverse service; check reverse_services of the server")
+		} else {
+			r.logger.Debug().
+				Err(err).
+				Str("name", r.name).
+				Msg("Failed to park a reverse stream")
+		}
+		backoff = min(max(2*backoff, time.Second), reverseMaxBackoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// wait opens a stream for the service and waits until a connection arrives
+// over it.
+func (r *reverse) wait(ctx context.Context, d netproxy.Dialer) (netproxy.Conn, error) {
+	stream, err := d.Dial("tcp", net.JoinHostPort(server.ReverseHostname, "0"))
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = stream.Close() })
+	defer stop()
+	if _, err = stream.Write(server.EncodeReverse(r.name)); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	var b [1]byte
+	if _, err = io.ReadFull(stream, b[:]); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	if b[0] != server.ReverseReady {
+		_ = stream.Close()
+		return nil, fmt.Errorf("unexpected reverse signal: %#x", b[0])
+	}
+	return stream, nil
+}
+
+func (r *reverse) serve(stream netproxy.Conn) {
+	defer stream.Close()
+	conn, err := net.DialTimeout("tcp", r.target, reverseDialTimeout)
+	if err != nil {
+		r.logger.Warn().
+			Err(err).
+			Str("name", r.name).
+			Str("target", r.target).
+			Msg("Failed to dial the target of reverse")
+		return
+	}
+	defer conn.Close()
+	r.logger.Info().Msgf("Reverse %v <-tcp-> %v", r.name, r.target)
+	if err = r.relay.RelayTCP(stream, conn); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return
+		}
+		r.logger.Debug().
+			Err(err).
+			Str("name", r.name).
+			Msg("Reverse relay ended")
+	}
+}
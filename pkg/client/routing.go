@@ -0,0 +1,240 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/acl"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/process"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol/direct"
+)
+
+// Outbounds of routing rules.
+const (
+	OutboundProxy  = "proxy"
+	OutboundDirect = "direct"
+)
+
+type routingRule struct {
+	processes []string
+	// asns match the targets that are IPs of these autonomous systems.
+	asns     []uint32
+	outbound string
+	// dryRunUntil puts the rule in dry run until then: it is only logged.
+	dryRunUntil time.Time
+}
+
+// router chooses the outbound of the connections to the local listener by
+// the processes that opened them, and by their targets if rules match ASNs.
+type router struct {
+	logger   *log.Logger
+	rules    []routingRule
+	fallback string
+	dialers  map[string]netproxy.Dialer
+	asnDb    *acl.AsnDb
+	// byProcess and byTarget are set if any rule matches processes or
+	// targets.
+	byProcess bool
+	byTarget  bool
+}
+
+func newRouter(conf *config.Routing, asnDb *acl.AsnDb, proxy netproxy.Dialer, logger *log.Logger) (*router, error) {
+	r := &router{
+		logger:   logger,
+		fallback: OutboundProxy,
+		// The direct outbound is full-cone, since a UDP session reaches any
+		// target.
+		dialers: map[string]netproxy.Dialer{
+			OutboundProxy:  proxy,
+			OutboundDirect: direct.FullconeDirect,
+		},
+		asnDb: asnDb,
+	}
+	if conf.Default != "" {
+		r.fallback = conf.Default
+	}
+	if _, ok := r.dialers[r.fallback]; !ok {
+		return nil, fmt.Errorf("unexpected default outbound of routing: %v", conf.Default)
+	}
+	for i, rule := range conf.Rules {
+		if _, ok := r.dialers[rule.Outbound]; !ok {
+			return nil, fmt.Errorf("routing rule %v: unexpected outbound: %v", i, rule.Outbound)
+		}
+		if len(rule.Processes) == 0 && len(rule.Asns) == 0 {
+			return nil, fmt.Errorf("routing rule %v: processes or asns are required", i)
+		}
+		if len(rule.Processes) > 0 && !process.Supported {
+			return nil, fmt.Errorf("routing rule %v: processes are not supported on %v", i, runtime.GOOS)
+		}
+		if len(rule.Asns) > 0 && asnDb == nil {
+			return nil, fmt.Errorf(`routing rule %v: "asns" require "asn_db"`, i)
+		}
+		parsed := routingRule{processes: rule.Processes, outbound: rule.Outbound}
+		for _, s := range rule.Asns {
+			asn, err := acl.ParseAsn(s)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %v: %w", i, err)
+			}
+			parsed.asns = append(parsed.asns, asn)
+		}
+		if rule.DryRun != "" {
+			dryRun, err := time.ParseDuration(rule.DryRun)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %v: parse dry_run: %w", i, err)
+			}
+			parsed.dryRunUntil = time.Now().Add(dryRun)
+		}
+		r.byProcess = r.byProcess || len(parsed.processes) > 0
+		r.byTarget = r.byTarget || len(parsed.asns) > 0
+		r.rules = append(r.rules, parsed)
+	}
+	return r, nil
+}
+
+// route returns the dialer for a connection or a UDP session from the
+// source. If rules match targets, the dialer routes each dial by its target,
+// which is the first target of a UDP session.
+func (r *router) route(source net.Addr) netproxy.Dialer {
+	var p *process.Process
+	if r.byProcess {
+		p = r.findProcess(source)
+	}
+	if !r.byTarget {
+		return r.dialers[r.decide(source.String(), p, "")]
+	}
+	return &routedDialer{r: r, source: source.String(), process: p, proxy: r.dialers[OutboundProxy]}
+}
+
+// findProcess returns the process that opened the connection or the UDP
+// socket of the source, or nil if it is unknown.
+func (r *router) findProcess(source net.Addr) *process.Process {
+	var p *process.Process
+	var err error
+	switch source := source.(type) {
+	case *net.TCPAddr:
+		p, err = process.FindByLocalAddr("tcp", source.AddrPort())
+	case *net.UDPAddr:
+		p, err = process.FindByLocalAddr("udp", source.AddrPort())
+	default:
+		return nil
+	}
+	if err != nil {
+		r.logger.Debug().
+			Err(err).
+			Str("source", source.String()).
+			Msg("Failed to find process of connection")
+		return nil
+	}
+	return p
+}
+
+// decide returns the outbound of the connection from the source opened by
+// the process, which is nil if unknown, to the target, which is empty if
+// unknown.
+func (r *router) decide(source string, p *process.Process, target string) string {
+	outbound := r.fallback
+	dryRun := -1
+	for i, rule := range r.rules {
+		if !r.match(&rule, p, target) {
+			continue
+		}
+		if time.Now().Before(rule.dryRunUntil) {
+			if dryRun < 0 {
+				dryRun = i
+			}
+			continue
+		}
+		outbound = rule.outbound
+		break
+	}
+	var path string
+	var pid int
+	if p != nil {
+		path, pid = p.Path, p.Pid
+	}
+	if dryRun >= 0 && r.rules[dryRun].outbound != outbound {
+		r.logger.Info().
+			Int("rule", dryRun).
+			Str("source", source).
+			Str("process", path).
+			Str("target", target).
+			Str("outbound", outbound).
+			Msg("Routing rule in dry run would route to " + r.rules[dryRun].outbound)
+	}
+	r.logger.Debug().
+		Str("source", source).
+		Str("process", path).
+		Int("pid", pid).
+		Str("target", target).
+		Str("outbound", outbound).
+		Msg("Routed connection")
+	return outbound
+}
+
+// match reports whether the rule matches by all of its conditions. Targets
+// that are domains never match asns: they are not resolved locally, which
+// would leak them to the local resolver.
+func (r *router) match(rule *routingRule, p *process.Process, target string) bool {
+	if len(rule.processes) > 0 && (p == nil || !matchProcess(p, rule.processes)) {
+		return false
+	}
+	if len(rule.asns) > 0 && !r.matchAsn(rule.asns, target) {
+		return false
+	}
+	return true
+}
+
+func (r *router) matchAsn(asns []uint32, target string) bool {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return false
+	}
+	asn, ok := r.asnDb.Lookup(addr.Unmap())
+	if !ok {
+		return false
+	}
+	for _, a := range asns {
+		if a == asn {
+			return true
+		}
+	}
+	return false
+}
+
+func matchProcess(p *process.Process, patterns []string) bool {
+	for _, pattern := range patterns {
+		if p.Match(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// routedDialer routes each dial of a connection by its target.
+type routedDialer struct {
+	r       *router
+	source  string
+	process *process.Process
+	// proxy is the dialer of the server, which isolation may replace.
+	proxy netproxy.Dialer
+}
+
+func (d *routedDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	outbound := d.r.decide(d.source, d.process, addr)
+	if outbound == OutboundProxy {
+		return d.proxy.Dial(network, addr)
+	}
+	return d.r.dialers[outbound].Dial(network, addr)
+}
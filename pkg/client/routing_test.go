@@ -0,0 +1,113 @@
+//go:build !no_geodata
+
+package client
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juicity/juicity/config"
+	"github.com/juicity/juicity/pkg/acl"
+	"github.com/juicity/juicity/pkg/acl/acltest"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/process"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// namedDialer fails its dials with its name, telling which dialer was chosen.
+type namedDialer string
+
+func (d namedDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	return nil, &net.AddrError{Err: string(d), Addr: addr}
+}
+
+func dialedBy(t *testing.T, d netproxy.Dialer, addr string) string {
+	t.Helper()
+	_, err := d.Dial("tcp", addr)
+	addrErr, ok := err.(*net.AddrError)
+	if !ok {
+		t.Fatalf("got %v dialing %v", err, addr)
+	}
+	return addrErr.Err
+}
+
+func TestRoutingAsns(t *testing.T) {
+	if !process.Supported {
+		t.Skip("processes are not supported")
+	}
+	db, err := acl.OpenAsnDb(acltest.WriteAsnDb(t, netip.MustParsePrefix("1.1.1.0/24"), 13335))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r, err := newRouter(&config.Routing{Rules: []config.RoutingRule{
+		{Processes: []string{"curl"}, Asns: []string{"AS13335"}, Outbound: OutboundProxy},
+		{Asns: []string{"AS13335"}, Outbound: OutboundDirect},
+	}}, db, namedDialer(OutboundProxy), log.NewLogger(&log.Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.dialers[OutboundDirect] = namedDialer(OutboundDirect)
+	d := r.route(&net.UnixAddr{Name: "@", Net: "unix"})
+	for addr, want := range map[string]string{
+		"1.1.1.1:443":          OutboundDirect,
+		"[::ffff:1.1.1.1]:443": OutboundDirect,
+		"8.8.8.8:443":          OutboundProxy,
+		// Domains are not resolved locally.
+		"one.one.one.one:443": OutboundProxy,
+	} {
+		if got := dialedBy(t, d, addr); got != want {
+			t.Errorf("%v: got %v, want %v", addr, got, want)
+		}
+	}
+	// Rules match by all of their conditions.
+	curl := &process.Process{Pid: 1, Path: "/usr/bin/curl"}
+	if got := r.decide("", curl, "1.1.1.1:443"); got != OutboundProxy {
+		t.Errorf("got %v for curl, want %v", got, OutboundProxy)
+	}
+
+	// Isolation replaces the dialer of the server within routed dialers.
+	i := newIsolation(namedDialer(OutboundProxy), nil, 0)
+	r.dialers[OutboundProxy] = i.proxy
+	isolated := i.isolate("alice", r.route(&net.UnixAddr{Name: "@", Net: "unix"}))
+	if routed, ok := isolated.(*routedDialer); !ok || routed.proxy == i.proxy {
+		t.Errorf("got %T not isolating the dialer of the server", isolated)
+	}
+
+	if _, err = newRouter(&config.Routing{Rules: []config.RoutingRule{
+		{Asns: []string{"AS13335"}, Outbound: OutboundDirect},
+	}}, nil, namedDialer(OutboundProxy), log.NewLogger(&log.Options{})); err == nil {
+		t.Error("got no error of asns without asn_db")
+	}
+}
+
+func TestRoutingUdpProcess(t *testing.T) {
+	if !process.Supported {
+		t.Skip("processes are not supported")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRouter(&config.Routing{Rules: []config.RoutingRule{
+		{Processes: []string{filepath.Base(exe)}, Outbound: OutboundDirect},
+	}}, nil, namedDialer(OutboundProxy), log.NewLogger(&log.Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.dialers[OutboundDirect] = namedDialer(OutboundDirect)
+	// The UDP socket of a SOCKS5 client, sending to the loopback.
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: pc.LocalAddr().(*net.UDPAddr).Port}
+	if got := dialedBy(t, r.route(source), "1.1.1.1:53"); got != OutboundDirect {
+		t.Errorf("got %v, want %v", got, OutboundDirect)
+	}
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"net/netip"
+
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/stats"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// trafficDialer counts the bytes through the server. Writes are uploads and
+// reads are downloads.
+type trafficDialer struct {
+	netproxy.Dialer
+	traffic *stats.Traffic
+}
+
+func (d *trafficDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	c, err := d.Dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if pc, ok := c.(netproxy.PacketConn); ok {
+		return &trafficPacketConn{PacketConn: pc, traffic: d.traffic}, nil
+	}
+	return &trafficConn{Conn: c, traffic: d.traffic}, nil
+}
+
+func count(counter interface{ Add(uint64) uint64 }, n int) {
+	if n > 0 {
+		counter.Add(uint64(n))
+	}
+}
+
+type trafficConn struct {
+	netproxy.Conn
+	traffic *stats.Traffic
+}
+
+func (c *trafficConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	count(&c.traffic.Down, n)
+	return n, err
+}
+
+func (c *trafficConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	count(&c.traffic.Up, n)
+	return n, err
+}
+
+func (c *trafficConn) CloseWrite() error {
+	if conn, ok := c.Conn.(relay.WriteCloser); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+type trafficPacketConn struct {
+	netproxy.PacketConn
+	traffic *stats.Traffic
+}
+
+func (c *trafficPacketConn) Read(b []byte) (n int, err error) {
+	n, err = c.PacketConn.Read(b)
+	count(&c.traffic.Down, n)
+	return n, err
+}
+
+func (c *trafficPacketConn) Write(b []byte) (n int, err error) {
+	n, err = c.PacketConn.Write(b)
+	count(&c.traffic.Up, n)
+	return n, err
+}
+
+func (c *trafficPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	count(&c.traffic.Down, n)
+	return n, addr, err
+}
+
+func (c *trafficPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	count(&c.traffic.Up, n)
+	return n, err
+}
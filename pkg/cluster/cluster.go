@@ -0,0 +1,198 @@
+// Package cluster shares per-user usage among juicity-server instances that
+// serve the same users, e.g. behind DNS round-robin. Every instance polls the
+// management API of its peers, so no extra coordination service is needed.
+//
+// Polling keeps deployments simple, at the cost of usage being only as recent
+// as the last poll and of every instance polling every other one. A shared
+// store like Redis would give exact, immediate counts, but would be one more
+// service to run and a single point of failure. For the same reason, the
+// instance sending the alerts of the cluster is elected from what the polls
+// return: the live instance with the lowest id.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/stats"
+)
+
+const (
+	DefaultInterval = 5 * time.Second
+	// staleIntervals is the number of intervals after which the state of an
+	// unreachable peer is ignored.
+	staleIntervals = 3
+)
+
+type Options struct {
+	Logger *log.Logger
+	// Instance is the id of this instance, as returned by the stats of the
+	// management API, see stats.Stats.Instance.
+	Instance string
+	// Peers are the base urls of the management API of other instances,
+	// e.g. http://10.0.0.2:9101.
+	Peers []string
+	// Token is the api_token of the peers.
+	Token    string
+	Interval time.Duration
+}
+
+type peerState struct {
+	instance string
+	users    map[string]stats.UserSnapshot
+	up, down uint64
+	updated  time.Time
+}
+
+// Cluster keeps the latest per-user usage reported by every peer.
+type Cluster struct {
+	Options
+	client *http.Client
+
+	mu    sync.RWMutex
+	peers map[string]*peerState
+}
+
+func New(opts Options) (*Cluster, error) {
+	if len(opts.Peers) == 0 {
+		return nil, fmt.Errorf("cluster peers are required")
+	}
+	if opts.Instance == "" {
+		return nil, fmt.Errorf("cluster instance id is required")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	for i, peer := range opts.Peers {
+		opts.Peers[i] = strings.TrimSuffix(peer, "/")
+	}
+	return &Cluster{
+		Options: opts,
+		client:  &http.Client{Timeout: opts.Interval},
+		peers:   map[string]*peerState{},
+	}, nil
+}
+
+// Run polls the peers every interval until ctx is done.
+func (c *Cluster) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		c.Poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll fetches the state of all peers once.
+func (c *Cluster) Poll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, peer := range c.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := c.poll(ctx, peer); err != nil {
+				c.Logger.Warn().
+					Err(err).
+					Str("peer", peer).
+					Msg("Failed to poll cluster peer")
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (c *Cluster) poll(ctx context.Context, peer string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/api/v1/stats", nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %v: %v", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var snapshot stats.Snapshot
+	if err = json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return fmt.Errorf("decode stats: %w", err)
+	}
+	state := &peerState{
+		instance: snapshot.Instance,
+		users:    make(map[string]stats.UserSnapshot, len(snapshot.Users)),
+		up:       snapshot.Up,
+		down:     snapshot.Down,
+		updated:  time.Now(),
+	}
+	for _, u := range snapshot.Users {
+		state.users[u.Name] = u
+	}
+	c.mu.Lock()
+	c.peers[peer] = state
+	c.mu.Unlock()
+	return nil
+}
+
+// each calls f with the state of every peer that reported in time.
+func (c *Cluster) each(f func(state *peerState)) {
+	deadline := time.Now().Add(-staleIntervals * c.Interval)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, state := range c.peers {
+		if !state.updated.Before(deadline) {
+			f(state)
+		}
+	}
+}
+
+// Connections returns the number of connections of the user on the peers.
+func (c *Cluster) Connections(user string) (n int) {
+	c.each(func(state *peerState) {
+		n += int(state.users[user].Connections)
+	})
+	return n
+}
+
+// Traffic returns the cumulative traffic of the user on the peers, or of all
+// users if user is empty.
+func (c *Cluster) Traffic(user string) (up, down uint64) {
+	c.each(func(state *peerState) {
+		if user == "" {
+			up += state.up
+			down += state.down
+			return
+		}
+		up += state.users[user].Up
+		down += state.users[user].Down
+	})
+	return up, down
+}
+
+// Leader reports whether this instance has the lowest id of the instances
+// that reported in time, so that it alone sends the alerts of the cluster.
+// Peers of versions without an id are not candidates.
+func (c *Cluster) Leader() (leader bool) {
+	leader = true
+	c.each(func(state *peerState) {
+		if state.instance != "" && state.instance < c.Instance {
+			leader = false
+		}
+	})
+	return leader
+}
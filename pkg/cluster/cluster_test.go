@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/stats"
+)
+
+func newPeer(t *testing.T, snapshot *stats.Snapshot) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/stats" || r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(snapshot)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCluster(t *testing.T) {
+	a := newPeer(t, &stats.Snapshot{Instance: "a", Up: 1000, Down: 2000, Users: []stats.UserSnapshot{
+		{Name: "alice", Connections: 2, Up: 100, Down: 200},
+		{Name: "bob", Connections: 1, Up: 10, Down: 20},
+	}})
+	b := newPeer(t, &stats.Snapshot{Instance: "c", Up: 3000, Down: 4000, Users: []stats.UserSnapshot{
+		{Name: "alice", Connections: 1, Up: 1, Down: 2},
+	}})
+	c, err := New(Options{
+		Logger:   log.NewLogger(&log.Options{}),
+		Instance: "b",
+		Peers:    []string{a.URL + "/", b.URL},
+		Token:    "tok",
+		Interval: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Poll(context.Background())
+	if n := c.Connections("alice"); n != 3 {
+		t.Errorf("got %v connections of alice, want 3", n)
+	}
+	if n := c.Connections("carol"); n != 0 {
+		t.Errorf("got %v connections of an unknown user, want 0", n)
+	}
+	if up, down := c.Traffic("alice"); up != 101 || down != 202 {
+		t.Errorf("got %v up and %v down of alice, want 101 and 202", up, down)
+	}
+	if up, down := c.Traffic(""); up != 4000 || down != 6000 {
+		t.Errorf("got %v up and %v down in total, want 4000 and 6000", up, down)
+	}
+	if c.Leader() {
+		t.Error("got the leader, want peer a to lead")
+	}
+
+	// Peers that stopped answering are ignored once stale.
+	c.mu.Lock()
+	c.peers[a.URL].updated = time.Now().Add(-staleIntervals * c.Interval * 2)
+	c.mu.Unlock()
+	if n := c.Connections("alice"); n != 1 {
+		t.Errorf("got %v connections of alice with a stale peer, want 1", n)
+	}
+	if !c.Leader() {
+		t.Error("got no leader with the lowest id stale")
+	}
+}
+
+func TestClusterUnauthorized(t *testing.T) {
+	a := newPeer(t, &stats.Snapshot{})
+	c, err := New(Options{Logger: log.NewLogger(&log.Options{}), Instance: "a", Peers: []string{a.URL}, Token: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.poll(context.Background(), a.URL); err == nil {
+		t.Error("got no error polling with a wrong token")
+	}
+}
@@ -0,0 +1,46 @@
+// Package cpu tunes how the process uses CPUs: GOMAXPROCS, optionally bounded
+// by the CPU quota of its cgroup like automaxprocs, and the CPUs it runs on.
+// Quotas and affinity are implemented on Linux.
+package cpu
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// ProcsAuto sizes GOMAXPROCS to the CPU quota of the cgroup of the process.
+const ProcsAuto = "auto"
+
+// SetMaxProcs sets GOMAXPROCS to procs, which is a number or ProcsAuto, and
+// returns the value set. An empty procs or the GOMAXPROCS environment
+// variable leaves the default of Go.
+func SetMaxProcs(procs string) (int, error) {
+	if procs == "" || os.Getenv("GOMAXPROCS") != "" {
+		return runtime.GOMAXPROCS(0), nil
+	}
+	var n int
+	if procs == ProcsAuto {
+		quota, ok, err := cgroupQuota()
+		if err != nil {
+			return 0, fmt.Errorf("read cpu quota: %w", err)
+		}
+		if !ok {
+			return runtime.GOMAXPROCS(0), nil
+		}
+		// Round up, since a quota of 1.5 CPUs is better used by 2 threads
+		// than throttled on 1.
+		n = int(quota + 0.999)
+		if n > runtime.NumCPU() {
+			n = runtime.NumCPU()
+		}
+	} else {
+		var err error
+		if n, err = strconv.Atoi(procs); err != nil || n <= 0 {
+			return 0, fmt.Errorf("unexpected gomaxprocs: %v", procs)
+		}
+	}
+	runtime.GOMAXPROCS(n)
+	return n, nil
+}
@@ -0,0 +1,145 @@
+package cpu
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroupQuota returns the CPUs the cgroup of the process may use, as given by
+// cpu.max of cgroup v2 or the cfs quota of cgroup v1. ok is false if the
+// cgroup has no quota.
+func cgroupQuota() (quota float64, ok bool, err error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines are like "0::/system.slice/juicity.service" for v2 and
+		// "4:cpu,cpuacct:/user.slice" for v1.
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			if quota, ok, err = quotaV2(filepath.Join("/sys/fs/cgroup", fields[2])); ok || err != nil {
+				return quota, ok, err
+			}
+		case hasController(fields[1], "cpu"):
+			if quota, ok, err = quotaV1(filepath.Join("/sys/fs/cgroup", fields[1], fields[2])); ok || err != nil {
+				return quota, ok, err
+			}
+		}
+	}
+	return 0, false, scanner.Err()
+}
+
+func hasController(controllers string, name string) bool {
+	for _, c := range strings.Split(controllers, ",") {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaV2 reads cpu.max, which is like "max 100000" or "150000 100000".
+func quotaV2(dir string) (float64, bool, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "cpu.max"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Inside a namespace, the cgroup of the process is the root
+			// of the mount.
+			if b, err = os.ReadFile("/sys/fs/cgroup/cpu.max"); err != nil {
+				if os.IsNotExist(err) {
+					return 0, false, nil
+				}
+				return 0, false, err
+			}
+		} else {
+			return 0, false, err
+		}
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return 0, false, fmt.Errorf("unexpected cpu.max: %q", b)
+	}
+	if fields[0] == "max" {
+		return 0, false, nil
+	}
+	return parseQuota(fields[0], fields[1])
+}
+
+// quotaV1 reads cpu.cfs_quota_us, which is -1 without quota, and
+// cpu.cfs_period_us.
+func quotaV1(dir string) (float64, bool, error) {
+	quota, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	period, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false, err
+	}
+	if strings.TrimSpace(string(quota)) == "-1" {
+		return 0, false, nil
+	}
+	return parseQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func parseQuota(quota string, period string) (float64, bool, error) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("parse cpu quota: %w", err)
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false, fmt.Errorf("unexpected cpu period: %v", period)
+	}
+	return q / p, true, nil
+}
+
+// SetAffinity pins every thread of the process to the CPUs. Threads started
+// later inherit the affinity of the thread starting them, so the runtime
+// stays on the CPUs.
+func SetAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, c := range cpus {
+		if c < 0 || c >= len(set)*64 {
+			return fmt.Errorf("unexpected cpu: %v", c)
+		}
+		set.Set(c)
+	}
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err = unix.SchedSetaffinity(tid, &set); err != nil {
+			// The thread may have exited meanwhile.
+			if err == unix.ESRCH {
+				continue
+			}
+			return fmt.Errorf("set affinity of thread %v: %w", tid, err)
+		}
+	}
+	return nil
+}
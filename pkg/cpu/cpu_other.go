@@ -0,0 +1,18 @@
+//go:build !linux
+
+package cpu
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// cgroupQuota reports no quota, since cgroups are specific to Linux.
+func cgroupQuota() (float64, bool, error) {
+	return 0, false, nil
+}
+
+// SetAffinity is not supported on this platform.
+func SetAffinity(cpus []int) error {
+	return fmt.Errorf("cpu affinity is not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,150 @@
+// Package decode parses the messages of the juicity protocol sent by clients:
+// the authentication, the underlay authentication and the header of streams.
+// Every length is checked before it is read and buffers are bounded by the
+// protocol, so untrusted input never makes them allocate more than a few
+// hundred bytes or panic.
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/daeuniverse/softwind/protocol/trojanc"
+	"github.com/daeuniverse/softwind/protocol/tuic"
+)
+
+const (
+	// AuthenticateSize is the size of an authentication with its command head.
+	AuthenticateSize = 2 + 16 + 32
+	// MaxHostnameLength is the longest domain of a header, bounded by its
+	// 1-byte length.
+	MaxHostnameLength = 255
+	// MaxStreamHeaderSize is the size of a stream header with the longest
+	// domain.
+	MaxStreamHeaderSize = 1 + 2 + MaxHostnameLength + 2
+)
+
+var (
+	ErrUnexpectedCommand     = fmt.Errorf("unexpected command type")
+	ErrUnexpectedNetwork     = fmt.Errorf("unexpected network")
+	ErrUnexpectedAddressType = fmt.Errorf("unexpected address type")
+	ErrEmptyHostname         = fmt.Errorf("empty hostname")
+)
+
+// ReadCommandHead reads the version and the command type of a command.
+func ReadCommandHead(r io.Reader) (*tuic.CommandHead, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, fmt.Errorf("read command head: %w", err)
+	}
+	return tuic.NewCommandHead(tuic.CommandType(b[1]), b[0]), nil
+}
+
+// ReadAuthenticateWithHead reads the rest of an authentication command of
+// head.
+func ReadAuthenticateWithHead(head *tuic.CommandHead, r io.Reader) (*tuic.Authenticate, error) {
+	if head.TYPE != tuic.AuthenticateType {
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedCommand, head.TYPE)
+	}
+	var b [AuthenticateSize - 2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, fmt.Errorf("read authenticate: %w", err)
+	}
+	authenticate := &tuic.Authenticate{
+		CommandHead: head,
+		VER:         head.VER,
+	}
+	copy(authenticate.UUID[:], b[:16])
+	copy(authenticate.TOKEN[:], b[16:])
+	return authenticate, nil
+}
+
+// ReadAuthenticate reads an authentication command.
+func ReadAuthenticate(r io.Reader) (*tuic.Authenticate, error) {
+	head, err := ReadCommandHead(r)
+	if err != nil {
+		return nil, err
+	}
+	return ReadAuthenticateWithHead(head, r)
+}
+
+// ReadUnderlayAuth reads the key and the target of an underlay UDP session,
+// sized by the cipher of juicity.
+func ReadUnderlayAuth(r io.Reader) (*juicity.UnderlayAuth, error) {
+	b := make([]byte, juicity.CipherConf.SaltLen+juicity.CipherConf.KeyLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("read underlay key: %w", err)
+	}
+	metadata, err := ReadAddress(r)
+	if err != nil {
+		return nil, err
+	}
+	return &juicity.UnderlayAuth{
+		IV:       b[:juicity.CipherConf.SaltLen],
+		Psk:      b[juicity.CipherConf.SaltLen:],
+		Metadata: metadata,
+	}, nil
+}
+
+// ReadStreamHeader reads the network and the target at the head of a stream.
+func ReadStreamHeader(r io.Reader) (*trojanc.Metadata, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, fmt.Errorf("read network: %w", err)
+	}
+	network := trojanc.ParseNetwork(b[0])
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedNetwork, b[0])
+	}
+	metadata, err := ReadAddress(r)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Network = network
+	return metadata, nil
+}
+
+// ReadAddress reads a target address: its type, the IP or the
+// length-prefixed domain, and the port.
+func ReadAddress(r io.Reader) (*trojanc.Metadata, error) {
+	var b [1 + MaxHostnameLength + 2]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return nil, fmt.Errorf("read address type: %w", err)
+	}
+	metadata := &trojanc.Metadata{}
+	metadata.Type = trojanc.ParseMetadataType(b[0])
+	switch metadata.Type {
+	case protocol.MetadataTypeIPv4:
+		if _, err := io.ReadFull(r, b[:4+2]); err != nil {
+			return nil, fmt.Errorf("read address: %w", err)
+		}
+		metadata.Hostname = netip.AddrFrom4([4]byte(b[:4])).String()
+		metadata.Port = binary.BigEndian.Uint16(b[4:])
+	case protocol.MetadataTypeIPv6:
+		if _, err := io.ReadFull(r, b[:16+2]); err != nil {
+			return nil, fmt.Errorf("read address: %w", err)
+		}
+		metadata.Hostname = netip.AddrFrom16([16]byte(b[:16])).Unmap().String()
+		metadata.Port = binary.BigEndian.Uint16(b[16:])
+	case protocol.MetadataTypeDomain:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return nil, fmt.Errorf("read address: %w", err)
+		}
+		n := int(b[0])
+		if n == 0 {
+			return nil, ErrEmptyHostname
+		}
+		if _, err := io.ReadFull(r, b[1:1+n+2]); err != nil {
+			return nil, fmt.Errorf("read address: %w", err)
+		}
+		metadata.Hostname = string(b[1 : 1+n])
+		metadata.Port = binary.BigEndian.Uint16(b[1+n:])
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedAddressType, b[0])
+	}
+	return metadata, nil
+}
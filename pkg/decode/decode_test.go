@@ -0,0 +1,101 @@
+package decode
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/daeuniverse/softwind/protocol/trojanc"
+	"github.com/daeuniverse/softwind/protocol/tuic"
+)
+
+func packStreamHeader(network string, typ protocol.MetadataType, hostname string, port uint16) []byte {
+	m := trojanc.Metadata{Metadata: protocol.Metadata{Type: typ, Hostname: hostname, Port: port}}
+	b := make([]byte, 1+m.Len())
+	b[0] = trojanc.NetworkToByte(network)
+	m.PackTo(b[1:])
+	return b
+}
+
+func TestReadStreamHeader(t *testing.T) {
+	// The longest domain name of DNS, which softwind encodes without
+	// overflowing its offsets.
+	longest := strings.Repeat("a", 253)
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"ipv4", packStreamHeader("tcp", protocol.MetadataTypeIPv4, "1.2.3.4", 443), "tcp 1.2.3.4:443"},
+		{"ipv6", packStreamHeader("udp", protocol.MetadataTypeIPv6, "2001:db8::1", 53), "udp 2001:db8::1:53"},
+		{"domain", packStreamHeader("tcp", protocol.MetadataTypeDomain, "example.com", 80), "tcp example.com:80"},
+		{"longest domain", packStreamHeader("tcp", protocol.MetadataTypeDomain, longest, 80), "tcp " + longest + ":80"},
+		{"empty domain", []byte{1, 3, 0, 0, 80}, ""},
+		{"msg", []byte{1, 2, 0}, ""},
+		{"bad network", []byte{2, 1, 1, 2, 3, 4, 0, 80}, ""},
+		{"truncated", []byte{1, 3, 11, 'e', 'x'}, ""},
+	}
+	for _, tt := range tests {
+		m, err := ReadStreamHeader(bytes.NewReader(tt.in))
+		if err != nil {
+			if tt.want != "" {
+				t.Errorf("%v: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if got := fmt.Sprintf("%v %v:%v", m.Network, m.Hostname, m.Port); got != tt.want {
+			t.Errorf("%v: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func FuzzReadStreamHeader(f *testing.F) {
+	f.Add(packStreamHeader("tcp", protocol.MetadataTypeIPv4, "1.2.3.4", 443))
+	f.Add(packStreamHeader("udp", protocol.MetadataTypeIPv6, "2001:db8::1", 53))
+	f.Add(packStreamHeader("tcp", protocol.MetadataTypeDomain, "example.com", 80))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := ReadStreamHeader(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		// What was accepted encodes back to the same header.
+		packed := packStreamHeader(m.Network, m.Type, m.Hostname, m.Port)
+		if !bytes.HasPrefix(b, packed) {
+			t.Fatalf("%x decoded to %+v, which encodes to %x", b, m, packed)
+		}
+	})
+}
+
+func FuzzReadAuthenticate(f *testing.F) {
+	var buf bytes.Buffer
+	_ = tuic.NewAuthenticate([16]byte{1}, [32]byte{2}, juicity.Version0).WriteTo(&buf)
+	f.Add(buf.Bytes())
+	f.Add([]byte{juicity.Version0, byte(tuic.ConnectType)})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		authenticate, err := ReadAuthenticate(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if len(b) < AuthenticateSize || authenticate.UUID != [16]byte(b[2:18]) || authenticate.TOKEN != [32]byte(b[18:50]) {
+			t.Fatalf("%x decoded to %+v", b, authenticate)
+		}
+	})
+}
+
+func FuzzReadUnderlayAuth(f *testing.F) {
+	keyLen := juicity.CipherConf.SaltLen + juicity.CipherConf.KeyLen
+	f.Add(append(make([]byte, keyLen), packStreamHeader("udp", protocol.MetadataTypeIPv4, "1.2.3.4", 443)[1:]...))
+	f.Add(append(make([]byte, keyLen), packStreamHeader("udp", protocol.MetadataTypeDomain, "example.com", 443)[1:]...))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		auth, err := ReadUnderlayAuth(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if len(auth.IV) != juicity.CipherConf.SaltLen || len(auth.Psk) != juicity.CipherConf.KeyLen {
+			t.Fatalf("%x decoded to a key of %v+%v bytes", b, len(auth.IV), len(auth.Psk))
+		}
+	})
+}
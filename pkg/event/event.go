@@ -0,0 +1,108 @@
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Type string
+
+const (
+	TypeConnect     Type = "connect"
+	TypeDisconnect  Type = "disconnect"
+	TypeAuth        Type = "auth"
+	TypeStreamOpen  Type = "stream_open"
+	TypeStreamClose Type = "stream_close"
+)
+
+// Event is a connection event of juicity-server.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    Type      `json:"type"`
+	Source  string    `json:"source,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Network string    `json:"network,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	// Class and Domain are sniffed from the first data of a stream: the
+	// class of its traffic, and the server name of TLS or the host of HTTP.
+	Class  string `json:"class,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	Up     uint64 `json:"up,omitempty"`
+	Down   uint64 `json:"down,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Bus fans events out to subscribers. Publishing never blocks: events are
+// dropped for subscribers that do not keep up.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	// n is the number of subscribers, read without lock by Publish.
+	n atomic.Int32
+}
+
+type Subscription struct {
+	bus *Bus
+	ch  chan *Event
+	// Dropped counts the events dropped because the channel was full.
+	Dropped atomic.Uint64
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Active reports whether there is any subscriber, so that callers can skip
+// building events nobody listens to.
+func (b *Bus) Active() bool {
+	return b.n.Load() > 0
+}
+
+func (b *Bus) Publish(e *Event) {
+	if !b.Active() {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		select {
+		case sub.ch <- e:
+		default:
+			sub.Dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe subscribes to events with a buffer of given size.
+func (b *Bus) Subscribe(size int) *Subscription {
+	sub := &Subscription{
+		bus: b,
+		ch:  make(chan *Event, size),
+	}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.n.Store(int32(len(b.subs)))
+	b.mu.Unlock()
+	return sub
+}
+
+func (s *Subscription) C() <-chan *Event {
+	return s.ch
+}
+
+func (s *Subscription) Close() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		b.n.Store(int32(len(b.subs)))
+		close(s.ch)
+	}
+}
@@ -0,0 +1,259 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+const (
+	SinkUdp   = "udp"
+	SinkUnix  = "unix"
+	SinkKafka = "kafka"
+
+	sinkBufferSize = 4096
+	sinkTimeout    = 10 * time.Second
+	// sinkRetryInterval bounds how often a lost unix socket is redialed.
+	sinkRetryInterval = 5 * time.Second
+	// sinkReportInterval bounds how often failures are logged.
+	sinkReportInterval = time.Minute
+	// kafkaBatchSize and kafkaFlushInterval bound the events buffered for a
+	// request to the Kafka REST proxy.
+	kafkaBatchSize     = 500
+	kafkaFlushInterval = time.Second
+	kafkaContentType   = "application/vnd.kafka.json.v2+json"
+)
+
+type SinkOptions struct {
+	Logger *log.Logger
+	// Type is one of udp, unix and kafka.
+	Type string
+	// Address is the host:port of udp, the path of a unix stream socket, or
+	// the url of a Kafka REST proxy, e.g. http://127.0.0.1:8082.
+	Address string
+	// Topic is the Kafka topic.
+	Topic string
+	// Types are the types of events sent, TypeStreamClose if empty.
+	Types []Type
+}
+
+// Sink sends events as json to an external system, e.g. abuse detection:
+// one datagram per event over udp, one line per event over unix, and
+// batches of records through the Kafka REST proxy. Events are dropped
+// rather than delaying the server when the system does not keep up.
+type Sink struct {
+	SinkOptions
+	types map[Type]bool
+	w     sinkWriter
+
+	// failed and lastErr are reported every sinkReportInterval.
+	failed  uint64
+	lastErr error
+}
+
+type sinkWriter interface {
+	write(e *Event) error
+	// flush sends the buffered events, if any.
+	flush() error
+}
+
+func NewSink(opts SinkOptions) (*Sink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("event sink address is required")
+	}
+	types := opts.Types
+	if len(types) == 0 {
+		types = []Type{TypeStreamClose}
+	}
+	s := &Sink{
+		SinkOptions: opts,
+		types:       make(map[Type]bool),
+	}
+	for _, t := range types {
+		switch t {
+		case TypeConnect, TypeDisconnect, TypeAuth, TypeStreamOpen, TypeStreamClose:
+		default:
+			return nil, fmt.Errorf("unexpected event type: %v", t)
+		}
+		s.types[t] = true
+	}
+	switch opts.Type {
+	case SinkUdp:
+		conn, err := net.Dial("udp", opts.Address)
+		if err != nil {
+			return nil, err
+		}
+		s.w = &udpSinkWriter{conn: conn}
+	case SinkUnix:
+		w := &unixSinkWriter{path: opts.Address}
+		// Connect early, e.g. before a chroot, but tolerate a consumer that
+		// starts later.
+		if err := w.dial(); err != nil {
+			opts.Logger.Warn().
+				Err(err).
+				Str("address", opts.Address).
+				Msg("Event sink is not connected yet")
+		}
+		s.w = w
+	case SinkKafka:
+		if opts.Topic == "" {
+			return nil, fmt.Errorf("kafka event sink requires a topic")
+		}
+		s.w = &kafkaSinkWriter{
+			url:    strings.TrimSuffix(opts.Address, "/") + "/topics/" + opts.Topic,
+			client: &http.Client{Timeout: sinkTimeout},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported event sink type: %v", opts.Type)
+	}
+	return s, nil
+}
+
+// Start sends the events of bus until ctx is done.
+func (s *Sink) Start(ctx context.Context, bus *Bus) {
+	sub := bus.Subscribe(sinkBufferSize)
+	go func() {
+		defer sub.Close()
+		flush := time.NewTicker(kafkaFlushInterval)
+		defer flush.Stop()
+		report := time.NewTicker(sinkReportInterval)
+		defer report.Stop()
+		var dropped uint64
+		for {
+			select {
+			case <-ctx.Done():
+				s.fail(s.w.flush())
+				return
+			case e := <-sub.C():
+				if s.types[e.Type] {
+					s.fail(s.w.write(e))
+				}
+			case <-flush.C:
+				s.fail(s.w.flush())
+			case <-report.C:
+				if d := sub.Dropped.Load(); d > dropped {
+					s.Logger.Warn().
+						Str("type", s.Type).
+						Uint64("dropped", d-dropped).
+						Msg("Event sink dropped events")
+					dropped = d
+				}
+				if s.failed > 0 {
+					s.Logger.Warn().
+						Err(s.lastErr).
+						Str("type", s.Type).
+						Uint64("failed", s.failed).
+						Msg("Event sink failed to send events")
+					s.failed, s.lastErr = 0, nil
+				}
+			}
+		}
+	}()
+}
+
+func (s *Sink) fail(err error) {
+	if err != nil {
+		s.failed++
+		s.lastErr = err
+	}
+}
+
+type udpSinkWriter struct {
+	conn net.Conn
+}
+
+func (w *udpSinkWriter) write(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.conn.Write(b)
+	return err
+}
+
+func (w *udpSinkWriter) flush() error { return nil }
+
+type unixSinkWriter struct {
+	path     string
+	conn     net.Conn
+	lastDial time.Time
+}
+
+func (w *unixSinkWriter) dial() (err error) {
+	w.lastDial = time.Now()
+	w.conn, err = net.DialTimeout("unix", w.path, sinkTimeout)
+	return err
+}
+
+func (w *unixSinkWriter) write(e *Event) error {
+	if w.conn == nil {
+		if time.Since(w.lastDial) < sinkRetryInterval {
+			return fmt.Errorf("not connected to %v", w.path)
+		}
+		if err := w.dial(); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_ = w.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	if _, err = w.conn.Write(append(b, '\n')); err != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *unixSinkWriter) flush() error { return nil }
+
+type kafkaSinkWriter struct {
+	url     string
+	client  *http.Client
+	records []kafkaRecord
+}
+
+type kafkaRecord struct {
+	Value *Event `json:"value"`
+}
+
+func (w *kafkaSinkWriter) write(e *Event) error {
+	w.records = append(w.records, kafkaRecord{Value: e})
+	if len(w.records) >= kafkaBatchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *kafkaSinkWriter) flush() error {
+	if len(w.records) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(struct {
+		Records []kafkaRecord `json:"records"`
+	}{w.records})
+	// The batch is dropped on failure, like events that do not keep up.
+	w.records = w.records[:0]
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, kafkaContentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("kafka rest proxy: %v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+func TestSinkKafka(t *testing.T) {
+	got := make(chan []kafkaRecord, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/juicity" || r.Header.Get("Content-Type") != kafkaContentType {
+			t.Errorf("unexpected request: %v %v", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var body struct {
+			Records []kafkaRecord `json:"records"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		got <- body.Records
+	}))
+	defer srv.Close()
+	sink, err := NewSink(SinkOptions{
+		Logger:  log.NewLogger(&log.Options{}),
+		Type:    SinkKafka,
+		Address: srv.URL + "/",
+		Topic:   "juicity",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := NewBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink.Start(ctx, bus)
+	bus.Publish(&Event{Type: TypeStreamOpen, Target: "example.com:443"})
+	bus.Publish(&Event{Type: TypeStreamClose, Target: "example.com:443", Domain: "example.com", Up: 1})
+	select {
+	case records := <-got:
+		if len(records) != 1 || records[0].Value.Type != TypeStreamClose || records[0].Value.Domain != "example.com" {
+			t.Fatalf("got records %+v, want the stream_close event", records)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request to the proxy")
+	}
+}
@@ -0,0 +1,435 @@
+// Package fallback carries the datagrams of QUIC over TCP/TLS or WebSocket
+// streams for networks that block UDP. Datagrams are sent as messages of
+// WebSocket, or prefixed by their 2-byte length on plain TLS streams.
+package fallback
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// NextProto is the ALPN of fallback streams, so that they look like HTTPS.
+const NextProto = "http/1.1"
+
+const (
+	maxDatagramSize = 0xffff
+	// maxReadDatagramSize bounds the datagrams a PacketConn reads, which are
+	// QUIC packets of at most 1452 bytes. Larger ones are dropped.
+	maxReadDatagramSize = 2048
+	// incomingQueueSize is the number of datagrams queued for the reader of
+	// a PacketConn, and outgoingQueueSize for each stream.
+	incomingQueueSize = 1024
+	outgoingQueueSize = 256
+	// wsBufferSize is the size of the I/O buffers of WebSocket sessions.
+	wsBufferSize = 4096
+)
+
+var (
+	// handshakeTimeout bounds the TLS and WebSocket handshakes of a stream
+	// and, on a PacketConn, the wait for its first datagram, before which
+	// nothing of the stream is allocated.
+	handshakeTimeout = 10 * time.Second
+	// idleTimeout closes the streams without datagrams for so long, far
+	// longer than the keep-alive period of QUIC connections.
+	idleTimeout = time.Minute
+)
+
+var (
+	ErrClosed        = fmt.Errorf("fallback closed")
+	ErrUnknownStream = fmt.Errorf("unknown fallback stream")
+)
+
+// Conn is a stream carrying datagrams.
+type Conn interface {
+	ReadDatagram(p []byte) (n int, err error)
+	WriteDatagram(p []byte) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+type frameConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+// NewFrameConn returns a Conn sending length-prefixed datagrams over conn.
+func NewFrameConn(conn net.Conn) Conn {
+	return &frameConn{Conn: conn}
+}
+
+func (c *frameConn) ReadDatagram(p []byte) (n int, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.Conn, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(p) {
+		if _, err = io.CopyN(io.Discard, c.Conn, int64(size)); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(c.Conn, p[:size])
+}
+
+func (c *frameConn) WriteDatagram(p []byte) error {
+	if len(p) > maxDatagramSize {
+		return fmt.Errorf("datagram too large: %v", len(p))
+	}
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[2:], p)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+type wsConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+}
+
+// NewWsConn returns a Conn sending datagrams as binary messages of ws.
+func NewWsConn(ws *websocket.Conn) Conn {
+	return &wsConn{Conn: ws}
+}
+
+func (c *wsConn) ReadDatagram(p []byte) (n int, err error) {
+	for {
+		t, r, err := c.Conn.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		if t != websocket.BinaryMessage {
+			continue
+		}
+		n, err = io.ReadFull(r, p)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		// The message may be larger than p, and is dropped as a frame is.
+		discarded, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return 0, err
+		}
+		if discarded > 0 {
+			return 0, io.ErrShortBuffer
+		}
+		return n, nil
+	}
+}
+
+func (c *wsConn) WriteDatagram(p []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(websocket.BinaryMessage, p)
+}
+
+// DialWs starts a WebSocket session at path over conn, which is usually a
+// TLS connection.
+func DialWs(ctx context.Context, conn net.Conn, host string, path string) (Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	d := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+		HandshakeTimeout: handshakeTimeout,
+	}
+	// The scheme is ws since conn is secured already.
+	ws, _, err := d.DialContext(ctx, "ws://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewWsConn(ws), nil
+}
+
+type datagram struct {
+	b    []byte
+	from *streamEntry
+}
+
+type streamEntry struct {
+	conn     Conn
+	addr     *net.UDPAddr
+	outgoing chan []byte
+}
+
+func (e *streamEntry) writeLoop(done <-chan struct{}) {
+	for {
+		select {
+		case b := <-e.outgoing:
+			if err := e.conn.WriteDatagram(b); err != nil {
+				_ = e.conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// PacketConn is a net.PacketConn receiving datagrams of all streams accepted
+// by a listener. The remote address of each stream stands for the client, so
+// replies to it are sent back through its stream.
+type PacketConn struct {
+	ln       net.Listener
+	incoming chan datagram
+
+	mu      sync.Mutex
+	streams map[string]*streamEntry
+	closed  chan struct{}
+	once    sync.Once
+
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+	// deadlineChanged is closed when the read deadline changes, so that a
+	// pending ReadFrom waits with the new one.
+	deadlineChanged chan struct{}
+}
+
+// Listen returns a PacketConn serving the streams accepted by ln. With a
+// path, streams are WebSocket sessions at the path, otherwise they are
+// length-prefixed.
+func Listen(ln net.Listener, path string) *PacketConn {
+	c := &PacketConn{
+		ln:       ln,
+		incoming: make(chan datagram, incomingQueueSize),
+		streams:  map[string]*streamEntry{},
+		closed:   make(chan struct{}),
+
+		handshakeTimeout: handshakeTimeout,
+		idleTimeout:      idleTimeout,
+		deadlineChanged:  make(chan struct{}),
+	}
+	if path == "" {
+		go c.acceptFrames()
+	} else {
+		go c.serveWs(path)
+	}
+	return c
+}
+
+func (c *PacketConn) acceptFrames() {
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		go func() {
+			// A TLS handshake is otherwise done by the first read, without
+			// a deadline.
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				ctx, cancel := context.WithTimeout(context.Background(), c.handshakeTimeout)
+				defer cancel()
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			c.serve(NewFrameConn(conn), conn)
+		}()
+	}
+}
+
+func (c *PacketConn) serveWs(path string) {
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: c.handshakeTimeout,
+		ReadBufferSize:   wsBufferSize,
+		WriteBufferSize:  wsBufferSize,
+		WriteBufferPool:  &sync.Pool{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.serve(NewWsConn(ws), ws.UnderlyingConn())
+	})
+	server := &http.Server{
+		Handler: mux,
+		// It also bounds the TLS handshake.
+		ReadHeaderTimeout: c.handshakeTimeout,
+		IdleTimeout:       c.handshakeTimeout,
+		MaxHeaderBytes:    wsBufferSize,
+		// Failed handshakes of probes are not worth logging.
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	_ = server.Serve(c.ln)
+	_ = c.Close()
+}
+
+// serve relays the datagrams of the stream, whose underlying conn carries
+// the read deadlines. The stream is only registered once its first datagram
+// arrives in time.
+func (c *PacketConn) serve(conn Conn, underlying net.Conn) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		_ = conn.Close()
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, maxReadDatagramSize)
+	_ = underlying.SetReadDeadline(time.Now().Add(c.handshakeTimeout))
+	n, err := readDatagram(conn, buf)
+	if err != nil {
+		return
+	}
+	entry := &streamEntry{
+		conn:     conn,
+		addr:     &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone},
+		outgoing: make(chan []byte, outgoingQueueSize),
+	}
+	key := entry.addr.String()
+	c.mu.Lock()
+	c.streams[key] = entry
+	c.mu.Unlock()
+	done := make(chan struct{})
+	go entry.writeLoop(done)
+	defer func() {
+		close(done)
+		c.mu.Lock()
+		if c.streams[key] == entry {
+			delete(c.streams, key)
+		}
+		c.mu.Unlock()
+	}()
+	for {
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		select {
+		case c.incoming <- datagram{b: b, from: entry}:
+		case <-c.closed:
+			return
+		default:
+			// Drop it like a congested UDP socket would.
+		}
+		_ = underlying.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		if n, err = readDatagram(conn, buf); err != nil {
+			return
+		}
+	}
+}
+
+// readDatagram reads the next datagram that fits buf.
+func readDatagram(conn Conn, buf []byte) (int, error) {
+	for {
+		n, err := conn.ReadDatagram(buf)
+		if err == io.ErrShortBuffer {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		c.deadlineMu.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.deadlineMu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case d := <-c.incoming:
+			n, addr = copy(p, d.b), d.from.addr
+		case <-c.closed:
+			err = ErrClosed
+		case <-timeout:
+			err = timeoutError{}
+		case <-changed:
+			// Wait again with the new deadline.
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if addr != nil || err != nil {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	entry, ok := c.streams[addr.String()]
+	c.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("%w: %v", ErrUnknownStream, addr)
+	}
+	b := make([]byte, len(p))
+	copy(b, p)
+	select {
+	case entry.outgoing <- b:
+	default:
+		// Drop it like a congested UDP socket would, instead of blocking
+		// the other streams.
+	}
+	return len(p), nil
+}
+
+func (c *PacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		_ = c.ln.Close()
+		c.mu.Lock()
+		for _, entry := range c.streams {
+			_ = entry.conn.Close()
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	addr, ok := c.ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return c.ln.Addr()
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op since writes never block.
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
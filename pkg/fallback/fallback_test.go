@@ -0,0 +1,158 @@
+package fallback
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenTest serves a PacketConn on the loopback, with short handshake
+// timeouts.
+func listenTest(t *testing.T, path string, tlsConfig *tls.Config) *PacketConn {
+	timeout := handshakeTimeout
+	handshakeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { handshakeTimeout = timeout })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	c := Listen(ln, path)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func testTlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func dialTest(t *testing.T, c *PacketConn, path string) Conn {
+	conn, err := net.Dial("tcp", c.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if path == "" {
+		return NewFrameConn(conn)
+	}
+	ws, err := DialWs(context.Background(), conn, "localhost", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func streamCount(c *PacketConn) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, path := range []string{"", "/ws"} {
+		c := listenTest(t, path, nil)
+		conn := dialTest(t, c, path)
+		// A datagram too large for a QUIC packet is dropped.
+		if err := conn.WriteDatagram(make([]byte, maxReadDatagramSize+1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteDatagram([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, maxDatagramSize)
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%q: %v", path, err)
+		}
+		if string(buf[:n]) != "ping" {
+			t.Fatalf("%q: got %q, want ping", path, buf[:n])
+		}
+		if _, err = c.WriteTo([]byte("pong"), addr); err != nil {
+			t.Fatal(err)
+		}
+		if n, err = conn.ReadDatagram(buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "pong" {
+			t.Fatalf("%q: got %q, want pong", path, buf[:n])
+		}
+	}
+}
+
+func TestSilentStream(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		path      string
+		tlsConfig *tls.Config
+	}{
+		{"frame", "", nil},
+		{"tls", "", testTlsConfig(t)},
+		{"ws", "/ws", nil},
+		{"wss", "/ws", testTlsConfig(t)},
+	} {
+		c := listenTest(t, tc.path, tc.tlsConfig)
+		conn, err := net.Dial("tcp", c.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// Neither a handshake nor a datagram is sent, so the stream is
+		// closed without being registered.
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("%v: read succeeded", tc.name)
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatalf("%v: stream was not closed", tc.name)
+		}
+		if n := streamCount(c); n != 0 {
+			t.Fatalf("%v: got %v streams, want 0", tc.name, n)
+		}
+	}
+}
+
+func TestReadFromDeadline(t *testing.T) {
+	c := listenTest(t, "", nil)
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, maxDatagramSize))
+		errCh <- err
+	}()
+	// The deadline is set while ReadFrom is blocked.
+	time.Sleep(50 * time.Millisecond)
+	_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	select {
+	case err := <-errCh:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("got %v, want a timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrom ignored the deadline")
+	}
+}
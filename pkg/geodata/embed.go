@@ -0,0 +1,16 @@
+//go:build embed_geodata
+
+package geodata
+
+import (
+	_ "embed"
+)
+
+const embedded = true
+
+var (
+	//go:embed data/geosite.txt
+	embeddedGeosite string
+	//go:embed data/geoip.txt
+	embeddedGeoip string
+)
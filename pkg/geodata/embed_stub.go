@@ -0,0 +1,10 @@
+//go:build !embed_geodata
+
+package geodata
+
+const embedded = false
+
+var (
+	embeddedGeosite string
+	embeddedGeoip   string
+)
@@ -0,0 +1,85 @@
+package geodata
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+var ErrNotEmbedded = fmt.Errorf("geodata is not embedded (built without embed_geodata)")
+
+var (
+	parseEmbedded sync.Once
+	geosites      map[string][]string
+	geoips        map[string][]netip.Prefix
+	embeddedErr   error
+)
+
+// Geosite returns the domains of the category of the embedded geosite, in the
+// syntax of rule domains.
+func Geosite(category string) ([]string, error) {
+	if err := loadEmbedded(); err != nil {
+		return nil, err
+	}
+	domains, ok := geosites[strings.ToLower(category)]
+	if !ok {
+		return nil, fmt.Errorf("no geosite category %v", category)
+	}
+	return domains, nil
+}
+
+// Geoip returns the prefixes of the category of the embedded geoip.
+func Geoip(category string) ([]netip.Prefix, error) {
+	if err := loadEmbedded(); err != nil {
+		return nil, err
+	}
+	prefixes, ok := geoips[strings.ToLower(category)]
+	if !ok {
+		return nil, fmt.Errorf("no geoip category %v", category)
+	}
+	return prefixes, nil
+}
+
+func loadEmbedded() error {
+	if !embedded {
+		return ErrNotEmbedded
+	}
+	parseEmbedded.Do(func() {
+		geosites, embeddedErr = parseCategories(embeddedGeosite, func(s string) (string, error) {
+			return strings.ToLower(s), nil
+		})
+		if embeddedErr != nil {
+			return
+		}
+		geoips, embeddedErr = parseCategories(embeddedGeoip, func(s string) (netip.Prefix, error) {
+			prefix, err := netip.ParsePrefix(s)
+			return prefix.Masked(), err
+		})
+	})
+	return embeddedErr
+}
+
+// parseCategories parses lines of "<category> <entry>", skipping empty lines
+// and comments.
+func parseCategories[T any](data string, parse func(string) (T, error)) (map[string][]T, error) {
+	categories := map[string][]T{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("parse embedded geodata: %q", line)
+		}
+		entry, err := parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parse embedded geodata: %w", err)
+		}
+		categories[fields[0]] = append(categories[fields[0]], entry)
+	}
+	return categories, nil
+}
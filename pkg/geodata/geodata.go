@@ -0,0 +1,179 @@
+// Package geodata keeps geo databases, e.g. MMDBs of ASNs, up to date by
+// downloading them from mirrors, and holds the geosite and geoip categories
+// embedded with the embed_geodata build tag.
+package geodata
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+const (
+	downloadTimeout = 5 * time.Minute
+	// maxChecksumSize bounds the size of checksum files.
+	maxChecksumSize = 4096
+)
+
+var ErrChecksumMismatch = fmt.Errorf("checksum mismatch")
+
+// File is a database downloaded from the first mirror that succeeds.
+type File struct {
+	Path string
+	Urls []string
+	// Sha256sum verifies the download against the sha256sum file published
+	// beside it, at its url with the suffix .sha256sum.
+	Sha256sum bool
+}
+
+// Update downloads the file and replaces it atomically once verified.
+func Update(ctx context.Context, client *http.Client, f *File) error {
+	if len(f.Urls) == 0 {
+		return fmt.Errorf("%v: no urls", f.Path)
+	}
+	var errs []error
+	for _, url := range f.Urls {
+		err := download(ctx, client, f, url)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", url, err))
+	}
+	return fmt.Errorf("update %v: %w", f.Path, errors.Join(errs...))
+}
+
+func download(ctx context.Context, client *http.Client, f *File, url string) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+	var want string
+	if f.Sha256sum {
+		if want, err = fetchSha256sum(ctx, client, url+".sha256sum"); err != nil {
+			return fmt.Errorf("fetch checksum: %w", err)
+		}
+	}
+	body, err := get(ctx, client, url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); want != "" && got != want {
+		return fmt.Errorf("%w: got %v, want %v", ErrChecksumMismatch, got, want)
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+func get(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// fetchSha256sum returns the hash in the first line of a sha256sum file,
+// which is "<hex>  <name>" or just "<hex>".
+func fetchSha256sum(ctx context.Context, client *http.Client, url string) (string, error) {
+	body, err := get(ctx, client, url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	line, err := bufio.NewReader(io.LimitReader(body, maxChecksumSize)).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid sha256sum: %q", line)
+	}
+	if _, err = hex.DecodeString(fields[0]); err != nil {
+		return "", fmt.Errorf("invalid sha256sum: %q", line)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// Updater updates files periodically.
+type Updater struct {
+	Logger   *log.Logger
+	Client   *http.Client
+	Files    []*File
+	Interval time.Duration
+	// OnUpdate is called with every file that was updated, if not nil.
+	OnUpdate func(f *File)
+}
+
+// Run updates the files every interval until ctx is done. Files that do not
+// exist yet are downloaded at once.
+func (u *Updater) Run(ctx context.Context) {
+	for _, f := range u.Files {
+		if _, err := os.Stat(f.Path); errors.Is(err, os.ErrNotExist) {
+			u.update(ctx, f)
+		}
+	}
+	ticker := time.NewTicker(u.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, f := range u.Files {
+			u.update(ctx, f)
+		}
+	}
+}
+
+func (u *Updater) update(ctx context.Context, f *File) {
+	if err := Update(ctx, u.Client, f); err != nil {
+		u.Logger.Warn().
+			Err(err).
+			Msg("Failed to update geodata")
+		return
+	}
+	u.Logger.Info().
+		Str("path", f.Path).
+		Msg("Updated geodata")
+	if u.OnUpdate != nil {
+		u.OnUpdate(f)
+	}
+}
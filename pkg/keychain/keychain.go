@@ -0,0 +1,40 @@
+// Package keychain stores secrets in the keychain of the OS: the Keychain
+// on macOS, the Credential Manager on Windows, and the Secret Service (e.g.
+// GNOME Keyring or KWallet) through secret-tool elsewhere.
+package keychain
+
+import (
+	"errors"
+)
+
+// Service is the service the secrets of juicity are stored under.
+const Service = "juicity"
+
+var (
+	ErrNotFound    = errors.New("secret not found in the keychain")
+	ErrUnsupported = errors.New("keychain is not supported on this platform")
+)
+
+// Get returns the secret of the account.
+func Get(account string) (string, error) {
+	if account == "" {
+		return "", errors.New("empty account")
+	}
+	return get(account)
+}
+
+// Set stores the secret of the account, replacing any.
+func Set(account string, secret string) error {
+	if account == "" {
+		return errors.New("empty account")
+	}
+	return set(account, secret)
+}
+
+// Delete removes the secret of the account.
+func Delete(account string) error {
+	if account == "" {
+		return errors.New("empty account")
+	}
+	return del(account)
+}
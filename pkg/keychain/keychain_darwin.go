@@ -0,0 +1,42 @@
+package keychain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The exit status of security when the item is not found.
+const errSecItemNotFound = 44
+
+func security(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/usr/bin/security", args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == errSecItemNotFound {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("security %v: %w: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
+
+func get(account string) (string, error) {
+	return security("find-generic-password", "-s", Service, "-a", account, "-w")
+}
+
+func set(account string, secret string) error {
+	// The secret is briefly visible in the arguments, which security offers
+	// no other way to take non-interactively.
+	_, err := security("add-generic-password", "-U", "-s", Service, "-a", account, "-w", secret)
+	return err
+}
+
+func del(account string) error {
+	_, err := security("delete-generic-password", "-s", Service, "-a", account)
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !darwin && !windows && !linux && !freebsd && !netbsd && !openbsd
+
+package keychain
+
+func get(account string) (string, error) {
+	return "", ErrUnsupported
+}
+
+func set(account string, secret string) error {
+	return ErrUnsupported
+}
+
+func del(account string) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,52 @@
+//go:build linux || freebsd || netbsd || openbsd
+
+package keychain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func secretTool(stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", fmt.Errorf("%w: install secret-tool (libsecret-tools or libsecret)", ErrUnsupported)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && stderr.Len() == 0 && args[0] == "lookup" {
+			// lookup fails without a message if nothing matches.
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("secret-tool %v: %w: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func get(account string) (string, error) {
+	secret, err := secretTool("", "lookup", "service", Service, "account", account)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", ErrNotFound
+	}
+	return strings.TrimSuffix(secret, "\n"), nil
+}
+
+func set(account string, secret string) error {
+	// The secret is read from stdin, without a newline.
+	_, err := secretTool(secret, "store", "--label", Service+" "+account, "service", Service, "account", account)
+	return err
+}
+
+func del(account string) error {
+	_, err := secretTool("", "clear", "service", Service, "account", account)
+	return err
+}
@@ -1,11 +1,14 @@
 package log
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/juicity/juicity/common"
 	"github.com/rs/zerolog"
@@ -14,9 +17,14 @@ import (
 
 type Logger = zerolog.Logger
 
+// TimeFormatEpochMillis makes the logger write timestamps as unix milliseconds.
+const TimeFormatEpochMillis = zerolog.TimeFormatUnixMs
+
 type Options struct {
 	Output     string
 	TimeFormat string
+	// TimeZone is the location timestamps are written in; nil means local time.
+	TimeZone   *time.Location
 	FileFormat string
 	NoColor    bool
 	File       string
@@ -36,6 +44,7 @@ func NewLogger(opt *Options) *Logger {
 		outputs[i] = strings.TrimSpace(outputs[i])
 	}
 	outputs = common.Deduplicate(outputs)
+	ts := newTimestamp(opt.TimeFormat, opt.TimeZone)
 	for _, output := range outputs {
 		switch output {
 		case "file":
@@ -58,18 +67,20 @@ func NewLogger(opt *Options) *Logger {
 				default:
 					// Raw format.
 					writerInputs = append(writerInputs, zerolog.ConsoleWriter{
-						Out:        fw,
-						TimeFormat: opt.TimeFormat,
-						NoColor:    opt.NoColor,
+						Out:             fw,
+						TimeFormat:      opt.TimeFormat,
+						NoColor:         opt.NoColor,
+						FormatTimestamp: ts.formatter(opt.NoColor),
 					})
 				}
 			}
 		case "console":
 			// Write to os.Stdout directly.
 			writerInputs = append(writerInputs, &zerolog.ConsoleWriter{
-				Out:        os.Stdout,
-				TimeFormat: opt.TimeFormat,
-				NoColor:    opt.NoColor,
+				Out:             os.Stdout,
+				TimeFormat:      opt.TimeFormat,
+				NoColor:         opt.NoColor,
+				FormatTimestamp: ts.formatter(opt.NoColor),
 			})
 		}
 	}
@@ -81,9 +92,104 @@ func NewLogger(opt *Options) *Logger {
 	}
 	logger = logger.With().Caller().Logger()
 	if opt.TimeFormat != "" {
-		logger = logger.With().Timestamp().Logger()
+		logger = logger.Hook(ts)
 	}
 	logger.Level(zerolog.DebugLevel)
 
 	return &logger
 }
+
+// ParseTimeFormat converts a log time format name to a layout accepted by
+// Options.TimeFormat. Other names must be Go time layouts.
+func ParseTimeFormat(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", "datetime":
+		return time.DateTime, nil
+	case "rfc3339":
+		return time.RFC3339, nil
+	case "rfc3339nano":
+		return time.RFC3339Nano, nil
+	case "epoch_millis":
+		return TimeFormatEpochMillis, nil
+	}
+	// Single digits such as "3" are layout elements too, so a misspelled
+	// name would pass as a layout unless one of the fuller elements is
+	// required.
+	for _, elem := range layoutElements {
+		if strings.Contains(name, elem) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown time format %q", name)
+}
+
+// layoutElements are the elements of the reference time of which a custom
+// layout must contain at least one.
+var layoutElements = []string{"2006", "01", "02", "15", "03", "04", "05", "Jan", "Mon"}
+
+// ParseTimeZone accepts "local", "utc" or an IANA time zone name.
+func ParseTimeZone(name string) (*time.Location, error) {
+	switch strings.ToLower(name) {
+	case "", "local":
+		return time.Local, nil
+	case "utc":
+		return time.UTC, nil
+	default:
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("load time zone: %w", err)
+		}
+		return loc, nil
+	}
+}
+
+// timestamp writes the time field of one logger in its own layout and
+// location, leaving the globals of zerolog untouched. The default console
+// layout (time.DateTime) is applied to console outputs only, so that json logs
+// keep RFC3339 unless asked otherwise.
+type timestamp struct {
+	layout      string
+	fieldLayout string
+	loc         *time.Location
+}
+
+func newTimestamp(layout string, loc *time.Location) *timestamp {
+	if loc == nil {
+		loc = time.Local
+	}
+	fieldLayout := time.RFC3339
+	if layout != "" && layout != time.DateTime {
+		fieldLayout = layout
+	}
+	return &timestamp{layout: layout, fieldLayout: fieldLayout, loc: loc}
+}
+
+// Run implements zerolog.Hook.
+func (ts *timestamp) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	now := time.Now().In(ts.loc)
+	if ts.fieldLayout == TimeFormatEpochMillis {
+		e.Int64(zerolog.TimestampFieldName, now.UnixMilli())
+		return
+	}
+	e.Str(zerolog.TimestampFieldName, now.Format(ts.fieldLayout))
+}
+
+// formatter renders the time field on console outputs in the layout.
+func (ts *timestamp) formatter(noColor bool) zerolog.Formatter {
+	return func(i interface{}) string {
+		t := "<nil>"
+		switch tt := i.(type) {
+		case string:
+			t = tt
+			if parsed, err := time.ParseInLocation(ts.fieldLayout, tt, ts.loc); err == nil && ts.layout != "" {
+				t = parsed.In(ts.loc).Format(ts.layout)
+			}
+		case json.Number:
+			t = tt.String()
+		}
+		if noColor {
+			return t
+		}
+		return "\x1b[90m" + t + "\x1b[0m"
+	}
+}
@@ -1,66 +1,129 @@
 package log
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
 
-type testCase struct {
-	condition string
-	logger    *Logger
+// logLine writes one line through a file output of the logger built from opt
+// and returns it.
+func logLine(t *testing.T, opt *Options) string {
+	t.Helper()
+	opt.Output = "file"
+	opt.File = filepath.Join(t.TempDir(), "app.log")
+	opt.NoColor = true
+	NewLogger(opt).Info().Msg("Hello World!")
+	b, err := os.ReadFile(opt.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
 }
 
 func TestLogger(t *testing.T) {
-	// construct test cases
-	cases := []testCase{
+	for _, tc := range []struct {
+		condition string
+		opt       *Options
+		want      string
+	}{
 		{
-			condition: "ConsoleWriter (Alone)",
-			logger: NewLogger(&Options{
-				TimeFormat: time.DateTime,
-			}),
+			condition: "raw datetime",
+			opt:       &Options{TimeFormat: time.DateTime},
+			want:      `^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d INF `,
 		},
 		{
-			condition: "JsonWriter (Alone)",
-			logger: NewLogger(&Options{
-				TimeFormat: time.DateTime,
-				FileFormat: "json",
-			}),
+			condition: "raw rfc3339 in UTC",
+			opt:       &Options{TimeFormat: time.RFC3339, TimeZone: time.UTC},
+			want:      `^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ INF `,
 		},
 		{
-			condition: "JsonWriter (Alone)",
-			logger: NewLogger(&Options{
-				TimeFormat: time.DateTime,
-				FileFormat: "raw",
-			}),
+			condition: "raw epoch millis",
+			opt:       &Options{TimeFormat: TimeFormatEpochMillis},
+			want:      `^\d{13} INF `,
 		},
 		{
-			condition: "ConsoleWriter + FileWriter (in Stdout format)",
-			logger: NewLogger(&Options{
-				TimeFormat: time.DateTime,
-				File:       "../../app_file_writer_stdout.log",
-			}),
+			condition: "raw custom layout",
+			opt:       &Options{TimeFormat: "15:04", TimeZone: time.UTC},
+			want:      `^\d\d:\d\d INF `,
 		},
 		{
-			condition: "ConsoleWriter + FileWriter (in Stdout format; disable Color Output)",
-			logger: NewLogger(&Options{
-				TimeFormat: time.DateTime,
-				File:       "../../app_file_writer_stdout.log",
-				NoColor:    true,
-			}),
+			condition: "json datetime",
+			opt:       &Options{TimeFormat: time.DateTime, FileFormat: "json", TimeZone: time.UTC},
+			want:      `"time":"\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ"`,
 		},
 		{
-			condition: "JsonWrtier + FileWriter (in JSON format)",
-			logger: NewLogger(&Options{
-				TimeFormat: time.DateTime,
-				File:       "../../app_file_writer_json.log",
-				FileFormat: "json",
-			}),
+			condition: "json epoch millis",
+			opt:       &Options{TimeFormat: TimeFormatEpochMillis, FileFormat: "json"},
+			want:      `"time":\d{13}[,}]`,
 		},
-	}
-
-	for _, tc := range cases {
+		{
+			condition: "no timestamp",
+			opt:       &Options{FileFormat: "json"},
+			want:      `^\{"level":"info","caller":"log_test.go:\d+","message":"Hello World!"\}$`,
+		},
+	} {
 		t.Run(tc.condition, func(t *testing.T) {
-			tc.logger.Info().Msg("Hello World!")
+			line := logLine(t, tc.opt)
+			if !regexp.MustCompile(tc.want).MatchString(line) {
+				t.Fatalf("got %q, want a match of %q", line, tc.want)
+			}
 		})
 	}
 }
+
+func TestLoggerIndependentFormats(t *testing.T) {
+	dir := t.TempDir()
+	millis := NewLogger(&Options{
+		Output:     "file",
+		File:       filepath.Join(dir, "millis.log"),
+		FileFormat: "json",
+		TimeFormat: TimeFormatEpochMillis,
+	})
+	// A logger built later must not change the format of earlier ones.
+	NewLogger(&Options{TimeFormat: time.RFC3339Nano, TimeZone: time.UTC, Output: "file"})
+	millis.Info().Msg("Hello World!")
+	b, err := os.ReadFile(filepath.Join(dir, "millis.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line struct {
+		Time json.Number `json:"time"`
+	}
+	if err = json.Unmarshal(b, &line); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := line.Time.Int64()
+	if err != nil {
+		t.Fatalf("got time %q, want epoch millis", line.Time)
+	}
+	if d := time.Since(time.UnixMilli(ms)); d < 0 || d > time.Minute {
+		t.Fatalf("got time %v, want now", time.UnixMilli(ms))
+	}
+}
+
+func TestParseTimeFormat(t *testing.T) {
+	for name, want := range map[string]string{
+		"":             time.DateTime,
+		"DateTime":     time.DateTime,
+		"rfc3339":      time.RFC3339,
+		"rfc3339nano":  time.RFC3339Nano,
+		"epoch_millis": TimeFormatEpochMillis,
+		"15:04:05":     "15:04:05",
+		"Jan _2 15:04": "Jan _2 15:04",
+	} {
+		got, err := ParseTimeFormat(name)
+		if err != nil || got != want {
+			t.Fatalf("%q: got %q, %v, want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"rfc3339-nano", "iso", "datetime2"} {
+		if _, err := ParseTimeFormat(name); err == nil {
+			t.Fatalf("%q: got no error", name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package process
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// findPid returns the owner of the socket bound to the local address in a
+// table of extendedTable on Windows, built on all platforms for tests. A
+// table is a count of rows followed by the rows:
+//
+//	MIB_TCPROW_OWNER_PID:  state, addr, port, remote addr, remote port, pid
+//	MIB_TCP6ROW_OWNER_PID: addr[16], scope, port, remote addr[16], remote
+//	                       scope, remote port, state, pid
+//	MIB_UDPROW_OWNER_PID:  addr, port, pid
+//	MIB_UDP6ROW_OWNER_PID: addr[16], scope, port, pid
+//
+// Addresses and ports are in network byte order, other fields in host byte
+// order.
+func findPid(table []byte, network string, ipv6 bool, local netip.AddrPort) (int, bool) {
+	var rowSize, addrOffset, portOffset, pidOffset int
+	switch {
+	case network == "tcp" && !ipv6:
+		rowSize, addrOffset, portOffset, pidOffset = 24, 4, 8, 20
+	case network == "tcp":
+		rowSize, addrOffset, portOffset, pidOffset = 56, 0, 20, 52
+	case !ipv6:
+		rowSize, addrOffset, portOffset, pidOffset = 12, 0, 4, 8
+	default:
+		rowSize, addrOffset, portOffset, pidOffset = 28, 0, 20, 24
+	}
+	addrSize := 4
+	if ipv6 {
+		addrSize = 16
+	}
+	if len(table) < 4 {
+		return 0, false
+	}
+	// The rows are 4-byte aligned, right after the count.
+	n, rows := int(binary.LittleEndian.Uint32(table)), table[4:]
+	// UDP sockets bound to any address own the packets of all addresses,
+	// unless one is bound to the address itself.
+	pid, found := 0, false
+	for i := 0; i < n && (i+1)*rowSize <= len(rows); i++ {
+		row := rows[i*rowSize : (i+1)*rowSize]
+		if binary.BigEndian.Uint16(row[portOffset:]) != local.Port() {
+			continue
+		}
+		addr, _ := netip.AddrFromSlice(row[addrOffset : addrOffset+addrSize])
+		if addr.Unmap() == local.Addr() {
+			return int(binary.LittleEndian.Uint32(row[pidOffset:])), true
+		}
+		if network == "udp" && addr.IsUnspecified() && !found {
+			pid, found = int(binary.LittleEndian.Uint32(row[pidOffset:])), true
+		}
+	}
+	return pid, found
+}
@@ -0,0 +1,35 @@
+// Package process finds the local process owning a connection, for rules
+// matching applications. It is implemented on Linux with procfs and on
+// Windows with the socket tables of the IP helper API. Elsewhere, e.g. on
+// macOS, Supported is false and FindByLocalAddr always fails.
+package process
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotFound = fmt.Errorf("process not found")
+
+// Process is the owner of a connection.
+type Process struct {
+	Pid int
+	// Path is the executable of the process, or its command name if the
+	// executable is not accessible.
+	Path string
+}
+
+// Name returns the base name of the executable.
+func (p *Process) Name() string {
+	return filepath.Base(p.Path)
+}
+
+// Match reports whether the process is named the pattern or, for patterns
+// with a path separator, located at the pattern.
+func (p *Process) Match(pattern string) bool {
+	if strings.ContainsRune(pattern, filepath.Separator) {
+		return p.Path == pattern
+	}
+	return p.Name() == pattern
+}
@@ -0,0 +1,224 @@
+package process
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Supported reports whether processes can be found on this platform.
+const Supported = true
+
+// FindByLocalAddr returns the process owning the local end of a tcp or udp
+// socket. UDP sockets bound to any address own the packets of all addresses,
+// unless one is bound to the address itself.
+func FindByLocalAddr(network string, local netip.AddrPort) (*Process, error) {
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	var inode, anyInode string
+	for _, table := range []string{network, network + "6"} {
+		exact, wildcard, err := findInode("/proc/net/"+table, local)
+		if err != nil {
+			return nil, err
+		}
+		if exact != "" {
+			inode = exact
+			break
+		}
+		if anyInode == "" && network == "udp" {
+			anyInode = wildcard
+		}
+	}
+	if inode == "" {
+		inode = anyInode
+	}
+	if inode == "" {
+		return nil, fmt.Errorf("%w: no socket at %v", ErrNotFound, local)
+	}
+	return findOwner("socket:[" + inode + "]")
+}
+
+// findInode returns the inode of the socket bound to the local address in a
+// table of /proc/net, and of one bound to its port on any address, or ""
+// if there is none.
+func findInode(path string, local netip.AddrPort) (inode string, anyInode string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] == "0" {
+			continue
+		}
+		addr, err := parseProcAddr(fields[1])
+		if err != nil {
+			return "", "", fmt.Errorf("parse %v: %w", path, err)
+		}
+		if addr == local {
+			return fields[9], "", nil
+		}
+		if anyInode == "" && addr.Port() == local.Port() && addr.Addr().IsUnspecified() {
+			anyInode = fields[9]
+		}
+	}
+	return "", anyInode, scanner.Err()
+}
+
+// parseProcAddr parses an address like 0100007F:1F90, whose IP is written as
+// 32-bit words in host byte order.
+func parseProcAddr(s string) (netip.AddrPort, error) {
+	ip, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address: %v", s)
+	}
+	b, err := hex.DecodeString(ip)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address: %v", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address: %v", s)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(p)), nil
+}
+
+// maxRecentOwners bounds the owners of sockets found lately, whose file
+// descriptors are searched before all processes.
+const maxRecentOwners = 16
+
+// owners caches the owners of sockets, since scanning the file descriptors
+// of all processes takes long on busy hosts.
+var owners = &ownerCache{}
+
+type ownerCache struct {
+	mu sync.Mutex
+	// sockets maps the sockets seen by the latest scan to their processes.
+	sockets map[string]int
+	// recent are the latest owners found, the most recent first: an app
+	// opening a connection likely opened others before.
+	recent []int
+	// scans counts the scans of all processes, for tests.
+	scans int
+}
+
+// findOwner returns the process with a file descriptor linked to the socket.
+func findOwner(socket string) (*Process, error) {
+	pid, err := owners.find(socket)
+	if err != nil {
+		return nil, err
+	}
+	return newProcess(pid), nil
+}
+
+// find returns the pid of the owner of the socket, looking it up in the
+// latest scan and among the recent owners before scanning all processes.
+func (c *ownerCache) find(socket string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Pids may be reused and descriptors passed on, so cached owners are
+	// checked to still own the socket.
+	if pid, ok := c.sockets[socket]; ok && hasFd(pid, socket) {
+		c.remember(pid)
+		return pid, nil
+	}
+	for _, pid := range c.recent {
+		if hasFd(pid, socket) {
+			c.remember(pid)
+			return pid, nil
+		}
+	}
+	c.scans++
+	c.sockets = scanSockets()
+	if pid, ok := c.sockets[socket]; ok {
+		c.remember(pid)
+		return pid, nil
+	}
+	return 0, fmt.Errorf("%w: no owner of %v", ErrNotFound, socket)
+}
+
+// remember moves the pid to the front of the recent owners.
+func (c *ownerCache) remember(pid int) {
+	recent := append(c.recent[:0:0], pid)
+	for _, p := range c.recent {
+		if p != pid && len(recent) < maxRecentOwners {
+			recent = append(recent, p)
+		}
+	}
+	c.recent = recent
+}
+
+// hasFd reports whether the process has a file descriptor linked to the
+// socket.
+func hasFd(pid int, socket string) bool {
+	found := false
+	walkFds(pid, func(link string) bool {
+		found = link == socket
+		return !found
+	})
+	return found
+}
+
+// scanSockets maps the sockets of all processes accessible to their pids.
+func scanSockets() map[string]int {
+	sockets := map[string]int{}
+	pids, err := os.ReadDir("/proc")
+	if err != nil {
+		return sockets
+	}
+	for _, entry := range pids {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		walkFds(pid, func(link string) bool {
+			if strings.HasPrefix(link, "socket:[") {
+				sockets[link] = pid
+			}
+			return true
+		})
+	}
+	return sockets
+}
+
+// walkFds calls f with the links of the file descriptors of the process
+// until it returns false. Processes of other users are skipped.
+func walkFds(pid int, f func(link string) bool) {
+	fdDir := filepath.Join("/proc", strconv.Itoa(pid), "fd")
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return
+	}
+	for _, fd := range fds {
+		if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && !f(link) {
+			return
+		}
+	}
+}
+
+func newProcess(pid int) *Process {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	if path, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		return &Process{Pid: pid, Path: strings.TrimSuffix(path, " (deleted)")}
+	}
+	comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+	return &Process{Pid: pid, Path: strings.TrimSpace(string(comm))}
+}
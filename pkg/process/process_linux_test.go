@@ -0,0 +1,91 @@
+package process
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func TestParseProcAddr(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"0100007F:1F90", "127.0.0.1:8080"},
+		{"00000000:0035", "0.0.0.0:53"},
+		{"00000000000000000000000001000000:01BB", "[::1]:443"},
+		{"0000000000000000FFFF00000100007F:0050", "127.0.0.1:80"},
+	}
+	for _, tt := range tests {
+		got, err := parseProcAddr(tt.s)
+		if err != nil {
+			t.Errorf("parseProcAddr(%v): %v", tt.s, err)
+			continue
+		}
+		if got != netip.MustParseAddrPort(tt.want) {
+			t.Errorf("parseProcAddr(%v) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+	for _, s := range []string{"0100007F", "0100007F:ZZ", "01007F:0050"} {
+		if _, err := parseProcAddr(s); err == nil {
+			t.Errorf("parseProcAddr(%v): got no error", s)
+		}
+	}
+}
+
+func TestFindByLocalAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dial := func() *net.TCPConn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn.(*net.TCPConn)
+	}
+	owners = &ownerCache{}
+	for i := 0; i < 3; i++ {
+		local := dial().LocalAddr().(*net.TCPAddr).AddrPort()
+		p, err := FindByLocalAddr("tcp", local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Pid != os.Getpid() {
+			t.Fatalf("got pid %v, want %v", p.Pid, os.Getpid())
+		}
+		if exe, _ := os.Executable(); p.Path != exe {
+			t.Errorf("got path %v, want %v", p.Path, exe)
+		}
+	}
+	// Later sockets of a recent owner are found without scanning all
+	// processes.
+	if owners.scans != 1 {
+		t.Errorf("got %v scans, want 1", owners.scans)
+	}
+
+	if _, err = FindByLocalAddr("tcp", netip.MustParseAddrPort("127.0.0.1:1")); err == nil {
+		t.Error("got no error of a port with no socket")
+	}
+}
+
+func TestFindByLocalAddrUdp(t *testing.T) {
+	// Packets to the loopback are owned by a socket bound to any address.
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+	p, err := FindByLocalAddr("udp", netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Pid != os.Getpid() {
+		t.Fatalf("got pid %v, want %v", p.Pid, os.Getpid())
+	}
+}
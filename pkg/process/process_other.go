@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package process
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+)
+
+// Supported reports whether processes can be found on this platform.
+const Supported = false
+
+// FindByLocalAddr is not supported on this platform.
+func FindByLocalAddr(network string, local netip.AddrPort) (*Process, error) {
+	return nil, fmt.Errorf("finding processes is not supported on %v", runtime.GOOS)
+}
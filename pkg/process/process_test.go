@@ -0,0 +1,84 @@
+package process
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	p := &Process{Pid: 1, Path: "/usr/lib/firefox/firefox"}
+	for pattern, want := range map[string]bool{
+		"firefox":                  true,
+		"/usr/lib/firefox/firefox": true,
+		"/usr/bin/firefox":         false,
+		"fire":                     false,
+	} {
+		if got := p.Match(pattern); got != want {
+			t.Errorf("Match(%v) = %v, want %v", pattern, got, want)
+		}
+	}
+}
+
+// row4 is a MIB_UDPROW_OWNER_PID.
+func row4(addr string, port uint16, pid uint32) []byte {
+	b := netip.MustParseAddr(addr).AsSlice()
+	b = binary.BigEndian.AppendUint16(b, port)
+	b = append(b, 0, 0)
+	return binary.LittleEndian.AppendUint32(b, pid)
+}
+
+// tcpRow6 is a MIB_TCP6ROW_OWNER_PID.
+func tcpRow6(addr string, port uint16, pid uint32) []byte {
+	b := netip.MustParseAddr(addr).AsSlice()
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, port)
+	b = append(b, 0, 0)
+	b = append(b, make([]byte, 16+4+4)...)
+	b = binary.LittleEndian.AppendUint32(b, 5) // established
+	return binary.LittleEndian.AppendUint32(b, pid)
+}
+
+func table(rows ...[]byte) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(rows)))
+	for _, row := range rows {
+		b = append(b, row...)
+	}
+	return b
+}
+
+func TestFindPid(t *testing.T) {
+	udp := table(
+		row4("0.0.0.0", 53, 10),
+		row4("127.0.0.1", 53, 11),
+		row4("127.0.0.1", 5353, 12),
+	)
+	tcp6 := table(
+		tcpRow6("::1", 8080, 20),
+		tcpRow6("2001:db8::1", 443, 21),
+	)
+	tests := []struct {
+		table   []byte
+		network string
+		ipv6    bool
+		local   string
+		pid     int
+		ok      bool
+	}{
+		{udp, "udp", false, "127.0.0.1:53", 11, true},
+		{udp, "udp", false, "192.0.2.1:53", 10, true},
+		{udp, "udp", false, "127.0.0.1:5353", 12, true},
+		{udp, "udp", false, "127.0.0.1:54", 0, false},
+		{tcp6, "tcp", true, "[2001:db8::1]:443", 21, true},
+		{tcp6, "tcp", true, "[::1]:8080", 20, true},
+		{tcp6, "tcp", true, "[::1]:443", 0, false},
+		// Truncated tables are not read beyond.
+		{udp[:20], "udp", false, "127.0.0.1:5353", 0, false},
+	}
+	for _, tt := range tests {
+		pid, ok := findPid(tt.table, tt.network, tt.ipv6, netip.MustParseAddrPort(tt.local))
+		if pid != tt.pid || ok != tt.ok {
+			t.Errorf("findPid(%v %v) = %v, %v, want %v, %v", tt.network, tt.local, pid, ok, tt.pid, tt.ok)
+		}
+	}
+}
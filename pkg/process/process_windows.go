@@ -0,0 +1,92 @@
+package process
+
+import (
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Supported reports whether processes can be found on this platform.
+const Supported = true
+
+// Classes of tables of GetExtendedTcpTable and GetExtendedUdpTable with the
+// pids of the owners.
+const (
+	tcpTableOwnerPidAll = 5
+	udpTableOwnerPid    = 1
+)
+
+var (
+	iphlpapi                = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetExtendedTcpTable = iphlpapi.NewProc("GetExtendedTcpTable")
+	procGetExtendedUdpTable = iphlpapi.NewProc("GetExtendedUdpTable")
+)
+
+// FindByLocalAddr returns the process owning the local end of a tcp or udp
+// socket.
+func FindByLocalAddr(network string, local netip.AddrPort) (*Process, error) {
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	family := uint32(windows.AF_INET)
+	if local.Addr().Is6() {
+		family = windows.AF_INET6
+	}
+	var table []byte
+	var err error
+	switch network {
+	case "tcp":
+		table, err = extendedTable(procGetExtendedTcpTable, family, tcpTableOwnerPidAll)
+	case "udp":
+		table, err = extendedTable(procGetExtendedUdpTable, family, udpTableOwnerPid)
+	default:
+		return nil, fmt.Errorf("unexpected network: %v", network)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pid, ok := findPid(table, network, family == windows.AF_INET6, local)
+	if !ok {
+		return nil, fmt.Errorf("%w: no socket at %v", ErrNotFound, local)
+	}
+	return newProcess(pid)
+}
+
+// extendedTable returns the table of sockets of the family, growing the
+// buffer until it fits.
+func extendedTable(proc *windows.LazyProc, family uint32, class uint32) ([]byte, error) {
+	size := uint32(16 << 10)
+	for {
+		buf := make([]byte, size)
+		ret, _, _ := proc.Call(
+			uintptr(unsafe.Pointer(&buf[0])),
+			uintptr(unsafe.Pointer(&size)),
+			0,
+			uintptr(family),
+			uintptr(class),
+			0,
+		)
+		switch windows.Errno(ret) {
+		case windows.ERROR_SUCCESS:
+			return buf[:size], nil
+		case windows.ERROR_INSUFFICIENT_BUFFER:
+			continue
+		default:
+			return nil, fmt.Errorf("%v: %w", proc.Name, windows.Errno(ret))
+		}
+	}
+}
+
+func newProcess(pid int) (*Process, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return nil, fmt.Errorf("open process %v: %w", pid, err)
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err = windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return nil, fmt.Errorf("query image of process %v: %w", pid, err)
+	}
+	return &Process{Pid: pid, Path: windows.UTF16ToString(buf[:size])}, nil
+}
@@ -0,0 +1,13 @@
+// Package sandbox restricts what the process can do once it is initialized.
+// It is implemented on Linux with Landlock and seccomp.
+package sandbox
+
+type Options struct {
+	// ReadPaths are files and directories that remain readable. Paths that
+	// do not exist are ignored.
+	ReadPaths []string
+	// WritePaths are files and directories that remain writable, including
+	// creating, truncating and removing files beneath the directories. Paths
+	// that do not exist are ignored.
+	WritePaths []string
+}
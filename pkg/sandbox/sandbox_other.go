@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64)
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Apply is not supported on this platform.
+func Apply(opts *Options) error {
+	return fmt.Errorf("sandbox is not supported on %v/%v", runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,163 @@
+// Package schedule describes the weekly time windows in which a user may
+// access the server.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a daily time range on some days of the week. A window that ends
+// before it starts, e.g. 22:00-06:00, ends on the next day.
+type Window struct {
+	Days [7]bool
+	// From and To are minutes since midnight.
+	From int
+	To   int
+}
+
+// ParseWindow parses a window like "mon-fri 08:00-18:00", "sat,sun
+// 10:00-22:00" or "22:00-06:00" (every day).
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	var days, times string
+	switch len(fields) {
+	case 1:
+		days, times = "*", fields[0]
+	case 2:
+		days, times = fields[0], fields[1]
+	default:
+		return Window{}, fmt.Errorf("invalid window: %v", s)
+	}
+	if err := parseDays(&w, strings.ToLower(days)); err != nil {
+		return Window{}, fmt.Errorf("invalid window %v: %w", s, err)
+	}
+	from, to, ok := strings.Cut(times, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid window %v: missing time range", s)
+	}
+	var err error
+	if w.From, err = parseClock(from); err != nil {
+		return Window{}, fmt.Errorf("invalid window %v: %w", s, err)
+	}
+	if w.To, err = parseClock(to); err != nil {
+		return Window{}, fmt.Errorf("invalid window %v: %w", s, err)
+	}
+	return w, nil
+}
+
+func parseDays(w *Window, s string) error {
+	if s == "*" {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		f, ok := weekdays[from]
+		if !ok {
+			return fmt.Errorf("unknown day: %v", from)
+		}
+		if !isRange {
+			w.Days[f] = true
+			continue
+		}
+		t, ok := weekdays[to]
+		if !ok {
+			return fmt.Errorf("unknown day: %v", to)
+		}
+		for d := f; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == t {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses HH:MM into minutes since midnight. 24:00 is allowed as the
+// end of a day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time: %v", s)
+	}
+	hour, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %v", s)
+	}
+	minute, err := strconv.Atoi(m)
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time: %v", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// contains reports whether the window contains the weekday and minute.
+func (w *Window) contains(day time.Weekday, minute int) bool {
+	if w.From <= w.To {
+		return w.Days[day] && minute >= w.From && minute < w.To
+	}
+	// Crossing midnight.
+	if w.Days[day] && minute >= w.From {
+		return true
+	}
+	return w.Days[(day+6)%7] && minute < w.To
+}
+
+// Schedule is a set of windows in a time zone.
+type Schedule struct {
+	Windows  []Window
+	Location *time.Location
+}
+
+// Parse parses the windows of a schedule in the location, which is the local
+// time if nil.
+func Parse(windows []string, loc *time.Location) (*Schedule, error) {
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("no windows")
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	s := &Schedule{Location: loc}
+	for _, window := range windows {
+		w, err := ParseWindow(window)
+		if err != nil {
+			return nil, err
+		}
+		s.Windows = append(s.Windows, w)
+	}
+	return s, nil
+}
+
+// Allows reports whether t is in any window of the schedule. It is safe to
+// call on a nil Schedule, which allows any time.
+func (s *Schedule) Allows(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	t = t.In(s.Location)
+	minute := t.Hour()*60 + t.Minute()
+	for i := range s.Windows {
+		if s.Windows[i].contains(t.Weekday(), minute) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllows(t *testing.T) {
+	s, err := Parse([]string{"mon-fri 08:00-18:00", "sat,sun 22:00-02:00"}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		time string
+		want bool
+	}{
+		{"2023-08-07T08:00:00Z", true},  // Monday
+		{"2023-08-07T07:59:00Z", false}, // Monday
+		{"2023-08-11T17:59:00Z", true},  // Friday
+		{"2023-08-11T18:00:00Z", false}, // Friday
+		{"2023-08-12T12:00:00Z", false}, // Saturday
+		{"2023-08-12T23:00:00Z", true},  // Saturday
+		{"2023-08-13T01:00:00Z", true},  // Sunday, from Saturday
+		{"2023-08-14T01:00:00Z", true},  // Monday, from Sunday
+		{"2023-08-15T01:00:00Z", false}, // Tuesday
+	}
+	for _, tt := range tests {
+		now, _ := time.Parse(time.RFC3339, tt.time)
+		if got := s.Allows(now); got != tt.want {
+			t.Errorf("Allows(%v) = %v, want %v", tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for _, s := range []string{"mon-fri", "mon 8-18", "fun 08:00-18:00", "08:00-25:00", "a b c"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("ParseWindow(%q) succeeded", s)
+		}
+	}
+	w, err := ParseWindow("fri-mon 00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Days != [7]bool{true, true, false, false, false, true, true} {
+		t.Errorf("unexpected days: %v", w.Days)
+	}
+}
@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// RuleStats are the matches of a rule of an acl, to find rules that never
+// match and to verify that new ones do.
+type RuleStats struct {
+	acl    string
+	rule   int
+	action string
+	Hits   atomic.Uint64
+	// lastHit is in unix nanoseconds, zero if never hit.
+	lastHit atomic.Int64
+}
+
+type ruleKey struct {
+	acl  string
+	rule int
+}
+
+// Hit records a match of the rule.
+func (r *RuleStats) Hit() {
+	r.Hits.Add(1)
+	r.lastHit.Store(time.Now().UnixNano())
+}
+
+// LastHit returns when the rule matched last, zero if never.
+func (r *RuleStats) LastHit() time.Time {
+	if t := r.lastHit.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// AclRule returns the statistics of the rule of the acl, e.g. "acl" or
+// "group <name>", creating it if absent.
+func (s *Stats) AclRule(acl string, rule int, action string) *RuleStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ruleKey{acl: acl, rule: rule}
+	r, ok := s.aclRules[key]
+	if !ok {
+		r = &RuleStats{acl: acl, rule: rule, action: action}
+		s.aclRules[key] = r
+	}
+	return r
+}
+
+// AclRules returns the statistics of all rules ordered by acl and rule.
+func (s *Stats) AclRules() []*RuleStats {
+	s.mu.Lock()
+	rules := make([]*RuleStats, 0, len(s.aclRules))
+	for _, r := range s.aclRules {
+		rules = append(rules, r)
+	}
+	s.mu.Unlock()
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].acl != rules[j].acl {
+			return rules[i].acl < rules[j].acl
+		}
+		return rules[i].rule < rules[j].rule
+	})
+	return rules
+}
+
+type AclRuleSnapshot struct {
+	Acl     string     `json:"acl"`
+	Rule    int        `json:"rule"`
+	Action  string     `json:"action"`
+	Hits    uint64     `json:"hits"`
+	LastHit *time.Time `json:"last_hit,omitempty"`
+}
+
+func (r *RuleStats) snapshot() AclRuleSnapshot {
+	snapshot := AclRuleSnapshot{
+		Acl:    r.acl,
+		Rule:   r.rule,
+		Action: r.action,
+		Hits:   r.Hits.Load(),
+	}
+	if t := r.LastHit(); !t.IsZero() {
+		snapshot.LastHit = &t
+	}
+	return snapshot
+}
+
+func writeAclMetrics(p *promWriter, rules []*RuleStats) {
+	if len(rules) == 0 {
+		return
+	}
+	p.header("juicity_acl_rule_hits_total", "counter", "Matches of acl rules, including rules in dry run.")
+	for _, r := range rules {
+		p.sample("juicity_acl_rule_hits_total", r.Hits.Load(), Label{"acl", r.acl}, Label{"rule", strconv.Itoa(r.rule)}, Label{"action", r.action})
+	}
+	p.header("juicity_acl_rule_last_hit_timestamp_seconds", "gauge", "Unix time of the last match of acl rules that matched.")
+	for _, r := range rules {
+		if t := r.lastHit.Load(); t != 0 {
+			p.sample("juicity_acl_rule_last_hit_timestamp_seconds", t/int64(time.Second), Label{"acl", r.acl}, Label{"rule", strconv.Itoa(r.rule)}, Label{"action", r.action})
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+const (
+	AlertTraffic = "traffic"
+	AlertSpeed   = "speed"
+
+	// AlertEachUser is the user of an alert on each user separately.
+	AlertEachUser = "*"
+
+	alertInterval = 5 * time.Second
+	alertTimeout  = 10 * time.Second
+)
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  uint64
+}{
+	{"tib", 1 << 40},
+	{"gib", 1 << 30},
+	{"mib", 1 << 20},
+	{"kib", 1 << 10},
+	{"tb", 1e12},
+	{"gb", 1e9},
+	{"mb", 1e6},
+	{"kb", 1e3},
+	{"b", 1},
+}
+
+// ParseSize parses an amount of bytes like "100 GB" or "1.5gib". A plain
+// number is in bytes.
+func ParseSize(s string) (uint64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	multiplier := uint64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			multiplier = u.bytes
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid size: %v", s)
+	}
+	return uint64(f * float64(multiplier)), nil
+}
+
+// Alert notifies when the traffic or the speed of a user, or of all users
+// together, crosses a threshold.
+type Alert struct {
+	// User is the name of a user, AlertEachUser, or empty for the total.
+	User string
+	// Traffic is the threshold of bytes relayed in both directions, none if
+	// zero.
+	Traffic uint64
+	// Speed is the threshold of bytes per second in either direction, none
+	// if zero.
+	Speed uint64
+	// Webhook is a url the payload is posted to as json.
+	Webhook string
+	// Command is a program and its arguments run with the payload as json on
+	// the standard input.
+	Command []string
+}
+
+// AlertPayload is sent once a threshold is crossed. Text makes it a valid
+// message of Slack and compatible incoming webhooks.
+type AlertPayload struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	User      string    `json:"user,omitempty"`
+	Threshold uint64    `json:"threshold"`
+	Value     uint64    `json:"value"`
+	Up        uint64    `json:"up"`
+	Down      uint64    `json:"down"`
+	Text      string    `json:"text"`
+}
+
+// PeerTraffic reports the traffic of users on other instances of a cluster.
+type PeerTraffic interface {
+	// Traffic returns the cumulative traffic of the user, or of all users if
+	// user is empty.
+	Traffic(user string) (up, down uint64)
+	// Leader reports whether this instance notifies of the traffic alerts of
+	// the cluster. Exactly one live instance should.
+	Leader() bool
+}
+
+// Alerter checks the alerts periodically. An alert fires once when its
+// threshold is crossed, and again only after the value has dropped below,
+// e.g. when the speed calms down.
+type Alerter struct {
+	logger *log.Logger
+	stats  *Stats
+	alerts []Alert
+	client *http.Client
+	peers  PeerTraffic
+
+	mu sync.Mutex
+	// fired are the keys of alerts above their thresholds.
+	fired map[alertKey]bool
+}
+
+type alertKey struct {
+	alert int
+	typ   string
+	user  string
+}
+
+func NewAlerter(s *Stats, logger *log.Logger, alerts []Alert) (*Alerter, error) {
+	for _, a := range alerts {
+		if a.Traffic == 0 && a.Speed == 0 {
+			return nil, fmt.Errorf("alert requires a traffic or speed threshold")
+		}
+		if a.Webhook == "" && len(a.Command) == 0 {
+			return nil, fmt.Errorf("alert requires a webhook or a command")
+		}
+	}
+	return &Alerter{
+		logger: logger,
+		stats:  s,
+		alerts: alerts,
+		client: &http.Client{Timeout: alertTimeout},
+		fired:  make(map[alertKey]bool),
+	}, nil
+}
+
+// SetPeers adds the traffic of users on the peers to the traffic of the
+// alerts, so that thresholds hold for a cluster as a whole. Every instance
+// sees the same crossings, so only the leader notifies of them; the others
+// keep track of them, so that a new leader does not notify of them again.
+// Speed alerts stay per instance. It is called before Run.
+func (a *Alerter) SetPeers(peers PeerTraffic) {
+	a.peers = peers
+}
+
+// Run checks the alerts every alertInterval until ctx is done.
+func (a *Alerter) Run(ctx context.Context) {
+	ticker := time.NewTicker(alertInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		a.Check(ctx)
+	}
+}
+
+// Check checks the alerts once, notifying in the background.
+func (a *Alerter) Check(ctx context.Context) {
+	for i := range a.alerts {
+		alert := &a.alerts[i]
+		switch alert.User {
+		case "":
+			up, down := a.stats.Speed()
+			a.check(ctx, i, "", &a.stats.total, up, down)
+		case AlertEachUser:
+			for _, u := range a.stats.Users() {
+				up, down := u.Speed()
+				a.check(ctx, i, u.name, &u.Traffic, up, down)
+			}
+		default:
+			a.stats.mu.Lock()
+			u, ok := a.stats.users[alert.User]
+			a.stats.mu.Unlock()
+			if ok {
+				up, down := u.Speed()
+				a.check(ctx, i, u.name, &u.Traffic, up, down)
+			}
+		}
+	}
+}
+
+func (a *Alerter) check(ctx context.Context, i int, user string, t *Traffic, upSpeed uint64, downSpeed uint64) {
+	alert := &a.alerts[i]
+	up, down := t.Up.Load(), t.Down.Load()
+	leader := true
+	if a.peers != nil {
+		peerUp, peerDown := a.peers.Traffic(user)
+		up, down = up+peerUp, down+peerDown
+		leader = a.peers.Leader()
+	}
+	if alert.Traffic > 0 {
+		a.cross(ctx, alertKey{i, AlertTraffic, user}, alert.Traffic, up+down, up, down, leader)
+	}
+	if alert.Speed > 0 {
+		a.cross(ctx, alertKey{i, AlertSpeed, user}, alert.Speed, max(upSpeed, downSpeed), upSpeed, downSpeed, true)
+	}
+}
+
+func (a *Alerter) cross(ctx context.Context, key alertKey, threshold uint64, value uint64, up uint64, down uint64, notify bool) {
+	a.mu.Lock()
+	above := value >= threshold
+	crossed := above && !a.fired[key]
+	if above {
+		a.fired[key] = true
+	} else {
+		delete(a.fired, key)
+	}
+	a.mu.Unlock()
+	if !crossed || !notify {
+		return
+	}
+	p := &AlertPayload{
+		Time:      time.Now(),
+		Type:      key.typ,
+		User:      key.user,
+		Threshold: threshold,
+		Value:     value,
+		Up:        up,
+		Down:      down,
+	}
+	who := "all users"
+	if key.user != "" {
+		who = "user " + key.user
+	}
+	switch key.typ {
+	case AlertTraffic:
+		p.Text = fmt.Sprintf("juicity: traffic of %v reached %v bytes (threshold %v)", who, value, threshold)
+	case AlertSpeed:
+		p.Text = fmt.Sprintf("juicity: speed of %v reached %v bytes/s (threshold %v)", who, value, threshold)
+	}
+	go a.notify(ctx, &a.alerts[key.alert], p)
+}
+
+func (a *Alerter) notify(ctx context.Context, alert *Alert, p *AlertPayload) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, alertTimeout)
+	defer cancel()
+	if alert.Webhook != "" {
+		if err := a.post(ctx, alert.Webhook, b); err != nil {
+			a.logger.Warn().
+				Err(err).
+				Str("type", p.Type).
+				Str("user", p.User).
+				Msg("Failed to post alert")
+		}
+	}
+	if len(alert.Command) > 0 {
+		cmd := exec.CommandContext(ctx, alert.Command[0], alert.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(b)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			a.logger.Warn().
+				Err(err).
+				Str("type", p.Type).
+				Str("user", p.User).
+				Bytes("output", bytes.TrimSpace(out)).
+				Msg("Failed to run alert command")
+		}
+	}
+}
+
+func (a *Alerter) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook responded %v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
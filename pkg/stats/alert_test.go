@@ -0,0 +1,188 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]uint64{
+		"100 GB": 100e9,
+		"1.5gib": 3 << 29,
+		"2048":   2048,
+		"10 kb":  10e3,
+	} {
+		if got, err := ParseSize(s); err != nil || got != want {
+			t.Errorf("%v: got %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "GB", "-1 GB", "10 apples"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("%v: expected an error", s)
+		}
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	posted := make(chan AlertPayload, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p AlertPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		posted <- p
+	}))
+	defer srv.Close()
+	out := filepath.Join(t.TempDir(), "alert.json")
+
+	s := New()
+	alice := s.User("alice")
+	bob := s.User("bob")
+	a, err := NewAlerter(s, log.NewLogger(&log.Options{}), []Alert{
+		{User: AlertEachUser, Traffic: 1000, Webhook: srv.URL},
+		{Traffic: 1500, Command: []string{"sh", "-c", "cat > " + out}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Upload(600)
+	alice.Download(600)
+	bob.Upload(100)
+	a.Check(context.Background())
+	select {
+	case p := <-posted:
+		if p.Type != AlertTraffic || p.User != "alice" || p.Value != 1200 || p.Threshold != 1000 || p.Text == "" {
+			t.Fatalf("got payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook posted")
+	}
+
+	// Alerts fire once per crossing.
+	bob.Upload(400)
+	a.Check(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(out)
+		var p AlertPayload
+		if json.Unmarshal(b, &p) == nil {
+			if p.User != "" || p.Value != 1700 {
+				t.Fatalf("got payload %+v of the command", p)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no command run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Check(context.Background())
+	select {
+	case p := <-posted:
+		t.Fatalf("unexpected payload %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := NewAlerter(s, nil, []Alert{{Traffic: 1}}); err == nil {
+		t.Error("expected an error without a webhook or a command")
+	}
+	if _, err := NewAlerter(s, nil, []Alert{{Webhook: srv.URL}}); err == nil {
+		t.Error("expected an error without a threshold")
+	}
+}
+
+type fakePeerTraffic struct {
+	users    map[string][2]uint64
+	follower bool
+}
+
+func (p *fakePeerTraffic) Traffic(user string) (up, down uint64) {
+	return p.users[user][0], p.users[user][1]
+}
+
+func (p *fakePeerTraffic) Leader() bool {
+	return !p.follower
+}
+
+func TestAlerterPeers(t *testing.T) {
+	posted := make(chan AlertPayload, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p AlertPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		posted <- p
+	}))
+	defer srv.Close()
+
+	s := New()
+	s.User("alice").Upload(400)
+	a, err := NewAlerter(s, log.NewLogger(&log.Options{}), []Alert{
+		{User: "alice", Traffic: 1000, Webhook: srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetPeers(&fakePeerTraffic{users: map[string][2]uint64{"alice": {300, 300}}})
+	a.Check(context.Background())
+	select {
+	case p := <-posted:
+		if p.User != "alice" || p.Value != 1000 || p.Up != 700 || p.Down != 300 {
+			t.Fatalf("got payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the traffic of the peers was not counted")
+	}
+}
+
+func TestAlerterFollower(t *testing.T) {
+	posted := make(chan AlertPayload, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p AlertPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		posted <- p
+	}))
+	defer srv.Close()
+
+	s := New()
+	s.User("alice").Upload(400)
+	a, err := NewAlerter(s, log.NewLogger(&log.Options{}), []Alert{
+		{User: "alice", Traffic: 1000, Webhook: srv.URL},
+		{User: "bob", Traffic: 1000, Webhook: srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := &fakePeerTraffic{users: map[string][2]uint64{"alice": {300, 300}}, follower: true}
+	a.SetPeers(peers)
+	a.Check(context.Background())
+	// A follower keeps track of the crossing of alice without notifying, so
+	// that it does not notify of it once it leads.
+	peers.follower = false
+	a.Check(context.Background())
+	s.User("bob").Upload(1000)
+	a.Check(context.Background())
+	select {
+	case p := <-posted:
+		if p.User != "bob" {
+			t.Fatalf("got payload %+v, want the one of bob", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the leader did not notify")
+	}
+	select {
+	case p := <-posted:
+		t.Fatalf("got payload %+v, want none", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,94 @@
+package stats
+
+import "sync/atomic"
+
+// Class is a rough class of relayed traffic, sniffed from the first bytes
+// of a stream.
+type Class uint8
+
+const (
+	ClassUnknown Class = iota
+	ClassTls
+	ClassHttp
+	ClassQuic
+	ClassDns
+	ClassBittorrent
+	numClasses
+)
+
+var classNames = [numClasses]string{
+	ClassUnknown:    "unknown",
+	ClassTls:        "tls",
+	ClassHttp:       "http",
+	ClassQuic:       "quic",
+	ClassDns:        "dns",
+	ClassBittorrent: "bittorrent",
+}
+
+func (c Class) String() string {
+	if c >= numClasses {
+		return classNames[ClassUnknown]
+	}
+	return classNames[c]
+}
+
+// ClassTraffic counts the streams and bytes of a class.
+type ClassTraffic struct {
+	Traffic
+	Streams atomic.Uint64
+}
+
+type ClassSnapshot struct {
+	Streams uint64 `json:"streams"`
+	Up      uint64 `json:"up"`
+	Down    uint64 `json:"down"`
+}
+
+// Class returns the traffic of the user in the class.
+func (u *UserStats) Class(c Class) *ClassTraffic {
+	if c >= numClasses {
+		c = ClassUnknown
+	}
+	return &u.classes[c]
+}
+
+func (u *UserStats) classSnapshots() map[string]ClassSnapshot {
+	var m map[string]ClassSnapshot
+	for c := range u.classes {
+		t := &u.classes[c]
+		if t.Streams.Load() == 0 {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]ClassSnapshot)
+		}
+		m[Class(c).String()] = ClassSnapshot{
+			Streams: t.Streams.Load(),
+			Up:      t.Up.Load(),
+			Down:    t.Down.Load(),
+		}
+	}
+	return m
+}
+
+func writeClassMetrics(p *promWriter, users []*UserStats) {
+	p.header("juicity_user_class_streams_total", "counter", "Relayed streams by user and sniffed class.")
+	for _, u := range users {
+		for c := range u.classes {
+			if n := u.classes[c].Streams.Load(); n > 0 {
+				p.sample("juicity_user_class_streams_total", n, Label{"user", u.name}, Label{"class", Class(c).String()})
+			}
+		}
+	}
+	p.header("juicity_user_class_traffic_bytes_total", "counter", "Relayed bytes by user and sniffed class.")
+	for _, u := range users {
+		for c := range u.classes {
+			t := &u.classes[c]
+			if t.Streams.Load() == 0 {
+				continue
+			}
+			p.sample("juicity_user_class_traffic_bytes_total", t.Up.Load(), Label{"user", u.name}, Label{"class", Class(c).String()}, Label{"direction", "up"})
+			p.sample("juicity_user_class_traffic_bytes_total", t.Down.Load(), Label{"user", u.name}, Label{"class", Class(c).String()}, Label{"direction", "down"})
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+const (
+	ExporterInfluxDB = "influxdb"
+	ExporterGraphite = "graphite"
+
+	DefaultExporterInterval = 10 * time.Second
+	DefaultExporterPrefix   = "juicity"
+	exporterTimeout         = 10 * time.Second
+)
+
+type ExporterOptions struct {
+	Logger *log.Logger
+	// Type is one of influxdb and graphite.
+	Type string
+	// Address is the write url of influxdb, e.g.
+	// http://127.0.0.1:8086/api/v2/write?org=my_org&bucket=juicity, or the
+	// host:port of the graphite plaintext receiver.
+	Address string
+	// Token is sent as "Authorization: Token <token>" to influxdb.
+	Token string
+	// Prefix is the measurement prefix of influxdb or the metric path prefix
+	// of graphite.
+	Prefix   string
+	Interval time.Duration
+}
+
+// Exporter pushes stats to influxdb or graphite periodically.
+type Exporter struct {
+	ExporterOptions
+	stats  *Stats
+	client *http.Client
+}
+
+func NewExporter(s *Stats, opts ExporterOptions) (*Exporter, error) {
+	switch opts.Type {
+	case ExporterInfluxDB, ExporterGraphite:
+	default:
+		return nil, fmt.Errorf("unsupported exporter type: %v", opts.Type)
+	}
+	if opts.Address == "" {
+		return nil, fmt.Errorf("exporter address is required")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultExporterInterval
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultExporterPrefix
+	}
+	return &Exporter{
+		ExporterOptions: opts,
+		stats:           s,
+		client:          &http.Client{Timeout: exporterTimeout},
+	}, nil
+}
+
+// Run pushes stats every interval until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := e.Push(ctx); err != nil {
+			e.Logger.Warn().
+				Err(err).
+				Str("type", e.Type).
+				Str("address", e.Address).
+				Msg("Failed to push stats")
+		}
+	}
+}
+
+// Push pushes the current stats once.
+func (e *Exporter) Push(ctx context.Context) error {
+	snapshot := e.stats.Snapshot()
+	var buf bytes.Buffer
+	switch e.Type {
+	case ExporterInfluxDB:
+		writeInfluxLines(&buf, e.Prefix, snapshot)
+		return e.pushInflux(ctx, &buf)
+	case ExporterGraphite:
+		writeGraphiteLines(&buf, e.Prefix, snapshot)
+		return e.pushGraphite(ctx, &buf)
+	}
+	return nil
+}
+
+func (e *Exporter) pushInflux(ctx context.Context, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Address, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.Token != "" {
+		req.Header.Set("Authorization", "Token "+e.Token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influxdb responded %v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (e *Exporter) pushGraphite(ctx context.Context, body io.Reader) error {
+	d := net.Dialer{Timeout: exporterTimeout}
+	conn, err := d.DialContext(ctx, "tcp", e.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(exporterTimeout))
+	_, err = io.Copy(conn, body)
+	return err
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// writeInfluxLines writes the snapshot in the influxdb line protocol.
+func writeInfluxLines(w io.Writer, prefix string, s *Snapshot) {
+	ts := s.Time.UnixNano()
+	fmt.Fprintf(w, "%v_traffic up=%vi,down=%vi %v\n", prefix, s.Up, s.Down, ts)
+	for _, u := range s.Users {
+		fmt.Fprintf(w, "%v_user,user=%v up=%vi,down=%vi,connections=%vi %v\n",
+			prefix, influxTagEscaper.Replace(u.Name), u.Up, u.Down, u.Connections, ts)
+	}
+	for reason, n := range s.AuthFailures {
+		fmt.Fprintf(w, "%v_auth_failures,reason=%v count=%vi %v\n", prefix, influxTagEscaper.Replace(reason), n, ts)
+	}
+}
+
+var graphiteEscaper = strings.NewReplacer(".", "_", " ", "_")
+
+// writeGraphiteLines writes the snapshot in the graphite plaintext protocol.
+func writeGraphiteLines(w io.Writer, prefix string, s *Snapshot) {
+	ts := s.Time.Unix()
+	fmt.Fprintf(w, "%v.traffic.up %v %v\n", prefix, s.Up, ts)
+	fmt.Fprintf(w, "%v.traffic.down %v %v\n", prefix, s.Down, ts)
+	for _, u := range s.Users {
+		name := graphiteEscaper.Replace(u.Name)
+		fmt.Fprintf(w, "%v.users.%v.up %v %v\n", prefix, name, u.Up, ts)
+		fmt.Fprintf(w, "%v.users.%v.down %v %v\n", prefix, name, u.Down, ts)
+		fmt.Fprintf(w, "%v.users.%v.connections %v %v\n", prefix, name, u.Connections, ts)
+	}
+	for reason, n := range s.AuthFailures {
+		fmt.Fprintf(w, "%v.auth_failures.%v %v %v\n", prefix, graphiteEscaper.Replace(reason), n, ts)
+	}
+}
@@ -0,0 +1,105 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+const DefaultSaveInterval = 5 * time.Minute
+
+type persistedTraffic struct {
+	Up   uint64 `json:"up"`
+	Down uint64 `json:"down"`
+}
+
+type persistedStats struct {
+	Time  time.Time                   `json:"time"`
+	Total persistedTraffic            `json:"total"`
+	Users map[string]persistedTraffic `json:"users"`
+}
+
+// Save writes the cumulative traffic counters to the file. The file is
+// replaced atomically so that a crash never leaves a truncated file.
+func (s *Stats) Save(path string) error {
+	p := persistedStats{
+		Time: time.Now(),
+		Total: persistedTraffic{
+			Up:   s.total.Up.Load(),
+			Down: s.total.Down.Load(),
+		},
+		Users: make(map[string]persistedTraffic),
+	}
+	for _, u := range s.Users() {
+		p.Users[u.name] = persistedTraffic{
+			Up:   u.Up.Load(),
+			Down: u.Down.Load(),
+		}
+	}
+	b, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Load restores the cumulative traffic counters from the file. A missing
+// file is not an error.
+func (s *Stats) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var p persistedStats
+	if err = json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("parse %v: %w", path, err)
+	}
+	s.total.Up.Store(p.Total.Up)
+	s.total.Down.Store(p.Total.Down)
+	for name, t := range p.Users {
+		u := s.User(name)
+		u.Up.Store(t.Up)
+		u.Down.Store(t.Down)
+	}
+	return nil
+}
+
+// SaveEvery saves the stats to the file every interval.
+func (s *Stats) SaveEvery(path string, interval time.Duration, logger *log.Logger) {
+	if interval <= 0 {
+		interval = DefaultSaveInterval
+	}
+	for range time.Tick(interval) {
+		if err := s.Save(path); err != nil {
+			logger.Warn().
+				Err(err).
+				Str("file", path).
+				Msg("Failed to save stats")
+		}
+	}
+}
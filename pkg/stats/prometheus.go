@@ -0,0 +1,51 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Label is a prometheus label pair.
+type Label struct {
+	Name  string
+	Value string
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// promWriter writes the prometheus text exposition format and keeps the
+// first write error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name string, value any, labels ...Label) {
+	if p.err != nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(l.Name)
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(l.Value))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	_, p.err = fmt.Fprintf(p.w, "%v %v\n", b.String(), value)
+}
@@ -0,0 +1,109 @@
+package stats
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// SocketStats are the statistics of the UDP socket of a listener.
+type SocketStats struct {
+	listen string
+	// Drops are the datagrams dropped by the kernel since the socket was
+	// opened, mostly because the receive buffer was full. Only known on
+	// Linux.
+	Drops      atomic.Uint64
+	SendErrors atomic.Uint64
+	// ReadBatches and ReadPackets give the average number of datagrams read
+	// by a system call.
+	ReadBatches atomic.Uint64
+	ReadPackets atomic.Uint64
+	// ReceiveBuffer and SendBuffer are the buffer sizes of the socket, zero
+	// if unknown.
+	ReceiveBuffer atomic.Int64
+	SendBuffer    atomic.Int64
+}
+
+// Listen returns the address of the listener.
+func (s *SocketStats) Listen() string {
+	return s.listen
+}
+
+// Socket returns the statistics of the socket of the listener, creating it
+// if absent.
+func (s *Stats) Socket(listen string) *SocketStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sock, ok := s.sockets[listen]
+	if !ok {
+		sock = &SocketStats{listen: listen}
+		s.sockets[listen] = sock
+	}
+	return sock
+}
+
+// Sockets returns the statistics of all sockets ordered by listen address.
+func (s *Stats) Sockets() []*SocketStats {
+	s.mu.Lock()
+	sockets := make([]*SocketStats, 0, len(s.sockets))
+	for _, sock := range s.sockets {
+		sockets = append(sockets, sock)
+	}
+	s.mu.Unlock()
+	sort.Slice(sockets, func(i, j int) bool {
+		return sockets[i].listen < sockets[j].listen
+	})
+	return sockets
+}
+
+type SocketSnapshot struct {
+	Listen        string `json:"listen"`
+	Drops         uint64 `json:"drops"`
+	SendErrors    uint64 `json:"send_errors"`
+	ReadBatches   uint64 `json:"read_batches"`
+	ReadPackets   uint64 `json:"read_packets"`
+	ReceiveBuffer int64  `json:"receive_buffer"`
+	SendBuffer    int64  `json:"send_buffer"`
+}
+
+func (s *SocketStats) snapshot() SocketSnapshot {
+	return SocketSnapshot{
+		Listen:        s.listen,
+		Drops:         s.Drops.Load(),
+		SendErrors:    s.SendErrors.Load(),
+		ReadBatches:   s.ReadBatches.Load(),
+		ReadPackets:   s.ReadPackets.Load(),
+		ReceiveBuffer: s.ReceiveBuffer.Load(),
+		SendBuffer:    s.SendBuffer.Load(),
+	}
+}
+
+func writeSocketMetrics(p *promWriter, sockets []*SocketStats) {
+	if len(sockets) == 0 {
+		return
+	}
+	p.header("juicity_udp_receive_drops_total", "counter", "Datagrams dropped by the kernel by listener.")
+	for _, sock := range sockets {
+		p.sample("juicity_udp_receive_drops_total", sock.Drops.Load(), Label{"listen", sock.listen})
+	}
+	p.header("juicity_udp_send_errors_total", "counter", "Failed sends of datagrams by listener.")
+	for _, sock := range sockets {
+		p.sample("juicity_udp_send_errors_total", sock.SendErrors.Load(), Label{"listen", sock.listen})
+	}
+	p.header("juicity_udp_read_batches_total", "counter", "Batched reads of datagrams by listener.")
+	for _, sock := range sockets {
+		p.sample("juicity_udp_read_batches_total", sock.ReadBatches.Load(), Label{"listen", sock.listen})
+	}
+	p.header("juicity_udp_read_packets_total", "counter", "Datagrams read in batches by listener.")
+	for _, sock := range sockets {
+		p.sample("juicity_udp_read_packets_total", sock.ReadPackets.Load(), Label{"listen", sock.listen})
+	}
+	p.header("juicity_udp_buffer_bytes", "gauge", "Socket buffer sizes by listener.")
+	for _, sock := range sockets {
+		if size := sock.ReceiveBuffer.Load(); size > 0 {
+			p.sample("juicity_udp_buffer_bytes", size, Label{"listen", sock.listen}, Label{"buffer", "receive"})
+		}
+		if size := sock.SendBuffer.Load(); size > 0 {
+			p.sample("juicity_udp_buffer_bytes", size, Label{"listen", sock.listen}, Label{"buffer", "send"})
+		}
+	}
+}
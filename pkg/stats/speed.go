@@ -0,0 +1,75 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	speedSampleInterval = time.Second
+	// speedWindow is the number of samples the speed is averaged over.
+	speedWindow = 10
+)
+
+type speedSample struct {
+	time time.Time
+	up   uint64
+	down uint64
+}
+
+// speedMeter computes the throughput of a Traffic over a sliding window.
+type speedMeter struct {
+	mu      sync.Mutex
+	samples [speedWindow + 1]speedSample
+	n       int
+	next    int
+}
+
+func (m *speedMeter) sample(t *Traffic, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples[m.next] = speedSample{
+		time: now,
+		up:   t.Up.Load(),
+		down: t.Down.Load(),
+	}
+	m.next = (m.next + 1) % len(m.samples)
+	if m.n < len(m.samples) {
+		m.n++
+	}
+}
+
+// speed returns bytes per second of both directions.
+func (m *speedMeter) speed() (up uint64, down uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.n < 2 {
+		return 0, 0
+	}
+	last := m.samples[(m.next-1+len(m.samples))%len(m.samples)]
+	first := m.samples[(m.next-m.n+len(m.samples))%len(m.samples)]
+	elapsed := last.time.Sub(first.time).Seconds()
+	if elapsed <= 0 || last.up < first.up || last.down < first.down {
+		return 0, 0
+	}
+	return uint64(float64(last.up-first.up) / elapsed), uint64(float64(last.down-first.down) / elapsed)
+}
+
+func (s *Stats) sampleSpeed() {
+	for now := range time.Tick(speedSampleInterval) {
+		s.totalSpeed.sample(&s.total, now)
+		for _, u := range s.Users() {
+			u.speed.sample(&u.Traffic, now)
+		}
+	}
+}
+
+// Speed returns the current throughput of the user in bytes per second.
+func (u *UserStats) Speed() (up uint64, down uint64) {
+	return u.speed.speed()
+}
+
+// Speed returns the current throughput of all users in bytes per second.
+func (s *Stats) Speed() (up uint64, down uint64) {
+	return s.totalSpeed.speed()
+}
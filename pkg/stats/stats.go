@@ -0,0 +1,323 @@
+package stats
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons of authentication failures.
+const (
+	AuthFailureUnknownUser = "unknown_user"
+	AuthFailureBadToken    = "bad_token"
+	AuthFailureTimeout     = "timeout"
+	AuthFailureProtocol    = "protocol"
+	AuthFailureSuspended   = "suspended"
+	AuthFailureConnLimit   = "connection_limit"
+	AuthFailureSchedule    = "schedule"
+)
+
+var authFailureReasons = []string{
+	AuthFailureUnknownUser,
+	AuthFailureBadToken,
+	AuthFailureTimeout,
+	AuthFailureProtocol,
+	AuthFailureSuspended,
+	AuthFailureConnLimit,
+	AuthFailureSchedule,
+}
+
+const (
+	// topTableSize bounds the memory used to track heavy sources and
+	// destinations.
+	topTableSize = 1024
+	// topExported is the number of top entries exported.
+	topExported = 10
+	// recentAuthFailures is the number of authentication failures kept for
+	// inspection.
+	recentAuthFailures = 20
+)
+
+type AuthFailure struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Reason string    `json:"reason"`
+}
+
+// Stats collects server statistics and exports them in the prometheus text
+// format.
+type Stats struct {
+	// instance identifies this process among the instances of a cluster.
+	instance           string
+	mu                 sync.Mutex
+	authFailures       map[string]*atomic.Uint64
+	recentAuthFailures []AuthFailure
+	users              map[string]*UserStats
+	sockets            map[string]*SocketStats
+	aclRules           map[ruleKey]*RuleStats
+
+	total      Traffic
+	totalSpeed speedMeter
+	// certNotAfter is the expiry of the server certificate in unix seconds,
+	// zero if unknown.
+	certNotAfter atomic.Int64
+	// handshakes are the completed handshakes, full ones first and resumed
+	// ones second.
+	handshakes         [2]atomic.Uint64
+	authFailureSources *TopN
+	destinations       *TopN
+}
+
+func New() *Stats {
+	instance := make([]byte, 8)
+	_, _ = rand.Read(instance)
+	s := &Stats{
+		instance:           hex.EncodeToString(instance),
+		authFailures:       make(map[string]*atomic.Uint64, len(authFailureReasons)),
+		users:              make(map[string]*UserStats),
+		sockets:            make(map[string]*SocketStats),
+		aclRules:           make(map[ruleKey]*RuleStats),
+		authFailureSources: NewTopN(topTableSize),
+		destinations:       NewTopN(topTableSize),
+	}
+	for _, reason := range authFailureReasons {
+		s.authFailures[reason] = &atomic.Uint64{}
+	}
+	go s.sampleSpeed()
+	return s
+}
+
+// SourcePrefix aggregates a source address to its /24 (IPv4) or /48 (IPv6)
+// network, so that one attacker cannot flood the table with many addresses.
+func SourcePrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// AuthFailed records an authentication failure of given reason from source.
+func (s *Stats) AuthFailed(reason string, source netip.Addr) {
+	s.mu.Lock()
+	counter, ok := s.authFailures[reason]
+	if !ok {
+		counter = &atomic.Uint64{}
+		s.authFailures[reason] = counter
+	}
+	if len(s.recentAuthFailures) >= recentAuthFailures {
+		s.recentAuthFailures = append(s.recentAuthFailures[:0], s.recentAuthFailures[1:]...)
+	}
+	s.recentAuthFailures = append(s.recentAuthFailures, AuthFailure{
+		Time:   time.Now(),
+		Source: source.String(),
+		Reason: reason,
+	})
+	s.mu.Unlock()
+	counter.Add(1)
+	if source.IsValid() {
+		s.authFailureSources.Add(SourcePrefix(source).String(), 1)
+	}
+}
+
+// Handshake records a completed handshake, resumed from a session ticket
+// or full.
+func (s *Stats) Handshake(resumed bool) {
+	if resumed {
+		s.handshakes[1].Add(1)
+	} else {
+		s.handshakes[0].Add(1)
+	}
+}
+
+// User returns the statistics of the user, creating it if absent.
+func (s *Stats) User(name string) *UserStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		u = &UserStats{name: name, total: &s.total}
+		s.users[name] = u
+	}
+	return u
+}
+
+// Instance returns the random id of this process, which differs from those of
+// the other instances of a cluster.
+func (s *Stats) Instance() string {
+	return s.instance
+}
+
+// Users returns the statistics of all seen users ordered by name.
+func (s *Stats) Users() []*UserStats {
+	s.mu.Lock()
+	users := make([]*UserStats, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	s.mu.Unlock()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].name < users[j].name
+	})
+	return users
+}
+
+// Total returns the traffic of all users.
+func (s *Stats) Total() *Traffic {
+	return &s.total
+}
+
+// Destination records a request to the destination host.
+func (s *Stats) Destination(host string) {
+	s.destinations.Add(host, 1)
+}
+
+// Snapshot is a point-in-time view of Stats suitable for json encoding.
+type Snapshot struct {
+	Instance           string            `json:"instance"`
+	Time               time.Time         `json:"time"`
+	Up                 uint64            `json:"up"`
+	Down               uint64            `json:"down"`
+	UpSpeed            uint64            `json:"up_speed"`
+	DownSpeed          uint64            `json:"down_speed"`
+	Users              []UserSnapshot    `json:"users"`
+	TopDestinations    []TopNEntry       `json:"top_destinations"`
+	AuthFailures       map[string]uint64 `json:"auth_failures"`
+	RecentAuthFailures []AuthFailure     `json:"recent_auth_failures"`
+	Sockets            []SocketSnapshot  `json:"sockets,omitempty"`
+	AclRules           []AclRuleSnapshot `json:"acl_rules,omitempty"`
+}
+
+type UserSnapshot struct {
+	Name        string `json:"name"`
+	Connections int64  `json:"connections"`
+	Up          uint64 `json:"up"`
+	Down        uint64 `json:"down"`
+	UpSpeed     uint64 `json:"up_speed"`
+	DownSpeed   uint64 `json:"down_speed"`
+	// RttMs is the latest heartbeat round-trip time in milliseconds.
+	RttMs float64 `json:"rtt_ms,omitempty"`
+	// Classes are the streams and bytes by sniffed class, e.g. "tls".
+	Classes map[string]ClassSnapshot `json:"classes,omitempty"`
+}
+
+func (s *Stats) Snapshot() *Snapshot {
+	snapshot := &Snapshot{
+		Instance:        s.instance,
+		Time:            time.Now(),
+		Up:              s.total.Up.Load(),
+		Down:            s.total.Down.Load(),
+		TopDestinations: s.destinations.Top(topExported),
+		AuthFailures:    make(map[string]uint64),
+	}
+	snapshot.UpSpeed, snapshot.DownSpeed = s.Speed()
+	for _, u := range s.Users() {
+		upSpeed, downSpeed := u.Speed()
+		snapshot.Users = append(snapshot.Users, UserSnapshot{
+			Name:        u.name,
+			Connections: u.Connections.Load(),
+			Up:          u.Up.Load(),
+			Down:        u.Down.Load(),
+			UpSpeed:     upSpeed,
+			DownSpeed:   downSpeed,
+			RttMs:       math.Round(float64(u.Rtt().Microseconds())/10) / 100,
+			Classes:     u.classSnapshots(),
+		})
+	}
+	s.mu.Lock()
+	for reason, counter := range s.authFailures {
+		snapshot.AuthFailures[reason] = counter.Load()
+	}
+	snapshot.RecentAuthFailures = append([]AuthFailure(nil), s.recentAuthFailures...)
+	s.mu.Unlock()
+	for _, sock := range s.Sockets() {
+		snapshot.Sockets = append(snapshot.Sockets, sock.snapshot())
+	}
+	for _, r := range s.AclRules() {
+		snapshot.AclRules = append(snapshot.AclRules, r.snapshot())
+	}
+	return snapshot
+}
+
+// SetCertNotAfter sets the expiry of the server certificate.
+func (s *Stats) SetCertNotAfter(t time.Time) {
+	s.certNotAfter.Store(t.Unix())
+}
+
+// WritePrometheus writes all metrics in the prometheus text format.
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	p := &promWriter{w: w}
+
+	p.header("juicity_auth_failures_total", "counter", "Authentication failures by reason.")
+	s.mu.Lock()
+	reasons := make([]string, 0, len(s.authFailures))
+	for reason := range s.authFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		p.sample("juicity_auth_failures_total", s.authFailures[reason].Load(), Label{"reason", reason})
+	}
+	s.mu.Unlock()
+
+	p.header("juicity_auth_failures_by_source", "gauge", "Approximate authentication failures of the top source prefixes.")
+	for _, e := range s.authFailureSources.Top(topExported) {
+		p.sample("juicity_auth_failures_by_source", e.Count, Label{"prefix", e.Key})
+	}
+
+	p.header("juicity_handshakes_total", "counter", "Completed handshakes by whether a session was resumed.")
+	p.sample("juicity_handshakes_total", s.handshakes[0].Load(), Label{"resumed", "false"})
+	p.sample("juicity_handshakes_total", s.handshakes[1].Load(), Label{"resumed", "true"})
+
+	if notAfter := s.certNotAfter.Load(); notAfter != 0 {
+		days := time.Until(time.Unix(notAfter, 0)).Hours() / 24
+		p.header("juicity_cert_expiry_days", "gauge", "Days remaining until the server certificate expires.")
+		p.sample("juicity_cert_expiry_days", math.Round(days*100)/100)
+	}
+
+	p.header("juicity_traffic_bytes_total", "counter", "Relayed bytes of all users.")
+	p.sample("juicity_traffic_bytes_total", s.total.Up.Load(), Label{"direction", "up"})
+	p.sample("juicity_traffic_bytes_total", s.total.Down.Load(), Label{"direction", "down"})
+
+	users := s.Users()
+	p.header("juicity_user_traffic_bytes_total", "counter", "Relayed bytes by user.")
+	for _, u := range users {
+		p.sample("juicity_user_traffic_bytes_total", u.Up.Load(), Label{"user", u.name}, Label{"direction", "up"})
+		p.sample("juicity_user_traffic_bytes_total", u.Down.Load(), Label{"user", u.name}, Label{"direction", "down"})
+	}
+	p.header("juicity_user_speed_bytes", "gauge", "Throughput by user in bytes per second over a sliding window.")
+	for _, u := range users {
+		upSpeed, downSpeed := u.Speed()
+		p.sample("juicity_user_speed_bytes", upSpeed, Label{"user", u.name}, Label{"direction", "up"})
+		p.sample("juicity_user_speed_bytes", downSpeed, Label{"user", u.name}, Label{"direction", "down"})
+	}
+	p.header("juicity_user_connections", "gauge", "Active connections by user.")
+	for _, u := range users {
+		p.sample("juicity_user_connections", u.Connections.Load(), Label{"user", u.name})
+	}
+	p.header("juicity_user_rtt_seconds", "gauge", "Latest heartbeat round-trip time by user.")
+	for _, u := range users {
+		if rtt := u.Rtt(); rtt > 0 {
+			p.sample("juicity_user_rtt_seconds", rtt.Seconds(), Label{"user", u.name})
+		}
+	}
+	writeClassMetrics(p, users)
+	writeSocketMetrics(p, s.Sockets())
+	writeAclMetrics(p, s.AclRules())
+	return p.err
+}
+
+// ServeHTTP implements http.Handler to be scraped by prometheus.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = s.WritePrometheus(w)
+}
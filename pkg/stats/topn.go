@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+)
+
+// TopN approximates the heaviest keys of an unbounded stream with bounded
+// memory (space-saving algorithm). When the table is full, the least counted
+// key is replaced and the newcomer inherits its count.
+type TopN struct {
+	mu       sync.Mutex
+	capacity int
+	counts   map[string]uint64
+}
+
+type TopNEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+func NewTopN(capacity int) *TopN {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TopN{
+		capacity: capacity,
+		counts:   make(map[string]uint64, capacity),
+	}
+}
+
+func (t *TopN) Add(key string, n uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.counts[key]; !ok && len(t.counts) >= t.capacity {
+		var (
+			minKey   string
+			minCount uint64
+			first    = true
+		)
+		for k, c := range t.counts {
+			if first || c < minCount {
+				minKey, minCount, first = k, c, false
+			}
+		}
+		delete(t.counts, minKey)
+		t.counts[key] = minCount
+	}
+	t.counts[key] += n
+}
+
+// Top returns at most n entries ordered by descending count.
+func (t *TopN) Top(n int) []TopNEntry {
+	t.mu.Lock()
+	entries := make([]TopNEntry, 0, len(t.counts))
+	for k, c := range t.counts {
+		entries = append(entries, TopNEntry{Key: k, Count: c})
+	}
+	t.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
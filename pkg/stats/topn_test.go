@@ -0,0 +1,24 @@
+package stats
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTopN(t *testing.T) {
+	topN := NewTopN(4)
+	for i := 0; i < 100; i++ {
+		topN.Add("heavy", 1)
+		topN.Add("noise"+strconv.Itoa(i), 1)
+	}
+	top := topN.Top(2)
+	if len(top) != 2 {
+		t.Fatalf("expected 2 entries, got %v", len(top))
+	}
+	if top[0].Key != "heavy" || top[0].Count < 100 {
+		t.Fatalf("expected heavy hitter first, got %+v", top[0])
+	}
+	if len(topN.counts) > 4 {
+		t.Fatalf("capacity exceeded: %v", len(topN.counts))
+	}
+}
@@ -0,0 +1,66 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Traffic counts relayed bytes. Up is client to remote, Down is remote to
+// client.
+type Traffic struct {
+	Up   atomic.Uint64
+	Down atomic.Uint64
+}
+
+// UserStats are the statistics of a single user.
+type UserStats struct {
+	Traffic
+	Connections atomic.Int64
+
+	speed speedMeter
+	name  string
+	total *Traffic
+	// rtt is the latest round-trip time reported by heartbeats of the user,
+	// in nanoseconds.
+	rtt     atomic.Int64
+	classes [numClasses]ClassTraffic
+}
+
+func (u *UserStats) Name() string {
+	return u.name
+}
+
+// Upload adds n bytes sent by the user to both the user and the total.
+func (u *UserStats) Upload(n int) {
+	if n > 0 {
+		u.Up.Add(uint64(n))
+		u.total.Up.Add(uint64(n))
+	}
+}
+
+// Download adds n bytes sent to the user to both the user and the total.
+func (u *UserStats) Download(n int) {
+	if n > 0 {
+		u.Down.Add(uint64(n))
+		u.total.Down.Add(uint64(n))
+	}
+}
+
+func (u *UserStats) Connected() {
+	u.Connections.Add(1)
+}
+
+func (u *UserStats) Disconnected() {
+	u.Connections.Add(-1)
+}
+
+// SetRtt records the round-trip time measured by a heartbeat of the user.
+func (u *UserStats) SetRtt(rtt time.Duration) {
+	u.rtt.Store(int64(rtt))
+}
+
+// Rtt returns the latest round-trip time of heartbeats of the user, or zero
+// if none was reported.
+func (u *UserStats) Rtt() time.Duration {
+	return time.Duration(u.rtt.Load())
+}
@@ -0,0 +1,20 @@
+package tun
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// packetInfoSize is the size of the address family that utun devices prepend
+// to each packet.
+const packetInfoSize = 4
+
+func putPacketInfo(b []byte, version int) {
+	family := uint32(unix.AF_INET)
+	if version == header.IPv6Version {
+		family = unix.AF_INET6
+	}
+	binary.BigEndian.PutUint32(b, family)
+}
@@ -0,0 +1,8 @@
+//go:build !darwin
+
+package tun
+
+// packetInfoSize is zero as the packets of the device have no header.
+const packetInfoSize = 0
+
+func putPacketInfo(b []byte, version int) {}
@@ -0,0 +1,332 @@
+// Package tun relays the TCP connections and UDP flows of a TUN device, e.g.
+// the one of an Android VpnService or of an iOS Packet Tunnel Provider,
+// through a dialer. They are terminated by a userspace network stack, so no
+// tun2socks is needed in front of the client.
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/common/consts"
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/pool"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	DefaultMtu = 1500
+	nicId      = 1
+	// maxInFlight bounds the TCP connections being dialed at once.
+	maxInFlight = 256
+)
+
+// Buffers are the memory budget of the network stack.
+type Buffers struct {
+	// Tcp is the size in bytes of the receive and of the send buffer of each
+	// TCP connection.
+	Tcp int
+	// Queue is the number of packets queued towards the device.
+	Queue int
+}
+
+var (
+	DefaultBuffers = Buffers{
+		Tcp:   1 << 20,
+		Queue: 512,
+	}
+	// SmallBuffers suit processes short of memory, e.g. the iOS Packet
+	// Tunnel extension, at the cost of the throughput of each TCP
+	// connection.
+	SmallBuffers = Buffers{
+		Tcp:   64 << 10,
+		Queue: 64,
+	}
+)
+
+type Options struct {
+	Logger *log.Logger
+	// Device is the TUN device, read and written one IP packet at a time.
+	Device io.ReadWriteCloser
+	// Mtu is the MTU of the device, DefaultMtu if zero.
+	Mtu int
+	// Dialer returns the dialer of the targets of the source.
+	Dialer          func(source net.Addr) netproxy.Dialer
+	StrictHalfClose bool
+	// Buffers is nil for DefaultBuffers.
+	Buffers *Buffers
+}
+
+// Tun serves a TUN device.
+type Tun struct {
+	logger   *log.Logger
+	device   io.ReadWriteCloser
+	mtu      int
+	dialer   func(source net.Addr) netproxy.Dialer
+	relay    relay.Relay
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	ctx      context.Context
+	cancel   func()
+
+	closeOnce sync.Once
+}
+
+func New(opts *Options) (*Tun, error) {
+	buffers := DefaultBuffers
+	if opts.Buffers != nil {
+		buffers = *opts.Buffers
+	}
+	mtu := opts.Mtu
+	if mtu == 0 {
+		mtu = DefaultMtu
+	}
+	t := &Tun{
+		logger:   opts.Logger,
+		device:   opts.Device,
+		mtu:      mtu,
+		dialer:   opts.Dialer,
+		relay:    relay.NewRelay(opts.Logger, opts.StrictHalfClose),
+		endpoint: channel.New(buffers.Queue, uint32(mtu), ""),
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+		}),
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	if err := t.setup(buffers); err != nil {
+		t.stack.Destroy()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tun) setup(buffers Buffers) error {
+	receive := tcpip.TCPReceiveBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: buffers.Tcp, Max: buffers.Tcp}
+	send := tcpip.TCPSendBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: buffers.Tcp, Max: buffers.Tcp}
+	moderate := tcpip.TCPModerateReceiveBufferOption(false)
+	for _, option := range []tcpip.SettableTransportProtocolOption{&receive, &send, &moderate} {
+		if err := t.stack.SetTransportProtocolOption(tcp.ProtocolNumber, option); err != nil {
+			return fmt.Errorf("set tcp option: %v", err)
+		}
+	}
+	if err := t.stack.CreateNIC(nicId, t.endpoint); err != nil {
+		return fmt.Errorf("create nic: %v", err)
+	}
+	// Accept packets to any address, and answer from any address.
+	if err := t.stack.SetPromiscuousMode(nicId, true); err != nil {
+		return fmt.Errorf("set promiscuous mode: %v", err)
+	}
+	if err := t.stack.SetSpoofing(nicId, true); err != nil {
+		return fmt.Errorf("set spoofing: %v", err)
+	}
+	t.stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicId},
+		{Destination: header.IPv6EmptySubnet, NIC: nicId},
+	})
+	t.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcp.NewForwarder(t.stack, 0, maxInFlight, t.handleTcp).HandlePacket)
+	t.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udp.NewForwarder(t.stack, t.handleUdp).HandlePacket)
+	return nil
+}
+
+// Serve relays the packets of the device until Close is called or reading
+// the device fails.
+func (t *Tun) Serve() error {
+	go t.writeLoop()
+	buf := make([]byte, packetInfoSize+t.mtu)
+	for {
+		n, err := t.device.Read(buf)
+		if err != nil {
+			select {
+			case <-t.ctx.Done():
+				return nil
+			default:
+			}
+			t.Close()
+			return fmt.Errorf("read tun: %w", err)
+		}
+		if n <= packetInfoSize {
+			continue
+		}
+		packet := buf[packetInfoSize:n]
+		var protocol tcpip.NetworkProtocolNumber
+		switch header.IPVersion(packet) {
+		case header.IPv4Version:
+			protocol = header.IPv4ProtocolNumber
+		case header.IPv6Version:
+			protocol = header.IPv6ProtocolNumber
+		default:
+			continue
+		}
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(packet),
+		})
+		t.endpoint.InjectInbound(protocol, pkt)
+		pkt.DecRef()
+	}
+}
+
+// writeLoop writes the packets of the stack to the device.
+func (t *Tun) writeLoop() {
+	buf := make([]byte, packetInfoSize+t.mtu)
+	for {
+		pkt := t.endpoint.ReadContext(t.ctx)
+		if pkt.IsNil() {
+			return
+		}
+		n := packetInfoSize
+		for _, s := range pkt.AsSlices() {
+			n += copy(buf[n:], s)
+		}
+		pkt.DecRef()
+		putPacketInfo(buf, header.IPVersion(buf[packetInfoSize:n]))
+		if _, err := t.device.Write(buf[:n]); err != nil {
+			select {
+			case <-t.ctx.Done():
+				return
+			default:
+			}
+			t.logger.Debug().
+				Err(err).
+				Msg("Failed to write tun")
+		}
+	}
+}
+
+func (t *Tun) handleTcp(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	source := net.TCPAddrFromAddrPort(netip.AddrPortFrom(addrOf(id.RemoteAddress), id.RemotePort))
+	target := netip.AddrPortFrom(addrOf(id.LocalAddress), id.LocalPort).String()
+	rConn, err := t.dialer(source).Dial("tcp", target)
+	if err != nil {
+		t.logger.Info().
+			Err(err).
+			Str("source", source.String()).
+			Str("target", target).
+			Msg("Failed to dial TCP")
+		r.Complete(true)
+		return
+	}
+	defer rConn.Close()
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	lConn := gonet.NewTCPConn(&wq, ep)
+	defer lConn.Close()
+	if err = t.relay.RelayTCP(lConn, rConn); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return // ignore i/o timeout
+		}
+		t.logger.Debug().
+			Err(err).
+			Str("target", target).
+			Msg("Relay TCP of tun")
+	}
+}
+
+// handleUdp is called with the first packet of each flow, which is read from
+// the endpoint it creates.
+func (t *Tun) handleUdp(r *udp.ForwarderRequest) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		return
+	}
+	lConn := gonet.NewUDPConn(t.stack, &wq, ep)
+	source := net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrOf(id.RemoteAddress), id.RemotePort))
+	target := netip.AddrPortFrom(addrOf(id.LocalAddress), id.LocalPort).String()
+	go t.relayUdp(lConn, source, target)
+}
+
+// relayUdp relays the flow of source to target until it idles out, for as
+// long as SelectTimeout selects for its first packet.
+func (t *Tun) relayUdp(lConn *gonet.UDPConn, source net.Addr, target string) {
+	defer lConn.Close()
+	buf := pool.GetFullCap(consts.EthernetMtu)
+	defer pool.Put(buf)
+	_ = lConn.SetReadDeadline(time.Now().Add(consts.DefaultNatTimeout))
+	n, err := lConn.Read(buf)
+	if err != nil {
+		return
+	}
+	timeout := t.relay.SelectTimeout(buf[:n])
+	c, err := t.dialer(source).Dial("udp", target)
+	if err != nil {
+		t.logger.Info().
+			Err(err).
+			Str("source", source.String()).
+			Str("target", target).
+			Msg("Failed to dial UDP")
+		return
+	}
+	rConn := c.(netproxy.PacketConn)
+	defer rConn.Close()
+	go func() {
+		buf := pool.GetFullCap(consts.EthernetMtu)
+		defer pool.Put(buf)
+		for {
+			_ = rConn.SetReadDeadline(time.Now().Add(timeout))
+			n, err := rConn.Read(buf)
+			if err != nil {
+				// Stop reading the flow too.
+				_ = lConn.Close()
+				return
+			}
+			if _, err = lConn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		if _, err = rConn.Write(buf[:n]); err != nil {
+			return
+		}
+		_ = lConn.SetReadDeadline(time.Now().Add(timeout))
+		if n, err = lConn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// Close stops serving the device and closes it.
+func (t *Tun) Close() error {
+	t.closeOnce.Do(func() {
+		t.cancel()
+		_ = t.device.Close()
+		t.endpoint.Close()
+		t.stack.Close()
+	})
+	return nil
+}
+
+func addrOf(a tcpip.Address) netip.Addr {
+	if a.Len() == 4 {
+		return netip.AddrFrom4(a.As4())
+	}
+	return netip.AddrFrom16(a.As16())
+}
@@ -0,0 +1,211 @@
+//go:build unix
+
+package tun
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol/direct"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+var peerAddr = tcpip.AddrFrom4([4]byte{10, 0, 0, 2})
+
+// newDevicePair returns the two ends of a TUN device: the file descriptor of
+// the device served and a file of the system side, which is written and read
+// one IP packet at a time.
+func newDevicePair(t testing.TB) (fd int, peer *os.File) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer = os.NewFile(uintptr(fds[1]), "peer")
+	t.Cleanup(func() { _ = peer.Close() })
+	return fds[0], peer
+}
+
+// newPeerStack returns the network stack of the system side of the device,
+// at peerAddr with the device as its default route. Its packets carry the
+// packet information of the device, if any.
+func newPeerStack(t testing.TB, device io.ReadWriter) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	ep := channel.New(64, DefaultMtu, "")
+	if err := s.CreateNIC(nicId, ep); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddProtocolAddress(nicId, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: peerAddr.WithPrefix(),
+	}, stack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicId}})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		s.Close()
+	})
+	go func() {
+		buf := make([]byte, packetInfoSize+DefaultMtu)
+		for {
+			n, err := device.Read(buf)
+			if err != nil {
+				return
+			}
+			if n <= packetInfoSize {
+				continue
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(buf[packetInfoSize:n])})
+			ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+			pkt.DecRef()
+		}
+	}()
+	go func() {
+		for {
+			pkt := ep.ReadContext(ctx)
+			if pkt.IsNil() {
+				return
+			}
+			b := make([]byte, packetInfoSize)
+			for _, s := range pkt.AsSlices() {
+				b = append(b, s...)
+			}
+			pkt.DecRef()
+			putPacketInfo(b, header.IPv4Version)
+			_, _ = device.Write(b)
+		}
+	}()
+	return s
+}
+
+// echoDialer dials every target at the echo server, recording the targets.
+type echoDialer struct {
+	echo string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (d *echoDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	d.mu.Lock()
+	d.targets = append(d.targets, network+" "+addr)
+	d.mu.Unlock()
+	return direct.SymmetricDirect.Dial(network, d.echo)
+}
+
+func (d *echoDialer) Targets() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.targets...)
+}
+
+func startEcho(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, DefaultMtu)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTun(t *testing.T) {
+	fd, peer := newDevicePair(t)
+	d := &echoDialer{echo: startEcho(t)}
+	tun, err := New(&Options{
+		Logger: log.NewLogger(&log.Options{}),
+		Device: os.NewFile(uintptr(fd), "tun"),
+		Dialer: func(source net.Addr) netproxy.Dialer {
+			return d
+		},
+		Buffers: &SmallBuffers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = tun.Serve() }()
+	t.Cleanup(func() { _ = tun.Close() })
+	s := newPeerStack(t, peer)
+	target := tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{198, 51, 100, 1}), Port: 80}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tcpConn, err := gonet.DialContextTCP(ctx, s, target, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+	_ = tcpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = tcpConn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(tcpConn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, %v over TCP, want ping", buf, err)
+	}
+
+	udpConn, err := gonet.DialUDP(s, nil, &target, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	_ = udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = udpConn.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := udpConn.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("got %q, %v over UDP, want pong", buf[:n], err)
+	}
+
+	targets := d.Targets()
+	if len(targets) != 2 || targets[0] != "tcp 198.51.100.1:80" || targets[1] != "udp 198.51.100.1:80" {
+		t.Fatalf("got targets %q", targets)
+	}
+}
@@ -0,0 +1,382 @@
+// Package upgrade replaces the running binary with the one of a GitHub
+// release, verified by the checksum published beside the release archive.
+package upgrade
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRepo = "juicity/juicity"
+
+	apiTimeout      = 30 * time.Second
+	downloadTimeout = 10 * time.Minute
+	// maxArchiveSize bounds the size of release archives, which are read into
+	// memory.
+	maxArchiveSize = 128 << 20
+	// maxDigestSize bounds the size of digest files.
+	maxDigestSize = 4096
+)
+
+var (
+	ErrNoAsset          = fmt.Errorf("no release asset for this platform")
+	ErrChecksumMismatch = fmt.Errorf("checksum mismatch")
+)
+
+// friendlyNames are the platforms of release assets named
+// juicity-<name>.zip, as in install/friendly-filenames.json.
+var friendlyNames = map[string]string{
+	"linux-386":      "linux-x86_32",
+	"linux-amd64v1":  "linux-x86_64",
+	"linux-amd64v2":  "linux-x86_64_v2_sse",
+	"linux-amd64v3":  "linux-x86_64_v3_avx2",
+	"linux-arm5":     "linux-armv5",
+	"linux-arm6":     "linux-armv6",
+	"linux-arm7":     "linux-armv7",
+	"linux-arm64":    "linux-arm64",
+	"linux-mips64le": "linux-mips64le",
+	"linux-mips64":   "linux-mips64",
+	"linux-mipsle":   "linux-mips32le",
+	"linux-mips":     "linux-mips32",
+	"linux-riscv64":  "linux-riscv64",
+	"darwin-amd64":   "macos-x86_64",
+	"darwin-arm64":   "macos-arm64",
+	"windows-amd64":  "windows-x86_64",
+	"windows-arm64":  "windows-arm64",
+	"android-arm64":  "android-arm64",
+}
+
+// AssetName returns the name of the release archive for the platform, where
+// variant is the GOARM or GOAMD64 of the build, if any.
+func AssetName(goos, goarch, variant string) (string, error) {
+	switch goarch {
+	case "arm":
+		if variant == "" {
+			variant = "7"
+		}
+		// GOARM may carry the float ABI, e.g. "7,softfloat".
+		variant, _, _ = strings.Cut(variant, ",")
+	case "amd64":
+		if goos != "linux" {
+			variant = ""
+		} else if variant == "" || variant == "v4" {
+			variant = "v3"
+		}
+	default:
+		variant = ""
+	}
+	name, ok := friendlyNames[goos+"-"+goarch+variant]
+	if !ok {
+		return "", fmt.Errorf("%w: %v/%v%v", ErrNoAsset, goos, goarch, variant)
+	}
+	return "juicity-" + name + ".zip", nil
+}
+
+// CurrentAssetName returns the name of the release archive for the platform
+// and the GOARM or GOAMD64 level the running binary was built for.
+func CurrentAssetName() (string, error) {
+	var variant string
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "GOARM" || s.Key == "GOAMD64" {
+				variant = s.Value
+			}
+		}
+	}
+	return AssetName(runtime.GOOS, runtime.GOARCH, variant)
+}
+
+type Asset struct {
+	Name string `json:"name"`
+	Url  string `json:"browser_download_url"`
+	Size int64  `json:"size"`
+}
+
+type Release struct {
+	Tag        string  `json:"tag_name"`
+	Prerelease bool    `json:"prerelease"`
+	Assets     []Asset `json:"assets"`
+}
+
+func (r *Release) asset(name string) (*Asset, bool) {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i], true
+		}
+	}
+	return nil, false
+}
+
+// Options locate releases. The zero value uses DefaultRepo on GitHub.
+type Options struct {
+	Client *http.Client
+	Repo   string
+	// ApiUrl is the base of the GitHub API, https://api.github.com if empty.
+	ApiUrl string
+}
+
+func (o *Options) client() *http.Client {
+	if o.Client == nil {
+		return http.DefaultClient
+	}
+	return o.Client
+}
+
+// FetchRelease returns the release of the tag, or the latest release if tag
+// is empty.
+func FetchRelease(ctx context.Context, opts Options, tag string) (*Release, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	repo, apiUrl := opts.Repo, opts.ApiUrl
+	if repo == "" {
+		repo = DefaultRepo
+	}
+	if apiUrl == "" {
+		apiUrl = "https://api.github.com"
+	}
+	url := strings.TrimSuffix(apiUrl, "/") + "/repos/" + repo + "/releases/latest"
+	if tag != "" {
+		url = strings.TrimSuffix(apiUrl, "/") + "/repos/" + repo + "/releases/tags/" + tag
+	}
+	body, err := get(ctx, opts.client(), url, 1<<20)
+	if err != nil {
+		return nil, fmt.Errorf("fetch release: %w", err)
+	}
+	var r Release
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("parse release: %w", err)
+	}
+	if r.Tag == "" {
+		return nil, fmt.Errorf("parse release: no tag_name")
+	}
+	return &r, nil
+}
+
+// IsNewer reports whether the version of tag is newer than current. Versions
+// that are not like v1.2.3, e.g. of unstable builds, are older than any
+// release.
+func IsNewer(tag string, current string) bool {
+	t, ok := parseVersion(tag)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return true
+	}
+	for i := range t {
+		if t[i] != c[i] {
+			return t[i] > c[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(s string) (v [3]int, ok bool) {
+	s = strings.TrimPrefix(s, "v")
+	// Pre-releases and build metadata are ignored.
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// Download returns the binary named binary, e.g. juicity-server, from the
+// archive of the release for the running platform, once the archive matches
+// the sha256 in the digest file published beside it.
+func Download(ctx context.Context, opts Options, r *Release, binary string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+	name, err := CurrentAssetName()
+	if err != nil {
+		return nil, err
+	}
+	asset, ok := r.asset(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v not in %v", ErrNoAsset, name, r.Tag)
+	}
+	digest, ok := r.asset(name + ".dgst")
+	if !ok {
+		return nil, fmt.Errorf("%v not in %v", name+".dgst", r.Tag)
+	}
+	b, err := get(ctx, opts.client(), digest.Url, maxDigestSize)
+	if err != nil {
+		return nil, fmt.Errorf("fetch digest: %w", err)
+	}
+	want, err := parseDigest(b)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := get(ctx, opts.client(), asset.Url, maxArchiveSize)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %v: %w", name, err)
+	}
+	sum := sha256.Sum256(archive)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return nil, fmt.Errorf("%w of %v: got %v, want %v", ErrChecksumMismatch, name, got, want)
+	}
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	return extract(archive, binary)
+}
+
+// parseDigest returns the sha256 of a digest file of the release workflow,
+// whose lines are "<hex>  <file>  <algorithm>".
+func parseDigest(b []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[len(fields)-1] != "sha256" {
+			continue
+		}
+		if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+			break
+		}
+		return strings.ToLower(fields[0]), nil
+	}
+	return "", fmt.Errorf("no sha256 in the digest")
+}
+
+func extract(archive []byte, binary string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) != binary {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, maxArchiveSize))
+	}
+	return nil, fmt.Errorf("%v not in the archive", binary)
+}
+
+func get(ctx context.Context, client *http.Client, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%v is larger than %v bytes", url, limit)
+	}
+	return b, nil
+}
+
+// Replace replaces the executable at path with binary atomically, after
+// checking that binary runs on this host. On Windows, where a running
+// executable cannot be replaced, the old one is kept as path.old.
+func Replace(path string, binary []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+	if _, err = tmp.Write(binary); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpName, info.Mode().Perm()|0100); err != nil {
+		return err
+	}
+	// A binary of another architecture or a broken download fails here
+	// rather than at the next start of the service.
+	if out, err := exec.Command(tmpName, "--version").CombinedOutput(); err != nil {
+		return fmt.Errorf("the new binary does not run: %w: %s", err, bytes.TrimSpace(out))
+	}
+	if runtime.GOOS == "windows" {
+		old := path + ".old"
+		_ = os.Remove(old)
+		if err = os.Rename(path, old); err != nil {
+			return err
+		}
+		if err = os.Rename(tmpName, path); err != nil {
+			return errors.Join(err, os.Rename(old, path))
+		}
+		return nil
+	}
+	return os.Rename(tmpName, path)
+}
+
+// Restart restarts the service through the service manager of the host: the
+// init script of OpenWrt or SysV init if there is one, and systemd otherwise.
+func Restart(service string) error {
+	var cmd *exec.Cmd
+	if script := filepath.Join("/etc/init.d", service); isFile(script) {
+		cmd = exec.Command(script, "restart")
+	} else if systemctl, err := exec.LookPath("systemctl"); err == nil && isDir("/run/systemd/system") {
+		cmd = exec.Command(systemctl, "restart", service)
+	} else {
+		return fmt.Errorf("no service manager found to restart %v", service)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %w: %s", strings.Join(cmd.Args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,58 @@
+package upgrade
+
+import (
+	"testing"
+)
+
+func TestAssetName(t *testing.T) {
+	tests := []struct {
+		goos, goarch, variant string
+		want                  string
+	}{
+		{"linux", "amd64", "v1", "juicity-linux-x86_64.zip"},
+		{"linux", "amd64", "", "juicity-linux-x86_64_v3_avx2.zip"},
+		{"linux", "arm", "6", "juicity-linux-armv6.zip"},
+		{"linux", "arm", "7,softfloat", "juicity-linux-armv7.zip"},
+		{"linux", "mipsle", "", "juicity-linux-mips32le.zip"},
+		{"darwin", "amd64", "v1", "juicity-macos-x86_64.zip"},
+		{"windows", "amd64", "v2", "juicity-windows-x86_64.zip"},
+		{"freebsd", "amd64", "v1", ""},
+	}
+	for _, tt := range tests {
+		got, err := AssetName(tt.goos, tt.goarch, tt.variant)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("AssetName(%v, %v, %v): got %v, %v, want %v", tt.goos, tt.goarch, tt.variant, got, err, tt.want)
+		}
+	}
+}
+
+func TestIsNewer(t *testing.T) {
+	tests := []struct {
+		tag, current string
+		want         bool
+	}{
+		{"v0.4.0", "v0.3.9", true},
+		{"v0.4.0", "v0.4.0", false},
+		{"v0.4.0", "v0.10.0", false},
+		{"v1.0.0", "unknown", true},
+		{"v0.4.0", "v0.4.0-rc1", false},
+		{"nightly", "v0.1.0", false},
+	}
+	for _, tt := range tests {
+		if got := IsNewer(tt.tag, tt.current); got != tt.want {
+			t.Errorf("IsNewer(%v, %v): got %v, want %v", tt.tag, tt.current, got, tt.want)
+		}
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	digest := "098f6bcd4621d373cade4e832627b4f6  ./juicity-linux-x86_64.zip  md5\n" +
+		sum + "  ./juicity-linux-x86_64.zip  sha256\n"
+	if got, err := parseDigest([]byte(digest)); err != nil || got != sum {
+		t.Errorf("got %v, %v, want %v", got, err, sum)
+	}
+	if _, err := parseDigest([]byte("098f6bcd4621d373cade4e832627b4f6  ./juicity-linux-x86_64.zip  md5\n")); err == nil {
+		t.Error("got no error for a digest without sha256")
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/pkg/acl"
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/mzz2017/quic-go"
+)
+
+// StreamCodeBlocked resets the TCP streams blocked by the acl.
+const StreamCodeBlocked quic.StreamErrorCode = 0xffffff12
+
+const (
+	// blackholeTimeout bounds how long a blackholed stream is held.
+	blackholeTimeout = 2 * time.Minute
+	// sniffTimeout bounds the wait for the request of a stream to be
+	// rejected with HTTP 403.
+	sniffTimeout = 5 * time.Second
+	// maxDryRunTargets bounds the targets of a UDP stream whose dry runs are
+	// logged.
+	maxDryRunTargets = 64
+)
+
+var (
+	http403Response = []byte("HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: 10\r\nConnection: close\r\n\r\nForbidden\n")
+	httpMethods     = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+)
+
+// reject rejects a blocked TCP stream in the given way. The caller closes
+// lConn afterwards.
+func (s *Server) reject(stream quic.Stream, lConn netproxy.Conn, reject acl.Reject) {
+	switch reject {
+	case acl.RejectBlackhole:
+		_ = lConn.SetReadDeadline(time.Now().Add(blackholeTimeout))
+		_, _ = io.Copy(io.Discard, lConn)
+		return
+	case acl.RejectHttp403:
+		if isHttpRequest(lConn) {
+			_, _ = lConn.Write(http403Response)
+			return
+		}
+	}
+	stream.CancelRead(StreamCodeBlocked)
+	stream.CancelWrite(StreamCodeBlocked)
+}
+
+// isHttpRequest reports whether the data of the conn starts with a plain
+// HTTP request line.
+func isHttpRequest(conn netproxy.Conn) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 8)
+	n, _ := io.ReadAtLeast(conn, buf, len(buf))
+	for _, method := range httpMethods {
+		if strings.HasPrefix(string(buf[:n]), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// logDryRun logs that a rule in dry run would have decided otherwise for
+// the target, so that new rules can be checked against live traffic.
+func logDryRun(logger *log.Logger, d acl.Decision, t acl.Target, user string, source string) {
+	logger.Info().
+		Int("rule", d.DryRun.Rule).
+		Str("action", string(d.Action)).
+		Str("network", t.Network).
+		Str("target", t.String()).
+		Str("user", user).
+		Str("source", source).
+		Msg("Acl rule in dry run would " + string(d.DryRun.Action))
+}
+
+// rewrite returns the target to dial for t.
+func (s *Server) rewrite(t acl.Target) acl.Target {
+	rewritten, ok := s.rewriter.Rewrite(t)
+	if ok {
+		s.logger.Debug().
+			Str("from", t.String()).
+			Str("to", rewritten.String()).
+			Msg("Rewrote target")
+	}
+	return rewritten
+}
+
+func parseTarget(network, addr string) (acl.Target, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return acl.Target{}, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return acl.Target{}, fmt.Errorf("parse port: %w", err)
+	}
+	return acl.NewTarget(network, host, uint16(portNum)), nil
+}
+
+// resolvedFilter applies the rules of IPs of the acl to the addresses that
+// domain targets of the network resolve to.
+func resolvedFilter(userAcl *acl.Acl, network string) addrFilter {
+	return func(target string, addr netip.AddrPort) bool {
+		t, err := parseTarget(network, target)
+		return err == nil && userAcl.DecideResolved(t, addr.Addr()).Action != acl.ActionBlock
+	}
+}
+
+// policyPacketConn applies the acl and rewrites to every packet of a UDP
+// stream, as a UDP stream may send to any target after the first one.
+// Packets to blocked targets are dropped.
+type policyPacketConn struct {
+	netproxy.PacketConn
+	s       *Server
+	userAcl *acl.Acl
+	logger  *log.Logger
+	user    string
+	source  string
+
+	mu sync.Mutex
+	// original maps rewritten IP targets to the targets the client sent to,
+	// so that replies appear to come from the latter.
+	original map[netip.AddrPort]netip.AddrPort
+	// dryRuns are the targets whose dry runs are logged, once each.
+	dryRuns map[acl.Target]struct{}
+}
+
+func (c *policyPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	target, err := parseTarget("udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	decision := c.userAcl.Decide(target)
+	if decision.DryRun != nil {
+		c.mu.Lock()
+		_, logged := c.dryRuns[target]
+		if !logged && len(c.dryRuns) < maxDryRunTargets {
+			if c.dryRuns == nil {
+				c.dryRuns = map[acl.Target]struct{}{}
+			}
+			c.dryRuns[target] = struct{}{}
+			logDryRun(c.logger, decision, target, c.user, c.source)
+		}
+		c.mu.Unlock()
+	}
+	if decision.Action == acl.ActionBlock {
+		return len(p), nil
+	}
+	if rewritten := c.s.rewrite(target); rewritten != target {
+		if target.IsIp() && rewritten.IsIp() {
+			c.mu.Lock()
+			if c.original == nil {
+				c.original = map[netip.AddrPort]netip.AddrPort{}
+			}
+			c.original[netip.AddrPortFrom(rewritten.Addr, rewritten.Port)] = netip.AddrPortFrom(target.Addr, target.Port)
+			c.mu.Unlock()
+		}
+		addr = rewritten.String()
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *policyPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err != nil {
+		return n, addr, err
+	}
+	c.mu.Lock()
+	if original, ok := c.original[netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())]; ok {
+		addr = original
+	}
+	c.mu.Unlock()
+	return n, addr, nil
+}
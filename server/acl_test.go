@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/acl"
+
+	"github.com/daeuniverse/softwind/ciphers"
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/daeuniverse/softwind/protocol/shadowsocks"
+	"github.com/daeuniverse/softwind/protocol/trojanc"
+)
+
+func TestAclResolved(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	a, err := acl.New(acl.Options{Rules: []acl.Rule{{
+		Action:  acl.ActionBlock,
+		Matcher: acl.Matcher{Prefixes: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, d := startTestServer(t, &Options{Acl: a})
+	// A name resolving into the blocked prefix is blocked as the IP is.
+	conn, err := d.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if b, err := io.ReadAll(conn); err == nil || len(b) > 0 {
+		t.Fatalf("got %q, %v through a name of a blocked prefix", b, err)
+	}
+
+	_, d = startTestServer(t, &Options{})
+	conn, err = d.Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if b, err := io.ReadAll(conn); err != nil || string(b) != "ok" {
+		t.Fatalf("got %q, %v without the acl", b, err)
+	}
+}
+
+func TestAclUnderlay(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	a, err := acl.New(acl.Options{Rules: []acl.Rule{{
+		Action:  acl.ActionBlock,
+		Matcher: acl.Matcher{Prefixes: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		opts    *Options
+		reached bool
+	}{
+		{"blocked", &Options{Acl: a}, false},
+		{"allowed", &Options{}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, addr := listenTestServer(t, tc.opts)
+			_, authStream := dialQuicAuth(t, addr)
+			// Auths written with the authentication could be buffered by
+			// it, unlike those of clients, which follow later.
+			if !eventually(func() bool { return s.Stats().User(testUser).Connections.Load() == 1 }) {
+				t.Fatal("not authenticated")
+			}
+			mdata, err := protocol.ParseMetadata(target.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			iv := make([]byte, juicity.CipherConf.SaltLen)
+			psk := make([]byte, juicity.CipherConf.KeyLen)
+			_, _ = rand.Read(iv[2:])
+			_, _ = rand.Read(psk)
+			auth := (&juicity.UnderlayAuth{
+				IV:       iv,
+				Psk:      psk,
+				Metadata: &trojanc.Metadata{Metadata: mdata, Network: "udp"},
+			}).PackFromPool()
+			defer auth.Put()
+			if _, err = authStream.Write(auth); err != nil {
+				t.Fatal(err)
+			}
+			packet, err := shadowsocks.EncryptUDPFromPool(&shadowsocks.Key{
+				CipherConf: juicity.CipherConf,
+				MasterKey:  psk,
+			}, []byte("ping"), iv, ciphers.JuicityReusedInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer packet.Put()
+			source, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close()
+			serverAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = source.WriteTo(packet, serverAddr); err != nil {
+				t.Fatal(err)
+			}
+			_ = target.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 2048)
+			_, _, err = target.ReadFrom(buf)
+			if reached := err == nil; reached != tc.reached {
+				t.Fatalf("target reached: %v, want %v", reached, tc.reached)
+			}
+			if up := s.Stats().User(testUser).Up.Load(); (up > 0) != tc.reached {
+				t.Fatalf("got %v bytes up", up)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+)
+
+// ApiHostname is the reserved target through which admins reach the
+// management API inside the tunnel, e.g. http://_api.juicity/api/v1/stats
+// through the proxy of the client.
+const ApiHostname = "_api.juicity"
+
+var ErrNotAdmin = fmt.Errorf("not an admin")
+
+// ApiListener accepts the streams of admins to ApiHostname as conns, to be
+// served by the management API. It is shared by the servers of all
+// listeners.
+type ApiListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewApiListener() *ApiListener {
+	return &ApiListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener.
+func (l *ApiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener.
+func (l *ApiListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *ApiListener) Addr() net.Addr {
+	return apiAddr{}
+}
+
+type apiAddr struct{}
+
+func (apiAddr) Network() string { return "juicity" }
+func (apiAddr) String() string  { return ApiHostname }
+
+// apiConn is a stream to ApiHostname as a net.Conn.
+type apiConn struct {
+	netproxy.Conn
+	local  net.Addr
+	remote net.Addr
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *apiConn) LocalAddr() net.Addr  { return c.local }
+func (c *apiConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *apiConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func parseApiAdmins(admins []string, users map[uuid.UUID]string) (map[uuid.UUID]bool, error) {
+	m := map[uuid.UUID]bool{}
+	for _, admin := range admins {
+		id, err := uuid.Parse(admin)
+		if err != nil {
+			return nil, fmt.Errorf("parse uuid of api admin(%v): %w", admin, err)
+		}
+		// Admins of other listeners are unknown to this server.
+		if _, ok := users[id]; ok {
+			m[id] = true
+		}
+	}
+	return m, nil
+}
+
+// handleApi hands the stream of an admin to the management API and waits
+// until it is done with it. The stream counts against the stream limits of
+// the admin.
+func (s *Server) handleApi(conn quic.Connection, stream quic.Stream, lConn netproxy.Conn, sess *session) error {
+	if s.api == nil || !s.apiAdmins[sess.user] {
+		stream.CancelRead(StreamCodeBlocked)
+		stream.CancelWrite(StreamCodeBlocked)
+		return fmt.Errorf("%w: %v", ErrNotAdmin, sess.user)
+	}
+	release, err := s.acquireStream(stream, sess)
+	if err != nil {
+		return err
+	}
+	defer release()
+	c := &apiConn{
+		Conn:   lConn,
+		local:  conn.LocalAddr(),
+		remote: conn.RemoteAddr(),
+		done:   make(chan struct{}),
+	}
+	select {
+	case s.api.conns <- c:
+	case <-s.api.closed:
+		return net.ErrClosed
+	case <-conn.Context().Done():
+		return nil
+	}
+	s.logger.Debug().
+		Str("user", sess.user.String()).
+		Str("source", conn.RemoteAddr().String()).
+		Msg("Admin opened the management API in the tunnel")
+	select {
+	case <-c.done:
+	case <-conn.Context().Done():
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestApiStreamLimit(t *testing.T) {
+	api := NewApiListener()
+	defer api.Close()
+	go func() {
+		_ = http.Serve(api, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "ok")
+		}))
+	}()
+	_, d := startTestServer(t, &Options{MaxStreamsPerUser: 1, Api: api, ApiAdmins: []string{testUser}})
+	conn, err := d.Dial("tcp", net.JoinHostPort(ApiHostname, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The keep-alive conn of the API holds the only stream slot of the user.
+	if _, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+ApiHostname+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len("HTTP/1.1 200"))
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "HTTP/1.1 200" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if err = dialClock(d); err == nil {
+		t.Error("got no error beyond the stream limit")
+	}
+}
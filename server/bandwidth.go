@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/juicity/juicity/pkg/brutal"
+
+	"github.com/mzz2017/quic-go"
+)
+
+// BandwidthHostname is the reserved target of the stream that declares the
+// bandwidth of the client. It carries the uplink and downlink in bytes per
+// second as two big-endian uint64s.
+const BandwidthHostname = "_bandwidth.juicity"
+
+const bandwidthReadTimeout = 10 * time.Second
+
+// EncodeBandwidth returns the payload of a bandwidth declaration.
+func EncodeBandwidth(up, down uint64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, up)
+	binary.BigEndian.PutUint64(b[8:], down)
+	return b
+}
+
+// handleBandwidth switches the connection to brutal at the downlink declared
+// by the client, bounded by the upload cap of the server or its group.
+// Declarations are ignored without a cap, since brutal at any declared rate
+// would let clients take the link from everybody else.
+func (s *Server) handleBandwidth(conn quic.Connection, stream quic.Stream, r io.Reader, sess *session) error {
+	release, err := s.acquireStream(stream, sess)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_ = stream.SetReadDeadline(time.Now().Add(bandwidthReadTimeout))
+	b := make([]byte, 16)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("read bandwidth: %w", err)
+	}
+	up, down := binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:])
+	maxRate := s.maxBandwidthOf(sess.user)
+	rate := min(down, maxRate)
+	s.logger.Debug().
+		Str("user", sess.user.String()).
+		Uint64("up", up).
+		Uint64("down", down).
+		Uint64("rate", rate).
+		Msg("Client declared bandwidth")
+	if rate == 0 {
+		return nil
+	}
+	conn.SetCongestionControl(brutal.NewSender(rate))
+	return nil
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicity/juicity/internal/relay"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/google/uuid"
+)
+
+const (
+	BittorrentBlock    = "block"
+	BittorrentThrottle = "throttle"
+)
+
+// Bittorrent is how streams found to carry BitTorrent traffic are handled.
+// Blocked TCP streams are reset and blocked UDP streams drop their packets.
+// Throttled streams of a user share Rate bytes per second.
+type Bittorrent struct {
+	Action string
+	Rate   uint64
+}
+
+func (b *Bittorrent) validate() error {
+	switch b.Action {
+	case BittorrentBlock:
+	case BittorrentThrottle:
+		if b.Rate == 0 {
+			return fmt.Errorf("bittorrent: throttle requires a rate")
+		}
+	default:
+		return fmt.Errorf("bittorrent: unexpected action: %v", b.Action)
+	}
+	return nil
+}
+
+func (s *Server) bittorrentOf(user uuid.UUID) *Bittorrent {
+	if g, ok := s.groups[user]; ok && g.Bittorrent != nil {
+		return g.Bittorrent
+	}
+	return s.bittorrent
+}
+
+// bittorrentThrottleOf returns the throttle shared by the BitTorrent traffic
+// of the user.
+func (s *Server) bittorrentThrottleOf(user uuid.UUID, rate uint64) *throttle {
+	s.bittorrentMu.Lock()
+	defer s.bittorrentMu.Unlock()
+	t, ok := s.bittorrentThrottles[user]
+	if !ok {
+		t = newThrottle(rate)
+		s.bittorrentThrottles[user] = t
+	}
+	return t
+}
+
+// throttle is a token bucket of bytes with a burst of one second.
+type throttle struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newThrottle(rate uint64) *throttle {
+	return &throttle{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may pass.
+func (t *throttle) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens = min(t.rate, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	t.tokens -= float64(n)
+	var d time.Duration
+	if t.tokens < 0 {
+		d = time.Duration(-t.tokens / t.rate * float64(time.Second))
+	}
+	t.mu.Unlock()
+	time.Sleep(d)
+}
+
+// bittorrentFilter applies the BitTorrent policy of a user to a stream once
+// BitTorrent traffic is detected in it.
+type bittorrentFilter struct {
+	s      *Server
+	user   uuid.UUID
+	policy *Bittorrent
+
+	blocked  atomic.Bool
+	throttle atomic.Pointer[throttle]
+}
+
+func (f *bittorrentFilter) detect(network, target string) {
+	f.s.logger.Debug().
+		Str("user", f.user.String()).
+		Str("target", target).
+		Str("action", f.policy.Action).
+		Msgf("Detected BitTorrent in a [%v] stream", network)
+	if f.policy.Action == BittorrentBlock {
+		f.blocked.Store(true)
+		return
+	}
+	f.throttle.Store(f.s.bittorrentThrottleOf(f.user, f.policy.Rate))
+}
+
+func (f *bittorrentFilter) detected() bool {
+	return f.blocked.Load() || f.throttle.Load() != nil
+}
+
+func (f *bittorrentFilter) wait(n int) {
+	if t := f.throttle.Load(); t != nil {
+		t.wait(n)
+	}
+}
+
+// bittorrentConn sniffs the first upload of a TCP stream.
+type bittorrentConn struct {
+	netproxy.Conn
+	*bittorrentFilter
+	target  string
+	sniffed bool
+}
+
+func (c *bittorrentConn) Write(b []byte) (n int, err error) {
+	if !c.sniffed {
+		c.sniffed = true
+		if isBittorrentStream(b) {
+			c.detect("tcp", c.target)
+			if c.blocked.Load() {
+				// Stop the download too.
+				_ = c.Conn.Close()
+				return 0, ErrBittorrent
+			}
+		}
+	}
+	c.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+func (c *bittorrentConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.wait(n)
+	return n, err
+}
+
+func (c *bittorrentConn) CloseWrite() error {
+	if conn, ok := c.Conn.(relay.WriteCloser); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// bittorrentPacketConn sniffs every packet uploaded through a UDP stream
+// until BitTorrent traffic is detected, as the socket of a client may send
+// DHT messages after other traffic.
+type bittorrentPacketConn struct {
+	netproxy.PacketConn
+	*bittorrentFilter
+}
+
+func (c *bittorrentPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	if !c.detected() && isBittorrentPacket(p) {
+		c.detect("udp", addr)
+	}
+	if c.blocked.Load() {
+		return len(p), nil
+	}
+	c.wait(len(p))
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *bittorrentPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || !c.blocked.Load() {
+			break
+		}
+	}
+	c.wait(n)
+	return n, addr, err
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+const (
+	clientCertOu  = "ou"
+	clientCertSan = "san"
+)
+
+// parseClientCertPattern splits a pattern like "ou:Engineering" into the
+// attribute and its value.
+func parseClientCertPattern(pattern string) (attr string, value string, err error) {
+	attr, value, ok := strings.Cut(pattern, ":")
+	attr = strings.ToLower(attr)
+	if !ok || value == "" || (attr != clientCertOu && attr != clientCertSan) {
+		return "", "", fmt.Errorf("invalid client certificate pattern: %v, expect ou:<unit> or san:<name>", pattern)
+	}
+	return attr, value, nil
+}
+
+// matchClientCert reports whether an attribute of cert matches one of the
+// patterns. Values match exactly, or by suffix if the pattern starts with *.
+// SANs are DNS names, email addresses, IPs and URIs.
+func matchClientCert(cert *x509.Certificate, patterns []string) bool {
+	for _, pattern := range patterns {
+		attr, value, err := parseClientCertPattern(pattern)
+		if err != nil {
+			continue
+		}
+		var values []string
+		switch attr {
+		case clientCertOu:
+			values = cert.Subject.OrganizationalUnit
+		case clientCertSan:
+			values = append(values, cert.DNSNames...)
+			values = append(values, cert.EmailAddresses...)
+			for _, ip := range cert.IPAddresses {
+				values = append(values, ip.String())
+			}
+			for _, uri := range cert.URIs {
+				values = append(values, uri.String())
+			}
+		}
+		for _, v := range values {
+			if v == value || (strings.HasPrefix(value, "*") && strings.HasSuffix(v, value[1:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certGroupOf returns the first group matching the verified client
+// certificate of the connection, or nil.
+func (s *Server) certGroupOf(state tls.ConnectionState) *userGroup {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	for _, g := range s.certGroups {
+		if matchClientCert(cert, g.ClientCerts) {
+			return g
+		}
+	}
+	return nil
+}
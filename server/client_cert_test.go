@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestMatchClientCert(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/eng/alice")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{OrganizationalUnit: []string{"Engineering", "Berlin"}},
+		DNSNames:       []string{"alice.eng.example.com"},
+		EmailAddresses: []string{"alice@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.7")},
+		URIs:           []*url.URL{spiffe},
+	}
+	for _, tt := range []struct {
+		patterns []string
+		want     bool
+	}{
+		{[]string{"ou:Engineering"}, true},
+		{[]string{"OU:Berlin"}, true},
+		{[]string{"ou:Sales"}, false},
+		{[]string{"ou:Sales", "san:alice@example.com"}, true},
+		{[]string{"san:*.eng.example.com"}, true},
+		{[]string{"san:*.ops.example.com"}, false},
+		{[]string{"san:10.0.0.7"}, true},
+		{[]string{"san:spiffe://example.com/eng/alice"}, true},
+		{[]string{"san:Engineering"}, false},
+		{[]string{"cn:alice"}, false},
+	} {
+		if got := matchClientCert(cert, tt.patterns); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.patterns, got, tt.want)
+		}
+	}
+	for _, pattern := range []string{"Engineering", "ou:", "cn:alice"} {
+		if _, _, err := parseClientCertPattern(pattern); err == nil {
+			t.Errorf("%v: expected an error", pattern)
+		}
+	}
+
+	eng := &userGroup{Group: &Group{Name: "eng", ClientCerts: []string{"ou:Engineering"}}}
+	s := &Server{certGroups: []*userGroup{
+		{Group: &Group{Name: "sales", ClientCerts: []string{"ou:Sales"}}},
+		eng,
+	}}
+	if g := s.certGroupOf(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}); g != eng {
+		t.Errorf("got group %v, want eng", g)
+	}
+	// Unverified certificates match no group.
+	if g := s.certGroupOf(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); g != nil {
+		t.Errorf("got group %v for an unverified certificate", g.Name)
+	}
+}
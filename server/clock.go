@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mzz2017/quic-go"
+)
+
+// ClockHostname is the reserved target through which clients compare their
+// clock with the server. A request is the time of the client in unix
+// nanoseconds as a big-endian int64, and the server responds its own time
+// the same way, then closes the stream.
+const ClockHostname = "_clock.juicity"
+
+const ClockSize = 8
+
+// clockTimeout bounds the whole exchange.
+const clockTimeout = 10 * time.Second
+
+// EncodeClock returns a request or a response of the time.
+func EncodeClock(t time.Time) []byte {
+	b := make([]byte, ClockSize)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func DecodeClock(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
+
+// handleClock responds the time of the server to a clock request.
+func (s *Server) handleClock(stream quic.Stream, rw io.ReadWriter, sess *session) error {
+	release, err := s.acquireStream(stream, sess)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_ = stream.SetDeadline(time.Now().Add(clockTimeout))
+	counter := newTrafficCounter(sess.userStats)
+	b := make([]byte, ClockSize)
+	if _, err = io.ReadFull(rw, b); err != nil {
+		return fmt.Errorf("read clock: %w", err)
+	}
+	counter.upload(len(b))
+	now := time.Now()
+	n, err := rw.Write(EncodeClock(now))
+	counter.download(n)
+	if err != nil {
+		return err
+	}
+	s.logger.Debug().
+		Str("user", sess.user.String()).
+		Dur("skew", DecodeClock(b).Sub(now)).
+		Msg("Clock of client")
+	return nil
+}
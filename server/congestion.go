@@ -0,0 +1,52 @@
+package server
+
+import (
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+	"github.com/mzz2017/quic-go"
+	"github.com/mzz2017/quic-go/congestion"
+)
+
+// DefaultInitialCwnd is the initial congestion window of bbr in packets.
+const DefaultInitialCwnd = 10
+
+// rttRecorder is a congestion control keeping the RTT stats of its
+// connection, which quic-go gives it when it is set.
+type rttRecorder struct {
+	congestion.CongestionControl
+	rttStats congestion.RTTStatsProvider
+}
+
+func (r *rttRecorder) SetRTTStatsProvider(provider congestion.RTTStatsProvider) {
+	r.rttStats = provider
+	r.CongestionControl.SetRTTStatsProvider(provider)
+}
+
+// rttConn records the RTT stats of the congestion controls set to it.
+type rttConn struct {
+	quic.Connection
+	recorder *rttRecorder
+}
+
+func (c *rttConn) SetCongestionControl(cc congestion.CongestionControl) {
+	c.recorder = &rttRecorder{CongestionControl: cc}
+	c.Connection.SetCongestionControl(c.recorder)
+}
+
+// setCongestionControl sets the congestion control cc with an initial window
+// of cwnd packets to conn, raised for clients whose handshake took long.
+func (s *Server) setCongestionControl(conn quic.Connection, cc string, cwnd int) {
+	if s.highRttCwnd <= cwnd {
+		common.SetCongestionController(conn, cc, cwnd)
+		return
+	}
+	c := &rttConn{Connection: conn}
+	common.SetCongestionController(c, cc, cwnd)
+	if rtt := c.recorder.rttStats.SmoothedRTT(); rtt >= s.highRtt {
+		s.logger.Debug().
+			Str("source", conn.RemoteAddr().String()).
+			Dur("rtt", rtt).
+			Int("cwnd", s.highRttCwnd).
+			Msg("Raised the initial congestion window of a high RTT client")
+		common.SetCongestionController(conn, cc, s.highRttCwnd)
+	}
+}
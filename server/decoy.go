@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mzz2017/quic-go"
+)
+
+// DecoyHostname is the reserved target of the decoy streams of a client,
+// which mask idle tunnels. A request is the size of the response and the
+// size of the padding that follows as big-endian uint32s, and the server
+// responds that many bytes, then closes the stream.
+const DecoyHostname = "_decoy.juicity"
+
+const (
+	DecoyHeaderSize = 8
+	// MaxDecoySize bounds the padding and the response of a decoy.
+	MaxDecoySize = 1 << 20
+	// decoyTimeout bounds the whole exchange.
+	decoyTimeout    = 30 * time.Second
+	decoyWriteChunk = 16 << 10
+	// decoyRate bounds the decoy bytes of a connection in bytes per second,
+	// in both directions together.
+	decoyRate = 256 << 10
+)
+
+// EncodeDecoyRequest returns a request of the given response size with
+// padding.
+func EncodeDecoyRequest(response, padding int) []byte {
+	b := make([]byte, DecoyHeaderSize+padding)
+	binary.BigEndian.PutUint32(b, uint32(response))
+	binary.BigEndian.PutUint32(b[4:], uint32(padding))
+	return b
+}
+
+// handleDecoy reads a decoy request and responds it. Decoys count against the
+// stream limits and the traffic of the user, and the decoys of a connection
+// share decoyRate.
+func (s *Server) handleDecoy(stream quic.Stream, rw io.ReadWriter, sess *session) error {
+	release, err := s.acquireStream(stream, sess)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_ = stream.SetDeadline(time.Now().Add(decoyTimeout))
+	counter := newTrafficCounter(sess.userStats)
+	throttle := sess.decoyThrottle()
+	b := make([]byte, DecoyHeaderSize)
+	if _, err = io.ReadFull(rw, b); err != nil {
+		return fmt.Errorf("read decoy: %w", err)
+	}
+	counter.upload(len(b))
+	response, padding := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+	if response > MaxDecoySize || padding > MaxDecoySize {
+		return fmt.Errorf("decoy larger than %v bytes", MaxDecoySize)
+	}
+	chunk := make([]byte, decoyWriteChunk)
+	for left := int(padding); left > 0; {
+		n, err := rw.Read(chunk[:min(left, len(chunk))])
+		counter.upload(n)
+		throttle.wait(n)
+		if err != nil {
+			return fmt.Errorf("read decoy: %w", err)
+		}
+		left -= n
+	}
+	clear(chunk)
+	for left := int(response); left > 0; {
+		throttle.wait(min(left, len(chunk)))
+		n, err := rw.Write(chunk[:min(left, len(chunk))])
+		counter.download(n)
+		if err != nil {
+			return err
+		}
+		left -= n
+	}
+	return nil
+}
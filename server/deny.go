@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/daeuniverse/softwind/protocol/tuic"
+	"github.com/mzz2017/quic-go"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// tarpitDelay is how long the packets to tarpitted sources are held,
+	// short of the handshake timeout of QUIC so that handshakes complete.
+	tarpitDelay = 2 * time.Second
+	// maxTarpitPackets bounds the packets held at once; more are dropped.
+	maxTarpitPackets = 1024
+	// maxTarpitConns bounds the connections held in the tarpit at once; more
+	// fail authentication at once.
+	maxTarpitConns = 256
+	// tarpitTimeout is how long a connection is held in the tarpit at most.
+	tarpitTimeout = 10 * time.Minute
+)
+
+// isDenied reports whether addr is in any of the prefixes.
+func isDenied(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrOf(addr net.Addr) netip.Addr {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort().Addr()
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort.Addr()
+}
+
+// denyConn drops the datagrams of denied sources, or, in tarpit mode, lets
+// them through and holds the datagrams to them for tarpitDelay, so that their
+// handshakes complete slowly.
+type denyConn struct {
+	net.PacketConn
+	deny   []netip.Prefix
+	tarpit bool
+	held   atomic.Int32
+}
+
+// newDenyConn wraps pktConn, keeping the batched reads and ECN of an
+// oobConn.
+func newDenyConn(pktConn net.PacketConn, deny []netip.Prefix, tarpit bool) net.PacketConn {
+	c := &denyConn{
+		PacketConn: pktConn,
+		deny:       deny,
+		tarpit:     tarpit,
+	}
+	if oob, ok := pktConn.(oobConn); ok {
+		return &denyOobConn{denyConn: c, oob: oob}
+	}
+	return c
+}
+
+func (c *denyConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || c.tarpit || !isDenied(c.deny, addrOf(addr)) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *denyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.tarpit || !isDenied(c.deny, addrOf(addr)) {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	b := bytes.Clone(p)
+	c.hold(func() { _, _ = c.PacketConn.WriteTo(b, addr) })
+	return len(p), nil
+}
+
+// hold writes after tarpitDelay, or never if too many writes are held.
+func (c *denyConn) hold(write func()) {
+	if c.held.Add(1) > maxTarpitPackets {
+		c.held.Add(-1)
+		return
+	}
+	time.AfterFunc(tarpitDelay, func() {
+		defer c.held.Add(-1)
+		write()
+	})
+}
+
+var _ oobConn = &denyOobConn{}
+
+type denyOobConn struct {
+	*denyConn
+	oob oobConn
+}
+
+func (c *denyOobConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	for {
+		n, err := c.oob.ReadBatch(ms, flags)
+		if err != nil || n == 0 || c.tarpit {
+			return n, err
+		}
+		kept := 0
+		for i := 0; i < n; i++ {
+			if isDenied(c.deny, addrOf(ms[i].Addr)) {
+				continue
+			}
+			if kept != i {
+				moveMessage(&ms[kept], &ms[i])
+			}
+			kept++
+		}
+		if kept > 0 {
+			return kept, nil
+		}
+	}
+}
+
+// moveMessage copies the datagram of src into the buffers of dst, since
+// quic-go pairs the buffers with the positions of messages.
+func moveMessage(dst *ipv4.Message, src *ipv4.Message) {
+	dst.N = copy(dst.Buffers[0], src.Buffers[0][:src.N])
+	dst.NN = copy(dst.OOB, src.OOB[:src.NN])
+	dst.Flags = src.Flags
+	dst.Addr = src.Addr
+}
+
+func (c *denyOobConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	for {
+		n, oobn, flags, addr, err = c.oob.ReadMsgUDP(b, oob)
+		if err != nil || c.tarpit || !isDenied(c.deny, addr.AddrPort().Addr()) {
+			return n, oobn, flags, addr, err
+		}
+	}
+}
+
+func (c *denyOobConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	if !c.tarpit || !isDenied(c.deny, addr.AddrPort().Addr()) {
+		return c.oob.WriteMsgUDP(b, oob, addr)
+	}
+	b, oob = bytes.Clone(b), bytes.Clone(oob)
+	c.hold(func() { _, _, _ = c.oob.WriteMsgUDP(b, oob, addr) })
+	return len(b), len(oob), nil
+}
+
+func (c *denyOobConn) SyscallConn() (syscall.RawConn, error) {
+	return c.oob.SyscallConn()
+}
+
+func (c *denyOobConn) SetReadBuffer(bytes int) error {
+	return c.oob.SetReadBuffer(bytes)
+}
+
+func (c *denyOobConn) SetWriteBuffer(bytes int) error {
+	return c.oob.SetWriteBuffer(bytes)
+}
+
+// holdInTarpit keeps the connection of a denied source open without ever
+// authenticating it, until the source gives up or tarpitTimeout passes.
+func (s *Server) holdInTarpit(conn quic.Connection) {
+	source := conn.RemoteAddr().String()
+	if s.tarpitConns.Add(1) > maxTarpitConns {
+		s.tarpitConns.Add(-1)
+		_ = conn.CloseWithError(tuic.AuthenticationFailed, "")
+		return
+	}
+	defer s.tarpitConns.Add(-1)
+	s.logger.Debug().
+		Str("source", source).
+		Msg("Holding a denied source in the tarpit")
+	timer := time.NewTimer(tarpitTimeout)
+	defer timer.Stop()
+	select {
+	case <-conn.Context().Done():
+	case <-timer.C:
+		_ = conn.CloseWithError(tuic.AuthenticationTimeout, "")
+	}
+}
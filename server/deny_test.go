@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/juicity/juicity/pkg/stats"
+
+	"golang.org/x/net/ipv4"
+)
+
+type queuePacketConn struct {
+	net.PacketConn
+	reads []*net.UDPAddr
+
+	mu     sync.Mutex
+	writes []net.Addr
+}
+
+func (c *queuePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	addr := c.reads[0]
+	c.reads = c.reads[1:]
+	return copy(p, "x"), addr, nil
+}
+
+func (c *queuePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = append(c.writes, addr)
+	return len(p), nil
+}
+
+func TestDenyConn(t *testing.T) {
+	deny := []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}
+	denied := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:198.51.100.7]:40000"))
+	allowed := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("203.0.113.1:40000"))
+
+	queue := &queuePacketConn{reads: []*net.UDPAddr{denied, denied, allowed}}
+	c := newDenyConn(queue, deny, false).(*denyConn)
+	b := make([]byte, 16)
+	if _, addr, err := c.ReadFrom(b); err != nil || addr != allowed {
+		t.Fatalf("got %v, %v, want %v", addr, err, allowed)
+	}
+
+	queue = &queuePacketConn{reads: []*net.UDPAddr{denied}}
+	c = newDenyConn(queue, deny, true).(*denyConn)
+	if _, addr, err := c.ReadFrom(b); err != nil || addr != denied {
+		t.Fatalf("tarpit: got %v, %v, want %v", addr, err, denied)
+	}
+	if _, err := c.WriteTo(b, allowed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WriteTo(b, denied); err != nil {
+		t.Fatal(err)
+	}
+	queue.mu.Lock()
+	writes := len(queue.writes)
+	queue.mu.Unlock()
+	if writes != 1 || c.held.Load() != 1 {
+		t.Errorf("got %v writes and %v held, want 1 and 1", writes, c.held.Load())
+	}
+}
+
+func TestDenyOobConn(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	socket := newSocketConn(udpConn, stats.New().Socket("test"))
+	c, ok := newDenyConn(socket, []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")}, false).(oobConn)
+	if !ok {
+		t.Fatal("lost the batched reads of the socket")
+	}
+	for _, source := range []string{"127.0.0.2", "127.0.0.1", "127.0.0.2"} {
+		conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.ParseIP(source)}, udpConn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Skip(err)
+		}
+		_, _ = conn.Write([]byte(source))
+		conn.Close()
+	}
+	ms := make([]ipv4.Message, 4)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, 16)}
+		ms[i].OOB = make([]byte, 64)
+	}
+	n, err := c.ReadBatch(ms, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("got %v, %v, want 1 message", n, err)
+	}
+	if got := string(ms[0].Buffers[0][:ms[0].N]); got != "127.0.0.1" {
+		t.Errorf("got %q, want the datagram of 127.0.0.1", got)
+	}
+	if socket.stats.ReadBatches.Load() == 0 {
+		t.Error("the reads were not counted in the stats of the socket")
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dialFailureCache remembers targets that recently failed to dial, so that
+// streams to a dead host fail fast instead of each waiting for the dial.
+// Failures are kept per outbound, since a target unreachable through one may
+// be reachable through another.
+type dialFailureCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	failures  map[dialFailureKey]time.Time // -> expiry
+	lastSweep time.Time
+}
+
+type dialFailureKey struct {
+	// outbound is the name of the group of the outbound, empty for the
+	// outbound of the server.
+	outbound string
+	target   string
+}
+
+func newDialFailureCache(ttl time.Duration) *dialFailureCache {
+	return &dialFailureCache{
+		ttl:       ttl,
+		failures:  map[dialFailureKey]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// failedRecently reports whether a recent dial to the target through the
+// outbound failed. It is safe to call on a nil cache.
+func (c *dialFailureCache) failedRecently(outbound, target string) bool {
+	if c == nil {
+		return false
+	}
+	key := dialFailureKey{outbound: outbound, target: target}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiry, ok := c.failures[key]
+	if ok && time.Now().After(expiry) {
+		delete(c.failures, key)
+		return false
+	}
+	return ok
+}
+
+// add remembers the failure of the target through the outbound if the host
+// is unreachable, i.e. the dial was refused or timed out. It is safe to call
+// on a nil cache.
+func (c *dialFailureCache) add(outbound, target string, err error) {
+	if c == nil || !isUnreachable(err) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.failures[dialFailureKey{outbound: outbound, target: target}] = now.Add(c.ttl)
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+	for key, expiry := range c.failures {
+		if now.After(expiry) {
+			delete(c.failures, key)
+		}
+	}
+}
+
+func isUnreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	_ "github.com/daeuniverse/outbound/dialer/socks"
+)
+
+func TestDialFailureCache(t *testing.T) {
+	c := newDialFailureCache(50 * time.Millisecond)
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	c.add("", "192.0.2.1:80", refused)
+	c.add("", "192.0.2.2:80", errors.New("no such host"))
+	if !c.failedRecently("", "192.0.2.1:80") {
+		t.Error("a refused target was not remembered")
+	}
+	if c.failedRecently("", "192.0.2.2:80") {
+		t.Error("a target failing otherwise was remembered")
+	}
+	if c.failedRecently("relay", "192.0.2.1:80") {
+		t.Error("a failure through an outbound was remembered for another")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if c.failedRecently("", "192.0.2.1:80") {
+		t.Error("a failure was remembered beyond the ttl")
+	}
+	if (*dialFailureCache)(nil).failedRecently("", "192.0.2.1:80") {
+		t.Error("a nil cache remembered a failure")
+	}
+}
+
+func TestDialFailureGroups(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+	}()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = dead.Close()
+
+	const relayUser = "00000000-0000-0000-0000-000000000002"
+	_, addr := listenTestServer(t, &Options{
+		Users:          map[string]string{testUser: testPassword, relayUser: testPassword},
+		DialFailureTtl: time.Minute,
+		Groups: []*Group{
+			// The outbound of relay is down, refusing every dial.
+			{Name: "relay", Users: []string{relayUser}, DialerLink: "socks5://" + dead.Addr().String()},
+			{Name: "direct", Users: []string{testUser}},
+		},
+	})
+	read := func(user string) ([]byte, error) {
+		conn, err := newUserTestDialer(t, addr, user, testPassword).Dial("tcp", target.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return io.ReadAll(conn)
+	}
+	if b, err := read(relayUser); err == nil && len(b) > 0 {
+		t.Fatalf("got %q through the dead outbound", b)
+	}
+	if b, err := read(testUser); err != nil || string(b) != "ok" {
+		t.Fatalf("got %q, %v through the outbound of the server after a failure of another", b, err)
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/juicity/juicity/pkg/acl"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// directDialer dials targets directly. Unlike the direct dialer of softwind,
+// it cancels the dial and the name resolution with the context, so that a
+// stream reset by the client releases its pending dial at once instead of
+// when the dial times out.
+type directDialer struct {
+	// lAddr is the local address, unspecified if invalid.
+	lAddr netip.Addr
+	// ports restricts the local ports for egress firewalls that only permit
+	// these source ports. Nil leaves them to the system.
+	ports    *acl.PortRange
+	fullCone bool
+	resolver *hostResolver
+	// guard leaves out the addresses of the server itself. Nil allows all.
+	guard *LoopGuard
+}
+
+// lookup resolves the addresses of addr that may be dialed.
+func (d *directDialer) lookup(ctx context.Context, mark int, addr string) ([]netip.AddrPort, error) {
+	rAddrs, err := d.resolver.lookupAddrPorts(ctx, markResolver(mark), addr)
+	if err != nil {
+		return nil, err
+	}
+	if filter := addrFilterOf(ctx); filter != nil {
+		if rAddrs, err = filter.filter(addr, rAddrs); err != nil {
+			return nil, err
+		}
+	}
+	if d.guard == nil {
+		return rAddrs, nil
+	}
+	return d.guard.filter(rAddrs)
+}
+
+// addrFilter reports whether an address that the host of a target resolved
+// to may be dialed, e.g. by the rules of IPs of the acl.
+type addrFilter func(target string, addr netip.AddrPort) bool
+
+type addrFilterKey struct{}
+
+// withAddrFilter makes the direct dials of ctx leave out the addresses that
+// the filter rejects.
+func withAddrFilter(ctx context.Context, filter addrFilter) context.Context {
+	return context.WithValue(ctx, addrFilterKey{}, filter)
+}
+
+func addrFilterOf(ctx context.Context) addrFilter {
+	filter, _ := ctx.Value(addrFilterKey{}).(addrFilter)
+	return filter
+}
+
+// filter removes the rejected addresses of the target, failing with
+// ErrBlocked if none is left.
+func (f addrFilter) filter(target string, addrs []netip.AddrPort) ([]netip.AddrPort, error) {
+	allowed := make([]netip.AddrPort, 0, len(addrs))
+	for _, addr := range addrs {
+		if f(target, addr) {
+			allowed = append(allowed, addr)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %v resolved to %v", ErrBlocked, target, addrs[0])
+	}
+	return allowed, nil
+}
+
+func (d *directDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *directDialer) DialContext(ctx context.Context, network string, addr string) (netproxy.Conn, error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	mark := int(magicNetwork.Mark)
+	switch magicNetwork.Network {
+	case "tcp":
+		rAddrs, err := d.lookup(ctx, mark, addr)
+		if err != nil {
+			return nil, err
+		}
+		return dialSerial(ctx, rAddrs, func(ctx context.Context, rAddr netip.AddrPort) (netproxy.Conn, error) {
+			return d.bind(func(port uint16) (netproxy.Conn, error) {
+				dialer := &net.Dialer{Control: markControl(mark)}
+				if d.lAddr.IsValid() || port != 0 {
+					dialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(d.lAddr, port))
+				}
+				return dialer.DialContext(ctx, "tcp", rAddr.String())
+			})
+		})
+	case "udp":
+		if d.fullCone {
+			return d.bind(func(port uint16) (netproxy.Conn, error) {
+				lAddr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(d.lAddr, port))
+				conn, err := (&net.ListenConfig{Control: markControl(mark)}).ListenPacket(ctx, "udp", lAddr.String())
+				if err != nil {
+					return nil, err
+				}
+				// Targets are resolved by each write, filtered as the dial.
+				resolveCtx := context.Background()
+				if filter := addrFilterOf(ctx); filter != nil {
+					resolveCtx = withAddrFilter(resolveCtx, filter)
+				}
+				resolve := func(addr string) (netip.AddrPort, error) {
+					rAddrs, err := d.lookup(resolveCtx, mark, addr)
+					if err != nil {
+						return netip.AddrPort{}, err
+					}
+					return rAddrs[0], nil
+				}
+				return &directPacketConn{UDPConn: conn.(*net.UDPConn), target: addr, resolve: resolve}, nil
+			})
+		}
+		rAddrs, err := d.lookup(ctx, mark, addr)
+		if err != nil {
+			return nil, err
+		}
+		return d.bind(func(port uint16) (netproxy.Conn, error) {
+			dialer := &net.Dialer{Control: markControl(mark)}
+			if d.lAddr.IsValid() || port != 0 {
+				dialer.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(d.lAddr, port))
+			}
+			conn, err := dialer.DialContext(ctx, "udp", rAddrs[0].String())
+			if err != nil {
+				return nil, err
+			}
+			return &directPacketConn{UDPConn: conn.(*net.UDPConn), connected: true}, nil
+		})
+	default:
+		return nil, fmt.Errorf("%w: %v", netproxy.UnsupportedTunnelTypeError, network)
+	}
+}
+
+// minDialAttempt is the least time a dial to one of several addresses is
+// given before falling back to the next one, as by net.Dialer.
+const minDialAttempt = 2 * time.Second
+
+// dialSerial dials the addresses in turn until one succeeds, splitting the
+// time left among the remaining ones.
+func dialSerial(ctx context.Context, rAddrs []netip.AddrPort, dial func(ctx context.Context, rAddr netip.AddrPort) (netproxy.Conn, error)) (conn netproxy.Conn, err error) {
+	for i, rAddr := range rAddrs {
+		attemptCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok && i < len(rAddrs)-1 {
+			timeout := max(time.Until(deadline)/time.Duration(len(rAddrs)-i), minDialAttempt)
+			var cancel context.CancelFunc
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if conn, err = dial(attemptCtx, rAddr); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+type directPacketConn struct {
+	*net.UDPConn
+	// connected is set if the socket is connected to the target, otherwise
+	// it is full cone and Write sends to target.
+	connected bool
+	target    string
+	resolve   func(addr string) (netip.AddrPort, error)
+	cached    netip.AddrPort
+}
+
+func (c *directPacketConn) Read(b []byte) (int, error) {
+	if c.connected {
+		return c.UDPConn.Read(b)
+	}
+	n, _, err := c.UDPConn.ReadFrom(b)
+	return n, err
+}
+
+func (c *directPacketConn) Write(b []byte) (int, error) {
+	if c.connected {
+		return c.UDPConn.Write(b)
+	}
+	if !c.cached.IsValid() {
+		addr, err := c.resolve(c.target)
+		if err != nil {
+			return 0, err
+		}
+		c.cached = addr
+	}
+	return c.UDPConn.WriteToUDPAddrPort(b, c.cached)
+}
+
+func (c *directPacketConn) ReadFrom(p []byte) (int, netip.AddrPort, error) {
+	return c.UDPConn.ReadFromUDPAddrPort(p)
+}
+
+func (c *directPacketConn) WriteTo(b []byte, addr string) (int, error) {
+	if c.connected {
+		return c.UDPConn.Write(b)
+	}
+	rAddr, err := c.resolve(addr)
+	if err != nil {
+		if errors.Is(err, ErrBlocked) {
+			// Dropped like the packets the acl blocks by target.
+			return len(b), nil
+		}
+		return 0, err
+	}
+	return c.UDPConn.WriteToUDPAddrPort(b, rAddr)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/juicity/juicity/pkg/fallback"
+)
+
+// ListenFallback binds the TCP address of the companion listener carrying
+// QUIC for clients whose UDP is blocked, to be served by ServePacketConn.
+// With a path, clients connect with WebSocket at the path.
+func (s *Server) ListenFallback(addr string, path string) (net.PacketConn, error) {
+	tlsConfig := s.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{fallback.NextProto}
+	if s.sessionTicketKeys != nil {
+		s.sessionTicketKeys.apply(tlsConfig)
+	}
+	ln, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	var pktConn net.PacketConn = fallback.Listen(ln, path)
+	if len(s.denySources) > 0 {
+		pktConn = newDenyConn(pktConn, s.denySources, s.tarpit)
+	}
+	return pktConn, nil
+}
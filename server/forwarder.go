@@ -21,6 +21,9 @@ type ForwarderOptions struct {
 	Dialer     netproxy.Dialer
 	LocalAddr  string
 	RemoteAddr string
+	// StrictHalfClose keeps relaying the opposite direction of a TCP
+	// connection half-closed by one side until it finishes.
+	StrictHalfClose bool
 }
 
 type Forwarder struct {
@@ -63,7 +66,7 @@ func NewForwarder(opts ForwarderOptions) (*Forwarder, error) {
 		ctx:              ctx,
 		cancel:           cancel,
 		ForwarderOptions: opts,
-		relay:            relay.NewRelay(opts.Logger),
+		relay:            relay.NewRelay(opts.Logger, opts.StrictHalfClose),
 		relayTcp:         isTcp,
 		relayUdp:         isUdp,
 		tcpListener:      nil,
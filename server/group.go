@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/juicity/juicity/pkg/acl"
+	"github.com/juicity/juicity/pkg/brutal"
+	"github.com/juicity/juicity/pkg/schedule"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+)
+
+// CongestionControlBrutal is the congestion control of groups sending at
+// their bandwidth regardless of losses.
+const CongestionControlBrutal = "brutal"
+
+// Group is a policy shared by a set of users. Zero or empty fields inherit
+// the options of the server.
+type Group struct {
+	Name string
+	// Users are the uuids of the members. A user belongs to one group at
+	// most.
+	Users             []string
+	MaxConnsPerUser   int
+	MaxStreamsPerUser int
+	Acl               *acl.Acl
+	// Schedule applies to members without a schedule of their own.
+	Schedule *schedule.Schedule
+	// DialerLink is the outbound of the members.
+	DialerLink string
+	// CongestionControl is one of cubic, bbr, new_reno and brutal, which
+	// sends at MaxBandwidthUp from the start. InitialCwnd is the initial
+	// window of bbr in packets.
+	CongestionControl string
+	InitialCwnd       int
+	// MaxBandwidthUp caps the rate in bytes per second of members declaring
+	// their bandwidth.
+	MaxBandwidthUp uint64
+	// Bittorrent replaces the BitTorrent policy of the server for members.
+	Bittorrent *Bittorrent
+	// ClientCerts are patterns like "ou:Engineering" or "san:*.example.com"
+	// of client certificates. Connections authenticated with a matching one
+	// take the Acl and DialerLink of the group, whoever their user is.
+	ClientCerts []string
+}
+
+// userGroup is a group as seen by a server.
+type userGroup struct {
+	*Group
+	dialer netproxy.ContextDialer
+}
+
+// parseGroups returns the groups of the users among the given ones, and the
+// groups matching client certificates. Members unknown to the server, e.g.
+// those of other listeners, are ignored.
+func parseGroups(opts *Options, users map[uuid.UUID]string) (map[uuid.UUID]*userGroup, []*userGroup, error) {
+	m := map[uuid.UUID]*userGroup{}
+	var certGroups []*userGroup
+	for _, g := range opts.Groups {
+		var group *userGroup
+		for _, _uuid := range g.Users {
+			id, err := uuid.Parse(_uuid)
+			if err != nil {
+				return nil, nil, fmt.Errorf("group %v: parse uuid(%v): %w", g.Name, _uuid, err)
+			}
+			if _, ok := users[id]; !ok {
+				continue
+			}
+			if other, ok := m[id]; ok {
+				return nil, nil, fmt.Errorf("user %v is in both group %v and %v", id, other.Name, g.Name)
+			}
+			if group == nil {
+				if group, err = newUserGroup(opts, g); err != nil {
+					return nil, nil, err
+				}
+			}
+			m[id] = group
+		}
+		if len(g.ClientCerts) > 0 {
+			if group == nil {
+				var err error
+				if group, err = newUserGroup(opts, g); err != nil {
+					return nil, nil, err
+				}
+			}
+			certGroups = append(certGroups, group)
+		}
+	}
+	return m, certGroups, nil
+}
+
+func newUserGroup(opts *Options, g *Group) (*userGroup, error) {
+	switch g.CongestionControl {
+	case "", "cubic", "bbr", "new_reno":
+	case CongestionControlBrutal:
+		if g.MaxBandwidthUp == 0 {
+			return nil, fmt.Errorf("group %v: brutal requires a bandwidth", g.Name)
+		}
+	default:
+		return nil, fmt.Errorf("group %v: unexpected congestion control: %v", g.Name, g.CongestionControl)
+	}
+	if g.Bittorrent != nil {
+		if err := g.Bittorrent.validate(); err != nil {
+			return nil, fmt.Errorf("group %v: %w", g.Name, err)
+		}
+	}
+	for _, pattern := range g.ClientCerts {
+		if _, _, err := parseClientCertPattern(pattern); err != nil {
+			return nil, fmt.Errorf("group %v: %w", g.Name, err)
+		}
+	}
+	group := &userGroup{Group: g}
+	if g.DialerLink != "" {
+		var err error
+		if group.dialer, err = newDialer(opts, outboundLinks(opts.Detour, g.DialerLink)...); err != nil {
+			return nil, fmt.Errorf("group %v: %w", g.Name, err)
+		}
+	}
+	return group, nil
+}
+
+// outboundLinks returns the chain of dialer links through the detour to the
+// outbound.
+func outboundLinks(detour []string, dialerLink string) []string {
+	links := append([]string(nil), detour...)
+	if dialerLink != "" {
+		links = append(links, dialerLink)
+	}
+	return links
+}
+
+func (s *Server) maxConnsOf(user uuid.UUID) int {
+	if g, ok := s.groups[user]; ok && g.MaxConnsPerUser > 0 {
+		return g.MaxConnsPerUser
+	}
+	return s.maxConnsPerUser
+}
+
+func (s *Server) maxStreamsOf(user uuid.UUID) int {
+	if g, ok := s.groups[user]; ok && g.MaxStreamsPerUser > 0 {
+		return g.MaxStreamsPerUser
+	}
+	return s.maxStreamsPerUser
+}
+
+func (s *Server) aclOf(sess *session) *acl.Acl {
+	if g := sess.certGroup; g != nil && g.Acl != nil {
+		return g.Acl
+	}
+	if g, ok := s.groups[sess.user]; ok && g.Acl != nil {
+		return g.Acl
+	}
+	return s.acl
+}
+
+func (s *Server) maxBandwidthOf(user uuid.UUID) uint64 {
+	if g, ok := s.groups[user]; ok && g.MaxBandwidthUp > 0 {
+		return g.MaxBandwidthUp
+	}
+	return s.maxBandwidthUp
+}
+
+// setCongestionControlOf switches the authenticated connection of the user to
+// the congestion control of its group, if the group sets one.
+func (s *Server) setCongestionControlOf(conn quic.Connection, user uuid.UUID) {
+	g, ok := s.groups[user]
+	if !ok || (g.CongestionControl == "" && g.InitialCwnd <= 0) {
+		return
+	}
+	if g.CongestionControl == CongestionControlBrutal {
+		conn.SetCongestionControl(brutal.NewSender(g.MaxBandwidthUp))
+		return
+	}
+	cc, cwnd := g.CongestionControl, g.InitialCwnd
+	if cc == "" {
+		cc = s.congestionControl
+	}
+	if cwnd <= 0 {
+		cwnd = s.cwnd
+	}
+	s.setCongestionControl(conn, cc, cwnd)
+}
+
+// dialerOf returns the outbound of the session and its name, the group it
+// belongs to or empty for the outbound of the server.
+func (s *Server) dialerOf(sess *session) (netproxy.ContextDialer, string) {
+	if g := sess.certGroup; g != nil && g.dialer != nil {
+		return g.dialer, g.Name
+	}
+	if g, ok := s.groups[sess.user]; ok && g.dialer != nil {
+		return g.dialer, g.Name
+	}
+	return s.dialer, ""
+}
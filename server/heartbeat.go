@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/mzz2017/quic-go"
+)
+
+// HeartbeatHostname is the reserved target of the heartbeat stream of a
+// client. Each ping is an 8-byte nonce followed by the round-trip time of the
+// previous ping in microseconds as a big-endian uint32, and the server echoes
+// the nonce on the stream.
+const HeartbeatHostname = "_heartbeat.juicity"
+
+const (
+	HeartbeatPingSize = 12
+	HeartbeatPongSize = 8
+)
+
+// EncodeHeartbeat returns a ping.
+func EncodeHeartbeat(nonce uint64, lastRtt time.Duration) []byte {
+	b := make([]byte, HeartbeatPingSize)
+	binary.BigEndian.PutUint64(b, nonce)
+	binary.BigEndian.PutUint32(b[8:], uint32(lastRtt.Microseconds()))
+	return b
+}
+
+// handleHeartbeatStream echoes the pings of a bidirectional stream until it
+// is closed, recording the round-trip times they report.
+func (s *Server) handleHeartbeatStream(stream quic.Stream, rw io.ReadWriter, sess *session) error {
+	release, err := s.acquireStream(stream, sess)
+	if err != nil {
+		return err
+	}
+	defer release()
+	userStats := sess.stats()
+	counter := newTrafficCounter(userStats)
+	b := make([]byte, HeartbeatPingSize)
+	for {
+		if _, err := io.ReadFull(rw, b); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		counter.upload(len(b))
+		n, err := rw.Write(b[:HeartbeatPongSize])
+		counter.download(n)
+		if err != nil {
+			return err
+		}
+		if rtt := time.Duration(binary.BigEndian.Uint32(b[8:])) * time.Microsecond; rtt > 0 {
+			userStats.SetRtt(rtt)
+		}
+	}
+}
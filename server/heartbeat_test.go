@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	s, addr := listenTestServer(t, &Options{})
+	d := newTestDialer(t, addr)
+	heartbeat, err := d.Dial("tcp", HeartbeatHostname+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer heartbeat.Close()
+	if _, err = heartbeat.Write(EncodeHeartbeat(7, 5*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, HeartbeatPongSize)
+	if _, err = io.ReadFull(heartbeat, b); err != nil {
+		t.Fatal(err)
+	}
+	if nonce := binary.BigEndian.Uint64(b); nonce != 7 {
+		t.Fatalf("got nonce %v, want 7", nonce)
+	}
+	user := s.Stats().User(testUser)
+	if rtt := user.Rtt(); rtt != 5*time.Millisecond {
+		t.Errorf("got rtt %v, want 5ms", rtt)
+	}
+}
+
+func TestHeartbeatStreamLimit(t *testing.T) {
+	_, addr := listenTestServer(t, &Options{MaxStreamsPerUser: 1})
+	d := newTestDialer(t, addr)
+	// The heartbeat holds the only stream slot of the user.
+	heartbeat, err := d.Dial("tcp", HeartbeatHostname+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer heartbeat.Close()
+	if _, err = heartbeat.Write(EncodeHeartbeat(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(heartbeat, make([]byte, HeartbeatPongSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err = dialClock(d); err == nil {
+		t.Error("got no error beyond the stream limit")
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mzz2017/quic-go"
+)
+
+// StreamCodeIdle resets the streams closed by the idle stream reaper.
+const StreamCodeIdle quic.StreamErrorCode = 0xffffff11
+
+const (
+	minReapInterval = time.Second
+	maxReapInterval = 30 * time.Second
+)
+
+type idleStream struct {
+	stream  quic.Stream
+	rConn   io.Closer
+	counter *trafficCounter
+	reaped  atomic.Bool
+}
+
+// wasReaped reports whether the stream was closed by the reaper. It is safe
+// to call on a nil stream.
+func (s *idleStream) wasReaped() bool {
+	return s != nil && s.reaped.Load()
+}
+
+// idleReaper closes relayed TCP streams that have been idle for too long,
+// e.g. half-open streams whose peers are gone. A stream is idle when no data
+// was relayed upstream for upTimeout and downstream for downTimeout. A zero
+// timeout ignores its direction.
+type idleReaper struct {
+	upTimeout   time.Duration
+	downTimeout time.Duration
+
+	mu      sync.Mutex
+	streams map[*idleStream]struct{}
+}
+
+func newIdleReaper(upTimeout, downTimeout time.Duration) *idleReaper {
+	r := &idleReaper{
+		upTimeout:   upTimeout,
+		downTimeout: downTimeout,
+		streams:     map[*idleStream]struct{}{},
+	}
+	go r.run()
+	return r
+}
+
+// add tracks the stream until it is removed. It is safe to call on a nil
+// reaper, which returns nil.
+func (r *idleReaper) add(stream quic.Stream, rConn io.Closer, counter *trafficCounter) *idleStream {
+	if r == nil {
+		return nil
+	}
+	s := &idleStream{stream: stream, rConn: rConn, counter: counter}
+	r.mu.Lock()
+	r.streams[s] = struct{}{}
+	r.mu.Unlock()
+	return s
+}
+
+func (r *idleReaper) remove(s *idleStream) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.streams, s)
+	r.mu.Unlock()
+}
+
+func (r *idleReaper) run() {
+	interval := r.upTimeout
+	if interval == 0 || (r.downTimeout > 0 && r.downTimeout < interval) {
+		interval = r.downTimeout
+	}
+	interval = min(max(interval/4, minReapInterval), maxReapInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.reap()
+	}
+}
+
+func (r *idleReaper) idle(s *idleStream, now int64) bool {
+	if r.upTimeout > 0 && now-s.counter.lastUp.Load() < int64(r.upTimeout) {
+		return false
+	}
+	if r.downTimeout > 0 && now-s.counter.lastDown.Load() < int64(r.downTimeout) {
+		return false
+	}
+	return true
+}
+
+func (r *idleReaper) reap() {
+	now := time.Now().UnixNano()
+	var idle []*idleStream
+	r.mu.Lock()
+	for s := range r.streams {
+		if r.idle(s, now) {
+			idle = append(idle, s)
+			delete(r.streams, s)
+		}
+	}
+	r.mu.Unlock()
+	for _, s := range idle {
+		s.reaped.Store(true)
+		s.stream.CancelRead(StreamCodeIdle)
+		s.stream.CancelWrite(StreamCodeIdle)
+		_ = s.rConn.Close()
+	}
+}
@@ -10,6 +10,13 @@ import (
 
 type inFlightKey = [juicity.UnderlaySaltLen]byte
 
+// underlayAuth is an auth of an underlay UDP session, bound to the session of
+// the connection that sent it, whose policies the underlay session follows.
+type underlayAuth struct {
+	*juicity.UnderlayAuth
+	sess *session
+}
+
 type ContextCancel struct {
 	Ctx    context.Context
 	Cancel func()
@@ -17,7 +24,7 @@ type ContextCancel struct {
 type InFlightUnderlayKey struct {
 	ttl    time.Duration
 	mu     sync.Mutex
-	m      map[inFlightKey]*juicity.UnderlayAuth
+	m      map[inFlightKey]*underlayAuth
 	notify map[inFlightKey]*ContextCancel
 }
 
@@ -25,12 +32,12 @@ func NewInFlightUnderlayKey(ttl time.Duration) *InFlightUnderlayKey {
 	return &InFlightUnderlayKey{
 		ttl:    ttl,
 		mu:     sync.Mutex{},
-		m:      make(map[inFlightKey]*juicity.UnderlayAuth, 64),
+		m:      make(map[inFlightKey]*underlayAuth, 64),
 		notify: make(map[inFlightKey]*ContextCancel, 64),
 	}
 }
 
-func (i *InFlightUnderlayKey) Evict(k [juicity.UnderlaySaltLen]byte) *juicity.UnderlayAuth {
+func (i *InFlightUnderlayKey) Evict(k [juicity.UnderlaySaltLen]byte) *underlayAuth {
 	i.mu.Lock()
 	cc, ok := i.notify[k]
 	if !ok {
@@ -64,7 +71,7 @@ func (i *InFlightUnderlayKey) Evict(k [juicity.UnderlaySaltLen]byte) *juicity.Un
 	return auth
 }
 
-func (i *InFlightUnderlayKey) Store(k [juicity.UnderlaySaltLen]byte, auth *juicity.UnderlayAuth) {
+func (i *InFlightUnderlayKey) Store(k [juicity.UnderlaySaltLen]byte, auth *underlayAuth) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 	cc, ok := i.notify[k]
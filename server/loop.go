@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// localAddrsTtl is how long the addresses of the interfaces are cached.
+const localAddrsTtl = 30 * time.Second
+
+var ErrLoopTarget = fmt.Errorf("target is the server itself")
+
+// LoopGuard blocks direct dials to the ports the server listens at on
+// addresses of the host, which would relay streams back into the server and
+// loop until the host is saturated. It is shared by the servers of all
+// listeners.
+type LoopGuard struct {
+	// blockLocal blocks every port of the addresses of the host.
+	blockLocal bool
+
+	mu      sync.Mutex
+	ports   map[uint16]struct{}
+	local   map[netip.Addr]struct{}
+	localAt time.Time
+}
+
+// NewLoopGuard returns a guard of no port, which blocks all ports of the
+// addresses of the host if blockLocal.
+func NewLoopGuard(blockLocal bool) *LoopGuard {
+	return &LoopGuard{
+		blockLocal: blockLocal,
+		ports:      map[uint16]struct{}{},
+	}
+}
+
+// AddListen guards the port of a listen address of the server, in any
+// protocol.
+func (g *LoopGuard) AddListen(listen string) error {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("parse port: %w", err)
+	}
+	g.mu.Lock()
+	g.ports[uint16(p)] = struct{}{}
+	g.mu.Unlock()
+	return nil
+}
+
+// Blocks reports whether dials to addr are blocked.
+func (g *LoopGuard) Blocks(addr netip.AddrPort) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.ports[addr.Port()]; !ok && !g.blockLocal {
+		return false
+	}
+	ip := addr.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	if time.Since(g.localAt) > localAddrsTtl {
+		g.local = localAddrs()
+		g.localAt = time.Now()
+	}
+	_, ok := g.local[ip.WithZone("")]
+	return ok
+}
+
+// filter removes the blocked addresses, failing with ErrLoopTarget if none
+// is left.
+func (g *LoopGuard) filter(addrs []netip.AddrPort) ([]netip.AddrPort, error) {
+	allowed := addrs[:0]
+	for _, addr := range addrs {
+		if !g.Blocks(addr) {
+			allowed = append(allowed, addr)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %v", ErrLoopTarget, addrs[0])
+	}
+	return allowed, nil
+}
+
+// localAddrs returns the addresses of the interfaces of the host.
+func localAddrs() map[netip.Addr]struct{} {
+	local := map[netip.Addr]struct{}{}
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return local
+	}
+	for _, ifAddr := range ifAddrs {
+		if prefix, err := netip.ParsePrefix(ifAddr.String()); err == nil {
+			local[prefix.Addr().Unmap()] = struct{}{}
+		}
+	}
+	return local
+}
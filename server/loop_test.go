@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestLoopGuard(t *testing.T) {
+	guard := NewLoopGuard(false)
+	if err := guard.AddListen(":23182"); err != nil {
+		t.Fatal(err)
+	}
+	blockLocal := NewLoopGuard(true)
+	tests := []struct {
+		addr       string
+		want       bool
+		blockLocal bool
+	}{
+		{"127.0.0.1:23182", true, true},
+		{"[::1]:23182", true, true},
+		{"[::ffff:127.0.0.2]:23182", true, true},
+		{"0.0.0.0:23182", true, true},
+		{"127.0.0.1:80", false, true},
+		{"1.1.1.1:23182", false, false},
+		{"1.1.1.1:80", false, false},
+	}
+	for _, tt := range tests {
+		addr := netip.MustParseAddrPort(tt.addr)
+		if got := guard.Blocks(addr); got != tt.want {
+			t.Errorf("Blocks(%v): got %v, want %v", tt.addr, got, tt.want)
+		}
+		if got := blockLocal.Blocks(addr); got != tt.blockLocal {
+			t.Errorf("Blocks(%v) of local targets: got %v, want %v", tt.addr, got, tt.blockLocal)
+		}
+	}
+
+	allowed, err := guard.filter([]netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:23182"),
+		netip.MustParseAddrPort("1.1.1.1:23182"),
+	})
+	if err != nil || len(allowed) != 1 || allowed[0].Addr() != netip.MustParseAddr("1.1.1.1") {
+		t.Errorf("filter: got %v, %v", allowed, err)
+	}
+	if _, err = guard.filter([]netip.AddrPort{netip.MustParseAddrPort("[::1]:23182")}); !errors.Is(err, ErrLoopTarget) {
+		t.Errorf("filter: got %v, want %v", err, ErrLoopTarget)
+	}
+}
@@ -1,9 +1,14 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	nethttp "net/http"
+	"net/netip"
 	"net/url"
+	"slices"
+	"sync"
 
 	"github.com/daeuniverse/softwind/netproxy"
 	gliderLog "github.com/nadoo/glider/pkg/log"
@@ -75,10 +80,43 @@ var _ proxy.Proxy = &forwarder{}
 
 // Mixed struct.
 type Mixed struct {
+	url  string
 	addr string
+	// router chooses the dialer of each connection if not nil.
+	router func(source net.Addr) netproxy.Dialer
+	// allowed are the sources served if not empty.
+	allowed []netip.Prefix
+	// pac renders the PAC file served at pacPath for the proxy address the
+	// client requested it from.
+	pacPath string
+	pac     func(proxyAddr string) []byte
+	// isolate returns the dialer of the SOCKS5 connections authenticated
+	// with the user, given the one chosen otherwise. SOCKS5 clients then
+	// authenticate themselves with any user and, if the url has one, its
+	// password.
+	isolate   func(user string, d netproxy.Dialer) netproxy.Dialer
+	user      string
+	password  string
+	noAuthUrl string
 
-	httpServer   *http.HTTP
-	socks5Server *socks5.Socks5
+	// dialer relays UDP, which bypasses the generic packet layers of glider.
+	dialer     netproxy.Dialer
+	httpServer *http.HTTP
+
+	mu         sync.Mutex
+	closed     bool
+	listener   net.Listener
+	packetConn *net.UDPConn
+	// associations are the live UDP associations by source, the only
+	// sources the UDP relay serves.
+	associations map[netip.Addr][]*udpAssociation
+}
+
+// udpAssociation is a UDP association of an authenticated connection.
+type udpAssociation struct {
+	user string
+	// port is the one the client declared to send from, or 0.
+	port uint16
 }
 
 // NewMixed returns a mixed proxy.
@@ -92,53 +130,278 @@ func NewMixed(s string, d netproxy.Dialer) (*Mixed, error) {
 		d: d,
 	}
 	m := &Mixed{
-		addr: u.Host,
+		url:    s,
+		addr:   u.Host,
+		dialer: d,
+	}
+	if u.User != nil {
+		m.user = u.User.Username()
+		m.password, _ = u.User.Password()
+		noAuth := *u
+		noAuth.User = nil
+		m.noAuthUrl = noAuth.String()
+	} else {
+		m.noAuthUrl = s
 	}
 
 	m.httpServer, err = http.NewHTTP(s, nil, p)
 	if err != nil {
 		return nil, err
 	}
-
-	m.socks5Server, err = socks5.NewSocks5(s, nil, p)
-	if err != nil {
+	// SOCKS5 servers are created for each connection once authenticated.
+	if _, err = socks5.NewSocks5(m.noAuthUrl, nil, p); err != nil {
 		return nil, err
 	}
 
 	return m, nil
 }
 
-// ListenAndServe listens on server's addr and serves connections.
-func (m *Mixed) ListenAndServe() {
-	go m.socks5Server.ListenAndServeUDP()
+// SetRouter makes TCP connections and SOCKS5 UDP sessions dial through the
+// dialer the router chooses by their source address, a *net.TCPAddr or a
+// *net.UDPAddr.
+func (m *Mixed) SetRouter(router func(source net.Addr) netproxy.Dialer) {
+	m.router = router
+}
+
+// SetAllowedSources makes the server ignore connections and packets from
+// sources outside the prefixes. All sources are allowed if empty.
+func (m *Mixed) SetAllowedSources(prefixes []netip.Prefix) {
+	m.allowed = prefixes
+}
+
+// SetPac serves the PAC file that pac renders on plain HTTP GET requests to
+// the path, which proxy requests never are.
+func (m *Mixed) SetPac(path string, pac func(proxyAddr string) []byte) {
+	m.pacPath = path
+	m.pac = pac
+}
+
+// SetIsolation makes SOCKS5 connections authenticated with a user, and the
+// UDP sessions of their associations, dial through the dialer isolate
+// returns for it, so that applications using different users get
+// unlinkable tunnels. Any user is accepted.
+func (m *Mixed) SetIsolation(isolate func(user string, d netproxy.Dialer) netproxy.Dialer) {
+	m.isolate = isolate
+}
+
+func (m *Mixed) isAllowed(source net.Addr) bool {
+	if len(m.allowed) == 0 {
+		return true
+	}
+	var addr netip.Addr
+	switch source := source.(type) {
+	case *net.TCPAddr:
+		addr = source.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		addr = source.AddrPort().Addr().Unmap()
+	default:
+		return false
+	}
+	return m.isAllowedAddr(addr)
+}
+
+func (m *Mixed) associate(source netip.Addr, a *udpAssociation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.associations == nil {
+		m.associations = map[netip.Addr][]*udpAssociation{}
+	}
+	m.associations[source] = append(m.associations[source], a)
+}
+
+func (m *Mixed) dissociate(source netip.Addr, a *udpAssociation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	associations := slices.DeleteFunc(m.associations[source], func(b *udpAssociation) bool { return a == b })
+	if len(associations) == 0 {
+		delete(m.associations, source)
+	} else {
+		m.associations[source] = associations
+	}
+}
+
+// udpUserOf returns the user of the association serving the UDP source: the
+// one declaring its port, or else the user of all the associations of its
+// address. Associations of different users, none declaring the port, are
+// ambiguous.
+func (m *Mixed) udpUserOf(source netip.AddrPort) (user string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var candidates []*udpAssociation
+	for _, a := range m.associations[source.Addr()] {
+		if a.port == source.Port() {
+			return a.user, true
+		}
+		if a.port == 0 {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	for _, a := range candidates[1:] {
+		if a.user != candidates[0].user {
+			return "", false
+		}
+	}
+	return candidates[0].user, true
+}
 
+// udpDialer returns the dialer of a new UDP session from the source, chosen
+// like for TCP connections, or nil to drop its packets.
+func (m *Mixed) udpDialer(source netip.AddrPort) netproxy.Dialer {
+	d := m.dialer
+	if m.router != nil {
+		d = m.router(net.UDPAddrFromAddrPort(source))
+	}
+	if m.isolate == nil {
+		return d
+	}
+	user, ok := m.udpUserOf(source)
+	if !ok {
+		gliderLog.F("[socks5u] %v: ambiguous user, the associations of different users must declare the port they send from", source)
+		return nil
+	}
+	if user != "" {
+		d = m.isolate(user, d)
+	}
+	return d
+}
+
+// isAssociated reports whether the source has a live UDP association and is
+// allowed, as UDP packets carry no authentication of their own.
+func (m *Mixed) isAssociated(source netip.Addr) bool {
+	if !m.isAllowedAddr(source) {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.associations[source]) > 0
+}
+
+func (m *Mixed) isAllowedAddr(addr netip.Addr) bool {
+	if len(m.allowed) == 0 {
+		return true
+	}
+	for _, prefix := range m.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenAndServe listens on server's addr and serves connections until Close
+// is called.
+func (m *Mixed) ListenAndServe() error {
 	l, err := net.Listen("tcp", m.addr)
 	if err != nil {
-		gliderLog.Fatalf("[mixed] failed to listen on %s: %v", m.addr, err)
-		return
+		return fmt.Errorf("[mixed] failed to listen on %s: %w", m.addr, err)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", m.addr)
+	if err != nil {
+		l.Close()
+		return fmt.Errorf("[socks5] failed to resolve UDP %s: %w", m.addr, err)
+	}
+	pc, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		l.Close()
+		return fmt.Errorf("[socks5] failed to listen on UDP %s: %w", m.addr, err)
 	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		l.Close()
+		pc.Close()
+		return nil
+	}
+	m.listener = l
+	m.packetConn = pc
+	m.mu.Unlock()
+
+	gliderLog.F("[socks5] listening UDP on %s", m.addr)
+	go newSocks5UdpRelay(pc, m.udpDialer, m.isAssociated).serve()
 
 	gliderLog.F("[mixed] http & socks5 server listening TCP on %s", m.addr)
 
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			gliderLog.F("[mixed] failed to accept: %v", err)
 			continue
 		}
+		if !m.isAllowed(c.RemoteAddr()) {
+			gliderLog.F("[mixed] rejected connection from %v", c.RemoteAddr())
+			c.Close()
+			continue
+		}
 
 		go m.Serve(c)
 	}
 }
 
+// Close stops listening.
+func (m *Mixed) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if m.listener != nil {
+		m.listener.Close()
+		m.packetConn.Close()
+	}
+	return nil
+}
+
 // Serve serves connections.
 func (m *Mixed) Serve(c net.Conn) {
+	httpServer := m.httpServer
+	d := m.dialer
+	if m.router != nil {
+		// The servers only hold the url and the proxy, so per-connection
+		// ones are cheap.
+		d = m.router(c.RemoteAddr())
+		httpServer, _ = http.NewHTTP(m.url, nil, &forwarder{d: d})
+	}
 	conn := proxy.NewConn(c)
 	if head, err := conn.Peek(1); err == nil {
 		if head[0] == socks5.Version {
-			m.socks5Server.Serve(conn)
+			m.serveSocks5(conn, d)
 			return
 		}
 	}
-	m.httpServer.Serve(conn)
+	if m.pac != nil && m.isPacRequest(conn) {
+		m.servePac(conn)
+		return
+	}
+	httpServer.Serve(conn)
+}
+
+func (m *Mixed) isPacRequest(conn *proxy.Conn) bool {
+	prefix := "GET " + m.pacPath
+	head, err := conn.Peek(len(prefix) + 1)
+	if err != nil || string(head[:len(prefix)]) != prefix {
+		return false
+	}
+	return head[len(prefix)] == ' ' || head[len(prefix)] == '?'
+}
+
+func (m *Mixed) servePac(conn *proxy.Conn) {
+	defer conn.Close()
+	req, err := nethttp.ReadRequest(conn.Reader())
+	if err != nil {
+		return
+	}
+	proxyAddr := req.Host
+	if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+		proxyAddr = conn.LocalAddr().String()
+	}
+	body := m.pac(proxyAddr)
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/x-ns-proxy-autoconfig\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", len(body))
+	_, _ = conn.Write(body)
 }
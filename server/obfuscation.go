@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/daeuniverse/softwind/pkg/fastrand"
+	"github.com/mzz2017/quic-go"
+)
+
+const (
+	// paddingWindow is when padding is sent after a connection is accepted,
+	// among the first packets of the client.
+	paddingWindow = time.Second
+	// maxPaddingWrites bounds the writes padding is split into.
+	maxPaddingWrites = 4
+)
+
+// Obfuscation blurs the size and timing signature of the handshake of
+// juicity against passive classifiers. The padding is sent on a
+// unidirectional stream that clients never read, so it works with any
+// client.
+type Obfuscation struct {
+	// PaddingMin and PaddingMax bound the random bytes of padding sent to
+	// a client in the first second of its connection, none if zero.
+	PaddingMin int
+	PaddingMax int
+	// AuthJitter bounds the random delay of the outcome of authentication:
+	// closing the connection of a failed one, or relaying the streams of a
+	// successful one.
+	AuthJitter time.Duration
+}
+
+func (o *Obfuscation) validate() error {
+	if o.PaddingMin < 0 || o.PaddingMax < o.PaddingMin {
+		return fmt.Errorf("obfuscation: invalid padding %v-%v", o.PaddingMin, o.PaddingMax)
+	}
+	if o.AuthJitter < 0 {
+		return fmt.Errorf("obfuscation: negative auth jitter")
+	}
+	return nil
+}
+
+// authDelay sleeps for a random part of AuthJitter.
+func (o *Obfuscation) authDelay() {
+	if o == nil || o.AuthJitter <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(fastrand.Int63n(int64(o.AuthJitter))))
+}
+
+// pad sends random padding to the client of conn in a few writes at random
+// moments of paddingWindow.
+func (o *Obfuscation) pad(conn quic.Connection) {
+	if o == nil || o.PaddingMax <= 0 {
+		return
+	}
+	total := o.PaddingMin + fastrand.Intn(o.PaddingMax-o.PaddingMin+1)
+	if total == 0 {
+		return
+	}
+	stream, err := conn.OpenUniStream()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	writes := 1 + fastrand.Intn(min(total, maxPaddingWrites))
+	slot := paddingWindow / time.Duration(writes)
+	for i := 0; i < writes; i++ {
+		n := total / (writes - i)
+		if i < writes-1 {
+			// Between half and one and a half of the even share.
+			n = n/2 + fastrand.Intn(n+1)
+		}
+		total -= n
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-time.After(time.Duration(fastrand.Int63n(int64(slot)))):
+		}
+		if _, err = stream.Write(make([]byte, n)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+const (
+	DefaultOutboundPoolSize        = 32
+	DefaultOutboundPoolIdleTimeout = 10 * time.Second
+	// outboundPoolPeek is how much data sent by the target first, e.g. a
+	// banner, a spare connection holds for the stream taking it.
+	outboundPoolPeek = 4096
+)
+
+// OutboundPool keeps a spare TCP connection to each target dialed again
+// within IdleTimeout, so that bursts of streams to the same host skip the
+// handshake. Connections are never reused after carrying a stream, as they
+// are bound to its protocol; spares are fresh ones nobody has written to.
+type OutboundPool struct {
+	// Size is how many targets may have a spare at once.
+	Size        int
+	IdleTimeout time.Duration
+}
+
+// outboundPool is the pool of a dialer.
+type outboundPool struct {
+	netproxy.ContextDialer
+	logger *log.Logger
+	size   int
+	ttl    time.Duration
+
+	mu sync.Mutex
+	// lastDial is when targets, by network and address, were last dialed.
+	lastDial map[string]time.Time
+	spares   map[string]*spareConn
+	// dialing are the targets whose spares are being dialed.
+	dialing map[string]struct{}
+}
+
+func newOutboundPool(logger *log.Logger, d netproxy.ContextDialer, conf *OutboundPool) *outboundPool {
+	p := &outboundPool{
+		ContextDialer: d,
+		logger:        logger,
+		size:          conf.Size,
+		ttl:           conf.IdleTimeout,
+		lastDial:      make(map[string]time.Time),
+		spares:        make(map[string]*spareConn),
+		dialing:       make(map[string]struct{}),
+	}
+	if p.size <= 0 {
+		p.size = DefaultOutboundPoolSize
+	}
+	if p.ttl <= 0 {
+		p.ttl = DefaultOutboundPoolIdleTimeout
+	}
+	return p
+}
+
+func (p *outboundPool) Dial(network string, addr string) (netproxy.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+func (p *outboundPool) DialContext(ctx context.Context, network string, addr string) (netproxy.Conn, error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil || magicNetwork.Network != "tcp" {
+		return p.ContextDialer.DialContext(ctx, network, addr)
+	}
+	key := network + " " + addr
+	now := time.Now()
+	p.mu.Lock()
+	last, hot := p.lastDial[key]
+	hot = hot && now.Sub(last) < p.ttl
+	p.lastDial[key] = now
+	spare := p.spares[key]
+	delete(p.spares, key)
+	p.mu.Unlock()
+	if hot {
+		defer p.replenish(network, addr, key)
+	}
+	if spare != nil {
+		if !allowsSpare(ctx, addr, spare.Conn) {
+			// Spares are shared by streams of any acl.
+			if c := spare.take(); c != nil {
+				_ = c.Close()
+			}
+		} else if c := spare.take(); c != nil {
+			p.logger.Debug().
+				Str("target", addr).
+				Msg("Took a spare outbound connection")
+			return c, nil
+		}
+	}
+	return p.ContextDialer.DialContext(ctx, network, addr)
+}
+
+// allowsSpare reports whether the address filter of ctx, if any, allows the
+// address that the spare to addr is connected to.
+func allowsSpare(ctx context.Context, addr string, c netproxy.Conn) bool {
+	filter := addrFilterOf(ctx)
+	if filter == nil {
+		return true
+	}
+	remote, ok := c.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return false
+	}
+	rAddr, ok := remote.RemoteAddr().(*net.TCPAddr)
+	return ok && filter(addr, rAddr.AddrPort())
+}
+
+// replenish dials a spare to the target in the background unless it has one
+// or the pool is full.
+func (p *outboundPool) replenish(network string, addr string, key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.spares[key]; ok {
+		return
+	}
+	if _, ok := p.dialing[key]; ok || len(p.spares)+len(p.dialing) >= p.size {
+		return
+	}
+	p.dialing[key] = struct{}{}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.ttl)
+		defer cancel()
+		c, err := p.ContextDialer.DialContext(ctx, network, addr)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.dialing, key)
+		if err != nil {
+			p.logger.Debug().
+				Err(err).
+				Str("target", addr).
+				Msg("Failed to dial a spare outbound connection")
+			return
+		}
+		if _, ok := p.spares[key]; ok {
+			c.Close()
+			return
+		}
+		spare := newSpareConn(c)
+		p.spares[key] = spare
+		spare.expiry = time.AfterFunc(p.ttl, func() {
+			p.mu.Lock()
+			if p.spares[key] == spare {
+				delete(p.spares, key)
+			}
+			p.mu.Unlock()
+			if c := spare.take(); c != nil {
+				c.Close()
+			}
+		})
+	}()
+	// Forget targets not dialed for a while.
+	if len(p.lastDial) > 4*p.size {
+		now := time.Now()
+		for k, last := range p.lastDial {
+			if now.Sub(last) >= p.ttl {
+				delete(p.lastDial, k)
+			}
+		}
+	}
+}
+
+// spareConn is an idle connection watched for being closed by the target.
+type spareConn struct {
+	netproxy.Conn
+	expiry *time.Timer
+
+	once sync.Once
+	// read is what the target sent until the connection is taken, closed or
+	// has outboundPoolPeek bytes buffered.
+	read chan spareRead
+}
+
+type spareRead struct {
+	b   []byte
+	err error
+}
+
+func newSpareConn(c netproxy.Conn) *spareConn {
+	s := &spareConn{Conn: c, read: make(chan spareRead, 1)}
+	go func() {
+		b := make([]byte, 0, outboundPoolPeek)
+		for len(b) < cap(b) {
+			n, err := c.Read(b[len(b):cap(b)])
+			b = b[:len(b)+n]
+			if err != nil {
+				s.read <- spareRead{b: b, err: err}
+				return
+			}
+		}
+		s.read <- spareRead{b: b}
+	}()
+	return s
+}
+
+// take returns the connection if it is still open, or nil. Only the first
+// call may return it.
+func (s *spareConn) take() (conn netproxy.Conn) {
+	s.once.Do(func() {
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+		if err := s.Conn.SetReadDeadline(time.Now()); err != nil {
+			s.Conn.Close()
+			return
+		}
+		r := <-s.read
+		if r.err != nil && !errors.Is(r.err, os.ErrDeadlineExceeded) {
+			s.Conn.Close()
+			return
+		}
+		_ = s.Conn.SetReadDeadline(time.Time{})
+		if len(r.b) > 0 {
+			conn = &prefixConn{Conn: s.Conn, prefix: r.b}
+			return
+		}
+		conn = s.Conn
+	})
+	return conn
+}
+
+// prefixConn returns the data read ahead before the rest of the connection.
+type prefixConn struct {
+	netproxy.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	if conn, ok := c.Conn.(relay.WriteCloser); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
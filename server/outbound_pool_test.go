@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+func TestOutboundPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// A banner, which a spare must hold for its stream.
+			_, _ = c.Write([]byte("hi"))
+			accepted <- c
+		}
+	}()
+	base := &directDialer{resolver: newHostResolver(DialDual, 0)}
+	p := newOutboundPool(log.NewLogger(&log.Options{}), base, &OutboundPool{IdleTimeout: time.Second})
+	waitSpare := func() *spareConn {
+		for i := 0; i < 100; i++ {
+			p.mu.Lock()
+			spare := p.spares["tcp "+ln.Addr().String()]
+			p.mu.Unlock()
+			if spare != nil {
+				return spare
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+
+	// A target is only kept a spare once dialed again.
+	for i := 0; i < 2; i++ {
+		c, err := p.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		<-accepted
+		p.mu.Lock()
+		if i == 0 && len(p.spares)+len(p.dialing) > 0 {
+			t.Fatal("a spare was dialed for the first dial")
+		}
+		p.mu.Unlock()
+	}
+	spare := waitSpare()
+	if spare == nil {
+		t.Fatal("no spare was dialed")
+	}
+	<-accepted
+	c, err := p.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if pc, ok := c.(*prefixConn); !ok || pc.Conn != spare.Conn {
+		t.Error("the spare was not taken with its banner")
+	}
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(c, b); err != nil || string(b) != "hi" {
+		t.Errorf("got %q, %v, want the banner", b, err)
+	}
+
+	// A spare closed by the target is discarded.
+	spare = waitSpare()
+	if spare == nil {
+		t.Fatal("the spare was not replenished")
+	}
+	(<-accepted).Close()
+	time.Sleep(50 * time.Millisecond)
+	if c, err = p.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if pc, ok := c.(*prefixConn); ok && pc.Conn == spare.Conn {
+		t.Error("the closed spare was taken")
+	}
+
+	// Spares are not taken by dials whose filter rejects their address.
+	spare = waitSpare()
+	if spare == nil {
+		t.Fatal("the spare was not replenished")
+	}
+	<-accepted
+	ctx := withAddrFilter(context.Background(), func(string, netip.AddrPort) bool { return false })
+	if _, err = p.DialContext(ctx, "tcp", ln.Addr().String()); !errors.Is(err, ErrBlocked) {
+		t.Errorf("got %v, want %v", err, ErrBlocked)
+	}
+	if _, err = spare.Conn.Write([]byte("x")); err == nil {
+		t.Error("the rejected spare was kept open")
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolHeaderLen = 16
+	// proxyProtocolFlowTtl is how long a client is remembered after its last
+	// packet through a load balancer.
+	proxyProtocolFlowTtl = 5 * time.Minute
+)
+
+var ErrInvalidProxyHeader = fmt.Errorf("invalid PROXY protocol header")
+
+// parseProxyHeader parses a PROXY protocol v2 header at the beginning of b.
+// It returns the length of the header and the source address it carries,
+// which is invalid for LOCAL commands and unspecified address families.
+func parseProxyHeader(b []byte) (n int, source netip.AddrPort, err error) {
+	if len(b) < proxyProtocolHeaderLen || !bytes.Equal(b[:12], proxyProtocolSignature) {
+		return 0, netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+	if b[12]>>4 != 2 {
+		return 0, netip.AddrPort{}, fmt.Errorf("%w: version %v", ErrInvalidProxyHeader, b[12]>>4)
+	}
+	n = proxyProtocolHeaderLen + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return 0, netip.AddrPort{}, fmt.Errorf("%w: truncated", ErrInvalidProxyHeader)
+	}
+	switch cmd := b[12] & 0xf; cmd {
+	case 0: // LOCAL
+		return n, netip.AddrPort{}, nil
+	case 1: // PROXY
+	default:
+		return 0, netip.AddrPort{}, fmt.Errorf("%w: command %v", ErrInvalidProxyHeader, cmd)
+	}
+	addrs := b[proxyProtocolHeaderLen:n]
+	switch family := b[13] >> 4; family {
+	case 1: // AF_INET
+		if len(addrs) < 12 {
+			return 0, netip.AddrPort{}, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidProxyHeader)
+		}
+		source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrs[:4])), binary.BigEndian.Uint16(addrs[8:10]))
+	case 2: // AF_INET6
+		if len(addrs) < 36 {
+			return 0, netip.AddrPort{}, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidProxyHeader)
+		}
+		source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrs[:16])).Unmap(), binary.BigEndian.Uint16(addrs[32:34]))
+	}
+	return n, source, nil
+}
+
+type proxiedFlow struct {
+	balancer netip.AddrPort
+	client   netip.AddrPort
+	lastSeen time.Time
+}
+
+// proxyProtocolConn strips PROXY protocol v2 headers that trusted load
+// balancers prepend to datagrams, and reports the client carried in the
+// header as the source. Balancers may send the header with every datagram or
+// only with the first one of a flow. Replies to the client are sent back
+// through its balancer.
+type proxyProtocolConn struct {
+	net.PacketConn
+	trusted []netip.Prefix
+
+	mu        sync.Mutex
+	clients   map[netip.AddrPort]*proxiedFlow // by client
+	balancers map[netip.AddrPort]*proxiedFlow // by balancer
+	lastSweep time.Time
+}
+
+// newProxyProtocolConn wraps conn, keeping the batched reads and ECN of an
+// oobConn.
+func newProxyProtocolConn(conn net.PacketConn, trusted []netip.Prefix) net.PacketConn {
+	c := &proxyProtocolConn{
+		PacketConn: conn,
+		trusted:    trusted,
+		clients:    map[netip.AddrPort]*proxiedFlow{},
+		balancers:  map[netip.AddrPort]*proxiedFlow{},
+		lastSweep:  time.Now(),
+	}
+	if oob, ok := conn.(oobConn); ok {
+		return &proxyProtocolOobConn{proxyProtocolConn: c, oob: oob}
+	}
+	return c
+}
+
+func (c *proxyProtocolConn) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// receive strips the header of the datagram b from a trusted balancer and
+// returns its length and its client, or false if it is dropped.
+func (c *proxyProtocolConn) receive(b []byte, addr *net.UDPAddr) (int, *net.UDPAddr, bool) {
+	from := netip.AddrPortFrom(addr.AddrPort().Addr().Unmap(), addr.AddrPort().Port())
+	if !c.isTrusted(from.Addr()) {
+		return len(b), addr, true
+	}
+	if !bytes.HasPrefix(b, proxyProtocolSignature) {
+		if client, ok := c.clientOf(from); ok {
+			return len(b), net.UDPAddrFromAddrPort(client), true
+		}
+		return len(b), addr, true
+	}
+	headerLen, client, err := parseProxyHeader(b)
+	if err != nil {
+		// Drop the malformed datagram.
+		return 0, nil, false
+	}
+	n := copy(b, b[headerLen:])
+	if !client.IsValid() {
+		return n, addr, true
+	}
+	c.track(from, client)
+	return n, net.UDPAddrFromAddrPort(client), true
+}
+
+// balancerOf returns the balancer to send to the address through, or the
+// address itself if it is not a client of any.
+func (c *proxyProtocolConn) balancerOf(addr *net.UDPAddr) *net.UDPAddr {
+	to := netip.AddrPortFrom(addr.AddrPort().Addr().Unmap(), addr.AddrPort().Port())
+	c.mu.Lock()
+	flow, ok := c.clients[to]
+	c.mu.Unlock()
+	if !ok {
+		return addr
+	}
+	return net.UDPAddrFromAddrPort(flow.balancer)
+}
+
+func (c *proxyProtocolConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			return n, addr, nil
+		}
+		if n, udpAddr, ok = c.receive(p[:n], udpAddr); ok {
+			return n, udpAddr, nil
+		}
+	}
+}
+
+func (c *proxyProtocolConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		addr = c.balancerOf(udpAddr)
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+var _ oobConn = &proxyProtocolOobConn{}
+
+type proxyProtocolOobConn struct {
+	*proxyProtocolConn
+	oob oobConn
+}
+
+func (c *proxyProtocolOobConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	for {
+		n, err := c.oob.ReadBatch(ms, flags)
+		if err != nil || n == 0 {
+			return n, err
+		}
+		kept := 0
+		for i := 0; i < n; i++ {
+			udpAddr, ok := ms[i].Addr.(*net.UDPAddr)
+			if ok {
+				if ms[i].N, udpAddr, ok = c.receive(ms[i].Buffers[0][:ms[i].N], udpAddr); !ok {
+					continue
+				}
+				ms[i].Addr = udpAddr
+			}
+			if kept != i {
+				moveMessage(&ms[kept], &ms[i])
+			}
+			kept++
+		}
+		if kept > 0 {
+			return kept, nil
+		}
+	}
+}
+
+func (c *proxyProtocolOobConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	for {
+		n, oobn, flags, addr, err = c.oob.ReadMsgUDP(b, oob)
+		if err != nil {
+			return n, oobn, flags, addr, err
+		}
+		var ok bool
+		if n, addr, ok = c.receive(b[:n], addr); ok {
+			return n, oobn, flags, addr, nil
+		}
+	}
+}
+
+func (c *proxyProtocolOobConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	return c.oob.WriteMsgUDP(b, oob, c.balancerOf(addr))
+}
+
+func (c *proxyProtocolOobConn) SyscallConn() (syscall.RawConn, error) {
+	return c.oob.SyscallConn()
+}
+
+func (c *proxyProtocolOobConn) SetReadBuffer(bytes int) error {
+	return c.oob.SetReadBuffer(bytes)
+}
+
+func (c *proxyProtocolOobConn) SetWriteBuffer(bytes int) error {
+	return c.oob.SetWriteBuffer(bytes)
+}
+
+func (c *proxyProtocolConn) clientOf(balancer netip.AddrPort) (netip.AddrPort, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flow, ok := c.balancers[balancer]
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	flow.lastSeen = time.Now()
+	return flow.client, true
+}
+
+func (c *proxyProtocolConn) track(balancer, client netip.AddrPort) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if old, ok := c.balancers[balancer]; ok && c.clients[old.client] == old {
+		delete(c.clients, old.client)
+	}
+	flow := &proxiedFlow{balancer: balancer, client: client, lastSeen: now}
+	c.clients[client] = flow
+	c.balancers[balancer] = flow
+	if now.Sub(c.lastSweep) < proxyProtocolFlowTtl {
+		return
+	}
+	c.lastSweep = now
+	for addr, flow := range c.balancers {
+		if now.Sub(flow.lastSeen) > proxyProtocolFlowTtl {
+			delete(c.balancers, addr)
+			if c.clients[flow.client] == flow {
+				delete(c.clients, flow.client)
+			}
+		}
+	}
+}
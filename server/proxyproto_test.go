@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/stats"
+
+	"golang.org/x/net/ipv4"
+)
+
+func proxyHeader(cmd byte, family byte, addrs []byte) []byte {
+	b := append([]byte{}, proxyProtocolSignature...)
+	b = append(b, 0x20|cmd, family<<4|2)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	v4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	binary.BigEndian.PutUint16(v6[32:], 443)
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		n       int
+		source  netip.AddrPort
+		invalid bool
+	}{
+		{"ipv4", append(proxyHeader(1, 1, v4), "payload"...), 28, netip.MustParseAddrPort("203.0.113.7:12345"), false},
+		{"ipv6", proxyHeader(1, 2, v6), 52, netip.MustParseAddrPort("[2001:db8::1]:443"), false},
+		{"local", proxyHeader(0, 0, nil), 16, netip.AddrPort{}, false},
+		{"truncated", proxyHeader(1, 1, v4)[:20], 0, netip.AddrPort{}, true},
+		{"short addresses", proxyHeader(1, 2, v4), 0, netip.AddrPort{}, true},
+		{"bad signature", bytes.Repeat([]byte{0}, 28), 0, netip.AddrPort{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, source, err := parseProxyHeader(tt.packet)
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidProxyHeader) {
+					t.Fatalf("expected ErrInvalidProxyHeader, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.n || source != tt.source {
+				t.Fatalf("got (%v, %v), want (%v, %v)", n, source, tt.n, tt.source)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolConn(t *testing.T) {
+	client := netip.MustParseAddrPort("203.0.113.7:12345")
+	addrs := []byte{203, 0, 113, 7, 127, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb}
+	reads := map[string]func(c net.PacketConn, b []byte) (int, *net.UDPAddr, error){
+		"ReadFrom": func(c net.PacketConn, b []byte) (int, *net.UDPAddr, error) {
+			n, addr, err := c.ReadFrom(b)
+			udpAddr, _ := addr.(*net.UDPAddr)
+			return n, udpAddr, err
+		},
+		"ReadMsgUDP": func(c net.PacketConn, b []byte) (int, *net.UDPAddr, error) {
+			n, _, _, addr, err := c.(oobConn).ReadMsgUDP(b, make([]byte, 128))
+			return n, addr, err
+		},
+		"ReadBatch": func(c net.PacketConn, b []byte) (int, *net.UDPAddr, error) {
+			ms := []ipv4.Message{{Buffers: [][]byte{b}, OOB: make([]byte, 128)}}
+			if _, err := c.(oobConn).ReadBatch(ms, 0); err != nil {
+				return 0, nil, err
+			}
+			return ms[0].N, ms[0].Addr.(*net.UDPAddr), nil
+		},
+	}
+	for name, read := range reads {
+		t.Run(name, func(t *testing.T) {
+			udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer udpConn.Close()
+			var inner net.PacketConn = struct{ net.PacketConn }{udpConn}
+			if name != "ReadFrom" {
+				inner = newSocketConn(udpConn, stats.New().Socket("test"))
+			}
+			c := newProxyProtocolConn(inner, []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")})
+			if _, ok := c.(oobConn); ok != (name != "ReadFrom") {
+				t.Fatalf("got oobConn %v", ok)
+			}
+			_ = c.SetReadDeadline(time.Now().Add(time.Second))
+			balancer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer balancer.Close()
+			untrusted, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer untrusted.Close()
+			expect := func(sender *net.UDPConn, packet []byte, payload string, from string) {
+				t.Helper()
+				if _, err := sender.WriteTo(packet, c.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+				b := make([]byte, 2048)
+				n, addr, err := read(c, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b[:n]) != payload || addr.String() != from {
+					t.Fatalf("got %q from %v, want %q from %v", b[:n], addr, payload, from)
+				}
+			}
+
+			// The first datagram of a flow carries the client, which later
+			// ones of the balancer are attributed to.
+			expect(balancer, append(proxyHeader(1, 1, addrs), "first"...), "first", client.String())
+			expect(balancer, []byte("later"), "later", client.String())
+			// Malformed headers are dropped.
+			if _, err = balancer.WriteTo(proxyHeader(1, 1, addrs)[:20], c.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			// Headers of untrusted sources are not interpreted.
+			header := append(proxyHeader(1, 1, addrs), "spoofed"...)
+			expect(untrusted, header, string(header), untrusted.LocalAddr().String())
+
+			// Replies to the client go through its balancer.
+			if name == "ReadFrom" {
+				_, err = c.WriteTo([]byte("reply"), net.UDPAddrFromAddrPort(client))
+			} else {
+				_, _, err = c.(oobConn).WriteMsgUDP([]byte("reply"), nil, net.UDPAddrFromAddrPort(client))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = balancer.SetReadDeadline(time.Now().Add(time.Second))
+			b := make([]byte, 2048)
+			n, _, err := balancer.ReadFrom(b)
+			if err != nil || string(b[:n]) != "reply" {
+				t.Fatalf("balancer got %q, %v", b[:n], err)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// DefaultDnsTimeout bounds the lookups of a target by default.
+const DefaultDnsTimeout = 5 * time.Second
+
+// DialStrategy picks the address family that targets named by hostnames are
+// dialed in.
+type DialStrategy int
+
+const (
+	// DialDual dials the family whose lookup answers first.
+	DialDual DialStrategy = iota
+	// DialPreferIPv4 and DialPreferIPv6 dial the preferred family if it has
+	// addresses, and the other one otherwise.
+	DialPreferIPv4
+	DialPreferIPv6
+	// DialIPv4 and DialIPv6 look up and dial the family only.
+	DialIPv4
+	DialIPv6
+)
+
+// hostResolver looks up the A and AAAA records of targets in parallel, where
+// getaddrinfo may look them up one after the other, and bounds both lookups
+// by one timeout.
+type hostResolver struct {
+	strategy DialStrategy
+	timeout  time.Duration
+}
+
+func newHostResolver(strategy DialStrategy, timeout time.Duration) *hostResolver {
+	if timeout <= 0 {
+		timeout = DefaultDnsTimeout
+	}
+	return &hostResolver{strategy: strategy, timeout: timeout}
+}
+
+type lookupResult struct {
+	// i is the rank of the family by the strategy.
+	i     int
+	addrs []netip.Addr
+	err   error
+}
+
+// lookup returns the addresses of host in the first usable family, looked up
+// by r, or the default resolver if r is nil. IP hosts are returned as they
+// are.
+func (h *hostResolver) lookup(ctx context.Context, r *net.Resolver, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	var networks []string
+	switch h.strategy {
+	case DialIPv4:
+		networks = []string{"ip4"}
+	case DialIPv6:
+		networks = []string{"ip6"}
+	case DialPreferIPv6:
+		networks = []string{"ip6", "ip4"}
+	default:
+		networks = []string{"ip4", "ip6"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	results := make(chan lookupResult, len(networks))
+	for i, network := range networks {
+		go func(i int, network string) {
+			addrs, err := r.LookupNetIP(ctx, network, host)
+			results <- lookupResult{i: i, addrs: addrs, err: err}
+		}(i, network)
+	}
+	done := make([]*lookupResult, len(networks))
+	for range networks {
+		res := <-results
+		done[res.i] = &res
+		if h.strategy == DialDual && len(res.addrs) > 0 {
+			return unmapAddrs(res.addrs), nil
+		}
+		for _, res := range done {
+			if res == nil {
+				// Wait for the preferred family.
+				break
+			}
+			if len(res.addrs) > 0 {
+				return unmapAddrs(res.addrs), nil
+			}
+		}
+	}
+	for _, res := range done {
+		if res.err != nil {
+			return nil, res.err
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookupAddrPorts returns the addresses of addr, a host:port, in the first
+// usable family.
+func (h *hostResolver) lookupAddrPorts(ctx context.Context, r *net.Resolver, addr string) ([]netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, &net.AddrError{Err: "invalid port", Addr: addr}
+	}
+	addrs, err := h.lookup(ctx, r, host)
+	if err != nil {
+		return nil, err
+	}
+	addrPorts := make([]netip.AddrPort, len(addrs))
+	for i := range addrs {
+		addrPorts[i] = netip.AddrPortFrom(addrs[i], uint16(p))
+	}
+	return addrPorts, nil
+}
+
+func unmapAddrs(addrs []netip.Addr) []netip.Addr {
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestResolver serves A and AAAA records after their delays.
+func newTestResolver(t *testing.T, records map[string][]dns.RR, delays map[uint16]time.Duration) *net.Resolver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		time.Sleep(delays[q.Qtype])
+		resp := new(dns.Msg).SetReply(req)
+		for _, rr := range records[q.Name] {
+			if rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", pc.LocalAddr().String())
+		},
+	}
+}
+
+func TestHostResolver(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	records := map[string][]dns.RR{
+		"dual.test.":   {rr("dual.test. 60 IN A 192.0.2.1"), rr("dual.test. 60 IN AAAA 2001:db8::1")},
+		"v6only.test.": {rr("v6only.test. 60 IN AAAA 2001:db8::2")},
+	}
+	r := newTestResolver(t, records, map[uint16]time.Duration{dns.TypeAAAA: 200 * time.Millisecond})
+
+	for _, tt := range []struct {
+		strategy DialStrategy
+		host     string
+		want     string
+	}{
+		{DialDual, "dual.test.", "192.0.2.1"},
+		{DialPreferIPv4, "dual.test.", "192.0.2.1"},
+		{DialPreferIPv6, "dual.test.", "2001:db8::1"},
+		{DialIPv6, "dual.test.", "2001:db8::1"},
+		{DialDual, "v6only.test.", "2001:db8::2"},
+		{DialPreferIPv4, "v6only.test.", "2001:db8::2"},
+		{DialDual, "192.0.2.9", "192.0.2.9"},
+	} {
+		addrs, err := newHostResolver(tt.strategy, 0).lookup(context.Background(), r, tt.host)
+		if err != nil {
+			t.Errorf("%v %v: %v", tt.strategy, tt.host, err)
+			continue
+		}
+		if want := netip.MustParseAddr(tt.want); len(addrs) != 1 || addrs[0] != want {
+			t.Errorf("%v %v: got %v, want %v", tt.strategy, tt.host, addrs, want)
+		}
+	}
+	if _, err := newHostResolver(DialIPv4, 0).lookup(context.Background(), r, "v6only.test."); err == nil {
+		t.Error("ipv4 resolved a host without A records")
+	}
+
+	// The timeout bounds both lookups.
+	slow := newTestResolver(t, records, map[uint16]time.Duration{dns.TypeA: time.Second, dns.TypeAAAA: time.Second})
+	start := time.Now()
+	if _, err := newHostResolver(DialDual, 100*time.Millisecond).lookup(context.Background(), slow, "dual.test."); err == nil {
+		t.Error("slow lookups did not time out")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("lookups took %v", elapsed)
+	}
+}
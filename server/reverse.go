@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/stats"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+)
+
+// ReverseHostname is the reserved target of the streams that clients park
+// for their reverse services. After the header, the client writes the length
+// of the name of the service in a byte and the name. Once a connection to the
+// service arrives, the server writes ReverseReady and relays the connection
+// over the stream.
+const ReverseHostname = "_reverse.juicity"
+
+const ReverseReady byte = 1
+
+const (
+	// maxReverseStreams is the number of streams parked for a service at
+	// once, and maxReverseStreamsPerConn those of a connection, so that a
+	// single client cannot take all of them.
+	maxReverseStreams        = 64
+	maxReverseStreamsPerConn = 16
+	// reverseNameTimeout is how long a client has to name the service of a
+	// stream.
+	reverseNameTimeout = 10 * time.Second
+	// reverseWaitTimeout is how long a connection to a service waits for a
+	// parked stream before it is closed.
+	reverseWaitTimeout = 10 * time.Second
+)
+
+var ErrReverseDenied = fmt.Errorf("reverse service denied")
+
+// EncodeReverse returns what a client writes on a stream parked for the
+// service.
+func EncodeReverse(name string) []byte {
+	return append([]byte{byte(len(name))}, name...)
+}
+
+// ReverseService exposes a port of the server that forwards connections back
+// to a client.
+type ReverseService struct {
+	Name   string
+	Listen string
+	// User is the only user whose clients may serve the service.
+	User uuid.UUID
+}
+
+type ReverseOptions struct {
+	Logger   *log.Logger
+	Services []ReverseService
+	// StrictHalfClose keeps relaying the opposite direction of a connection
+	// half-closed by one side until it finishes.
+	StrictHalfClose bool
+}
+
+// Reverse listens at the ports of reverse services and relays their
+// connections over the streams that clients park for them. It is shared by
+// the servers of all listeners.
+type Reverse struct {
+	logger   *log.Logger
+	relay    relay.Relay
+	services map[string]*reverseService
+	closed   chan struct{}
+	once     sync.Once
+}
+
+type reverseService struct {
+	ReverseService
+	ln      net.Listener
+	streams chan *reverseStream
+	parked  atomic.Int32
+}
+
+// reverseStream is a stream parked for a service, handed to a connection to
+// the service.
+type reverseStream struct {
+	conn      netproxy.Conn
+	userStats *stats.UserStats
+	done      chan struct{}
+}
+
+func NewReverse(opts ReverseOptions) (*Reverse, error) {
+	r := &Reverse{
+		logger:   opts.Logger,
+		relay:    relay.NewRelay(opts.Logger, opts.StrictHalfClose),
+		services: map[string]*reverseService{},
+		closed:   make(chan struct{}),
+	}
+	for _, s := range opts.Services {
+		if s.Name == "" || len(s.Name) > 255 {
+			return nil, fmt.Errorf("invalid name of reverse service: %q", s.Name)
+		}
+		if _, ok := r.services[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate reverse service: %v", s.Name)
+		}
+		r.services[s.Name] = &reverseService{
+			ReverseService: s,
+			streams:        make(chan *reverseStream),
+		}
+	}
+	return r, nil
+}
+
+// Listen binds the ports of the services.
+func (r *Reverse) Listen() error {
+	for _, s := range r.services {
+		ln, err := net.Listen("tcp", s.Listen)
+		if err != nil {
+			r.Close()
+			return fmt.Errorf("reverse service %v: %w", s.Name, err)
+		}
+		s.ln = ln
+	}
+	return nil
+}
+
+// Serve accepts the connections to the services until Close is called or any
+// of the listeners fails.
+func (r *Reverse) Serve() error {
+	errs := make(chan error, len(r.services))
+	for _, s := range r.services {
+		r.logger.Info().
+			Str("name", s.Name).
+			Str("user", s.User.String()).
+			Msg("Reverse service listen at " + s.Listen)
+		go func(s *reverseService) {
+			for {
+				c, err := s.ln.Accept()
+				if err != nil {
+					errs <- fmt.Errorf("reverse service %v: %w", s.Name, err)
+					return
+				}
+				go r.handleConn(s, c)
+			}
+		}(s)
+	}
+	select {
+	case err := <-errs:
+		select {
+		case <-r.closed:
+			return nil
+		default:
+		}
+		r.Close()
+		return err
+	case <-r.closed:
+		return nil
+	}
+}
+
+// Close closes the listeners of the services.
+func (r *Reverse) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		for _, s := range r.services {
+			if s.ln != nil {
+				_ = s.ln.Close()
+			}
+		}
+	})
+	return nil
+}
+
+// handleConn relays a connection to the service over a parked stream, waiting
+// up to reverseWaitTimeout for one.
+func (r *Reverse) handleConn(s *reverseService, c net.Conn) {
+	defer c.Close()
+	timer := time.NewTimer(reverseWaitTimeout)
+	defer timer.Stop()
+	var rs *reverseStream
+	for rs == nil {
+		select {
+		case rs = <-s.streams:
+		case <-timer.C:
+			r.logger.Warn().
+				Str("name", s.Name).
+				Str("source", c.RemoteAddr().String()).
+				Msg("No client serves the reverse service")
+			return
+		case <-r.closed:
+			return
+		}
+		// Streams of clients gone without closing their connection fail
+		// here, and the next one is tried.
+		if _, err := rs.conn.Write([]byte{ReverseReady}); err != nil {
+			close(rs.done)
+			rs = nil
+		}
+	}
+	defer close(rs.done)
+	r.logger.Info().Msgf("Reverse %v <-tcp-> service %v", c.RemoteAddr(), s.Name)
+	// Bytes towards the source of the connection are sent by the client.
+	tConn := &trafficConn{Conn: c, trafficCounter: newTrafficCounter(rs.userStats)}
+	if err := r.relay.RelayTCP(rs.conn, tConn); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return
+		}
+		r.logger.Debug().
+			Err(err).
+			Str("name", s.Name).
+			Msg("Reverse relay ended")
+	}
+}
+
+// park offers the stream of the session to connections to the service until
+// one takes it and is done with it, or the connection of the stream is
+// closed.
+func (r *Reverse) park(ctx context.Context, s *reverseService, lConn netproxy.Conn, sess *session) error {
+	if sess.reverseParked.Add(1) > maxReverseStreamsPerConn {
+		sess.reverseParked.Add(-1)
+		return fmt.Errorf("%w: too many streams parked by the connection", ErrReverseDenied)
+	}
+	if s.parked.Add(1) > maxReverseStreams {
+		s.parked.Add(-1)
+		sess.reverseParked.Add(-1)
+		return fmt.Errorf("%w: too many streams parked for %v", ErrReverseDenied, s.Name)
+	}
+	unpark := func() {
+		s.parked.Add(-1)
+		sess.reverseParked.Add(-1)
+	}
+	rs := &reverseStream{
+		conn:      lConn,
+		userStats: sess.userStats,
+		done:      make(chan struct{}),
+	}
+	select {
+	case s.streams <- rs:
+		unpark()
+	case <-ctx.Done():
+		unpark()
+		return nil
+	case <-r.closed:
+		unpark()
+		return net.ErrClosed
+	}
+	select {
+	case <-rs.done:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// handleReverse parks the stream of a client for the reverse service it
+// names, if the user of the client serves it. The stream counts against the
+// stream limits until it is done.
+func (s *Server) handleReverse(conn quic.Connection, stream quic.Stream, lConn netproxy.Conn, sess *session) error {
+	release, err := s.acquireStream(stream, sess)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_ = lConn.SetReadDeadline(time.Now().Add(reverseNameTimeout))
+	var n [1]byte
+	if _, err := io.ReadFull(lConn, n[:]); err != nil {
+		return err
+	}
+	name := make([]byte, n[0])
+	if _, err := io.ReadFull(lConn, name); err != nil {
+		return err
+	}
+	_ = lConn.SetReadDeadline(time.Time{})
+	var service *reverseService
+	if s.reverse != nil {
+		service = s.reverse.services[string(name)]
+	}
+	if service == nil || service.User != sess.user {
+		stream.CancelRead(StreamCodeBlocked)
+		stream.CancelWrite(StreamCodeBlocked)
+		return fmt.Errorf("%w: %v for %v", ErrReverseDenied, string(name), sess.user)
+	}
+	if err := s.reverse.park(conn.Context(), service, lConn, sess); err != nil {
+		stream.CancelRead(StreamCodeBlocked)
+		stream.CancelWrite(StreamCodeBlocked)
+		return err
+	}
+	return nil
+}
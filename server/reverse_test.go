@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/stats"
+
+	"github.com/google/uuid"
+)
+
+func TestReverse(t *testing.T) {
+	user := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	logger := log.NewLogger(&log.Options{})
+	if _, err := NewReverse(ReverseOptions{Logger: logger, Services: []ReverseService{
+		{Name: "ssh", Listen: "127.0.0.1:0", User: user},
+		{Name: "ssh", Listen: "127.0.0.1:0", User: user},
+	}}); err == nil {
+		t.Fatal("duplicate services: got no error")
+	}
+	r, err := NewReverse(ReverseOptions{Logger: logger, Services: []ReverseService{
+		{Name: "ssh", Listen: "127.0.0.1:0", User: user},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go r.Serve()
+	service := r.services["ssh"]
+
+	// The client side of a parked stream echoes once signaled.
+	client, stream := net.Pipe()
+	userStats := stats.New().User(user.String())
+	parked := make(chan error, 1)
+	go func() {
+		parked <- r.park(context.Background(), service, stream, &session{user: user, userStats: userStats})
+	}()
+	go func() {
+		defer client.Close()
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(client, b); err != nil || b[0] != ReverseReady {
+			return
+		}
+		_, _ = io.CopyN(client, client, 5)
+	}()
+
+	c, err := net.Dial("tcp", service.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got %q, want hello", b)
+	}
+	c.Close()
+	if err = <-parked; err != nil {
+		t.Fatal(err)
+	}
+	if up := userStats.Up.Load(); up != 5 {
+		t.Errorf("got upload %v, want 5", up)
+	}
+}
+
+func TestReverseParkedPerConn(t *testing.T) {
+	user := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	r, err := NewReverse(ReverseOptions{Logger: log.NewLogger(&log.Options{}), Services: []ReverseService{
+		{Name: "ssh", Listen: "127.0.0.1:0", User: user},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	service := r.services["ssh"]
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	userStats := stats.New().User(user.String())
+	sess := &session{user: user, userStats: userStats}
+	for i := 0; i < maxReverseStreamsPerConn; i++ {
+		go r.park(ctx, service, nil, sess)
+	}
+	if !eventually(func() bool { return service.parked.Load() == maxReverseStreamsPerConn }) {
+		t.Fatalf("got %v parked streams, want %v", service.parked.Load(), maxReverseStreamsPerConn)
+	}
+	if err = r.park(ctx, service, nil, sess); !errors.Is(err, ErrReverseDenied) {
+		t.Fatalf("got %v, want ErrReverseDenied", err)
+	}
+	// Other connections of the user still park theirs.
+	go r.park(ctx, service, nil, &session{user: user, userStats: userStats})
+	if !eventually(func() bool { return service.parked.Load() == maxReverseStreamsPerConn+1 }) {
+		t.Fatal("the stream of another connection was not parked")
+	}
+	cancel()
+	if !eventually(func() bool { return service.parked.Load() == 0 && sess.reverseParked.Load() == 0 }) {
+		t.Fatal("streams were not unparked")
+	}
+}
+
+func TestReverseStreamLimit(t *testing.T) {
+	r, err := NewReverse(ReverseOptions{Logger: log.NewLogger(&log.Options{}), Services: []ReverseService{
+		{Name: "ssh", Listen: "127.0.0.1:0", User: uuid.MustParse(testUser)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, d := startTestServer(t, &Options{MaxStreamsPerUser: 1, Reverse: r})
+	service := r.services["ssh"]
+	conn, err := d.Dial("tcp", net.JoinHostPort(ReverseHostname, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(EncodeReverse("ssh")); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { return service.parked.Load() == 1 }) {
+		t.Fatal("the stream was not parked")
+	}
+	// The parked stream holds the only stream slot of the user.
+	other, err := d.Dial("tcp", net.JoinHostPort(ReverseHostname, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, _ = other.Write(EncodeReverse("ssh"))
+	if _, err = io.ReadAll(other); err == nil {
+		t.Error("got no error beyond the stream limit")
+	}
+	if n := service.parked.Load(); n != 1 {
+		t.Errorf("got %v parked streams, want 1", n)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juicity/juicity/pkg/schedule"
+
+	"github.com/google/uuid"
+)
+
+// scheduleCheckInterval is how often the connections of users outside their
+// schedules are closed. Windows have a resolution of a minute.
+const scheduleCheckInterval = time.Minute
+
+var ErrOutsideSchedule = fmt.Errorf("outside schedule")
+
+// parseSchedules returns the schedules of the users among the given ones.
+// Schedules of other users, e.g. those of other listeners, are ignored.
+func parseSchedules(schedules map[string]*schedule.Schedule, users map[uuid.UUID]string) (map[uuid.UUID]*schedule.Schedule, error) {
+	m := map[uuid.UUID]*schedule.Schedule{}
+	for _uuid, sched := range schedules {
+		id, err := uuid.Parse(_uuid)
+		if err != nil {
+			return nil, fmt.Errorf("parse schedule uuid(%v): %w", _uuid, err)
+		}
+		if _, ok := users[id]; ok {
+			m[id] = sched
+		}
+	}
+	return m, nil
+}
+
+// enforceSchedules closes the connections of users outside their schedules
+// every minute. Users are denied authentication meanwhile by
+// handleConnAuth.
+func (s *Server) enforceSchedules() {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for user, sched := range s.schedules {
+			if sched.Allows(now) {
+				continue
+			}
+			var closed int
+			for _, sess := range s.sessions.take(user) {
+				_ = sess.conn.CloseWithError(CloseCodeOutsideSchedule, "outside schedule")
+				closed++
+			}
+			if closed > 0 {
+				s.logger.Info().
+					Str("user", user.String()).
+					Int("closed", closed).
+					Msg("Closed connections outside schedule")
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -11,18 +12,25 @@ import (
 	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	jcommon "github.com/juicity/juicity/common"
 	"github.com/juicity/juicity/common/consts"
 	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/acl"
+	"github.com/juicity/juicity/pkg/decode"
+	"github.com/juicity/juicity/pkg/event"
 	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/schedule"
+	"github.com/juicity/juicity/pkg/stats"
 
 	"github.com/daeuniverse/outbound/dialer"
 	"github.com/daeuniverse/softwind/ciphers"
 	"github.com/daeuniverse/softwind/netproxy"
 	"github.com/daeuniverse/softwind/pkg/fastrand"
 	"github.com/daeuniverse/softwind/pool"
-	"github.com/daeuniverse/softwind/protocol/direct"
 	"github.com/daeuniverse/softwind/protocol/juicity"
 	"github.com/daeuniverse/softwind/protocol/shadowsocks"
 	"github.com/daeuniverse/softwind/protocol/tuic"
@@ -32,6 +40,10 @@ import (
 )
 
 const (
+	// DefaultMaxIncomingStreams is the default of both MaxIncomingStreams and
+	// MaxIncomingUniStreams.
+	DefaultMaxIncomingStreams = 100
+
 	AuthenticateTimeout = 10 * time.Second
 	AcceptTimeout       = AuthenticateTimeout
 	inFlightUnderlayTtl = AuthenticateTimeout
@@ -41,11 +53,18 @@ var (
 	ErrUnexpectedVersion    = fmt.Errorf("unexpected version")
 	ErrUnexpectedCmdType    = fmt.Errorf("unexpected cmd type")
 	ErrAuthenticationFailed = fmt.Errorf("authentication failed")
+	ErrUnknownUser          = fmt.Errorf("unknown user")
 	ErrDisabledTrafficType  = fmt.Errorf("disabled traffic type")
+	ErrTooManyStreams       = fmt.Errorf("too many streams")
+	ErrRecentDialFailure    = fmt.Errorf("target failed to dial recently")
+	ErrBlocked              = fmt.Errorf("blocked by acl")
+	ErrBittorrent           = fmt.Errorf("blocked bittorrent")
 )
 
 type Options struct {
 	Logger                *log.Logger
+	Stats                 *stats.Stats
+	Events                *event.Bus
 	Users                 map[string]string
 	Certificate           string
 	PrivateKey            string
@@ -54,24 +73,207 @@ type Options struct {
 	SendThrough           string
 	DialerLink            string
 	DisableOutboundUdp443 bool
+	// UdpBroadcast handles the UDP packets to broadcast and multicast
+	// targets, UdpBroadcastDrop by default.
+	UdpBroadcast UdpBroadcast
+	// MaxStreamsPerConn and MaxStreamsPerUser limit the concurrently open
+	// streams of a connection and of a user across its connections. Zero
+	// means no limit.
+	MaxStreamsPerConn int
+	MaxStreamsPerUser int
+	// MaxConnsPerUser limits the connections of a user, including those on
+	// Peers if given. Zero means no limit.
+	MaxConnsPerUser int
+	Peers           Peers
+	// ProxyProtocolTrusted are the sources allowed to prepend PROXY protocol
+	// v2 headers, e.g. UDP load balancers. Disabled if empty.
+	ProxyProtocolTrusted []netip.Prefix
+	// DenySources are the sources whose datagrams are dropped, or, with
+	// Tarpit, whose connections complete handshakes slowly and are then held
+	// without ever being authenticated.
+	DenySources []netip.Prefix
+	Tarpit      bool
+	// ListenNetwork is one of udp (dual-stack), udp4 and udp6 (IPv6 only).
+	// Defaults to udp.
+	ListenNetwork string
+	// DialFailureTtl is how long streams to a target fail fast after a dial
+	// to it was refused or timed out. Disabled if zero.
+	DialFailureTtl time.Duration
+	// TcpIdleTimeoutUp and TcpIdleTimeoutDown close relayed TCP streams
+	// without data upstream and downstream for so long. A zero timeout
+	// ignores its direction; the reaper is disabled if both are zero.
+	TcpIdleTimeoutUp   time.Duration
+	TcpIdleTimeoutDown time.Duration
+	// StrictHalfClose keeps relaying the opposite direction of a TCP stream
+	// half-closed by one side until it finishes.
+	StrictHalfClose bool
+	// Acl decides which targets streams may be relayed to. Nil allows all.
+	Acl *acl.Acl
+	// Rewriter replaces the targets of streams allowed by the acl. Nil
+	// rewrites nothing.
+	Rewriter *acl.Rewriter
+	// Schedules restrict when users, by uuid, may be connected. Users
+	// without a schedule may connect at any time.
+	Schedules map[string]*schedule.Schedule
+	// Bittorrent handles the streams found to carry BitTorrent traffic. Nil
+	// relays them like any other.
+	Bittorrent *Bittorrent
+	// Groups override the options above for their members.
+	Groups []*Group
+	// Detour are dialer links of hops before DialerLink, or the outbound of
+	// a group, the first one dialed directly.
+	Detour []string
+	// SourcePorts restricts the local ports of direct outbound connections.
+	// Nil leaves them to the system.
+	SourcePorts *acl.PortRange
+	// DialStrategy picks the address family of direct outbound connections
+	// to hostnames, whose A and AAAA records are looked up in parallel
+	// within DnsTimeout, DefaultDnsTimeout if zero.
+	DialStrategy DialStrategy
+	DnsTimeout   time.Duration
+	// LoopGuard blocks direct outbound connections to the server itself.
+	// Nil allows all.
+	LoopGuard *LoopGuard
+	// OutboundPool keeps spare TCP connections to targets dialed repeatedly.
+	// Nil disables it.
+	OutboundPool *OutboundPool
+	// MaxBandwidthUp caps the rate in bytes per second that clients
+	// declaring their bandwidth are sent at. Declarations are ignored if
+	// zero.
+	MaxBandwidthUp uint64
+	// MaxIncomingStreams and MaxIncomingUniStreams are the streams a client
+	// may have open at once in a connection: bidirectional ones carry its
+	// TCP and UDP sessions, and unidirectional ones its authentications.
+	// Zero means DefaultMaxIncomingStreams.
+	MaxIncomingStreams    int64
+	MaxIncomingUniStreams int64
+	// InitialCwnd is the initial congestion window of bbr in packets, zero
+	// meaning DefaultInitialCwnd. Clients whose handshake RTT is at least
+	// HighRtt start at HighRttCwnd instead if it is larger.
+	InitialCwnd int
+	HighRtt     time.Duration
+	HighRttCwnd int
+	// ReceiveWindows are the QUIC flow control windows of connections, nil
+	// meaning DefaultReceiveWindows.
+	ReceiveWindows *ReceiveWindows
+	// Api receives the streams of ApiAdmins, by uuid, to ApiHostname. Nil
+	// rejects them.
+	Api       *ApiListener
+	ApiAdmins []string
+	// Reverse parks the streams of clients serving reverse services to
+	// ReverseHostname. Nil rejects them.
+	Reverse *Reverse
+	// Obfuscation pads the early packets of connections and delays the
+	// outcome of authentication randomly. Nil disables both.
+	Obfuscation *Obfuscation
+	// Tracing traces the connections matching its filters. A Tracing
+	// without qlogs is created if nil.
+	Tracing *Tracing
+	// UdpReceiveBuffer and UdpSendBuffer are the buffer sizes in bytes
+	// listening sockets are raised to, failing Listen if the kernel refuses.
+	// Zero means DefaultUdpBufferSize, only warned about if refused.
+	UdpReceiveBuffer int
+	UdpSendBuffer    int
+	// UdpSessionQueue is the packets each UDP session of a connection may
+	// have queued towards the client, the oldest dropped when full. Zero
+	// means relay.DefaultUdpSessionQueue.
+	UdpSessionQueue int
+	// SessionTicketKeys encrypt the TLS session tickets, so that they stay
+	// valid across restarts. Keys of the process are used if nil.
+	SessionTicketKeys *SessionTicketKeys
+	// ClientCAs verify the certificates that clients must then present, for
+	// groups matching them. Nil disables client certificates.
+	ClientCAs *x509.CertPool
+}
+
+// ReceiveWindows are the sizes in bytes of the QUIC flow control windows,
+// which bound the memory buffered for each stream and connection.
+type ReceiveWindows struct {
+	InitialStream     uint64
+	MaxStream         uint64
+	InitialConnection uint64
+	MaxConnection     uint64
 }
 
+var (
+	DefaultReceiveWindows = ReceiveWindows{
+		InitialStream:     common.InitialStreamReceiveWindow,
+		MaxStream:         common.MaxStreamReceiveWindow,
+		InitialConnection: common.InitialConnectionReceiveWindow,
+		MaxConnection:     common.MaxConnectionReceiveWindow,
+	}
+	// SmallReceiveWindows suit devices short of memory, at the cost of the
+	// throughput of connections with a large bandwidth-delay product.
+	SmallReceiveWindows = ReceiveWindows{
+		InitialStream:     256 << 10,
+		MaxStream:         2 << 20,
+		InitialConnection: 1 << 20,
+		MaxConnection:     4 << 20,
+	}
+)
+
 type Server struct {
 	logger                 *log.Logger
+	stats                  *stats.Stats
+	events                 *event.Bus
+	tracing                *Tracing
+	obfuscation            *Obfuscation
+	api                    *ApiListener
+	apiAdmins              map[uuid.UUID]bool
+	reverse                *Reverse
 	relay                  relay.Relay
 	dialer                 netproxy.ContextDialer
 	tlsConfig              *tls.Config
+	sessionTicketKeys      *SessionTicketKeys
 	maxOpenIncomingStreams int64
+	maxIncomingUniStreams  int64
+	receiveWindows         ReceiveWindows
 	congestionControl      string
 	cwnd                   int
+	highRtt                time.Duration
+	highRttCwnd            int
+	maxBandwidthUp         uint64
 	users                  map[uuid.UUID]string
 	fwmark                 int
 	disableOutboundUdp443  bool
-	inFlightUnderlayKey    *InFlightUnderlayKey
-	udpEndpointPool        *UdpEndpointPool
+	udpBroadcast           UdpBroadcast
+	maxStreamsPerConn      int
+	maxStreamsPerUser      int
+	maxConnsPerUser        int
+	peers                  Peers
+	proxyProtocolTrusted   []netip.Prefix
+	listenNetwork          string
+	udpReceiveBuffer       int
+	udpSendBuffer          int
+	// udpReceiveBufferExplicit and udpSendBufferExplicit are set if the
+	// sizes were given rather than defaulted, failing to set them is fatal.
+	udpReceiveBufferExplicit bool
+	udpSendBufferExplicit    bool
+	udpSessionQueue          int
+	dialFailures             *dialFailureCache
+	idleReaper               *idleReaper
+	acl                      *acl.Acl
+	rewriter                 *acl.Rewriter
+	schedules                map[uuid.UUID]*schedule.Schedule
+	groups                   map[uuid.UUID]*userGroup
+	certGroups               []*userGroup
+	bittorrent               *Bittorrent
+	bittorrentMu             sync.Mutex
+	bittorrentThrottles      map[uuid.UUID]*throttle
+	openConns                atomic.Int64
+	denySources              []netip.Prefix
+	tarpit                   bool
+	tarpitConns              atomic.Int32
+	inFlightUnderlayKey      *InFlightUnderlayKey
+	udpEndpointPool          *UdpEndpointPool
+	sessions                 *sessionRegistry
 }
 
+// New returns a server of the options. Defaults are filled in a copy of
+// opts, so that callers can derive the options of other servers from it.
 func New(opts *Options) (*Server, error) {
+	copied := *opts
+	opts = &copied
 	users := map[uuid.UUID]string{}
 	for _uuid, password := range opts.Users {
 		id, err := uuid.Parse(_uuid)
@@ -80,31 +282,193 @@ func New(opts *Options) (*Server, error) {
 		}
 		users[id] = password
 	}
-	cert, err := tls.LoadX509KeyPair(opts.Certificate, opts.PrivateKey)
+	cert, err := jcommon.LoadX509KeyPair(opts.Certificate, opts.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
-	var d netproxy.Dialer
-	uesFullconeDialer := opts.DialerLink == ""
-	switch {
-	case opts.SendThrough != "":
-		lAddr, err := netip.ParseAddr(opts.SendThrough)
-		if err != nil {
+	d, err := newDialer(opts, outboundLinks(opts.Detour, opts.DialerLink)...)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.ListenNetwork {
+	case "":
+		opts.ListenNetwork = "udp"
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unexpected listen network: %v", opts.ListenNetwork)
+	}
+	if opts.MaxIncomingStreams < 0 || opts.MaxIncomingUniStreams < 0 {
+		return nil, fmt.Errorf("negative max incoming streams")
+	}
+	if opts.MaxIncomingStreams == 0 {
+		opts.MaxIncomingStreams = DefaultMaxIncomingStreams
+	}
+	if opts.MaxIncomingUniStreams == 0 {
+		opts.MaxIncomingUniStreams = DefaultMaxIncomingStreams
+	}
+	if opts.InitialCwnd < 0 || opts.HighRttCwnd < 0 {
+		return nil, fmt.Errorf("negative initial congestion window")
+	}
+	if opts.InitialCwnd == 0 {
+		opts.InitialCwnd = DefaultInitialCwnd
+	}
+	if opts.UdpReceiveBuffer < 0 || opts.UdpSendBuffer < 0 {
+		return nil, fmt.Errorf("negative udp buffer size")
+	}
+	if opts.UdpSessionQueue < 0 {
+		return nil, fmt.Errorf("negative udp session queue")
+	}
+	receiveBufferExplicit, sendBufferExplicit := opts.UdpReceiveBuffer != 0, opts.UdpSendBuffer != 0
+	if opts.UdpReceiveBuffer == 0 {
+		opts.UdpReceiveBuffer = DefaultUdpBufferSize
+	}
+	if opts.UdpSendBuffer == 0 {
+		opts.UdpSendBuffer = DefaultUdpBufferSize
+	}
+	if opts.Stats == nil {
+		opts.Stats = stats.New()
+	}
+	if opts.Events == nil {
+		opts.Events = event.NewBus()
+	}
+	if opts.Tracing == nil {
+		opts.Tracing = NewTracing(opts.Logger, "")
+	}
+
+	var dialFailures *dialFailureCache
+	if opts.DialFailureTtl > 0 {
+		dialFailures = newDialFailureCache(opts.DialFailureTtl)
+	}
+	var reaper *idleReaper
+	if opts.TcpIdleTimeoutUp > 0 || opts.TcpIdleTimeoutDown > 0 {
+		reaper = newIdleReaper(opts.TcpIdleTimeoutUp, opts.TcpIdleTimeoutDown)
+	}
+	schedules, err := parseSchedules(opts.Schedules, users)
+	if err != nil {
+		return nil, err
+	}
+	groups, certGroups, err := parseGroups(opts, users)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Bittorrent != nil {
+		if err = opts.Bittorrent.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Obfuscation != nil {
+		if err = opts.Obfuscation.validate(); err != nil {
+			return nil, err
+		}
+	}
+	apiAdmins, err := parseApiAdmins(opts.ApiAdmins, users)
+	if err != nil {
+		return nil, err
+	}
+	for user, g := range groups {
+		if _, ok := schedules[user]; !ok && g.Schedule != nil {
+			schedules[user] = g.Schedule
+		}
+	}
+
+	s := &Server{
+		logger:                   opts.Logger,
+		stats:                    opts.Stats,
+		events:                   opts.Events,
+		tracing:                  opts.Tracing,
+		obfuscation:              opts.Obfuscation,
+		api:                      opts.Api,
+		apiAdmins:                apiAdmins,
+		reverse:                  opts.Reverse,
+		relay:                    relay.NewRelay(opts.Logger, opts.StrictHalfClose),
+		dialer:                   d,
+		tlsConfig:                &tls.Config{NextProtos: []string{"h3"}, MinVersion: tls.VersionTLS13, Certificates: []tls.Certificate{cert}},
+		maxOpenIncomingStreams:   opts.MaxIncomingStreams,
+		maxIncomingUniStreams:    opts.MaxIncomingUniStreams,
+		receiveWindows:           DefaultReceiveWindows,
+		congestionControl:        opts.CongestionControl,
+		cwnd:                     opts.InitialCwnd,
+		highRtt:                  opts.HighRtt,
+		highRttCwnd:              opts.HighRttCwnd,
+		maxBandwidthUp:           opts.MaxBandwidthUp,
+		users:                    users,
+		fwmark:                   opts.Fwmark,
+		disableOutboundUdp443:    opts.DisableOutboundUdp443,
+		udpBroadcast:             opts.UdpBroadcast,
+		maxStreamsPerConn:        opts.MaxStreamsPerConn,
+		maxStreamsPerUser:        opts.MaxStreamsPerUser,
+		maxConnsPerUser:          opts.MaxConnsPerUser,
+		peers:                    opts.Peers,
+		proxyProtocolTrusted:     opts.ProxyProtocolTrusted,
+		denySources:              opts.DenySources,
+		tarpit:                   opts.Tarpit,
+		listenNetwork:            opts.ListenNetwork,
+		udpReceiveBuffer:         opts.UdpReceiveBuffer,
+		udpSendBuffer:            opts.UdpSendBuffer,
+		udpReceiveBufferExplicit: receiveBufferExplicit,
+		udpSendBufferExplicit:    sendBufferExplicit,
+		udpSessionQueue:          opts.UdpSessionQueue,
+		dialFailures:             dialFailures,
+		idleReaper:               reaper,
+		acl:                      opts.Acl,
+		rewriter:                 opts.Rewriter,
+		schedules:                schedules,
+		groups:                   groups,
+		certGroups:               certGroups,
+		bittorrent:               opts.Bittorrent,
+		bittorrentThrottles:      map[uuid.UUID]*throttle{},
+		inFlightUnderlayKey:      NewInFlightUnderlayKey(inFlightUnderlayTtl),
+		udpEndpointPool:          NewUdpEndpointPool(),
+		sessions:                 newSessionRegistry(),
+		sessionTicketKeys:        opts.SessionTicketKeys,
+	}
+	if opts.ClientCAs != nil {
+		s.tlsConfig.ClientCAs = opts.ClientCAs
+		s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if s.sessionTicketKeys != nil {
+		s.sessionTicketKeys.apply(s.tlsConfig)
+	}
+	if opts.ReceiveWindows != nil {
+		s.receiveWindows = *opts.ReceiveWindows
+	}
+	if len(schedules) > 0 {
+		go s.enforceSchedules()
+	}
+	return s, nil
+}
+
+// newDialer returns the dialer through the chain of outbounds given by dialer
+// links, where each outbound is dialed through the previous one, or the
+// dialer of direct connections if there are none.
+func newDialer(opts *Options, dialerLinks ...string) (netproxy.ContextDialer, error) {
+	var lAddr netip.Addr
+	if opts.SendThrough != "" {
+		var err error
+		if lAddr, err = netip.ParseAddr(opts.SendThrough); err != nil {
 			return nil, fmt.Errorf("parse send_through: %w", err)
 		}
-		d = direct.NewDirectDialerLaddr(uesFullconeDialer, lAddr)
-	case uesFullconeDialer:
-		d = direct.FullconeDirect
-	default:
-		d = direct.SymmetricDirect
 	}
-	if opts.DialerLink != "" {
-		var property *dialer.Property
+	base := &directDialer{
+		lAddr:    lAddr,
+		ports:    opts.SourcePorts,
+		fullCone: len(dialerLinks) == 0,
+		resolver: newHostResolver(opts.DialStrategy, opts.DnsTimeout),
+		guard:    opts.LoopGuard,
+	}
+	var cd netproxy.ContextDialer = base
+	var d netproxy.Dialer = base
+	for _, dialerLink := range dialerLinks {
+		var (
+			property *dialer.Property
+			err      error
+		)
 		if d, property, err = dialer.NewNetproxyDialerFromLink(d, &dialer.ExtraOption{
 			AllowInsecure:     false,
 			TlsImplementation: "",
 			UtlsImitate:       "",
-		}, opts.DialerLink); err != nil {
+		}, dialerLink); err != nil {
 			return nil, fmt.Errorf("parse DialerLink: %w", err)
 		}
 		opts.Logger.Info().
@@ -113,44 +477,114 @@ func New(opts *Options) (*Server, error) {
 			Str("addr", property.Address).
 			Msg("Dial use given dialer")
 	}
+	if len(dialerLinks) > 0 {
+		// Outbounds dial without contexts, so dials through them are
+		// abandoned rather than cancelled.
+		cd = &netproxy.ContextDialerConverter{Dialer: d}
+	}
+	if opts.OutboundPool != nil {
+		return newOutboundPool(opts.Logger, cd, opts.OutboundPool), nil
+	}
+	return cd, nil
+}
 
-	return &Server{
-		logger:                 opts.Logger,
-		relay:                  relay.NewRelay(opts.Logger),
-		dialer:                 &netproxy.ContextDialerConverter{Dialer: d},
-		tlsConfig:              &tls.Config{NextProtos: []string{"h3"}, MinVersion: tls.VersionTLS13, Certificates: []tls.Certificate{cert}},
-		maxOpenIncomingStreams: 100,
-		congestionControl:      opts.CongestionControl,
-		cwnd:                   10,
-		users:                  users,
-		fwmark:                 opts.Fwmark,
-		disableOutboundUdp443:  opts.DisableOutboundUdp443,
-		inFlightUnderlayKey:    NewInFlightUnderlayKey(inFlightUnderlayTtl),
-		udpEndpointPool:        NewUdpEndpointPool(),
-	}, nil
+// Stats returns the statistics collected by the server.
+func (s *Server) Stats() *stats.Stats {
+	return s.stats
 }
 
-func (s *Server) Serve(addr string) (err error) {
-	quicMaxOpenIncomingStreams := int64(s.maxOpenIncomingStreams)
+// Certificate returns the leaf certificate the server presents.
+func (s *Server) Certificate() (*x509.Certificate, error) {
+	return x509.ParseCertificate(s.tlsConfig.Certificates[0].Certificate[0])
+}
+
+// Events returns the bus that connection events are published to.
+func (s *Server) Events() *event.Bus {
+	return s.events
+}
+
+// Tracing returns the tracing shared by the servers of all listeners.
+func (s *Server) Tracing() *Tracing {
+	return s.tracing
+}
+
+// Connections returns the number of open connections, authenticated or not.
+func (s *Server) Connections() int64 {
+	return s.openConns.Load()
+}
 
-	pktConn, err := net.ListenPacket("udp", addr)
+func (s *Server) Serve(addr string) (err error) {
+	pktConn, err := s.Listen(addr)
 	if err != nil {
 		return err
 	}
+	return s.ServePacketConn(pktConn)
+}
+
+// Listen binds the address to be served by ServePacketConn, which allows
+// binding privileged ports before dropping privileges.
+func (s *Server) Listen(addr string) (net.PacketConn, error) {
+	pktConn, err := net.ListenPacket(s.listenNetwork, addr)
+	if err != nil {
+		return nil, err
+	}
+	if udpConn, ok := pktConn.(*net.UDPConn); ok {
+		// Buffers are set here since forcing them beyond the limits of the
+		// kernel needs privileges, which may be dropped before serving.
+		receive, send, receiveErr, sendErr := tuneSocketBuffers(udpConn, s.udpReceiveBuffer, s.udpSendBuffer)
+		for _, b := range []struct {
+			name     string
+			size     int
+			err      error
+			explicit bool
+		}{
+			{"receive", receive, receiveErr, s.udpReceiveBufferExplicit},
+			{"send", send, sendErr, s.udpSendBufferExplicit},
+		} {
+			if b.err == nil {
+				continue
+			}
+			if b.explicit {
+				_ = udpConn.Close()
+				return nil, fmt.Errorf("set socket %v buffer: %w", b.name, b.err)
+			}
+			// The default is a wish: the socket serves with what it has.
+			s.logger.Warn().
+				Err(b.err).
+				Str("listen", addr).
+				Int("size", b.size).
+				Msgf("Failed to raise the %v buffer of the socket", b.name)
+		}
+		s.logSocketBuffers(addr, receive, send)
+		conn := newSocketConn(udpConn, s.stats.Socket(addr))
+		go s.monitorSocket(conn, addr)
+		pktConn = conn
+	}
+	if len(s.proxyProtocolTrusted) > 0 {
+		pktConn = newProxyProtocolConn(pktConn, s.proxyProtocolTrusted)
+	}
+	if len(s.denySources) > 0 {
+		pktConn = newDenyConn(pktConn, s.denySources, s.tarpit)
+	}
+	return pktConn, nil
+}
+
+func (s *Server) ServePacketConn(pktConn net.PacketConn) (err error) {
 	transport := quic.Transport{
 		Conn: pktConn,
 	}
 	listener, err := transport.Listen(s.tlsConfig, &quic.Config{
-		InitialStreamReceiveWindow:     common.InitialStreamReceiveWindow,
-		MaxStreamReceiveWindow:         common.MaxStreamReceiveWindow,
-		InitialConnectionReceiveWindow: common.InitialConnectionReceiveWindow,
-		MaxConnectionReceiveWindow:     common.MaxConnectionReceiveWindow,
-		MaxIncomingStreams:             quicMaxOpenIncomingStreams,
-		MaxIncomingUniStreams:          quicMaxOpenIncomingStreams,
+		InitialStreamReceiveWindow:     s.receiveWindows.InitialStream,
+		MaxStreamReceiveWindow:         s.receiveWindows.MaxStream,
+		InitialConnectionReceiveWindow: s.receiveWindows.InitialConnection,
+		MaxConnectionReceiveWindow:     s.receiveWindows.MaxConnection,
+		MaxIncomingStreams:             s.maxOpenIncomingStreams,
+		MaxIncomingUniStreams:          s.maxIncomingUniStreams,
 		KeepAlivePeriod:                10 * time.Second,
 		DisablePathMTUDiscovery:        false,
 		EnableDatagrams:                false,
 		CapabilityCallback:             nil,
+		Tracer:                         s.tracing.connectionTracer,
 	})
 	if err != nil {
 		return err
@@ -202,6 +636,8 @@ func (s *Server) handleNonQuicPacket(transport *quic.Transport, buf []byte, ulAd
 		return fmt.Errorf("insuffient [underlay] data: len %v", len(buf))
 	}
 	lAddr := ulAddr.AddrPort()
+	// auth is set if a new endpoint is created.
+	var auth *underlayAuth
 	// source ip/port -> dst mapping.
 	endpoint, isNew, err := s.udpEndpointPool.GetOrCreate(lAddr, &UdpEndpointOptions{
 		Handler: func(data []byte, from netip.AddrPort, metadata any) error {
@@ -225,26 +661,15 @@ func (s *Server) handleNonQuicPacket(transport *quic.Transport, buf []byte, ulAd
 		NatTimeout: 0,
 		GetDialOption: func() (*DialOption, error) {
 			iv := buf[:juicity.CipherConf.SaltLen]
-			auth := s.inFlightUnderlayKey.Evict(inFlightKey(iv))
+			auth = s.inFlightUnderlayKey.Evict(inFlightKey(iv))
 			if auth == nil {
 				return nil, fmt.Errorf("[underlay] auth fail")
 			}
-			if s.disableOutboundUdp443 && auth.Metadata.Port == 443 {
-				s.logger.Debug().
-					Str("target", net.JoinHostPort(auth.Metadata.Hostname, strconv.Itoa(int(auth.Metadata.Port)))).
-					Str("source", lAddr.String()).
-					Msg("juicity blocked an [underlay] request")
-				return nil, ErrDisabledTrafficType
-			}
-			return &DialOption{
-				Target:   net.JoinHostPort(auth.Metadata.Hostname, strconv.Itoa(int(auth.Metadata.Port))),
-				Dialer:   s.dialer,
-				Metadata: auth.Psk,
-			}, nil
+			return s.underlayDialOption(auth, lAddr)
 		},
 	})
 	if err != nil {
-		if errors.Is(err, ErrDisabledTrafficType) {
+		if errors.Is(err, ErrDisabledTrafficType) || errors.Is(err, ErrBlocked) {
 			return nil
 		}
 		return err
@@ -261,9 +686,15 @@ func (s *Server) handleNonQuicPacket(transport *quic.Transport, buf []byte, ulAd
 		defer decrypted.Put()
 		buf = decrypted
 	} else {
+		// The endpoint lives no longer than the connection whose policies
+		// it follows.
+		context.AfterFunc(auth.sess.conn.Context(), func() {
+			_ = s.udpEndpointPool.Remove(lAddr, endpoint)
+		})
 		s.logger.Debug().
 			Str("target", endpoint.DialTarget).
 			Str("source", lAddr.String()).
+			Str("user", auth.sess.user.String()).
 			Msg("juicity performed an [underlay] request")
 	}
 	if _, err = endpoint.WriteTo(buf, endpoint.DialTarget); err != nil {
@@ -272,25 +703,163 @@ func (s *Server) handleNonQuicPacket(transport *quic.Transport, buf []byte, ulAd
 	return nil
 }
 
+// underlayDialOption applies the policies of the session that sent the auth
+// to its underlay UDP session, as handleStream does to UDP streams.
+func (s *Server) underlayDialOption(auth *underlayAuth, source netip.AddrPort) (*DialOption, error) {
+	sess := auth.sess
+	if sess.conn.Context().Err() != nil {
+		return nil, fmt.Errorf("[underlay] auth of a closed connection")
+	}
+	mdata := auth.Metadata
+	target := net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port)))
+	logger := s.logger
+	if sess.traced {
+		logger = s.tracing.logger
+	}
+	if s.disableOutboundUdp443 && mdata.Port == 443 {
+		logger.Debug().
+			Str("target", target).
+			Str("source", source.String()).
+			Msg("juicity blocked an [underlay] request")
+		return nil, ErrDisabledTrafficType
+	}
+	if s.dropsBroadcast(mdata.Hostname) {
+		e := logger.Debug()
+		if s.udpBroadcast == UdpBroadcastLog {
+			e = logger.Info()
+		}
+		e.Str("target", target).
+			Str("source", source.String()).
+			Msg("Dropped UDP packets to a broadcast or multicast target")
+		return nil, ErrDisabledTrafficType
+	}
+	userAcl := s.aclOf(sess)
+	t := acl.NewTarget("udp", mdata.Hostname, mdata.Port)
+	decision := userAcl.Decide(t)
+	if decision.DryRun != nil {
+		logDryRun(logger, decision, t, sess.user.String(), source.String())
+	}
+	if decision.Action == acl.ActionBlock {
+		logger.Debug().
+			Str("target", target).
+			Str("source", source.String()).
+			Msg("juicity blocked an [underlay] request")
+		return nil, fmt.Errorf("%w: [underlay] %v", ErrBlocked, t)
+	}
+	s.stats.Destination(mdata.Hostname)
+	d, _ := s.dialerOf(sess)
+	ctx := context.Background()
+	if userAcl != nil {
+		ctx = withAddrFilter(ctx, resolvedFilter(userAcl, "udp"))
+	}
+	return &DialOption{
+		Target:   s.rewrite(t).String(),
+		Dialer:   d,
+		Metadata: auth.Psk,
+		Network: netproxy.MagicNetwork{
+			Network: "udp",
+			Mark:    uint32(s.fwmark),
+		}.Encode(),
+		Context: ctx,
+		Wrap: func(pc netproxy.PacketConn) netproxy.PacketConn {
+			if policy := s.bittorrentOf(sess.user); policy != nil {
+				pc = &bittorrentPacketConn{
+					PacketConn:       pc,
+					bittorrentFilter: &bittorrentFilter{s: s, user: sess.user, policy: policy},
+				}
+			}
+			return &trafficPacketConn{PacketConn: pc, trafficCounter: newTrafficCounter(sess.userStats)}
+		},
+	}, nil
+}
+
 func (s *Server) handleConn(conn quic.Connection) (err error) {
-	common.SetCongestionController(conn, s.congestionControl, s.cwnd)
+	if s.tarpit && isDenied(s.denySources, remoteAddr(conn).Addr()) {
+		s.holdInTarpit(conn)
+		return nil
+	}
+	s.setCongestionControl(conn, s.congestionControl, s.cwnd)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	authCtx, authDone := context.WithTimeout(ctx, AuthenticateTimeout)
 	defer authDone()
+	s.stats.Handshake(conn.ConnectionState().TLS.DidResume)
+	s.openConns.Add(1)
+	context.AfterFunc(conn.Context(), func() {
+		s.openConns.Add(-1)
+	})
+	sess := &session{
+		conn:      conn,
+		udp:       relay.NewUdpScheduler(s.udpSessionQueue),
+		certGroup: s.certGroupOf(conn.ConnectionState().TLS),
+	}
+	go s.obfuscation.pad(conn)
+	source := conn.RemoteAddr().String()
+	s.events.Publish(&event.Event{Type: event.TypeConnect, Source: source})
+	context.AfterFunc(conn.Context(), func() {
+		s.events.Publish(&event.Event{Type: event.TypeDisconnect, Source: source, User: sess.userName()})
+		if dropped := sess.udp.Dropped.Load(); dropped > 0 {
+			s.logger.Debug().
+				Str("source", source).
+				Uint64("dropped", dropped).
+				Msg("Dropped UDP packets from full session queues")
+		}
+	})
 	go func() {
 		var (
+			user      *uuid.UUID
 			uniStream quic.ReceiveStream
 			err       error
 		)
-		if _, uniStream, err = s.handleConnAuth(authCtx, conn); err != nil {
+		fail := func(err error) {
 			s.logger.Warn().
 				Err(err).
 				Msg("handleAuth")
+			s.stats.AuthFailed(authFailureReason(err), remoteAddr(conn).Addr())
+			s.events.Publish(&event.Event{Type: event.TypeAuth, Source: source, Error: err.Error()})
 			cancel()
-			_ = conn.CloseWithError(tuic.AuthenticationFailed, "")
+			closeCode := tuic.AuthenticationFailed
+			switch {
+			case errors.Is(err, ErrUserSuspended):
+				closeCode = CloseCodeSuspended
+			case errors.Is(err, ErrTooManyConns):
+				closeCode = CloseCodeTooManyConns
+			case errors.Is(err, ErrOutsideSchedule):
+				closeCode = CloseCodeOutsideSchedule
+			}
+			s.obfuscation.authDelay()
+			_ = conn.CloseWithError(closeCode, "")
+		}
+		if user, uniStream, err = s.handleConnAuth(authCtx, conn); err != nil {
+			fail(err)
 			return
 		}
+		sess.mu.Lock()
+		sess.user = *user
+		sess.userStats = s.stats.User(user.String())
+		sess.mu.Unlock()
+		var others int
+		if s.peers != nil {
+			others = s.peers.Connections(user.String())
+		}
+		remove, err := s.sessions.add(sess, s.maxConnsOf(*user), others)
+		if err != nil {
+			fail(fmt.Errorf("%w: %w", ErrAuthenticationFailed, err))
+			return
+		}
+		context.AfterFunc(conn.Context(), remove)
+		if f := s.tracing.match(remoteAddr(conn).Addr(), user); f != nil {
+			sess.traced = true
+			s.tracing.trace(conn, *user, f)
+		}
+		s.setCongestionControlOf(conn, *user)
+		sess.userStats.Connected()
+		context.AfterFunc(conn.Context(), sess.userStats.Disconnected)
+		s.events.Publish(&event.Event{Type: event.TypeAuth, Source: source, User: user.String()})
+		s.obfuscation.authDelay()
+		sess.mu.Lock()
+		sess.authed = true
+		sess.mu.Unlock()
 		authDone()
 		for {
 			select {
@@ -298,7 +867,7 @@ func (s *Server) handleConn(conn quic.Connection) (err error) {
 				return
 			default:
 			}
-			if err = s.handleUnderlayAuth(ctx, uniStream); err != nil {
+			if err = s.handleUnderlayAuth(ctx, uniStream, sess); err != nil {
 				if errors.Is(err, io.EOF) {
 					s.logger.Debug().
 						Err(err).
@@ -318,7 +887,7 @@ func (s *Server) handleConn(conn quic.Connection) (err error) {
 			return err
 		}
 		go func(stream quic.Stream) {
-			if err = s.handleStream(ctx, authCtx, conn, stream); err != nil {
+			if err = s.handleStream(ctx, authCtx, conn, stream, sess); err != nil {
 				s.logger.Warn().
 					Err(err).
 					Send()
@@ -327,40 +896,154 @@ func (s *Server) handleConn(conn quic.Connection) (err error) {
 	}
 }
 
-func (s *Server) handleStream(ctx context.Context, authCtx context.Context, conn quic.Connection, stream quic.Stream) error {
-	lConn := juicity.NewConn(stream, nil, nil)
-	defer lConn.Close()
-	// Read the header and initiate the metadata
-	_, err := lConn.Read(nil)
+func (s *Server) handleStream(ctx context.Context, authCtx context.Context, conn quic.Connection, stream quic.Stream, sess *session) (err error) {
+	mdata, err := decode.ReadStreamHeader(stream)
 	if err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
 		return err
 	}
+	lConn := newStreamConn(stream, mdata)
+	defer lConn.Close()
 	<-authCtx.Done()
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
 	}
-	mdata := lConn.Metadata
+	// The authentication context is also done when it times out.
+	if !sess.authenticated() {
+		stream.CancelRead(StreamCodeUnauthenticated)
+		stream.CancelWrite(StreamCodeUnauthenticated)
+		return ErrAuthenticationFailed
+	}
+	if lConn.Metadata.Network == "tcp" {
+		switch lConn.Metadata.Hostname {
+		case BandwidthHostname:
+			return s.handleBandwidth(conn, stream, lConn, sess)
+		case HeartbeatHostname:
+			return s.handleHeartbeatStream(stream, lConn, sess)
+		case DecoyHostname:
+			return s.handleDecoy(stream, lConn, sess)
+		case ClockHostname:
+			return s.handleClock(stream, lConn, sess)
+		case ApiHostname:
+			return s.handleApi(conn, stream, lConn, sess)
+		case ReverseHostname:
+			return s.handleReverse(conn, stream, lConn, sess)
+		}
+	}
+	release, err := s.acquireStream(stream, sess)
+	if err != nil {
+		return err
+	}
+	defer release()
 	source := conn.RemoteAddr().String()
+	s.stats.Destination(mdata.Hostname)
+	counter := newTrafficCounter(sess.userStats)
+	logger := s.logger
+	var smp *sampler
+	if sess.traced {
+		logger = s.tracing.logger
+		target := net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port)))
+		smp = &sampler{logger: logger, target: target}
+		start := time.Now()
+		logger.Debug().
+			Int64("stream", int64(stream.StreamID())).
+			Str("network", mdata.Network).
+			Str("target", target).
+			Str("source", source).
+			Msg("Traced stream opened")
+		defer func() {
+			e := logger.Debug().
+				Int64("stream", int64(stream.StreamID())).
+				Str("target", target).
+				Uint64("up", counter.Up.Load()).
+				Uint64("down", counter.Down.Load()).
+				Dur("duration", time.Since(start))
+			if err != nil {
+				e = e.Err(err)
+			}
+			e.Msg("Traced stream closed")
+		}()
+	}
+	if s.events.Active() {
+		streamEvent := event.Event{
+			Source:  source,
+			User:    sess.user.String(),
+			Network: mdata.Network,
+			Target:  net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port))),
+		}
+		openEvent := streamEvent
+		openEvent.Type = event.TypeStreamOpen
+		s.events.Publish(&openEvent)
+		defer func() {
+			closeEvent := streamEvent
+			closeEvent.Type = event.TypeStreamClose
+			closeEvent.Up = counter.Up.Load()
+			closeEvent.Down = counter.Down.Load()
+			if class, domain, ok := counter.sniffed(); ok {
+				closeEvent.Class = class.String()
+				closeEvent.Domain = domain
+			}
+			if err != nil {
+				closeEvent.Error = err.Error()
+			}
+			s.events.Publish(&closeEvent)
+		}()
+	}
+	userAcl := s.aclOf(sess)
+	d, outbound := s.dialerOf(sess)
 	switch mdata.Network {
 	case "tcp":
-		target := net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port)))
-		s.logger.Debug().
+		t := acl.NewTarget("tcp", mdata.Hostname, mdata.Port)
+		decision := userAcl.Decide(t)
+		if decision.DryRun != nil {
+			logDryRun(logger, decision, t, sess.user.String(), source)
+		}
+		if decision.Action == acl.ActionBlock {
+			s.reject(stream, lConn, decision.Reject)
+			return fmt.Errorf("%w: [tcp] %v", ErrBlocked, t)
+		}
+		target := s.rewrite(t).String()
+		logger.Debug().
 			Str("target", target).
 			Str("source", source).
 			Msg("juicity received a [tcp] request")
+		if s.dialFailures.failedRecently(outbound, target) {
+			return fmt.Errorf("%w: %v", ErrRecentDialFailure, target)
+		}
 		magicNetwork := netproxy.MagicNetwork{
 			Network: "tcp",
 			Mark:    uint32(s.fwmark),
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), consts.DefaultDialTimeout)
+		// The dial is cancelled once the client resets the stream.
+		ctx, cancel := context.WithTimeout(stream.Context(), consts.DefaultDialTimeout)
 		defer cancel()
-		rConn, err := s.dialer.DialContext(ctx, magicNetwork.Encode(), target)
+		var resolved acl.Decision
+		if userAcl != nil {
+			ctx = withAddrFilter(ctx, func(_ string, addr netip.AddrPort) bool {
+				resolved = userAcl.DecideResolved(t, addr.Addr())
+				return resolved.Action != acl.ActionBlock
+			})
+		}
+		rConn, err := d.DialContext(ctx, magicNetwork.Encode(), target)
 		if err != nil {
+			if stream.Context().Err() != nil {
+				logger.Debug().
+					Str("target", target).
+					Str("source", source).
+					Msg("The client reset the stream before the dial completed")
+				return nil
+			}
+			if errors.Is(err, ErrBlocked) {
+				s.reject(stream, lConn, resolved.Reject)
+				return err
+			}
+			s.dialFailures.add(outbound, target, err)
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
-				s.logger.Debug().
+				logger.Debug().
 					Err(err).
 					Send()
 				return nil // ignore i/o timeout
@@ -368,7 +1051,34 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, conn
 			return err
 		}
 		defer rConn.Close()
-		if err = s.relay.RelayTCP(lConn, rConn); err != nil {
+		idle := s.idleReaper.add(stream, rConn, counter)
+		defer s.idleReaper.remove(idle)
+		var tConn netproxy.Conn = rConn
+		if smp != nil {
+			tConn = &sampleConn{Conn: rConn, sampler: smp}
+		}
+		var bt *bittorrentConn
+		if policy := s.bittorrentOf(sess.user); policy != nil {
+			bt = &bittorrentConn{
+				Conn:             tConn,
+				bittorrentFilter: &bittorrentFilter{s: s, user: sess.user, policy: policy},
+				target:           target,
+			}
+			tConn = bt
+		}
+		if err = s.relay.RelayTCP(lConn, &trafficConn{Conn: tConn, trafficCounter: counter, port: mdata.Port}); err != nil {
+			if bt != nil && bt.blocked.Load() {
+				stream.CancelRead(StreamCodeBlocked)
+				stream.CancelWrite(StreamCodeBlocked)
+				return fmt.Errorf("%w: [tcp] %v", ErrBittorrent, target)
+			}
+			if idle.wasReaped() {
+				logger.Debug().
+					Str("target", target).
+					Str("source", source).
+					Msg("Closed idle stream")
+				return nil
+			}
 			var netErr net.Error
 			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) || strings.HasSuffix(err.Error(), "with error code 0") {
 				return nil // ignore i/o timeout
@@ -377,13 +1087,13 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, conn
 		}
 	case "udp":
 		if s.disableOutboundUdp443 && mdata.Port == 443 {
-			s.logger.Debug().
+			logger.Debug().
 				Str("target", net.JoinHostPort(mdata.Hostname, strconv.Itoa(int(mdata.Port)))).
 				Str("source", source).
 				Msg("juicity blocked a [udp] request")
 			return nil
 		}
-		lConn := &juicity.PacketConn{Conn: lConn}
+		lConn := &packetStreamConn{streamConn: lConn}
 		buf := pool.GetFullCap(consts.EthernetMtu)
 		defer pool.Put(buf)
 		_ = lConn.SetReadDeadline(time.Now().Add(consts.DefaultNatTimeout))
@@ -396,21 +1106,56 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, conn
 			Network: "udp",
 			Mark:    uint32(s.fwmark),
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), consts.DefaultDialTimeout)
+		ctx, cancel := context.WithTimeout(stream.Context(), consts.DefaultDialTimeout)
 		defer cancel()
-		c, err := s.dialer.DialContext(ctx, magicNetwork.Encode(), addr.String())
-		s.logger.Debug().
+		if userAcl != nil {
+			ctx = withAddrFilter(ctx, resolvedFilter(userAcl, "udp"))
+		}
+		c, err := d.DialContext(ctx, magicNetwork.Encode(), addr.String())
+		logger.Debug().
 			Str("target", addr.String()).
 			Str("source", source).
 			Msg("juicity received a [udp] request")
 		if err != nil {
+			if stream.Context().Err() != nil {
+				return nil
+			}
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
 				return nil // ignore i/o timeout
 			}
 			return fmt.Errorf("Dial: %w", err)
 		}
-		rConn := c.(netproxy.PacketConn)
+		pc := c.(netproxy.PacketConn)
+		if smp != nil {
+			pc = &samplePacketConn{PacketConn: pc, sampler: smp}
+		}
+		if policy := s.bittorrentOf(sess.user); policy != nil {
+			pc = &bittorrentPacketConn{
+				PacketConn:       pc,
+				bittorrentFilter: &bittorrentFilter{s: s, user: sess.user, policy: policy},
+			}
+		}
+		var rConn netproxy.PacketConn = &trafficPacketConn{PacketConn: pc, trafficCounter: counter}
+		if userAcl != nil || s.rewriter != nil {
+			rConn = &policyPacketConn{
+				PacketConn: rConn,
+				s:          s,
+				userAcl:    userAcl,
+				logger:     logger,
+				user:       sess.user.String(),
+				source:     source,
+			}
+		}
+		if s.udpBroadcast != UdpBroadcastRelay {
+			rConn = &broadcastPacketConn{
+				PacketConn: rConn,
+				logger:     logger,
+				logInfo:    s.udpBroadcast == UdpBroadcastLog,
+				user:       sess.user.String(),
+				source:     source,
+			}
+		}
 		_ = rConn.SetWriteDeadline(time.Now().Add(consts.DefaultNatTimeout)) // should keep consistent
 		_, err = rConn.WriteTo(buf[:n], addr.String())
 		if err != nil {
@@ -425,6 +1170,7 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, conn
 			rConn,
 			lConn,
 			len(buf),
+			sess.udp,
 		); err != nil {
 			var netErr net.Error
 			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) || strings.HasSuffix(err.Error(), "with error code 0") {
@@ -438,6 +1184,8 @@ func (s *Server) handleStream(ctx context.Context, authCtx context.Context, conn
 	return nil
 }
 
+// handleConnAuth authenticates the connection by the handler of its protocol
+// version, then applies the policies of the user, whatever the version.
 func (s *Server) handleConnAuth(authCtx context.Context, conn quic.Connection) (uuid *uuid.UUID, uniStream quic.ReceiveStream, err error) {
 	uniStream, err = conn.AcceptUniStream(authCtx)
 	if err != nil {
@@ -448,46 +1196,57 @@ func (s *Server) handleConnAuth(authCtx context.Context, conn quic.Connection) (
 	if err != nil {
 		return nil, nil, err
 	}
-	switch v[0] {
-	case juicity.Version0:
-		commandHead, err := tuic.ReadCommandHead(r)
-		if err != nil {
-			return nil, nil, fmt.Errorf("ReadCommandHead: %w", err)
-		}
-		switch commandHead.TYPE {
-		case tuic.AuthenticateType:
-			authenticate, err := tuic.ReadAuthenticateWithHead(commandHead, r)
-			if err != nil {
-				return nil, nil, fmt.Errorf("ReadAuthenticateWithHead: %w", err)
-			}
-			var token [32]byte
-			if password, ok := s.users[authenticate.UUID]; ok {
-				token, err = tuic.GenToken(conn.ConnectionState(), authenticate.UUID, password)
-				if err != nil {
-					return nil, nil, fmt.Errorf("GenToken: %w", err)
-				}
-				if token == authenticate.TOKEN {
-					return &authenticate.UUID, uniStream, nil
-				} else {
-					_ = conn.CloseWithError(tuic.AuthenticationFailed, "")
-				}
-			}
-			return nil, nil, fmt.Errorf("%w: %v", ErrAuthenticationFailed, authenticate.UUID)
-		default:
-			return nil, nil, fmt.Errorf("%w: %v", ErrUnexpectedCmdType, commandHead.TYPE)
-		}
-	default:
+	handler, ok := versionHandlers[v[0]]
+	if !ok {
 		return nil, nil, fmt.Errorf("%w: %v", ErrUnexpectedVersion, v)
 	}
+	if uuid, err = handler(s, conn, r); err != nil {
+		return nil, nil, err
+	}
+	if until, ok := s.sessions.suspended(*uuid); ok {
+		return nil, nil, fmt.Errorf("%w: %w: %v until %v", ErrAuthenticationFailed, ErrUserSuspended, uuid, until.Format(time.RFC3339))
+	}
+	if !s.schedules[*uuid].Allows(time.Now()) {
+		return nil, nil, fmt.Errorf("%w: %w: %v", ErrAuthenticationFailed, ErrOutsideSchedule, uuid)
+	}
+	return uuid, uniStream, nil
+}
+
+func authFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrUserSuspended):
+		return stats.AuthFailureSuspended
+	case errors.Is(err, ErrTooManyConns):
+		return stats.AuthFailureConnLimit
+	case errors.Is(err, ErrOutsideSchedule):
+		return stats.AuthFailureSchedule
+	case errors.Is(err, ErrUnknownUser):
+		return stats.AuthFailureUnknownUser
+	case errors.Is(err, ErrAuthenticationFailed):
+		return stats.AuthFailureBadToken
+	case errors.Is(err, context.DeadlineExceeded):
+		return stats.AuthFailureTimeout
+	default:
+		return stats.AuthFailureProtocol
+	}
 }
-func (s *Server) handleUnderlayAuth(ctx context.Context, uniStream quic.ReceiveStream) (err error) {
+
+func remoteAddr(conn quic.Connection) netip.AddrPort {
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		return addr.AddrPort()
+	}
+	addrPort, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	return addrPort
+}
+
+func (s *Server) handleUnderlayAuth(ctx context.Context, uniStream quic.ReceiveStream, sess *session) (err error) {
 	// Read an auth from the connection.
-	var auth juicity.UnderlayAuth
-	if _, err = auth.Unpack(uniStream); err != nil {
+	auth, err := decode.ReadUnderlayAuth(uniStream)
+	if err != nil {
 		return err
 	}
 
-	// Store the key.
-	s.inFlightUnderlayKey.Store(inFlightKey(auth.IV), &auth)
+	// Store the key, bound to the session that sent it.
+	s.inFlightUnderlayKey.Store(inFlightKey(auth.IV), &underlayAuth{UnderlayAuth: auth, sess: sess})
 	return nil
 }
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+	"github.com/juicity/juicity/pkg/schedule"
+	"github.com/juicity/juicity/pkg/stats"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/direct"
+	"github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/daeuniverse/softwind/protocol/tuic"
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+)
+
+const (
+	testUser     = "00000000-0000-0000-0000-000000000001"
+	testPassword = "password"
+)
+
+// writeTestCert writes a self-signed certificate of localhost and its key to
+// dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startTestServer serves a server of testUser on the loopback with opts, in
+// which the logger, stats, users and certificate are filled if empty, and
+// returns a dialer of testUser through it.
+func startTestServer(t *testing.T, opts *Options) (*Server, netproxy.Dialer) {
+	s, addr := listenTestServer(t, opts)
+	return s, newTestDialer(t, addr)
+}
+
+// listenTestServer is startTestServer returning the address of the server.
+func listenTestServer(t *testing.T, opts *Options) (*Server, string) {
+	if opts.Logger == nil {
+		opts.Logger = log.NewLogger(&log.Options{})
+	}
+	if opts.Stats == nil {
+		opts.Stats = stats.New()
+	}
+	if opts.Users == nil {
+		opts.Users = map[string]string{testUser: testPassword}
+	}
+	if opts.Certificate == "" {
+		opts.Certificate, opts.PrivateKey = writeTestCert(t, t.TempDir())
+	}
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pktConn, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.ServePacketConn(pktConn) }()
+	t.Cleanup(func() { _ = pktConn.Close() })
+	return s, pktConn.LocalAddr().String()
+}
+
+// newTestDialer returns a dialer of testUser through the server at addr,
+// which opens a connection of its own.
+func newTestDialer(t *testing.T, addr string) netproxy.Dialer {
+	return newUserTestDialer(t, addr, testUser, testPassword)
+}
+
+// newUserTestDialer is newTestDialer of another user.
+func newUserTestDialer(t *testing.T, addr string, user string, password string) netproxy.Dialer {
+	d, err := juicity.NewDialer(direct.SymmetricDirect, protocol.Header{
+		ProxyAddress: addr,
+		TlsConfig: &tls.Config{
+			NextProtos:         []string{"h3"},
+			MinVersion:         tls.VersionTLS13,
+			ServerName:         "localhost",
+			InsecureSkipVerify: true,
+		},
+		User:     user,
+		Password: password,
+		IsClient: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// eventually waits up to a second for cond, which the server may satisfy
+// only after the client got its response.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestNewKeepsOptions(t *testing.T) {
+	certificate, privateKey := writeTestCert(t, t.TempDir())
+	opts := &Options{
+		Logger:      log.NewLogger(&log.Options{}),
+		Users:       map[string]string{testUser: testPassword},
+		Certificate: certificate,
+		PrivateKey:  privateKey,
+	}
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MaxIncomingStreams != 0 || opts.UdpReceiveBuffer != 0 || opts.ListenNetwork != "" || opts.Stats != nil || opts.Events != nil {
+		t.Fatalf("defaults were filled in the options: %+v", opts)
+	}
+	// Servers derived from the options do not share the defaulted stats.
+	derived := *opts
+	other, err := New(&derived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Stats() == other.Stats() {
+		t.Error("derived server shares the stats")
+	}
+}
+
+func TestDecoy(t *testing.T) {
+	s, d := startTestServer(t, &Options{MaxStreamsPerUser: 1})
+	conn, err := d.Dial("tcp", net.JoinHostPort(DecoyHostname, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The decoy takes a while at decoyRate, holding the only stream slot of
+	// the user.
+	const response = 2 * decoyRate
+	if _, err = conn.Write(EncodeDecoyRequest(response, 24)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.Dial("tcp", net.JoinHostPort(DecoyHostname, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, _ = other.Write(EncodeDecoyRequest(1, 0))
+	if _, err = io.ReadAll(other); err == nil {
+		t.Error("got no error beyond the stream limit")
+	}
+	if n, err := io.Copy(io.Discard, conn); err != nil || n != response-1 {
+		t.Fatalf("got %v bytes, %v, want %v", n, err, response)
+	}
+	user := s.Stats().User(testUser)
+	if !eventually(func() bool { return user.Down.Load() == response }) || user.Up.Load() != DecoyHeaderSize+24 {
+		up, down := user.Up.Load(), user.Down.Load()
+		t.Errorf("got %v up and %v down, want %v and %v", up, down, DecoyHeaderSize+24, response)
+	}
+}
+
+func TestClock(t *testing.T) {
+	s, d := startTestServer(t, &Options{})
+	conn, err := d.Dial("tcp", net.JoinHostPort(ClockHostname, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(EncodeClock(time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, ClockSize)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if skew := time.Since(DecodeClock(b)); skew < 0 || skew > time.Minute {
+		t.Errorf("got skew %v", skew)
+	}
+	user := s.Stats().User(testUser)
+	if !eventually(func() bool { return user.Down.Load() == ClockSize }) || user.Up.Load() != ClockSize {
+		up, down := user.Up.Load(), user.Down.Load()
+		t.Errorf("got %v up and %v down, want %v each", up, down, ClockSize)
+	}
+}
+
+// dialClock asks the server for its clock through d.
+func dialClock(d netproxy.Dialer) error {
+	conn, err := d.Dial("tcp", net.JoinHostPort(ClockHostname, "0"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.Write(EncodeClock(time.Now())); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, make([]byte, ClockSize))
+	return err
+}
+
+func TestMaxConnsPerUser(t *testing.T) {
+	s, addr := listenTestServer(t, &Options{MaxConnsPerUser: 1})
+	if err := dialClock(newTestDialer(t, addr)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialClock(newTestDialer(t, addr)); err == nil {
+		t.Fatal("got no error beyond the connection limit")
+	}
+	if n := s.Stats().Snapshot().AuthFailures[stats.AuthFailureConnLimit]; n != 1 {
+		t.Errorf("got %v failures of the connection limit, want 1", n)
+	}
+}
+
+func TestAuthPolicies(t *testing.T) {
+	// The window of the schedule is always a day away.
+	day := strings.ToLower(time.Now().Add(48 * time.Hour).Weekday().String()[:3])
+	closed, err := schedule.Parse([]string{day + " 00:00-00:01"}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := listenTestServer(t, &Options{Schedules: map[string]*schedule.Schedule{testUser: closed}})
+	if err = dialClock(newTestDialer(t, addr)); err == nil {
+		t.Fatal("got no error outside the schedule")
+	}
+	if n := s.Stats().Snapshot().AuthFailures[stats.AuthFailureSchedule]; n != 1 {
+		t.Errorf("got %v failures outside the schedule, want 1", n)
+	}
+
+	s, addr = listenTestServer(t, &Options{})
+	if _, err = s.Kick(uuid.MustParse(testUser), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = dialClock(newTestDialer(t, addr)); err == nil {
+		t.Fatal("got no error of a suspended user")
+	}
+	if n := s.Stats().Snapshot().AuthFailures[stats.AuthFailureSuspended]; n != 1 {
+		t.Errorf("got %v failures of suspended users, want 1", n)
+	}
+}
+
+// dialQuicAuth authenticates a QUIC connection of testUser to the server at
+// addr, for the parts of the protocol that the dialer of softwind lacks. It
+// returns the stream it authenticated on, which goes on carrying underlay
+// auths.
+func dialQuicAuth(t *testing.T, addr string) (quic.Connection, quic.SendStream) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{
+		NextProtos:         []string{"h3"},
+		MinVersion:         tls.VersionTLS13,
+		ServerName:         "localhost",
+		InsecureSkipVerify: true,
+	}, &quic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.CloseWithError(0, "") })
+	user := uuid.MustParse(testUser)
+	token, err := tuic.GenToken(conn.ConnectionState(), user, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = tuic.NewAuthenticate(user, token, juicity.Version0).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := conn.OpenUniStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = auth.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return conn, auth
+}
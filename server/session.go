@@ -0,0 +1,286 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/stats"
+
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+)
+
+// Application error codes that juicity-server closes connections with, in
+// addition to the ones of tuic.
+const (
+	CloseCodeKicked          quic.ApplicationErrorCode = 0xffffff00
+	CloseCodeSuspended       quic.ApplicationErrorCode = 0xffffff01
+	CloseCodeTooManyConns    quic.ApplicationErrorCode = 0xffffff02
+	CloseCodeOutsideSchedule quic.ApplicationErrorCode = 0xffffff03
+)
+
+// StreamCodeTooManyStreams resets the streams exceeding the stream limits.
+const StreamCodeTooManyStreams quic.StreamErrorCode = 0xffffff10
+
+// StreamCodeUnauthenticated resets the streams of connections that failed to
+// authenticate in time.
+const StreamCodeUnauthenticated quic.StreamErrorCode = 0xffffff13
+
+var (
+	ErrUserSuspended = fmt.Errorf("user suspended")
+	ErrTooManyConns  = fmt.Errorf("too many connections")
+)
+
+// Peers reports the usage of users on other instances of a cluster. The
+// usage is as recent as the peers were polled, so limits across instances
+// are best-effort: handshakes racing on two instances may both succeed.
+type Peers interface {
+	// Connections returns the number of connections of the user.
+	Connections(user string) int
+}
+
+// session is the state of an authenticated connection. It is filled before
+// the authentication context is done.
+type session struct {
+	conn quic.Connection
+	// mu protects the fields against readers not synchronized with the
+	// authentication context, e.g. the disconnect event.
+	mu        sync.Mutex
+	user      uuid.UUID
+	userStats *stats.UserStats
+	// traced is set if a trace filter matches the connection.
+	traced bool
+	// certGroup is the group matching the client certificate, if any.
+	certGroup *userGroup
+	// udp schedules the packets of the UDP sessions of the connection
+	// towards the client.
+	udp *relay.UdpScheduler
+	// streams is the number of open streams, protected by the mutex of the
+	// sessionRegistry.
+	streams int
+	// reverseParked is the number of streams parked for reverse services.
+	reverseParked atomic.Int32
+	// authed is set once all the fields above are filled.
+	authed bool
+	// decoy paces the decoys of the connection, created by the first one.
+	decoy *throttle
+}
+
+func (sess *session) decoyThrottle() *throttle {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.decoy == nil {
+		sess.decoy = newThrottle(decoyRate)
+	}
+	return sess.decoy
+}
+
+// authenticated reports whether the connection authenticated. It is only
+// meaningful once the authentication context is done.
+func (sess *session) authenticated() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.authed
+}
+
+// stats returns the stats of the user, nil before the authentication.
+func (sess *session) stats() *stats.UserStats {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.userStats
+}
+
+func (sess *session) userName() string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.userStats == nil {
+		return ""
+	}
+	return sess.user.String()
+}
+
+// Ban is a temporary suspension of a user.
+type Ban struct {
+	User  uuid.UUID `json:"user"`
+	Until time.Time `json:"until"`
+}
+
+// sessionRegistry tracks the authenticated sessions of every user and the
+// users that are suspended. Bans are kept in memory only.
+type sessionRegistry struct {
+	mu          sync.Mutex
+	sessions    map[uuid.UUID]map[*session]struct{}
+	bans        map[uuid.UUID]time.Time
+	userStreams map[uuid.UUID]int
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions:    map[uuid.UUID]map[*session]struct{}{},
+		bans:        map[uuid.UUID]time.Time{},
+		userStreams: map[uuid.UUID]int{},
+	}
+}
+
+// add registers an authenticated session and returns the function to
+// unregister it. It fails if the user has limit connections already, counting
+// others on top of the registered ones, where zero means no limit. Checking
+// and registering under one lock keeps concurrent handshakes within the
+// limit.
+func (r *sessionRegistry) add(sess *session, limit int, others int) (remove func(), err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := len(r.sessions[sess.user]) + others; limit > 0 && n >= limit {
+		return nil, fmt.Errorf("%w: %v has %v", ErrTooManyConns, sess.user, n)
+	}
+	m, ok := r.sessions[sess.user]
+	if !ok {
+		m = map[*session]struct{}{}
+		r.sessions[sess.user] = m
+	}
+	m[sess] = struct{}{}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// The sessions of the user may have been taken by a kick meanwhile.
+		if m, ok := r.sessions[sess.user]; ok {
+			delete(m, sess)
+			if len(m) == 0 {
+				delete(r.sessions, sess.user)
+			}
+		}
+	}, nil
+}
+
+// take unregisters and returns all sessions of the user.
+func (r *sessionRegistry) take(user uuid.UUID) []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := make([]*session, 0, len(r.sessions[user]))
+	for sess := range r.sessions[user] {
+		sessions = append(sessions, sess)
+	}
+	delete(r.sessions, user)
+	return sessions
+}
+
+// acquireStream counts a new stream of the session. It reports false if the
+// stream would exceed the limits of the connection or the user, where zero
+// means no limit.
+func (r *sessionRegistry) acquireStream(sess *session, perConn, perUser int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if perConn > 0 && sess.streams >= perConn {
+		return false
+	}
+	if perUser > 0 && r.userStreams[sess.user] >= perUser {
+		return false
+	}
+	sess.streams++
+	r.userStreams[sess.user]++
+	return true
+}
+
+// acquireStream counts the stream, bidirectional or not, against the stream
+// limits of its connection and user, resetting it if they are reached.
+// release is called once the stream is done.
+func (s *Server) acquireStream(stream quic.ReceiveStream, sess *session) (release func(), err error) {
+	if !s.sessions.acquireStream(sess, s.maxStreamsPerConn, s.maxStreamsOf(sess.user)) {
+		stream.CancelRead(StreamCodeTooManyStreams)
+		if send, ok := stream.(quic.SendStream); ok {
+			send.CancelWrite(StreamCodeTooManyStreams)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrTooManyStreams, sess.user)
+	}
+	return func() { s.sessions.releaseStream(sess) }, nil
+}
+
+func (r *sessionRegistry) releaseStream(sess *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess.streams--
+	if r.userStreams[sess.user]--; r.userStreams[sess.user] <= 0 {
+		delete(r.userStreams, sess.user)
+	}
+}
+
+func (r *sessionRegistry) ban(user uuid.UUID, until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bans[user] = until
+}
+
+func (r *sessionRegistry) unban(user uuid.UUID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.bans[user]
+	delete(r.bans, user)
+	return ok
+}
+
+// suspended reports whether the user is banned at the moment, and until when.
+func (r *sessionRegistry) suspended(user uuid.UUID) (until time.Time, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok = r.bans[user]
+	if ok && !time.Now().Before(until) {
+		delete(r.bans, user)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+func (r *sessionRegistry) activeBans() []Ban {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	bans := make([]Ban, 0, len(r.bans))
+	for user, until := range r.bans {
+		if !now.Before(until) {
+			delete(r.bans, user)
+			continue
+		}
+		bans = append(bans, Ban{User: user, Until: until})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// Kick closes all connections of the user immediately and returns the number
+// of closed connections. If ban is positive, the user cannot authenticate
+// again until it expires.
+func (s *Server) Kick(user uuid.UUID, ban time.Duration) (closed int, err error) {
+	if _, ok := s.users[user]; !ok {
+		return 0, fmt.Errorf("%w: %v", ErrUnknownUser, user)
+	}
+	if ban > 0 {
+		s.sessions.ban(user, time.Now().Add(ban))
+	}
+	for _, sess := range s.sessions.take(user) {
+		_ = sess.conn.CloseWithError(CloseCodeKicked, "kicked")
+		closed++
+	}
+	s.logger.Info().
+		Str("user", user.String()).
+		Int("closed", closed).
+		Dur("ban", ban).
+		Msg("Kicked user")
+	return closed, nil
+}
+
+// Unban lifts the suspension of the user. It reports whether the user was
+// suspended.
+func (s *Server) Unban(user uuid.UUID) bool {
+	return s.sessions.unban(user)
+}
+
+// Bans returns the active suspensions, the earliest to expire first.
+func (s *Server) Bans() []Ban {
+	return s.sessions.activeBans()
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSessionRegistryLimit(t *testing.T) {
+	r := newSessionRegistry()
+	user := uuid.MustParse(testUser)
+	var (
+		wg      sync.WaitGroup
+		added   atomic.Int32
+		removes = make(chan func(), 50)
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			remove, err := r.add(&session{user: user}, 3, 1)
+			if err == nil {
+				added.Add(1)
+				removes <- remove
+			} else if !errors.Is(err, ErrTooManyConns) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if added.Load() != 2 {
+		t.Fatalf("added %v sessions with a limit of 3 and 1 on peers, want 2", added.Load())
+	}
+	(<-removes)()
+	if _, err := r.add(&session{user: user}, 3, 1); err != nil {
+		t.Errorf("got %v after a session was removed", err)
+	}
+	if _, err := r.add(&session{user: user}, 0, 100); err != nil {
+		t.Errorf("got %v without a limit", err)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+const (
+	// DefaultSessionTicketKeyRotation is how often a new key encrypts the
+	// session tickets by default.
+	DefaultSessionTicketKeyRotation = 24 * time.Hour
+	// DefaultSessionTicketValidKeys keep tickets valid for their lifetime in
+	// crypto/tls, 7 days, plus a rotation by default.
+	DefaultSessionTicketValidKeys = 8
+	// sessionTicketKeysCheck is how often the file is read again at most, so
+	// that servers sharing it follow the rotations of each other.
+	sessionTicketKeysCheck = time.Hour
+)
+
+// SessionTicketPolicy is how the keys of the session tickets rotate. A ticket
+// stays valid for at most Rotation times ValidKeys, after which its key is
+// gone, bounding what a leaked key decrypts.
+type SessionTicketPolicy struct {
+	Rotation time.Duration
+	// ValidKeys is how many keys decrypt tickets, the newest of which
+	// encrypts them.
+	ValidKeys int
+}
+
+type sessionTicketKey struct {
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// SessionTicketKeys are the keys of the TLS session tickets of the server,
+// kept in a file so that clients resume their sessions with an abbreviated
+// handshake after the server restarts, instead of all doing full ones at
+// once. Servers sharing the file accept the tickets of each other. Without a
+// file, the keys are kept in memory.
+type SessionTicketKeys struct {
+	logger *log.Logger
+	path   string
+	policy SessionTicketPolicy
+
+	mu      sync.Mutex
+	keys    []sessionTicketKey
+	configs []*tls.Config
+}
+
+// LoadSessionTicketKeys loads the keys of the file, creating it if missing
+// and rotating them if due. The keys are kept in memory if path is empty.
+// Zero fields of policy take their defaults.
+func LoadSessionTicketKeys(logger *log.Logger, path string, policy SessionTicketPolicy) (*SessionTicketKeys, error) {
+	if policy.Rotation <= 0 {
+		policy.Rotation = DefaultSessionTicketKeyRotation
+	}
+	if policy.ValidKeys <= 0 {
+		policy.ValidKeys = DefaultSessionTicketValidKeys
+	}
+	k := &SessionTicketKeys{
+		logger: logger,
+		path:   path,
+		policy: policy,
+	}
+	if err := k.update(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Run rotates the keys until the process exits.
+func (k *SessionTicketKeys) Run() {
+	for range time.Tick(min(sessionTicketKeysCheck, k.policy.Rotation/4)) {
+		if err := k.update(); err != nil {
+			k.logger.Warn().
+				Err(err).
+				Str("file", k.path).
+				Msg("Failed to rotate session ticket keys")
+		}
+	}
+}
+
+// apply makes the keys encrypt and decrypt the session tickets of conf from
+// now on.
+func (k *SessionTicketKeys) apply(conf *tls.Config) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.configs = append(k.configs, conf)
+	conf.SetSessionTicketKeys(k.ticketKeys())
+}
+
+func (k *SessionTicketKeys) ticketKeys() [][32]byte {
+	keys := make([][32]byte, len(k.keys))
+	for i := range k.keys {
+		copy(keys[i][:], k.keys[i].Key)
+	}
+	return keys
+}
+
+// update reads the file, adds a new key if the newest is due for rotation,
+// drops expired ones and applies them.
+func (k *SessionTicketKeys) update() error {
+	keys, err := k.read()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	changed := false
+	if len(keys) == 0 || now.Sub(keys[0].Created) >= k.policy.Rotation {
+		key := sessionTicketKey{Key: make([]byte, 32), Created: now}
+		if _, err = rand.Read(key.Key); err != nil {
+			return err
+		}
+		keys = append([]sessionTicketKey{key}, keys...)
+		changed = true
+	}
+	// Keys of a server that was down for a while expire by age too.
+	window := k.policy.Rotation * time.Duration(k.policy.ValidKeys)
+	for len(keys) > 1 && (len(keys) > k.policy.ValidKeys || now.Sub(keys[len(keys)-1].Created) >= window) {
+		keys = keys[:len(keys)-1]
+		changed = true
+	}
+	if changed {
+		if k.path != "" {
+			if err = writeSessionTicketKeys(k.path, keys); err != nil {
+				return err
+			}
+		}
+		event := k.logger.Info()
+		if k.path != "" {
+			event = event.Str("file", k.path)
+		}
+		event.Msg("Rotated session ticket keys")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	for _, conf := range k.configs {
+		conf.SetSessionTicketKeys(k.ticketKeys())
+	}
+	return nil
+}
+
+// read returns the keys of the file, or the ones in memory without a file.
+func (k *SessionTicketKeys) read() ([]sessionTicketKey, error) {
+	if k.path == "" {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		return append([]sessionTicketKey(nil), k.keys...), nil
+	}
+	return readSessionTicketKeys(k.path)
+}
+
+// readSessionTicketKeys reads the keys of the file, newest first. A missing
+// file has none.
+func readSessionTicketKeys(path string) ([]sessionTicketKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []sessionTicketKey
+	if err = json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("parse %v: %w", path, err)
+	}
+	for _, key := range keys {
+		if len(key.Key) != 32 {
+			return nil, fmt.Errorf("parse %v: session ticket keys must be 32 bytes", path)
+		}
+	}
+	return keys, nil
+}
+
+// writeSessionTicketKeys replaces the file atomically with one readable by
+// the owner only.
+func writeSessionTicketKeys(path string, keys []sessionTicketKey) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
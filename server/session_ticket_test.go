@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+)
+
+func TestSessionTicketKeys(t *testing.T) {
+	logger := log.NewLogger(&log.Options{})
+	path := filepath.Join(t.TempDir(), "tickets.json")
+
+	k, err := LoadSessionTicketKeys(logger, path, SessionTicketPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected file: %v %v", info, err)
+	}
+	if len(k.keys) != 1 {
+		t.Fatalf("expected one key, got %v", len(k.keys))
+	}
+	// A restart keeps the key.
+	again, err := LoadSessionTicketKeys(logger, path, SessionTicketPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.keys) != 1 || !bytes.Equal(again.keys[0].Key, k.keys[0].Key) {
+		t.Fatalf("key not kept across loads")
+	}
+
+	// Due keys are rotated and expired ones dropped.
+	now := time.Now()
+	old := []sessionTicketKey{
+		{Key: bytes.Repeat([]byte{1}, 32), Created: now.Add(-2 * DefaultSessionTicketKeyRotation)},
+		{Key: bytes.Repeat([]byte{2}, 32), Created: now.Add(-(DefaultSessionTicketValidKeys + 1) * DefaultSessionTicketKeyRotation)},
+	}
+	if err = writeSessionTicketKeys(path, old); err != nil {
+		t.Fatal(err)
+	}
+	if k, err = LoadSessionTicketKeys(logger, path, SessionTicketPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(k.keys) != 2 || !bytes.Equal(k.keys[1].Key, old[0].Key) || time.Since(k.keys[0].Created) > time.Minute {
+		t.Fatalf("unexpected keys: %+v", k.keys)
+	}
+
+	// Without a file, keys rotate in memory, as many as the policy keeps.
+	mem, err := LoadSessionTicketKeys(logger, "", SessionTicketPolicy{Rotation: time.Hour, ValidKeys: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.keys = []sessionTicketKey{
+		{Key: bytes.Repeat([]byte{3}, 32), Created: now.Add(-time.Hour)},
+		{Key: bytes.Repeat([]byte{4}, 32), Created: now.Add(-90 * time.Minute)},
+	}
+	if err = mem.update(); err != nil {
+		t.Fatal(err)
+	}
+	if len(mem.keys) != 2 || bytes.Equal(mem.keys[0].Key, mem.keys[1].Key) || mem.keys[1].Key[0] != 3 {
+		t.Fatalf("unexpected keys: %+v", mem.keys)
+	}
+
+	if err = os.WriteFile(path, []byte(`[{"key":"AAAA"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadSessionTicketKeys(logger, path, SessionTicketPolicy{}); err == nil {
+		t.Fatal("expected an error for a short key")
+	}
+}
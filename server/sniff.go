@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/juicity/juicity/pkg/stats"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// quicMinInitialSize is the size clients must pad the datagrams of their
+	// QUIC Initial packets to.
+	quicMinInitialSize = 1200
+	// utpHeaderSize is the size of the header of uTP (BEP 29) packets.
+	utpHeaderSize = 20
+	// udpTrackerProtocolId starts the connect requests to UDP trackers
+	// (BEP 15).
+	udpTrackerProtocolId = 0x41727101980
+)
+
+var bittorrentHandshake = []byte("\x13BitTorrent protocol")
+
+// classifyTcp sniffs the class of a TCP stream from its first upload and
+// the port of its target.
+func classifyTcp(b []byte, port uint16) stats.Class {
+	switch {
+	case isBittorrentStream(b):
+		return stats.ClassBittorrent
+	case len(b) >= 3 && b[0] == 0x16 && b[1] == 0x03:
+		// A TLS handshake record.
+		return stats.ClassTls
+	case port == 53:
+		return stats.ClassDns
+	}
+	for _, method := range httpMethods {
+		if strings.HasPrefix(string(b[:min(len(b), len(method))]), method) {
+			return stats.ClassHttp
+		}
+	}
+	return stats.ClassUnknown
+}
+
+// classifyUdp sniffs the class of a UDP stream from its first packet and
+// the port of its target, zero if unknown.
+func classifyUdp(b []byte, port uint16) stats.Class {
+	switch {
+	case isBittorrentPacket(b):
+		return stats.ClassBittorrent
+	case len(b) >= quicMinInitialSize && b[0]&0xc0 == 0xc0:
+		// A long header with the fixed bit, padded like an Initial.
+		return stats.ClassQuic
+	case port == 53 || isDnsQuery(b):
+		return stats.ClassDns
+	}
+	return stats.ClassUnknown
+}
+
+func isDnsQuery(b []byte) bool {
+	var msg dns.Msg
+	if err := msg.Unpack(b); err != nil {
+		return false
+	}
+	return !msg.Response && msg.Opcode == dns.OpcodeQuery && len(msg.Question) == 1
+}
+
+// portOf returns the port of addr like "example.com:443", zero if invalid.
+func portOf(addr string) uint16 {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return uint16(p)
+}
+
+// isBittorrentStream reports whether the first upload of a TCP stream is a
+// peer handshake or an announce to an HTTP tracker. Handshakes obfuscated
+// with message stream encryption are not detected.
+func isBittorrentStream(b []byte) bool {
+	if bytes.HasPrefix(b, bittorrentHandshake) {
+		return true
+	}
+	if !bytes.HasPrefix(b, []byte("GET /")) {
+		return false
+	}
+	line, _, _ := bytes.Cut(b, []byte("\r\n"))
+	return bytes.Contains(line, []byte("info_hash="))
+}
+
+// isBittorrentPacket reports whether a UDP packet is a DHT message (BEP 5),
+// a connect request to a UDP tracker, a uTP SYN or a peer handshake over
+// uTP.
+func isBittorrentPacket(b []byte) bool {
+	switch {
+	case (bytes.HasPrefix(b, []byte("d1:")) || bytes.HasPrefix(b, []byte("d2:ip"))) && bytes.Contains(b, []byte("1:y1:")):
+		// A bencoded dict with a message type.
+		return true
+	case len(b) >= 16 && binary.BigEndian.Uint64(b) == udpTrackerProtocolId && binary.BigEndian.Uint32(b[8:]) == 0:
+		return true
+	case len(b) >= utpHeaderSize && b[0] == 0x41 && b[1] <= 2 && binary.BigEndian.Uint32(b[8:]) == 0:
+		// ST_SYN of version 1, with no timestamp difference yet.
+		return true
+	case len(b) >= utpHeaderSize && b[0] == 0x01 && b[1] == 0:
+		// ST_DATA of version 1 without extensions.
+		return bytes.HasPrefix(b[utpHeaderSize:], bittorrentHandshake)
+	}
+	return false
+}
+
+// sniffDomain returns the server name of a TLS ClientHello or the host of
+// an HTTP request, empty if there is none in b.
+func sniffDomain(class stats.Class, b []byte) string {
+	switch class {
+	case stats.ClassTls:
+		return tlsServerName(b)
+	case stats.ClassHttp:
+		return httpHost(b)
+	}
+	return ""
+}
+
+// tlsServerName returns the server_name extension of a ClientHello in the
+// first record of b.
+func tlsServerName(b []byte) string {
+	// Record header, handshake header, version and random.
+	const offset = 5 + 4 + 2 + 32
+	if len(b) < offset+1 || b[5] != 0x01 {
+		return ""
+	}
+	b = b[offset:]
+	skip := func(lenSize int) bool {
+		if len(b) < lenSize {
+			return false
+		}
+		n := 0
+		for _, c := range b[:lenSize] {
+			n = n<<8 | int(c)
+		}
+		if len(b) < lenSize+n {
+			return false
+		}
+		b = b[lenSize+n:]
+		return true
+	}
+	// Session id, cipher suites and compression methods.
+	if !skip(1) || !skip(2) || !skip(1) || len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return ""
+		}
+		data := b[4 : 4+n]
+		b = b[4+n:]
+		if typ != 0 {
+			continue
+		}
+		// A server name list with a host_name first.
+		if len(data) < 5 || data[2] != 0 {
+			return ""
+		}
+		nameLen := int(binary.BigEndian.Uint16(data[3:]))
+		if len(data) < 5+nameLen {
+			return ""
+		}
+		return string(data[5 : 5+nameLen])
+	}
+	return ""
+}
+
+// httpHost returns the host without port of the Host header of a request.
+func httpHost(b []byte) string {
+	header, _, _ := bytes.Cut(b, []byte("\r\n\r\n"))
+	for _, line := range bytes.Split(header, []byte("\r\n"))[1:] {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(name), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			return h
+		}
+		return host
+	}
+	return ""
+}
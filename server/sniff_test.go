@@ -0,0 +1,156 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/stats"
+
+	"github.com/miekg/dns"
+)
+
+func TestClassify(t *testing.T) {
+	query, err := new(dns.Msg).SetQuestion("example.com.", dns.TypeA).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := make([]byte, quicMinInitialSize)
+	initial[0] = 0xc3
+	for _, c := range []struct {
+		name    string
+		network string
+		b       []byte
+		port    uint16
+		want    stats.Class
+	}{
+		{"tls", "tcp", []byte{0x16, 0x03, 0x01, 0x02, 0x00}, 443, stats.ClassTls},
+		{"http", "tcp", []byte("GET / HTTP/1.1\r\n"), 80, stats.ClassHttp},
+		{"dns over tcp", "tcp", []byte{0x00, 0x1d}, 53, stats.ClassDns},
+		{"short", "tcp", []byte("GE"), 80, stats.ClassUnknown},
+		{"ssh", "tcp", []byte("SSH-2.0-OpenSSH_9.6\r\n"), 22, stats.ClassUnknown},
+		{"quic", "udp", initial, 443, stats.ClassQuic},
+		{"quic short header", "udp", initial[1:], 443, stats.ClassUnknown},
+		{"dns", "udp", query, 5353, stats.ClassDns},
+		{"dns port", "udp", []byte{0x01}, 53, stats.ClassDns},
+		{"unknown", "udp", []byte("ping"), 7, stats.ClassUnknown},
+	} {
+		classify := classifyTcp
+		if c.network == "udp" {
+			classify = classifyUdp
+		}
+		if got := classify(c.b, c.port); got != c.want {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestIsBittorrent(t *testing.T) {
+	handshake := append(append([]byte{}, bittorrentHandshake...), make([]byte, 48)...)
+	utpData := append(make([]byte, utpHeaderSize), handshake...)
+	utpData[0] = 0x01
+	utpSyn := make([]byte, utpHeaderSize)
+	utpSyn[0], utpSyn[4] = 0x41, 0x12
+	connect := make([]byte, 16)
+	connect[2], connect[3], connect[4], connect[5], connect[6], connect[7] = 0x04, 0x17, 0x27, 0x10, 0x19, 0x80
+	for _, c := range []struct {
+		name   string
+		stream bool
+		b      []byte
+		want   bool
+	}{
+		{"handshake", true, handshake, true},
+		{"announce", true, []byte("GET /announce?info_hash=%12%34&peer_id=x HTTP/1.1\r\n"), true},
+		{"http", true, []byte("GET /index.html?q=info_hash HTTP/1.1\r\n"), false},
+		{"info_hash in body", true, []byte("GET / HTTP/1.1\r\nX: info_hash=1\r\n"), false},
+		{"dht query", false, []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), true},
+		{"dht response with ip", false, []byte("d2:ip6:abcdef1:rd2:id20:abcdefghij0123456789e1:t2:aa1:y1:re"), true},
+		{"bencode without type", false, []byte("d1:ai1ee"), false},
+		{"udp tracker connect", false, connect, true},
+		{"utp syn", false, utpSyn, true},
+		{"utp handshake", false, utpData, true},
+		{"utp data", false, utpData[:utpHeaderSize+4], false},
+		{"dns", false, []byte{0x41, 0x00, 0x01, 0x00, 0x00, 0x01}, false},
+	} {
+		is := isBittorrentPacket
+		if c.stream {
+			is = isBittorrentStream
+		}
+		if got := is(c.b); got != c.want {
+			t.Errorf("%v: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(1000)
+	start := time.Now()
+	// The burst passes at once, the rest at the rate.
+	th.wait(1000)
+	th.wait(200)
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("waited %v, want about 200ms", d)
+	}
+}
+
+func TestSniffDomain(t *testing.T) {
+	hello := []byte{
+		0x16, 0x03, 0x01, 0x00, 0x00, // record
+		0x01, 0x00, 0x00, 0x00, // handshake
+		0x03, 0x03, // version
+	}
+	hello = append(hello, make([]byte, 32)...)                // random
+	hello = append(hello, 0x00)                               // session id
+	hello = append(hello, 0x00, 0x02, 0x13, 0x01)             // cipher suites
+	hello = append(hello, 0x01, 0x00)                         // compression methods
+	hello = append(hello, 0x00, 0x1a)                         // extensions
+	hello = append(hello, 0x00, 0x0a, 0x00, 0x02, 0x00, 0x1d) // supported groups
+	hello = append(hello, 0x00, 0x00, 0x00, 0x10, 0x00, 0x0e, 0x00, 0x00, 0x0b)
+	hello = append(hello, "example.com"...)
+	for _, c := range []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"sni", hello, "example.com"},
+		{"truncated", hello[:len(hello)-3], ""},
+		{"http", []byte("GET / HTTP/1.1\r\nUser-Agent: x\r\nhost: example.org:8080\r\n\r\n"), "example.org"},
+		{"http without host", []byte("GET / HTTP/1.0\r\n\r\n"), ""},
+	} {
+		class := classifyTcp(c.b, 0)
+		if got := sniffDomain(class, c.b); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBittorrentConnCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn := &trafficConn{
+		Conn:           &bittorrentConn{Conn: c, bittorrentFilter: &bittorrentFilter{}},
+		trafficCounter: newTrafficCounter(stats.New().User("user")),
+	}
+	if err = conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// The FIN reaches the target.
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/juicity/juicity/pkg/stats"
+
+	"github.com/mzz2017/quic-go"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// DefaultUdpBufferSize is the size the buffers of listening sockets are
+	// raised to, the one quic-go wants.
+	DefaultUdpBufferSize = 7 << 20
+
+	socketCheckInterval = 10 * time.Second
+	// socketWarnInterval is how often drops of a socket are warned at most.
+	socketWarnInterval = time.Minute
+)
+
+// socketConn records the health of the UDP socket of a listener. It keeps
+// the optimizations of quic-go for a *net.UDPConn, implementing the batched
+// reads it would otherwise do on the socket itself.
+type socketConn struct {
+	*net.UDPConn
+	batch *ipv4.PacketConn
+	stats *stats.SocketStats
+}
+
+// oobConn is a socket that quic-go reads in batches and with ECN, e.g. a
+// socketConn. Wrappers of sockets implement it too, lest quic-go falls back
+// to single reads without ECN, or reads the descriptor behind their back.
+type oobConn interface {
+	quic.OOBCapablePacketConn
+	SetWriteBuffer(bytes int) error
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+var _ oobConn = &socketConn{}
+
+func newSocketConn(conn *net.UDPConn, stats *stats.SocketStats) *socketConn {
+	return &socketConn{UDPConn: conn, batch: ipv4.NewPacketConn(conn), stats: stats}
+}
+
+func (c *socketConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, err := c.batch.ReadBatch(ms, flags)
+	if n > 0 {
+		c.stats.ReadBatches.Add(1)
+		c.stats.ReadPackets.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (c *socketConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	n, oobn, err = c.UDPConn.WriteMsgUDP(b, oob, addr)
+	if err != nil {
+		c.stats.SendErrors.Add(1)
+	}
+	return n, oobn, err
+}
+
+func (c *socketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	n, err = c.UDPConn.WriteTo(b, addr)
+	if err != nil {
+		c.stats.SendErrors.Add(1)
+	}
+	return n, err
+}
+
+// tuneSocketBuffers raises the buffers of conn to the sizes in bytes,
+// bypassing the limits of the kernel if the process is allowed to, and
+// returns the sizes achieved, zero if unknown, and the errors raising either.
+func tuneSocketBuffers(conn *net.UDPConn, receive int, send int) (receiveSize int, sendSize int, receiveErr error, sendErr error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err, err
+	}
+	if err = forceReceiveBuffer(rawConn, receive); err != nil {
+		receiveErr = conn.SetReadBuffer(receive)
+	}
+	if err = forceSendBuffer(rawConn, send); err != nil {
+		sendErr = conn.SetWriteBuffer(send)
+	}
+	receiveSize, sendSize, _ = socketBuffers(rawConn)
+	return receiveSize, sendSize, receiveErr, sendErr
+}
+
+// logSocketBuffers logs the buffer sizes achieved for the listener, warning
+// how to lift the limits of the kernel if they are below the targets.
+func (s *Server) logSocketBuffers(listen string, receive int, send int) {
+	if receive == 0 && send == 0 {
+		return
+	}
+	s.logger.Info().
+		Str("listen", listen).
+		Int("receive_buffer", receive).
+		Int("send_buffer", send).
+		Msg("Socket buffers")
+	for _, b := range []struct {
+		name     string
+		size     int
+		target   int
+		sysctl   string
+		override string
+	}{
+		{"receive", receive, s.udpReceiveBuffer, receiveBufferSysctl, "udp_receive_buffer"},
+		{"send", send, s.udpSendBuffer, sendBufferSysctl, "udp_send_buffer"},
+	} {
+		if b.size == 0 || b.size >= b.target {
+			continue
+		}
+		s.logger.Warn().
+			Str("listen", listen).
+			Int("size", b.size).
+			Int("target", b.target).
+			Msgf("The %v buffer of the socket is capped by the kernel, which may drop datagrams under load; run `sysctl -w %v=%v`, start as root, or lower %v",
+				b.name, b.sysctl, b.target, b.override)
+	}
+}
+
+// monitorSocket updates the stats of the socket of the listener until it is
+// closed, and warns if the kernel drops datagrams.
+func (s *Server) monitorSocket(conn *socketConn, listen string) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	drops, err := newSocketDrops(rawConn)
+	if err != nil {
+		s.logger.Debug().
+			Err(err).
+			Str("listen", listen).
+			Msg("Drops of the socket are unknown")
+	}
+	ticker := time.NewTicker(socketCheckInterval)
+	defer ticker.Stop()
+	var (
+		warned   time.Time
+		unwarned uint64
+	)
+	for range ticker.C {
+		receive, send, err := socketBuffers(rawConn)
+		if err != nil {
+			// Closed.
+			return
+		}
+		conn.stats.ReceiveBuffer.Store(int64(receive))
+		conn.stats.SendBuffer.Store(int64(send))
+		if drops == nil {
+			continue
+		}
+		n, err := drops.read()
+		if err != nil {
+			continue
+		}
+		if last := conn.stats.Drops.Swap(n); n > last {
+			unwarned += n - last
+		}
+		if unwarned > 0 && time.Since(warned) >= socketWarnInterval {
+			s.logger.Warn().
+				Str("listen", listen).
+				Uint64("dropped", unwarned).
+				Int("receive_buffer", receive).
+				Msg("The kernel is dropping datagrams; raise udp_receive_buffer or net.core.rmem_max")
+			warned = time.Now()
+			unwarned = 0
+		}
+	}
+}
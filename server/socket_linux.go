@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func forceReceiveBuffer(rawConn syscall.RawConn, size int) error {
+	return setsockoptInt(rawConn, unix.SO_RCVBUFFORCE, size)
+}
+
+func forceSendBuffer(rawConn syscall.RawConn, size int) error {
+	return setsockoptInt(rawConn, unix.SO_SNDBUFFORCE, size)
+}
+
+func setsockoptInt(rawConn syscall.RawConn, opt int, value int) error {
+	var err error
+	if e := rawConn.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, value)
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+const (
+	receiveBufferSysctl = "net.core.rmem_max"
+	sendBufferSysctl    = "net.core.wmem_max"
+)
+
+// socketBuffers returns the buffer sizes of the socket as set. Linux reports
+// twice these, including its bookkeeping.
+func socketBuffers(rawConn syscall.RawConn) (receive int, send int, err error) {
+	if e := rawConn.Control(func(fd uintptr) {
+		if receive, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF); err != nil {
+			return
+		}
+		send, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	}); e != nil {
+		return 0, 0, e
+	}
+	return receive / 2, send / 2, err
+}
+
+// socketDrops reads the drops of a socket from /proc/net/udp and
+// /proc/net/udp6 by its inode.
+type socketDrops struct {
+	inode string
+}
+
+func newSocketDrops(rawConn syscall.RawConn) (*socketDrops, error) {
+	var (
+		link string
+		err  error
+	)
+	if e := rawConn.Control(func(fd uintptr) {
+		link, err = os.Readlink(fmt.Sprintf("/proc/self/fd/%v", fd))
+	}); e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, err
+	}
+	inode, ok := strings.CutPrefix(link, "socket:[")
+	if !ok {
+		return nil, fmt.Errorf("unexpected link of the socket: %v", link)
+	}
+	return &socketDrops{inode: strings.TrimSuffix(inode, "]")}, nil
+}
+
+func (d *socketDrops) read() (uint64, error) {
+	for _, name := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		drops, ok, err := d.readFile(name)
+		if err != nil || ok {
+			return drops, err
+		}
+	}
+	return 0, fmt.Errorf("socket %v is not found", d.inode)
+}
+
+func (d *socketDrops) readFile(name string) (uint64, bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || fields[9] != d.inode {
+			continue
+		}
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		return drops, true, err
+	}
+	return 0, false, scanner.Err()
+}
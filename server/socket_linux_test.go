@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocketDrops(t *testing.T) {
+	for _, network := range []string{"udp4", "udp"} {
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		rawConn, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		drops, err := newSocketDrops(rawConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := drops.read(); err != nil || n != 0 {
+			t.Errorf("%v: got %v drops, %v; want 0 drops", network, n, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+// The limit of the BSDs and macOS, unused while sizes are unknown here.
+const (
+	receiveBufferSysctl = "kern.ipc.maxsockbuf"
+	sendBufferSysctl    = "kern.ipc.maxsockbuf"
+)
+
+var errSocketStatsUnsupported = errors.New("not supported on this platform")
+
+func forceReceiveBuffer(rawConn syscall.RawConn, size int) error {
+	return errSocketStatsUnsupported
+}
+
+func forceSendBuffer(rawConn syscall.RawConn, size int) error {
+	return errSocketStatsUnsupported
+}
+
+func socketBuffers(rawConn syscall.RawConn) (receive int, send int, err error) {
+	// Only fails if the socket is closed.
+	err = rawConn.Control(func(fd uintptr) {})
+	return 0, 0, err
+}
+
+type socketDrops struct{}
+
+func newSocketDrops(rawConn syscall.RawConn) (*socketDrops, error) {
+	return nil, errSocketStatsUnsupported
+}
+
+func (d *socketDrops) read() (uint64, error) {
+	return 0, errSocketStatsUnsupported
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	gliderLog "github.com/nadoo/glider/pkg/log"
+	"github.com/nadoo/glider/pkg/socks"
+	"github.com/nadoo/glider/proxy"
+	"github.com/nadoo/glider/proxy/socks5"
+)
+
+const (
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthRejected = 0xff
+	// socks5AuthVersion is the version of the username/password
+	// authentication of RFC 1929.
+	socks5AuthVersion = 1
+)
+
+var errSocks5Auth = errors.New("socks5 authentication failed")
+
+// serveSocks5 authenticates a SOCKS5 connection by itself and serves its
+// UDP associations, so that the UDP relay only serves the sources of live
+// associations of authenticated connections. Other commands are served by
+// glider through the dialer, isolated for the user if enabled.
+func (m *Mixed) serveSocks5(conn *proxy.Conn, d netproxy.Dialer) {
+	user, err := m.socks5Auth(conn)
+	if err != nil {
+		gliderLog.F("[socks5] %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if head, err := conn.Peek(2); err == nil && head[1] == socks.CmdUDPAssociate {
+		m.serveUdpAssociate(conn, user)
+		return
+	}
+	if user != "" && m.isolate != nil {
+		d = m.isolate(user, d)
+	}
+	// The connection is authenticated, so glider serves it without.
+	s, err := socks5.NewSocks5(m.noAuthUrl, nil, &forwarder{d: d})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.Serve(&socks5AuthedConn{Conn: conn, greeting: []byte{socks5.Version, 1, socks5AuthNone}})
+}
+
+// serveUdpAssociate replies to a UDP ASSOCIATE request of the user with the
+// address of the UDP relay, which serves the source of the connection until
+// it closes.
+func (m *Mixed) serveUdpAssociate(conn net.Conn, user string) {
+	defer conn.Close()
+	// VER, CMD and RSV, then the address the client will send from. Clients
+	// rarely know it, so only its port tells the associations of different
+	// users apart.
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	declared, err := socks.ReadAddr(conn)
+	if err != nil {
+		return
+	}
+	a := &udpAssociation{user: user}
+	if _, port, err := net.SplitHostPort(declared.String()); err == nil {
+		p, _ := strconv.ParseUint(port, 10, 16)
+		a.port = uint16(p)
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	source := tcpAddr.AddrPort().Addr().Unmap()
+	bound := socks.ParseAddr(conn.LocalAddr().String())
+	if bound == nil {
+		return
+	}
+	if _, err := conn.Write(append([]byte{socks5.Version, 0, 0}, bound...)); err != nil {
+		return
+	}
+	m.associate(source, a)
+	defer m.dissociate(source, a)
+	// The association lasts as long as the connection.
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// socks5Auth negotiates the method of RFC 1928 and returns the user the
+// client authenticated with, or an empty one for clients without
+// credentials if the listener has no password. Without isolation, the user
+// must also be the one of the listener.
+func (m *Mixed) socks5Auth(conn net.Conn) (user string, err error) {
+	buf := make([]byte, 255)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	methods, err := readN(conn, buf, int(buf[1]))
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case bytes.IndexByte(methods, socks5AuthPassword) >= 0:
+		if _, err = conn.Write([]byte{socks5.Version, socks5AuthPassword}); err != nil {
+			return "", err
+		}
+	case bytes.IndexByte(methods, socks5AuthNone) >= 0 && m.password == "":
+		_, err = conn.Write([]byte{socks5.Version, socks5AuthNone})
+		return "", err
+	default:
+		_, _ = conn.Write([]byte{socks5.Version, socks5AuthRejected})
+		return "", fmt.Errorf("%w: no acceptable method", errSocks5Auth)
+	}
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socks5AuthVersion {
+		return "", fmt.Errorf("%w: unexpected version %v", errSocks5Auth, buf[0])
+	}
+	b, err := readN(conn, buf, int(buf[1]))
+	if err != nil {
+		return "", err
+	}
+	user = string(b)
+	if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+		return "", err
+	}
+	b, err = readN(conn, buf, int(buf[0]))
+	if err != nil {
+		return "", err
+	}
+	if m.password != "" && (string(b) != m.password || (m.isolate == nil && user != m.user)) {
+		_, _ = conn.Write([]byte{socks5AuthVersion, 1})
+		return "", fmt.Errorf("%w: wrong password of %v", errSocks5Auth, user)
+	}
+	_, err = conn.Write([]byte{socks5AuthVersion, 0})
+	return user, err
+}
+
+func readN(r io.Reader, buf []byte, n int) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// socks5AuthedConn replays a greeting without authentication to the server
+// of a connection authenticated already, and drops its reply.
+type socks5AuthedConn struct {
+	net.Conn
+	greeting []byte
+	// dropped are the bytes of the reply dropped so far.
+	dropped int
+}
+
+func (c *socks5AuthedConn) Read(b []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(b, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *socks5AuthedConn) Write(b []byte) (int, error) {
+	if drop := min(2-c.dropped, len(b)); drop > 0 {
+		c.dropped += drop
+		n, err := c.Conn.Write(b[drop:])
+		return n + drop, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+func TestSocks5Auth(t *testing.T) {
+	userPass := func(user, pass string) []byte {
+		b := []byte{socks5AuthVersion, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(pass)))
+		return append(b, pass...)
+	}
+	for _, tt := range []struct {
+		name     string
+		isolated bool
+		password string
+		send     []byte
+		user     string
+		reply    []byte
+		err      bool
+	}{
+		{"password", true, "", append([]byte{5, 2, 0, 2}, userPass("app1", "x")...), "app1", []byte{5, 2, 1, 0}, false},
+		{"none", true, "", []byte{5, 1, 0}, "", []byte{5, 0}, false},
+		{"listener password", true, "secret", append([]byte{5, 1, 2}, userPass("app2", "secret")...), "app2", []byte{5, 2, 1, 0}, false},
+		{"wrong password", true, "secret", append([]byte{5, 1, 2}, userPass("app2", "guess")...), "", []byte{5, 2, 1, 1}, true},
+		{"none with listener password", true, "secret", []byte{5, 1, 0}, "", []byte{5, 0xff}, true},
+		{"listener user", false, "secret", append([]byte{5, 1, 2}, userPass("user", "secret")...), "user", []byte{5, 2, 1, 0}, false},
+		{"wrong user", false, "secret", append([]byte{5, 1, 2}, userPass("app2", "secret")...), "", []byte{5, 2, 1, 1}, true},
+	} {
+		client, server := net.Pipe()
+		m := &Mixed{user: "user", password: tt.password}
+		if tt.isolated {
+			m.isolate = func(user string, d netproxy.Dialer) netproxy.Dialer { return d }
+		}
+		done := make(chan struct{})
+		var user string
+		var err error
+		go func() {
+			defer close(done)
+			defer server.Close()
+			user, err = m.socks5Auth(server)
+		}()
+		go func() {
+			_, _ = client.Write(tt.send)
+		}()
+		reply, _ := io.ReadAll(client)
+		<-done
+		if user != tt.user || (err != nil) != tt.err || !bytes.Equal(reply, tt.reply) {
+			t.Errorf("%v: got %q, %v, reply %v", tt.name, user, err, reply)
+		}
+		if tt.err && !errors.Is(err, errSocks5Auth) {
+			t.Errorf("%v: got %v, want %v", tt.name, err, errSocks5Auth)
+		}
+	}
+
+	// The server of the authenticated connection reads a greeting without
+	// authentication, and its reply is dropped.
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &socks5AuthedConn{Conn: server, greeting: []byte{5, 1, socks5AuthNone}}
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(c, b); err != nil || !bytes.Equal(b, []byte{5, 1, 0}) {
+		t.Fatalf("got greeting %v, %v", b, err)
+	}
+	go func() {
+		_, _ = c.Write([]byte{5})
+		_, _ = c.Write([]byte{0, 5, 0, 0, 1})
+		server.Close()
+	}()
+	if got, _ := io.ReadAll(client); !bytes.Equal(got, []byte{5, 0, 0, 1}) {
+		t.Errorf("got %v after the dropped reply", got)
+	}
+}
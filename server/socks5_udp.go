@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	gliderLog "github.com/nadoo/glider/pkg/log"
+)
+
+const (
+	socks5UdpTimeout = 2 * time.Minute
+	// socks5UdpMaxHeader is the longest header of a SOCKS5 UDP packet with
+	// an IP: RSV, FRAG, ATYP, an IPv6 and the port.
+	socks5UdpMaxHeader = 3 + 1 + 16 + 2
+	socks5UdpBufSize   = 64 << 10
+
+	socks5AtypIPv4   = 1
+	socks5AtypDomain = 3
+	socks5AtypIPv6   = 4
+)
+
+// socks5UdpRelay relays the UDP packets of SOCKS5 clients through the dialer.
+// Unlike the generic relay of glider, packets are not copied between pooled
+// buffers, targets are not resolved locally and there is no channel between
+// the socket and the session: each packet is parsed in place and written to
+// the session of its source at once.
+type socks5UdpRelay struct {
+	conn *net.UDPConn
+	// dialerOf returns the dialer of a new session from the source, or nil
+	// to drop its packets.
+	dialerOf  func(source netip.AddrPort) netproxy.Dialer
+	isAllowed func(source netip.Addr) bool
+	// timeout is how long a session lasts without packets of its source.
+	timeout time.Duration
+	// closed is closed with conn, ending the sessions.
+	closed chan struct{}
+
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*socks5UdpSession
+}
+
+type socks5UdpSession struct {
+	lastActive atomic.Int64
+
+	// pc is set once dialed. Packets arriving before are queued in pending.
+	mu      sync.Mutex
+	pc      netproxy.PacketConn
+	pending []socks5UdpPacket
+}
+
+type socks5UdpPacket struct {
+	target  string
+	payload []byte
+}
+
+// socks5UdpMaxPending bounds the packets queued while a session is dialed.
+const socks5UdpMaxPending = 16
+
+func newSocks5UdpRelay(conn *net.UDPConn, dialerOf func(source netip.AddrPort) netproxy.Dialer, isAllowed func(source netip.Addr) bool) *socks5UdpRelay {
+	return &socks5UdpRelay{
+		conn:      conn,
+		dialerOf:  dialerOf,
+		isAllowed: isAllowed,
+		timeout:   socks5UdpTimeout,
+		closed:    make(chan struct{}),
+		sessions:  make(map[netip.AddrPort]*socks5UdpSession),
+	}
+}
+
+// serve relays packets until the conn is closed, and then closes the
+// sessions.
+func (r *socks5UdpRelay) serve() {
+	buf := make([]byte, socks5UdpBufSize)
+	for {
+		n, source, err := r.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				r.closeSessions()
+				return
+			}
+			continue
+		}
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		if !r.isAllowed(source.Addr()) {
+			continue
+		}
+		target, payload, ok := parseSocks5UdpPacket(buf[:n])
+		if !ok {
+			continue
+		}
+		r.session(source, target).write(target, payload)
+	}
+}
+
+// session returns the session of the source, dialing one to the first
+// target in the background if there is none.
+func (r *socks5UdpRelay) session(source netip.AddrPort, target string) *socks5UdpSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[source]
+	if !ok {
+		s = &socks5UdpSession{}
+		r.sessions[source] = s
+		go r.serveSession(source, s, target)
+	}
+	return s
+}
+
+func (r *socks5UdpRelay) closeSessions() {
+	close(r.closed)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		s.mu.Lock()
+		if s.pc != nil {
+			_ = s.pc.Close()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *socks5UdpSession) write(target string, payload []byte) {
+	s.lastActive.Store(time.Now().UnixNano())
+	s.mu.Lock()
+	pc := s.pc
+	if pc == nil {
+		if len(s.pending) < socks5UdpMaxPending {
+			s.pending = append(s.pending, socks5UdpPacket{target, append([]byte(nil), payload...)})
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	_, _ = pc.WriteTo(payload, target)
+}
+
+// serveSession writes the replies of the session back to the source until
+// it is idle for the timeout or the relay is closed.
+func (r *socks5UdpRelay) serveSession(source netip.AddrPort, s *socks5UdpSession, target string) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.sessions, source)
+		r.mu.Unlock()
+	}()
+	d := r.dialerOf(source)
+	if d == nil {
+		return
+	}
+	c, err := d.Dial("udp", target)
+	if err != nil {
+		gliderLog.F("[socks5u] remote dial error: %v", err)
+		return
+	}
+	pc := c.(netproxy.PacketConn)
+	defer pc.Close()
+	s.mu.Lock()
+	s.pc = pc
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	select {
+	case <-r.closed:
+		// The relay was closed while dialing.
+		return
+	default:
+	}
+	for _, p := range pending {
+		_, _ = pc.WriteTo(p.payload, p.target)
+	}
+
+	buf := make([]byte, socks5UdpBufSize)
+	for {
+		_ = pc.SetReadDeadline(time.Now().Add(r.timeout))
+		n, from, err := pc.ReadFrom(buf[socks5UdpMaxHeader:])
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, s.lastActive.Load())) < r.timeout {
+				// The client is still sending.
+				continue
+			}
+			return
+		}
+		header := socks5UdpHeader(buf[:socks5UdpMaxHeader], from)
+		if _, err = r.conn.WriteToUDPAddrPort(buf[socks5UdpMaxHeader-header:socks5UdpMaxHeader+n], source); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	}
+}
+
+// parseSocks5UdpPacket returns the target and the payload of a SOCKS5 UDP
+// packet. Fragments are not supported, like by most clients.
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+func parseSocks5UdpPacket(b []byte) (target string, payload []byte, ok bool) {
+	if len(b) < 4 || b[2] != 0 {
+		return "", nil, false
+	}
+	var host string
+	var rest []byte
+	switch b[3] {
+	case socks5AtypIPv4:
+		if len(b) < 4+4+2 {
+			return "", nil, false
+		}
+		host = netip.AddrFrom4([4]byte(b[4:8])).String()
+		rest = b[8:]
+	case socks5AtypIPv6:
+		if len(b) < 4+16+2 {
+			return "", nil, false
+		}
+		host = netip.AddrFrom16([16]byte(b[4:20])).String()
+		rest = b[20:]
+	case socks5AtypDomain:
+		if len(b) < 5 || len(b) < 5+int(b[4])+2 {
+			return "", nil, false
+		}
+		host = string(b[5 : 5+int(b[4])])
+		rest = b[5+int(b[4]):]
+	default:
+		return "", nil, false
+	}
+	port := binary.BigEndian.Uint16(rest)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), rest[2:], true
+}
+
+// socks5UdpHeader writes the header of a reply from the address at the end
+// of b and returns its length.
+func socks5UdpHeader(b []byte, from netip.AddrPort) int {
+	addr := from.Addr().Unmap()
+	var n int
+	if addr.Is4() {
+		n = 3 + 1 + 4 + 2
+		ip := addr.As4()
+		copy(b[len(b)-6:], ip[:])
+		b[len(b)-n+3] = socks5AtypIPv4
+	} else {
+		n = 3 + 1 + 16 + 2
+		ip := addr.As16()
+		copy(b[len(b)-18:], ip[:])
+		b[len(b)-n+3] = socks5AtypIPv6
+	}
+	h := b[len(b)-n:]
+	h[0], h[1], h[2] = 0, 0, 0
+	binary.BigEndian.PutUint16(b[len(b)-2:], from.Port())
+	return n
+}
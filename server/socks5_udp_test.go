@@ -0,0 +1,383 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol/direct"
+	gliderLog "github.com/nadoo/glider/pkg/log"
+	"github.com/nadoo/glider/proxy/socks5"
+)
+
+func TestSocks5UdpPacket(t *testing.T) {
+	for _, c := range []struct {
+		packet []byte
+		target string
+		ok     bool
+	}{
+		{[]byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53, 'h', 'i'}, "127.0.0.1:53", true},
+		{append([]byte{0, 0, 0, 4}, append(netip.MustParseAddr("2001:db8::1").AsSlice(), 1, 187, 'h', 'i')...), "[2001:db8::1]:443", true},
+		{[]byte{0, 0, 0, 3, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 80, 'h', 'i'}, "example:80", true},
+		// Fragments, truncated addresses and unknown types.
+		{[]byte{0, 0, 1, 1, 127, 0, 0, 1, 0, 53, 'h', 'i'}, "", false},
+		{[]byte{0, 0, 0, 3, 7, 'e', 'x'}, "", false},
+		{[]byte{0, 0, 0, 9, 1, 2}, "", false},
+	} {
+		target, payload, ok := parseSocks5UdpPacket(c.packet)
+		if ok != c.ok || target != c.target || (ok && string(payload) != "hi") {
+			t.Errorf("parse %v: got %v %q %v", c.packet, target, payload, ok)
+		}
+	}
+
+	for _, from := range []string{"127.0.0.1:53", "[::ffff:10.0.0.1]:53", "[2001:db8::1]:443"} {
+		addr := netip.MustParseAddrPort(from)
+		b := make([]byte, socks5UdpMaxHeader+2)
+		copy(b[socks5UdpMaxHeader:], "hi")
+		n := socks5UdpHeader(b[:socks5UdpMaxHeader], addr)
+		target, payload, ok := parseSocks5UdpPacket(b[socks5UdpMaxHeader-n:])
+		want := netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()).String()
+		if !ok || target != want || !bytes.Equal(payload, []byte("hi")) {
+			t.Errorf("header of %v: got %v %q %v", from, target, payload, ok)
+		}
+	}
+}
+
+// startTestMixed serves a mixed proxy of the url, whose host is filled with
+// a free port of the loopback, dialing directly once set up.
+func startTestMixed(t *testing.T, userinfo string, setup func(m *Mixed)) *Mixed {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	gliderLog.SetLogger(log.NewLogger(&log.Options{}))
+	m, err := NewMixed("mixed://"+userinfo+addr, direct.SymmetricDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(m)
+	}
+	go func() { _ = m.ListenAndServe() }()
+	t.Cleanup(func() { _ = m.Close() })
+	if !eventually(func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		return err == nil
+	}) {
+		t.Fatal("mixed proxy not listening")
+	}
+	return m
+}
+
+// socks5Associate opens a UDP association authenticated with the user and
+// password, declaring the port it sends from if not 0, which lasts until the
+// returned conn is closed.
+func socks5Associate(t *testing.T, addr, user, password string, port uint16) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	req := []byte{5, 1, socks5AuthPassword, socks5AuthVersion, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	req = append(req, 5, 3, 0, socks5AtypIPv4, 0, 0, 0, 0, byte(port>>8), byte(port))
+	if _, err = c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+2+10)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:5], []byte{5, socks5AuthPassword, socks5AuthVersion, 0, 5}) || reply[5] != 0 {
+		t.Fatalf("got reply %v", reply)
+	}
+	return c
+}
+
+// exchangeSocks5Udp sends a packet to the target through the relay at addr
+// and returns the payload of the reply, or false if none arrives in time.
+func exchangeSocks5Udp(t *testing.T, pc net.PacketConn, addr string, target netip.AddrPort, payload string) (string, bool) {
+	relay, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, socks5UdpMaxHeader+len(payload))
+	copy(b[socks5UdpMaxHeader:], payload)
+	n := socks5UdpHeader(b[:socks5UdpMaxHeader], target)
+	if _, err = pc.WriteTo(b[socks5UdpMaxHeader-n:], relay); err != nil {
+		t.Fatal(err)
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 2048)
+	n, _, err = pc.ReadFrom(buf)
+	if err != nil {
+		return "", false
+	}
+	from, reply, ok := parseSocks5UdpPacket(buf[:n])
+	if !ok || from != target.String() {
+		t.Fatalf("got reply from %v: %v", from, buf[:n])
+	}
+	return string(reply), true
+}
+
+// startUdpEcho echoes UDP packets on the loopback.
+func startUdpEcho(t testing.TB) netip.AddrPort {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], from)
+		}
+	}()
+	return echo.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestSocks5UdpAssociation(t *testing.T) {
+	target := startUdpEcho(t)
+	m := startTestMixed(t, "user:pass@", nil)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if reply, ok := exchangeSocks5Udp(t, pc, m.addr, target, "before"); ok {
+		t.Fatalf("relayed %q without an association", reply)
+	}
+	assoc := socks5Associate(t, m.addr, "user", "pass", 0)
+	if reply, ok := exchangeSocks5Udp(t, pc, m.addr, target, "during"); !ok || reply != "during" {
+		t.Fatalf("got %q, %v during the association", reply, ok)
+	}
+	assoc.Close()
+	if !eventually(func() bool { return !m.isAssociated(netip.MustParseAddr("127.0.0.1")) }) {
+		t.Fatal("association outlived its connection")
+	}
+	if reply, ok := exchangeSocks5Udp(t, pc, m.addr, target, "after"); ok {
+		t.Fatalf("relayed %q after the association", reply)
+	}
+}
+
+// startTestSocks5UdpRelay serves a relay on the loopback dialing full-cone
+// sessions directly, like those of the client reaching any target, with
+// sessions idle for the timeout expiring.
+func startTestSocks5UdpRelay(t testing.TB, timeout time.Duration) (*socks5UdpRelay, chan struct{}) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := newSocks5UdpRelay(conn, func(netip.AddrPort) netproxy.Dialer { return direct.FullconeDirect }, func(netip.Addr) bool { return true })
+	r.timeout = timeout
+	done := make(chan struct{})
+	go func() {
+		r.serve()
+		close(done)
+	}()
+	return r, done
+}
+
+func (r *socks5UdpRelay) sessionCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+func TestSocks5UdpRelay(t *testing.T) {
+	gliderLog.SetLogger(log.NewLogger(&log.Options{}))
+	r, done := startTestSocks5UdpRelay(t, 200*time.Millisecond)
+	addr := r.conn.LocalAddr().String()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// The session of a source relays to every target, and replies carry
+	// the address of the target they came from.
+	for _, target := range []netip.AddrPort{startUdpEcho(t), startUdpEcho(t)} {
+		if reply, ok := exchangeSocks5Udp(t, pc, addr, target, target.String()); !ok || reply != target.String() {
+			t.Fatalf("got %q, %v from %v", reply, ok, target)
+		}
+	}
+	if n := r.sessionCount(); n != 1 {
+		t.Fatalf("got %v sessions, want 1", n)
+	}
+
+	if !eventually(func() bool { return r.sessionCount() == 0 }) {
+		t.Fatal("idle session did not expire")
+	}
+
+	target := startUdpEcho(t)
+	if reply, ok := exchangeSocks5Udp(t, pc, addr, target, "again"); !ok || reply != "again" {
+		t.Fatalf("got %q, %v after the session expired", reply, ok)
+	}
+	r.conn.Close()
+	<-done
+	if !eventually(func() bool { return r.sessionCount() == 0 }) {
+		t.Fatal("session outlived the relay")
+	}
+}
+
+// BenchmarkSocks5Udp compares the relay with the generic packet server of
+// glider it replaced, exchanging packets with an echo target.
+func BenchmarkSocks5Udp(b *testing.B) {
+	gliderLog.SetLogger(log.NewLogger(&log.Options{}))
+	payload := make([]byte, 1200)
+	bench := func(b *testing.B, addr net.Addr) {
+		target := startUdpEcho(b)
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer pc.Close()
+		packet := make([]byte, socks5UdpMaxHeader+len(payload))
+		copy(packet[socks5UdpMaxHeader:], payload)
+		packet = packet[socks5UdpMaxHeader-socks5UdpHeader(packet[:socks5UdpMaxHeader], target):]
+		buf := make([]byte, 2048)
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		start := cpuTime(b)
+		for i := 0; i < b.N; i++ {
+			if _, err = pc.WriteTo(packet, addr); err != nil {
+				b.Fatal(err)
+			}
+			_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+			if _, _, err = pc.ReadFrom(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+		// The echo target and the client take the same time with both.
+		b.ReportMetric(float64(cpuTime(b)-start)/float64(b.N), "cpu-ns/op")
+	}
+	b.Run("relay", func(b *testing.B) {
+		r, _ := startTestSocks5UdpRelay(b, socks5UdpTimeout)
+		bench(b, r.conn.LocalAddr())
+	})
+	b.Run("glider", func(b *testing.B) {
+		s, err := socks5.NewSocks5("socks5://127.0.0.1:0", nil, &forwarder{d: direct.FullconeDirect})
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		go s.ServePacket(blockingPacketConn{conn})
+		bench(b, conn.LocalAddr())
+	})
+}
+
+// cpuTime returns the CPU time the process used so far.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Skip(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// blockingPacketConn parks the packet server of glider once closed, which
+// otherwise retries reading forever.
+type blockingPacketConn struct {
+	net.PacketConn
+}
+
+func (c blockingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if errors.Is(err, net.ErrClosed) {
+		select {}
+	}
+	return n, addr, err
+}
+
+// recordingDialer dials directly, recording the users of isolated dials.
+type recordingDialer struct {
+	user  string
+	dials chan string
+}
+
+func (d *recordingDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	d.dials <- d.user
+	return direct.FullconeDirect.Dial(network, addr)
+}
+
+func TestSocks5UdpRouting(t *testing.T) {
+	target := startUdpEcho(t)
+	dials := make(chan string, 16)
+	sources := make(chan net.Addr, 16)
+	m := startTestMixed(t, "user:pass@", func(m *Mixed) {
+		m.SetRouter(func(source net.Addr) netproxy.Dialer {
+			if _, ok := source.(*net.UDPAddr); ok {
+				sources <- source
+			}
+			return &recordingDialer{dials: dials}
+		})
+		m.SetIsolation(func(user string, d netproxy.Dialer) netproxy.Dialer {
+			return &recordingDialer{user: user, dials: dials}
+		})
+	})
+	newSource := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	// exchange returns the user the session of the source was dialed for,
+	// or false if it was not relayed.
+	exchange := func(pc net.PacketConn) (string, bool) {
+		if reply, ok := exchangeSocks5Udp(t, pc, m.addr, target, "hi"); !ok || reply != "hi" {
+			return "", false
+		}
+		return <-dials, true
+	}
+
+	alice := newSource()
+	socks5Associate(t, m.addr, "alice", "pass", 0)
+	// Sessions are routed by their UDP source and isolated for the user of
+	// the association.
+	if user, ok := exchange(alice); !ok || user != "alice" {
+		t.Fatalf("got %q, %v, want alice", user, ok)
+	}
+	if source := <-sources; source.String() != alice.LocalAddr().String() {
+		t.Errorf("routed %v, want %v", source, alice.LocalAddr())
+	}
+
+	// With associations of two users, sources of undeclared ports are
+	// ambiguous.
+	socks5Associate(t, m.addr, "bob", "pass", 0)
+	if user, ok := exchange(newSource()); ok {
+		t.Errorf("relayed an ambiguous source for %q", user)
+	}
+	carol := newSource()
+	socks5Associate(t, m.addr, "carol", "pass", uint16(carol.LocalAddr().(*net.UDPAddr).Port))
+	if user, ok := exchange(carol); !ok || user != "carol" {
+		t.Fatalf("got %q, %v, want carol", user, ok)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// maxSourcePortAttempts bounds the ports tried by a dial when the range is
+// crowded.
+const maxSourcePortAttempts = 256
+
+var ErrSourcePortsExhausted = fmt.Errorf("no free source port")
+
+// bind calls dial with ports of the range from a random one until a port is
+// free, or with port zero if there is no range.
+func (d *directDialer) bind(dial func(port uint16) (netproxy.Conn, error)) (netproxy.Conn, error) {
+	if d.ports == nil {
+		return dial(0)
+	}
+	size := int(d.ports.To) - int(d.ports.From) + 1
+	start := rand.Intn(size)
+	for i := 0; i < min(size, maxSourcePortAttempts); i++ {
+		port := d.ports.From + uint16((start+i)%size)
+		c, err := dial(port)
+		if err == nil {
+			return c, nil
+		}
+		// EADDRNOTAVAIL is returned by connect if the port is in use with
+		// the same target.
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w in %v-%v", ErrSourcePortsExhausted, d.ports.From, d.ports.To)
+}
+
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return netproxy.SoMarkControl(c, mark)
+	}
+}
+
+// markResolver resolves names with the mark, or is nil for the default
+// resolver.
+func markResolver(mark int) *net.Resolver {
+	if mark == 0 {
+		return nil
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Control: markControl(mark)}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
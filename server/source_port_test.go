@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/juicity/juicity/pkg/acl"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+func TestSourcePortDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	// Occupy a port so that the range has one free port left.
+	used, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	busy := uint16(used.LocalAddr().(*net.UDPAddr).Port)
+	ports := acl.PortRange{From: busy, To: busy + 1}
+	d := &directDialer{ports: &ports, fullCone: true, resolver: newHostResolver(DialDual, 0)}
+
+	for _, network := range []string{"udp", "tcp"} {
+		c, err := d.Dial(network, ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%v: %v", network, err)
+		}
+		defer c.Close()
+		_, port, _ := net.SplitHostPort(c.(interface{ LocalAddr() net.Addr }).LocalAddr().String())
+		// The port busy in UDP is free in TCP.
+		if want := strconv.Itoa(int(busy + 1)); network == "udp" && port != want {
+			t.Errorf("%v: got source port %v, want %v", network, port, want)
+		}
+		if p, _ := strconv.Atoi(port); p < int(ports.From) || p > int(ports.To) {
+			t.Errorf("%v: source port %v is out of %v", network, port, ports)
+		}
+	}
+	d.ports = &acl.PortRange{From: busy, To: busy}
+	if _, err = d.Dial("udp", ln.Addr().String()); !errors.Is(err, ErrSourcePortsExhausted) {
+		t.Errorf("got %v, want %v", err, ErrSourcePortsExhausted)
+	}
+	if _, ok := any(&directPacketConn{}).(netproxy.PacketConn); !ok {
+		t.Error("directPacketConn is not a netproxy.PacketConn")
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/pool"
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/daeuniverse/softwind/protocol/trojanc"
+	"github.com/mzz2017/quic-go"
+)
+
+// streamConn is a stream of a client whose header was already read into its
+// metadata, unlike the server conns of softwind, which read the header
+// themselves.
+type streamConn struct {
+	quic.Stream
+	Metadata *trojanc.Metadata
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var _ netproxy.Conn = &streamConn{}
+
+func newStreamConn(stream quic.Stream, mdata *trojanc.Metadata) *streamConn {
+	return &streamConn{Stream: stream, Metadata: mdata}
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Stream.Write(b)
+}
+
+// CloseWrite ends the direction towards the client, which can still be read.
+func (c *streamConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Stream.Close()
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		// Keep a blocked writer from holding the lock forever.
+		_ = c.Stream.SetWriteDeadline(time.Now())
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		// Closing the stream only ends the direction towards the client.
+		c.Stream.CancelRead(0)
+		c.closeErr = c.Stream.Close()
+	})
+	return c.closeErr
+}
+
+// packetStreamConn carries the UDP packets of a stream, each framed as the
+// address, the length as a big-endian uint16 and the payload.
+type packetStreamConn struct {
+	*streamConn
+	domainIpMapping sync.Map
+}
+
+var _ netproxy.FullConn = &packetStreamConn{}
+
+func (c *packetStreamConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *packetStreamConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, net.JoinHostPort(c.Metadata.Hostname, strconv.Itoa(int(c.Metadata.Port))))
+}
+
+// ReadFrom reads a packet into p, truncating it if p is too short.
+func (c *packetStreamConn) ReadFrom(p []byte) (n int, addrPort netip.AddrPort, err error) {
+	m := trojanc.Metadata{}
+	if _, err = m.Unpack(c.Stream); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	if addrPort, err = m.DomainIpMapping(&c.domainIpMapping); err != nil {
+		return 0, netip.AddrPort{}, fmt.Errorf("ReadFrom AddrPort: %w", err)
+	}
+	var b [2]byte
+	if _, err = io.ReadFull(c.Stream, b[:]); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	length := int(binary.BigEndian.Uint16(b[:]))
+	if n, err = io.ReadFull(c.Stream, p[:min(length, len(p))]); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	if length > len(p) {
+		_, _ = io.CopyN(io.Discard, c.Stream, int64(length-len(p)))
+	}
+	return n, addrPort, nil
+}
+
+func (c *packetStreamConn) WriteTo(p []byte, addr string) (int, error) {
+	mdata, err := protocol.ParseMetadata(addr)
+	if err != nil {
+		return 0, err
+	}
+	metadata := trojanc.Metadata{Metadata: mdata, Network: "udp"}
+	buf := pool.Get(metadata.Len() + 2 + len(p))
+	defer pool.Put(buf)
+	if _, err = c.streamConn.Write(juicity.SealUDP(metadata, buf, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
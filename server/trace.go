@@ -0,0 +1,509 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+	"github.com/mzz2017/quic-go/logging"
+	"github.com/mzz2017/quic-go/qlog"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultTraceDuration is how long a trace filter lasts if not given.
+	DefaultTraceDuration = 30 * time.Minute
+	// traceSampleSize is how many of the first bytes of each direction of a
+	// traced stream are logged.
+	traceSampleSize = 64
+)
+
+var ErrEmptyTraceFilter = fmt.Errorf("trace filter needs a source or a user")
+
+// TraceFilter selects the connections to trace by their source, their user
+// or both.
+type TraceFilter struct {
+	Id uint64 `json:"id"`
+	// Source matches any source if invalid.
+	Source netip.Prefix `json:"source"`
+	// User matches any user if uuid.Nil.
+	User  uuid.UUID `json:"user"`
+	Until time.Time `json:"until"`
+}
+
+// matches reports whether the filter matches the source, and the user if it
+// is authenticated.
+func (f *TraceFilter) matches(source netip.Addr, user *uuid.UUID) bool {
+	if f.Source.IsValid() && !f.Source.Contains(source.Unmap()) {
+		return false
+	}
+	if f.User != uuid.Nil && (user == nil || *user != f.User) {
+		return false
+	}
+	return true
+}
+
+// Tracing traces the connections matching its filters verbosely: streams
+// are logged at debug level with samples of their first bytes, and a qlog of
+// the connection is written if a directory is given. It is shared by the
+// servers of all listeners.
+type Tracing struct {
+	logger  *log.Logger
+	qlogDir string
+
+	mu      sync.Mutex
+	filters map[uint64]*TraceFilter
+	lastId  uint64
+	// conns are the tracers of connections by their tracing id of quic.
+	conns map[uint64]*connTracer
+	// n is the number of filters, read without lock by new connections.
+	n atomic.Int32
+}
+
+// NewTracing returns a Tracing logging to logger at debug level whatever its
+// level is. No qlogs are written if qlogDir is empty.
+func NewTracing(logger *log.Logger, qlogDir string) *Tracing {
+	l := logger.Level(zerolog.DebugLevel)
+	return &Tracing{
+		logger:  &l,
+		qlogDir: qlogDir,
+		filters: map[uint64]*TraceFilter{},
+		conns:   map[uint64]*connTracer{},
+	}
+}
+
+// Add adds the filter, lasting DefaultTraceDuration if Until is zero, and
+// returns it with its id.
+func (t *Tracing) Add(f TraceFilter) (TraceFilter, error) {
+	if !f.Source.IsValid() && f.User == uuid.Nil {
+		return TraceFilter{}, ErrEmptyTraceFilter
+	}
+	if f.Source.IsValid() {
+		bits := f.Source.Bits()
+		if f.Source.Addr().Is4In6() {
+			bits = max(bits-96, 0)
+		}
+		f.Source = netip.PrefixFrom(f.Source.Addr().Unmap(), bits).Masked()
+	}
+	if f.Until.IsZero() {
+		f.Until = time.Now().Add(DefaultTraceDuration)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastId++
+	f.Id = t.lastId
+	t.filters[f.Id] = &f
+	t.n.Store(int32(len(t.filters)))
+	e := t.logger.Info().
+		Uint64("id", f.Id)
+	if f.Source.IsValid() {
+		e = e.Str("source", f.Source.String())
+	}
+	if f.User != uuid.Nil {
+		e = e.Str("user", f.User.String())
+	}
+	e.Time("until", f.Until).
+		Msg("Trace filter added")
+	return f, nil
+}
+
+// Remove removes the filter of the id. It reports false if there is none.
+func (t *Tracing) Remove(id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.filters[id]; !ok {
+		return false
+	}
+	delete(t.filters, id)
+	t.n.Store(int32(len(t.filters)))
+	return true
+}
+
+// Filters returns the active filters by id.
+func (t *Tracing) Filters() []TraceFilter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expireLocked()
+	filters := make([]TraceFilter, 0, len(t.filters))
+	for _, f := range t.filters {
+		filters = append(filters, *f)
+	}
+	sort.Slice(filters, func(i, j int) bool {
+		return filters[i].Id < filters[j].Id
+	})
+	return filters
+}
+
+func (t *Tracing) expireLocked() {
+	now := time.Now()
+	for id, f := range t.filters {
+		if now.After(f.Until) {
+			delete(t.filters, id)
+		}
+	}
+	t.n.Store(int32(len(t.filters)))
+}
+
+// match returns the first filter matching the source, and the user if it is
+// authenticated, or nil.
+func (t *Tracing) match(source netip.Addr, user *uuid.UUID) *TraceFilter {
+	if t.n.Load() == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expireLocked()
+	var matched *TraceFilter
+	for _, f := range t.filters {
+		if f.matches(source, user) && (matched == nil || f.Id < matched.Id) {
+			matched = f
+		}
+	}
+	return matched
+}
+
+// connectionTracer is the Tracer of quic.Config. Connections started while
+// there is no filter, or without qlogs, are not traced by quic at all.
+func (t *Tracing) connectionTracer(ctx context.Context, p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	if t.qlogDir == "" || t.n.Load() == 0 {
+		return nil
+	}
+	id, _ := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	c := &connTracer{t: t, id: id, perspective: p, odcid: odcid}
+	t.mu.Lock()
+	t.conns[id] = c
+	t.mu.Unlock()
+	return c
+}
+
+// trace starts tracing an authenticated connection matched by f.
+func (t *Tracing) trace(conn quic.Connection, user uuid.UUID, f *TraceFilter) {
+	t.logger.Debug().
+		Uint64("filter", f.Id).
+		Str("source", conn.RemoteAddr().String()).
+		Str("user", user.String()).
+		Msg("Tracing connection")
+	id, _ := conn.Context().Value(quic.ConnectionTracingKey).(uint64)
+	t.mu.Lock()
+	c := t.conns[id]
+	t.mu.Unlock()
+	if c != nil {
+		c.startQlog()
+	}
+}
+
+// connTracer writes the qlog of a connection once it is traced, replaying
+// the start of the connection.
+type connTracer struct {
+	t           *Tracing
+	id          uint64
+	perspective logging.Perspective
+	odcid       logging.ConnectionID
+	qlog        atomic.Pointer[qlogTracer]
+
+	mu      sync.Mutex
+	closed  bool
+	started func(logging.ConnectionTracer)
+}
+
+type qlogTracer struct {
+	logging.ConnectionTracer
+}
+
+type qlogFile struct {
+	*bufio.Writer
+	f *os.File
+}
+
+func (f *qlogFile) Close() error {
+	if err := f.Flush(); err != nil {
+		_ = f.f.Close()
+		return err
+	}
+	return f.f.Close()
+}
+
+func (c *connTracer) startQlog() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.qlog.Load() != nil {
+		return
+	}
+	path := filepath.Join(c.t.qlogDir, fmt.Sprintf("%v-%v.qlog", time.Now().Format("20060102-150405"), c.odcid))
+	f, err := os.Create(path)
+	if err != nil {
+		c.t.logger.Warn().
+			Err(err).
+			Msg("Failed to create qlog")
+		return
+	}
+	tracer := qlog.NewConnectionTracer(&qlogFile{Writer: bufio.NewWriter(f), f: f}, c.perspective, c.odcid)
+	if c.started != nil {
+		c.started(tracer)
+	}
+	c.qlog.Store(&qlogTracer{tracer})
+	c.t.logger.Debug().
+		Str("path", path).
+		Msg("Writing qlog")
+}
+
+func (c *connTracer) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+	c.mu.Lock()
+	c.started = func(tracer logging.ConnectionTracer) {
+		tracer.StartedConnection(local, remote, srcConnID, destConnID)
+	}
+	c.mu.Unlock()
+	var source netip.Addr
+	if addr, ok := remote.(*net.UDPAddr); ok {
+		source = addr.AddrPort().Addr()
+	}
+	// Filters of sources alone trace from the handshake on.
+	if c.t.match(source, nil) != nil {
+		c.startQlog()
+	}
+}
+
+func (c *connTracer) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.t.mu.Lock()
+	delete(c.t.conns, c.id)
+	c.t.mu.Unlock()
+	if q := c.qlog.Load(); q != nil {
+		q.Close()
+	}
+}
+
+func (c *connTracer) NegotiatedVersion(chosen logging.VersionNumber, clientVersions, serverVersions []logging.VersionNumber) {
+	if q := c.qlog.Load(); q != nil {
+		q.NegotiatedVersion(chosen, clientVersions, serverVersions)
+	}
+}
+
+func (c *connTracer) ClosedConnection(err error) {
+	if q := c.qlog.Load(); q != nil {
+		q.ClosedConnection(err)
+	}
+}
+
+func (c *connTracer) SentTransportParameters(p *logging.TransportParameters) {
+	if q := c.qlog.Load(); q != nil {
+		q.SentTransportParameters(p)
+	}
+}
+
+func (c *connTracer) ReceivedTransportParameters(p *logging.TransportParameters) {
+	if q := c.qlog.Load(); q != nil {
+		q.ReceivedTransportParameters(p)
+	}
+}
+
+func (c *connTracer) RestoredTransportParameters(p *logging.TransportParameters) {
+	if q := c.qlog.Load(); q != nil {
+		q.RestoredTransportParameters(p)
+	}
+}
+
+func (c *connTracer) SentLongHeaderPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, ack *logging.AckFrame, frames []logging.Frame) {
+	if q := c.qlog.Load(); q != nil {
+		q.SentLongHeaderPacket(hdr, size, ack, frames)
+	}
+}
+
+func (c *connTracer) SentShortHeaderPacket(hdr *logging.ShortHeader, size logging.ByteCount, ack *logging.AckFrame, frames []logging.Frame) {
+	if q := c.qlog.Load(); q != nil {
+		q.SentShortHeaderPacket(hdr, size, ack, frames)
+	}
+}
+
+func (c *connTracer) ReceivedVersionNegotiationPacket(dest, src logging.ArbitraryLenConnectionID, versions []logging.VersionNumber) {
+	if q := c.qlog.Load(); q != nil {
+		q.ReceivedVersionNegotiationPacket(dest, src, versions)
+	}
+}
+
+func (c *connTracer) ReceivedRetry(hdr *logging.Header) {
+	if q := c.qlog.Load(); q != nil {
+		q.ReceivedRetry(hdr)
+	}
+}
+
+func (c *connTracer) ReceivedLongHeaderPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	if q := c.qlog.Load(); q != nil {
+		q.ReceivedLongHeaderPacket(hdr, size, frames)
+	}
+}
+
+func (c *connTracer) ReceivedShortHeaderPacket(hdr *logging.ShortHeader, size logging.ByteCount, frames []logging.Frame) {
+	if q := c.qlog.Load(); q != nil {
+		q.ReceivedShortHeaderPacket(hdr, size, frames)
+	}
+}
+
+func (c *connTracer) BufferedPacket(t logging.PacketType, size logging.ByteCount) {
+	if q := c.qlog.Load(); q != nil {
+		q.BufferedPacket(t, size)
+	}
+}
+
+func (c *connTracer) DroppedPacket(t logging.PacketType, size logging.ByteCount, reason logging.PacketDropReason) {
+	if q := c.qlog.Load(); q != nil {
+		q.DroppedPacket(t, size, reason)
+	}
+}
+
+func (c *connTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+	if q := c.qlog.Load(); q != nil {
+		q.UpdatedMetrics(rttStats, cwnd, bytesInFlight, packetsInFlight)
+	}
+}
+
+func (c *connTracer) AcknowledgedPacket(level logging.EncryptionLevel, pn logging.PacketNumber) {
+	if q := c.qlog.Load(); q != nil {
+		q.AcknowledgedPacket(level, pn)
+	}
+}
+
+func (c *connTracer) LostPacket(level logging.EncryptionLevel, pn logging.PacketNumber, reason logging.PacketLossReason) {
+	if q := c.qlog.Load(); q != nil {
+		q.LostPacket(level, pn, reason)
+	}
+}
+
+func (c *connTracer) UpdatedCongestionState(state logging.CongestionState) {
+	if q := c.qlog.Load(); q != nil {
+		q.UpdatedCongestionState(state)
+	}
+}
+
+func (c *connTracer) UpdatedPTOCount(value uint32) {
+	if q := c.qlog.Load(); q != nil {
+		q.UpdatedPTOCount(value)
+	}
+}
+
+func (c *connTracer) UpdatedKeyFromTLS(level logging.EncryptionLevel, p logging.Perspective) {
+	if q := c.qlog.Load(); q != nil {
+		q.UpdatedKeyFromTLS(level, p)
+	}
+}
+
+func (c *connTracer) UpdatedKey(generation logging.KeyPhase, remote bool) {
+	if q := c.qlog.Load(); q != nil {
+		q.UpdatedKey(generation, remote)
+	}
+}
+
+func (c *connTracer) DroppedEncryptionLevel(level logging.EncryptionLevel) {
+	if q := c.qlog.Load(); q != nil {
+		q.DroppedEncryptionLevel(level)
+	}
+}
+
+func (c *connTracer) DroppedKey(generation logging.KeyPhase) {
+	if q := c.qlog.Load(); q != nil {
+		q.DroppedKey(generation)
+	}
+}
+
+func (c *connTracer) SetLossTimer(t logging.TimerType, level logging.EncryptionLevel, deadline time.Time) {
+	if q := c.qlog.Load(); q != nil {
+		q.SetLossTimer(t, level, deadline)
+	}
+}
+
+func (c *connTracer) LossTimerExpired(t logging.TimerType, level logging.EncryptionLevel) {
+	if q := c.qlog.Load(); q != nil {
+		q.LossTimerExpired(t, level)
+	}
+}
+
+func (c *connTracer) LossTimerCanceled() {
+	if q := c.qlog.Load(); q != nil {
+		q.LossTimerCanceled()
+	}
+}
+
+func (c *connTracer) Debug(name, msg string) {
+	if q := c.qlog.Load(); q != nil {
+		q.Debug(name, msg)
+	}
+}
+
+// sampler logs the first bytes of each direction of a traced stream.
+type sampler struct {
+	logger *log.Logger
+	target string
+	up     atomic.Bool
+	down   atomic.Bool
+}
+
+func (s *sampler) sample(sampled *atomic.Bool, direction string, b []byte) {
+	if len(b) == 0 || sampled.Swap(true) {
+		return
+	}
+	s.logger.Debug().
+		Str("target", s.target).
+		Str("direction", direction).
+		Int("size", len(b)).
+		Str("hex", hex.EncodeToString(b[:min(len(b), traceSampleSize)])).
+		Msg("Traced bytes")
+}
+
+// sampleConn samples the bytes written to and read from the target.
+type sampleConn struct {
+	netproxy.Conn
+	*sampler
+}
+
+func (c *sampleConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.sample(&c.down, "down", b[:n])
+	return n, err
+}
+
+func (c *sampleConn) Write(b []byte) (n int, err error) {
+	c.sample(&c.up, "up", b)
+	return c.Conn.Write(b)
+}
+
+func (c *sampleConn) CloseWrite() error {
+	if conn, ok := c.Conn.(relay.WriteCloser); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// samplePacketConn samples the first datagrams sent to and received from
+// the targets.
+type samplePacketConn struct {
+	netproxy.PacketConn
+	*sampler
+}
+
+func (c *samplePacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	c.sample(&c.down, "down", p[:n])
+	return n, addr, err
+}
+
+func (c *samplePacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	c.sample(&c.up, "up", p)
+	return c.PacketConn.WriteTo(p, addr)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/google/uuid"
+)
+
+func TestTracingMatch(t *testing.T) {
+	tracing := NewTracing(log.NewLogger(&log.Options{}), "")
+	if _, err := tracing.Add(TraceFilter{}); !errors.Is(err, ErrEmptyTraceFilter) {
+		t.Fatalf("Add of an empty filter: got %v, want %v", err, ErrEmptyTraceFilter)
+	}
+	user := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	other := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	bySource, err := tracing.Add(TraceFilter{Source: netip.MustParsePrefix("::ffff:10.0.0.0/104")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParsePrefix("10.0.0.0/8"); bySource.Source != want {
+		t.Fatalf("source: got %v, want %v", bySource.Source, want)
+	}
+	byUser, err := tracing.Add(TraceFilter{User: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tracing.Add(TraceFilter{User: other, Until: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		user   *uuid.UUID
+		want   uint64
+	}{
+		{"source before auth", "10.1.2.3", nil, bySource.Id},
+		{"mapped source", "::ffff:10.1.2.3", &other, bySource.Id},
+		{"user", "192.0.2.1", &user, byUser.Id},
+		{"unauthenticated", "192.0.2.1", nil, 0},
+		{"expired", "192.0.2.1", &other, 0},
+	}
+	for _, tt := range tests {
+		var got uint64
+		if f := tracing.match(netip.MustParseAddr(tt.source), tt.user); f != nil {
+			got = f.Id
+		}
+		if got != tt.want {
+			t.Errorf("%v: got filter %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if len(tracing.Filters()) != 2 {
+		t.Errorf("expired filter is not removed: %v", tracing.Filters())
+	}
+	if !tracing.Remove(bySource.Id) || tracing.Remove(bySource.Id) {
+		t.Errorf("Remove of %v", bySource.Id)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/juicity/juicity/internal/relay"
+	"github.com/juicity/juicity/pkg/stats"
+)
+
+// trafficCounter counts the bytes of a stream into itself and its user, and
+// records when data was last relayed in each direction. Once the stream is
+// classified, its bytes are also counted into the class of the user.
+type trafficCounter struct {
+	stats.Traffic
+	user *stats.UserStats
+	// lastUp and lastDown are in unix nanoseconds.
+	lastUp     atomic.Int64
+	lastDown   atomic.Int64
+	classified atomic.Bool
+	class      atomic.Pointer[stats.ClassTraffic]
+	// kind and domain are what was sniffed, published by storing class.
+	kind   stats.Class
+	domain string
+}
+
+func newTrafficCounter(user *stats.UserStats) *trafficCounter {
+	c := &trafficCounter{user: user}
+	now := time.Now().UnixNano()
+	c.lastUp.Store(now)
+	c.lastDown.Store(now)
+	return c
+}
+
+// classify attributes the stream to the class of the user, including the
+// bytes downloaded so far, and records the domain sniffed if any. Only the
+// first call counts.
+func (c *trafficCounter) classify(class stats.Class, domain string) {
+	if !c.classified.CompareAndSwap(false, true) {
+		return
+	}
+	c.kind, c.domain = class, domain
+	t := c.user.Class(class)
+	// Read before publishing the class, so that a concurrent download is
+	// never counted twice.
+	down := c.Down.Load()
+	c.class.Store(t)
+	t.Streams.Add(1)
+	t.Up.Add(c.Up.Load())
+	t.Down.Add(down)
+}
+
+// sniffed returns the class and the domain of the stream, if classified.
+func (c *trafficCounter) sniffed() (class stats.Class, domain string, ok bool) {
+	if c.class.Load() == nil {
+		return stats.ClassUnknown, "", false
+	}
+	return c.kind, c.domain, true
+}
+
+func (c *trafficCounter) upload(n int) {
+	if n > 0 {
+		c.Up.Add(uint64(n))
+		c.user.Upload(n)
+		c.lastUp.Store(time.Now().UnixNano())
+		if t := c.class.Load(); t != nil {
+			t.Up.Add(uint64(n))
+		}
+	}
+}
+
+func (c *trafficCounter) download(n int) {
+	if n > 0 {
+		t := c.class.Load()
+		c.Down.Add(uint64(n))
+		c.user.Download(n)
+		c.lastDown.Store(time.Now().UnixNano())
+		if t != nil {
+			t.Down.Add(uint64(n))
+		}
+	}
+}
+
+// trafficConn counts the bytes relayed through an outbound conn. Writes are
+// uploads of the user and reads are downloads.
+type trafficConn struct {
+	netproxy.Conn
+	*trafficCounter
+	// port is of the target, to classify the stream.
+	port uint16
+}
+
+func (c *trafficConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.download(n)
+	return n, err
+}
+
+func (c *trafficConn) Write(b []byte) (n int, err error) {
+	if !c.classified.Load() {
+		class := classifyTcp(b, c.port)
+		c.classify(class, sniffDomain(class, b))
+	}
+	n, err = c.Conn.Write(b)
+	c.upload(n)
+	return n, err
+}
+
+func (c *trafficConn) CloseWrite() error {
+	if conn, ok := c.Conn.(relay.WriteCloser); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// trafficPacketConn counts the bytes relayed through an outbound packet conn.
+type trafficPacketConn struct {
+	netproxy.PacketConn
+	*trafficCounter
+}
+
+func (c *trafficPacketConn) Read(b []byte) (n int, err error) {
+	n, err = c.PacketConn.Read(b)
+	c.download(n)
+	return n, err
+}
+
+func (c *trafficPacketConn) Write(b []byte) (n int, err error) {
+	if !c.classified.Load() {
+		c.classify(classifyUdp(b, 0), "")
+	}
+	n, err = c.PacketConn.Write(b)
+	c.upload(n)
+	return n, err
+}
+
+func (c *trafficPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	c.download(n)
+	return n, addr, err
+}
+
+func (c *trafficPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	if !c.classified.Load() {
+		c.classify(classifyUdp(p, portOf(addr)), "")
+	}
+	n, err = c.PacketConn.WriteTo(p, addr)
+	c.upload(n)
+	return n, err
+}
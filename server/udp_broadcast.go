@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/netip"
+	"sync"
+
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// UdpBroadcast is what happens to UDP packets that clients send to broadcast
+// and multicast addresses, mostly discovery chatter of the LANs of TUN
+// clients like mDNS and SSDP, which would otherwise fail to send or reach the
+// network of the server.
+type UdpBroadcast int
+
+const (
+	// UdpBroadcastDrop drops them, logged at debug level.
+	UdpBroadcastDrop UdpBroadcast = iota
+	// UdpBroadcastLog drops them, logged at info level.
+	UdpBroadcastLog
+	// UdpBroadcastRelay sends them like other packets.
+	UdpBroadcastRelay
+)
+
+// maxBroadcastTargets bounds the targets of a UDP stream whose drops are
+// logged.
+const maxBroadcastTargets = 16
+
+var limitedBroadcast = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+// isBroadcast reports whether addr is the limited broadcast address or a
+// multicast address. Broadcasts directed to a subnet look like unicasts and
+// are not recognized.
+func isBroadcast(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr == limitedBroadcast || addr.IsMulticast()
+}
+
+// dropsBroadcast reports whether the packets to host are dropped as
+// broadcasts.
+func (s *Server) dropsBroadcast(host string) bool {
+	if s.udpBroadcast == UdpBroadcastRelay {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && isBroadcast(addr)
+}
+
+// broadcastPacketConn drops the packets of a UDP stream to broadcast and
+// multicast targets, logging each target once.
+type broadcastPacketConn struct {
+	netproxy.PacketConn
+	logger *log.Logger
+	// logInfo logs the drops at info level instead of debug.
+	logInfo bool
+	user    string
+	source  string
+
+	mu     sync.Mutex
+	logged map[netip.AddrPort]struct{}
+}
+
+func (c *broadcastPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	target, err := netip.ParseAddrPort(addr)
+	if err != nil || !isBroadcast(target.Addr()) {
+		// Domain targets are never broadcasts.
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	c.mu.Lock()
+	_, logged := c.logged[target]
+	if !logged && len(c.logged) < maxBroadcastTargets {
+		if c.logged == nil {
+			c.logged = map[netip.AddrPort]struct{}{}
+		}
+		c.logged[target] = struct{}{}
+		e := c.logger.Debug()
+		if c.logInfo {
+			e = c.logger.Info()
+		}
+		e.Str("target", addr).
+			Str("user", c.user).
+			Str("source", c.source).
+			Msg("Dropped UDP packets to a broadcast or multicast target")
+	}
+	c.mu.Unlock()
+	return len(p), nil
+}
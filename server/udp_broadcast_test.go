@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/juicity/juicity/pkg/log"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+type recordPacketConn struct {
+	netproxy.PacketConn
+	targets []string
+}
+
+func (c *recordPacketConn) WriteTo(p []byte, addr string) (int, error) {
+	c.targets = append(c.targets, addr)
+	return len(p), nil
+}
+
+func TestBroadcastPacketConn(t *testing.T) {
+	record := &recordPacketConn{}
+	c := &broadcastPacketConn{PacketConn: record, logger: log.NewLogger(&log.Options{})}
+	for _, addr := range []string{
+		"255.255.255.255:67",
+		"224.0.0.251:5353",
+		"239.255.255.250:1900",
+		"[ff02::fb]:5353",
+		"[::ffff:224.0.0.251]:5353",
+		"1.1.1.1:53",
+		"192.168.1.255:137",
+		"example.com:443",
+	} {
+		if n, err := c.WriteTo([]byte("x"), addr); n != 1 || err != nil {
+			t.Fatalf("WriteTo %v: got %v, %v", addr, n, err)
+		}
+	}
+	want := []string{"1.1.1.1:53", "192.168.1.255:137", "example.com:443"}
+	if len(record.targets) != len(want) {
+		t.Fatalf("got targets %v, want %v", record.targets, want)
+	}
+	for i := range want {
+		if record.targets[i] != want[i] {
+			t.Errorf("got targets %v, want %v", record.targets, want)
+		}
+	}
+}
@@ -64,6 +64,14 @@ type DialOption struct {
 	Target   string
 	Dialer   netproxy.Dialer
 	Metadata any
+	// Network is the network dialed, udp if empty, e.g. a magic network
+	// carrying a mark.
+	Network string
+	// Context carries the values of the dial, e.g. its address filter.
+	// Defaults to context.Background.
+	Context context.Context
+	// Wrap wraps the dialed conn, e.g. to count its traffic. Nil keeps it.
+	Wrap func(conn netproxy.PacketConn) netproxy.PacketConn
 }
 
 // UdpEndpointPool is a full-cone udp conn pool
@@ -85,8 +93,8 @@ func NewUdpEndpointPool() *UdpEndpointPool {
 }
 
 func (p *UdpEndpointPool) Remove(lAddr netip.AddrPort, udpEndpoint *UdpEndpoint) (err error) {
-	if ue, ok := p.pool.LoadAndDelete(lAddr); ok {
-		if ue != udpEndpoint {
+	if ue, ok := p.pool.Load(lAddr); ok {
+		if ue != udpEndpoint || !p.pool.CompareAndDelete(lAddr, ue) {
 			return fmt.Errorf("target udp endpoint is not in the pool")
 		}
 		ue.(*UdpEndpoint).Close()
@@ -121,20 +129,36 @@ begin:
 		if err != nil {
 			return nil, false, err
 		}
-		cd := netproxy.ContextDialerConverter{
-			Dialer: dialOption.Dialer,
+		cd, ok := dialOption.Dialer.(netproxy.ContextDialer)
+		if !ok {
+			cd = &netproxy.ContextDialerConverter{
+				Dialer: dialOption.Dialer,
+			}
 		}
-		ctx, cancel := context.WithTimeout(context.TODO(), consts.DefaultDialTimeout)
+		dialCtx := dialOption.Context
+		if dialCtx == nil {
+			dialCtx = context.Background()
+		}
+		network := dialOption.Network
+		if network == "" {
+			network = "udp"
+		}
+		ctx, cancel := context.WithTimeout(dialCtx, consts.DefaultDialTimeout)
 		defer cancel()
-		udpConn, err := cd.DialContext(ctx, "udp", dialOption.Target)
+		udpConn, err := cd.DialContext(ctx, network, dialOption.Target)
 		if err != nil {
 			return nil, true, err
 		}
-		if _, ok = udpConn.(netproxy.PacketConn); !ok {
+		pc, ok := udpConn.(netproxy.PacketConn)
+		if !ok {
+			_ = udpConn.Close()
 			return nil, true, fmt.Errorf("protocol does not support udp")
 		}
+		if dialOption.Wrap != nil {
+			pc = dialOption.Wrap(pc)
+		}
 		ue := &UdpEndpoint{
-			conn: udpConn.(netproxy.PacketConn),
+			conn: pc,
 			mu:   sync.Mutex{},
 			deadlineTimer: time.AfterFunc(createOption.NatTimeout, func() {
 				if ue, ok := p.pool.LoadAndDelete(lAddr); ok {
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+
+	"github.com/juicity/juicity/pkg/decode"
+
+	"github.com/daeuniverse/softwind/protocol/juicity"
+	"github.com/daeuniverse/softwind/protocol/tuic"
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+)
+
+// versionHandler authenticates a connection by the first command of its
+// authentication stream, whose first byte is the protocol version. Versions
+// after Version0 may negotiate features of the connection there, e.g. padding
+// or datagrams. Handlers only check the credentials: the policies of users,
+// e.g. suspensions and schedules, are applied by handleConnAuth.
+type versionHandler func(s *Server, conn quic.Connection, r *bufio.Reader) (*uuid.UUID, error)
+
+// versionHandlers are the protocol versions accepted by the server. Each
+// connection speaks the version its client authenticates with, so new
+// versions are added without breaking older clients.
+var versionHandlers = map[byte]versionHandler{}
+
+// registerVersion adds the handler of a protocol version. Experimental
+// versions register themselves in init of files behind build tags.
+func registerVersion(version byte, handler versionHandler) {
+	if _, ok := versionHandlers[version]; ok {
+		panic(fmt.Sprintf("protocol version %v registered twice", version))
+	}
+	versionHandlers[version] = handler
+}
+
+func init() {
+	registerVersion(juicity.Version0, handleVersion0Auth)
+}
+
+func handleVersion0Auth(s *Server, conn quic.Connection, r *bufio.Reader) (*uuid.UUID, error) {
+	commandHead, err := decode.ReadCommandHead(r)
+	if err != nil {
+		return nil, fmt.Errorf("ReadCommandHead: %w", err)
+	}
+	switch commandHead.TYPE {
+	case tuic.AuthenticateType:
+		authenticate, err := decode.ReadAuthenticateWithHead(commandHead, r)
+		if err != nil {
+			return nil, fmt.Errorf("ReadAuthenticateWithHead: %w", err)
+		}
+		var token [32]byte
+		if password, ok := s.users[authenticate.UUID]; ok {
+			token, err = tuic.GenToken(conn.ConnectionState(), authenticate.UUID, password)
+			if err != nil {
+				return nil, fmt.Errorf("GenToken: %w", err)
+			}
+			if token == authenticate.TOKEN {
+				return &authenticate.UUID, nil
+			} else {
+				_ = conn.CloseWithError(tuic.AuthenticationFailed, "")
+			}
+			return nil, fmt.Errorf("%w: %v", ErrAuthenticationFailed, authenticate.UUID)
+		}
+		return nil, fmt.Errorf("%w: %w: %v", ErrAuthenticationFailed, ErrUnknownUser, authenticate.UUID)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedCmdType, commandHead.TYPE)
+	}
+}